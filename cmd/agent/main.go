@@ -2,80 +2,104 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go-agent/internal/agent"
 	"go-agent/internal/config"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 )
 
 func main() {
 	configPath := flag.String("config", "", "config file path")
 	once := flag.Bool("once", false, "run once")
+	checkConfig := flag.Bool("check-config", false, "validate the config, print the effective result and exit")
 	flag.Parse()
 
-	cfg, err := config.Load(*configPath)
+	cfg, files, err := config.LoadWithFiles(*configPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "config load failed: %v\n", err)
+		fmt.Fprintf(os.Stderr, "config load failed:\n%v\n", err)
 		os.Exit(1)
 	}
 
-	var env agent.RuntimeEnv = agent.DetectEnv()
-	fmt.Printf("Detected Environment: %s\n", env.Kind())
-	fmt.Printf("Config interval: %s\n", cfg.Interval.Duration)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	grpc, err := agent.NewGRPCOut(ctx, "127.0.0.1:50051")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "grpc agent load failed: %v\n", err)
-	} else {
-		defer grpc.Close()
+	if *checkConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(cfg.Redacted()); err != nil {
+			fmt.Fprintf(os.Stderr, "config encode failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	defer signal.Stop(sigCh)
+	if err := agent.SetupLogging(cfg.Log); err != nil {
+		fmt.Fprintf(os.Stderr, "log setup failed: %v\n", err)
+		os.Exit(1)
+	}
 
-	ticker := time.NewTicker(cfg.Interval.Duration)
-	defer ticker.Stop()
+	var env agent.RuntimeEnv = agent.DetectEnv()
+	slog.Info("detected environment", "env", env.Kind())
+	slog.Info("config loaded", "interval", cfg.Interval.Duration.String())
 
-	fmt.Print("Agent Start.\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	if *once {
+		outs, err := agent.BuildOutputs(cfg.Outputs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "output load failed: %v\n", err)
+			os.Exit(1)
+		}
+		defer agent.CloseOutputs(outs)
+
+		slog.Info("agent start", "once", true)
 		c := agent.Collect(ctx, env)
 		agent.ConsoleOut(ctx, env, c)
-		fmt.Println("Agent Stop.")
+		writeOutputs(ctx, outs, c)
+		slog.Info("agent stop")
 		return
 	}
 
-	for {
-		select {
-		case sig := <-sigCh:
-			fmt.Printf("received: %v\n", sig)
-			fmt.Println("Agent Stop.")
-			return
-		case <-ticker.C:
-			c := agent.Collect(ctx, env)
-			agent.ConsoleOut(ctx, env, c)
-			if grpc != nil {
-				res, err := grpc.SendHeartbeat(ctx)
-				if err != nil {
-					log.Printf("[hb] failed: %v", err)
-				} else {
-					for _, cmd := range res.Commands {
-						if err := grpc.HandleAndReportCommand(ctx, cmd); err != nil {
-							log.Printf("[command] handle failed: %v", err)
-						}
-					}
+	runner, err := agent.NewRunner(ctx, env, *configPath, cfg, files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "agent start failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer runner.Close()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	reload := make(chan struct{}, 1)
+	go func() {
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				select {
+				case reload <- struct{}{}:
+				default:
 				}
-				agent.GRPCSend(ctx, grpc, c)
+				continue
 			}
+			slog.Info("received signal", "signal", sig.String())
+			cancel()
+			return
+		}
+	}()
+
+	slog.Info("agent start")
+	runner.Run(ctx, reload)
+	slog.Info("agent stop")
+}
+
+func writeOutputs(ctx context.Context, outs []agent.Output, c agent.Collected) {
+	for _, o := range outs {
+		if err := o.Write(ctx, c); err != nil {
+			slog.Error("write failed", "output", o.Name(), "err", err)
 		}
 	}
 }
@@ -0,0 +1,109 @@
+// Command cmdsign makes operator keys and signs commands ahead of time, so
+// that agents requiring signed commands run them without the collector
+// holding a key. It prints a request for the collector's POST /v1/commands.
+//
+//	cmdsign -gen-key operator.pem
+//	cmdsign -key operator.pem -agent a1,a2 -name exec -args '{"program":"uptime"}' -ttl 10m
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go-agent/internal/cmdsign"
+	"go-agent/internal/collector"
+	"go-agent/internal/config"
+)
+
+func main() {
+	genKey := flag.String("gen-key", "", "write a new private key to this file and print its public key")
+	keyPath := flag.String("key", "", "private key (PKCS#8 PEM) to sign with")
+	pubKey := flag.Bool("public-key", false, "print the public key of -key, as agents are configured with it")
+	agents := flag.String("agent", "", "comma separated ids of the agents the command is for")
+	name := flag.String("name", "", "command name")
+	args := flag.String("args", "{}", "command arguments as a JSON object")
+	ttl := flag.Duration("ttl", 10*time.Minute, "how long the command stays valid")
+	timeout := flag.Duration("timeout", 0, "how long the command may run; 0 leaves it to the agent")
+	flag.Parse()
+
+	if *genKey != "" {
+		pub, key, err := cmdsign.GenerateKey()
+		if err != nil {
+			fail(err)
+		}
+		f, err := os.OpenFile(*genKey, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			fail(err)
+		}
+		if _, err := f.Write(key); err != nil {
+			fail(err)
+		}
+		if err := f.Close(); err != nil {
+			fail(err)
+		}
+		fmt.Println(cmdsign.EncodePublicKey(pub))
+		return
+	}
+
+	if *keyPath == "" {
+		fail(fmt.Errorf("-key or -gen-key is required"))
+	}
+	key, err := cmdsign.LoadPrivateKey(*keyPath)
+	if err != nil {
+		fail(err)
+	}
+	if *pubKey {
+		fmt.Println(cmdsign.EncodePublicKey(key.Public().(ed25519.PublicKey)))
+		return
+	}
+	if *name == "" || *agents == "" {
+		fail(fmt.Errorf("-name and -agent are required"))
+	}
+	// signed as the collector will pass it on
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(*args)); err != nil {
+		fail(fmt.Errorf("-args: %w", err))
+	}
+
+	expires := time.Now().Add(*ttl).Truncate(time.Second).UTC()
+	req := request{Name: *name, Args: compact.Bytes()}
+	if *timeout > 0 {
+		req.Timeout = &config.Duration{Duration: *timeout}
+	}
+	for _, id := range strings.Split(*agents, ",") {
+		cmdID := uuid.NewString()
+		req.Signed = append(req.Signed, collector.SignedTarget{
+			AgentID:   id,
+			CommandID: cmdID,
+			Expires:   expires,
+			Signature: cmdsign.Sign(key, id, cmdID, *name, compact.String(), expires.Unix()),
+		})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(req); err != nil {
+		fail(err)
+	}
+}
+
+// request is the part of collector.EnqueueRequest used for signed
+// commands.
+type request struct {
+	Name    string                   `json:"name"`
+	Args    json.RawMessage          `json:"args"`
+	Timeout *config.Duration         `json:"timeout,omitempty"`
+	Signed  []collector.SignedTarget `json:"signed"`
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "cmdsign: %v\n", err)
+	os.Exit(1)
+}
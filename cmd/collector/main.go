@@ -3,20 +3,47 @@ package main
 import (
 	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"go-agent/internal/collector"
+	"go-agent/internal/logging"
 )
 
 func main() {
 	cfg := collector.DefaultConfig()
 
 	flag.StringVar(&cfg.ListenAddr, "listen", cfg.ListenAddr, "gRPC listen address")
+	flag.StringVar(&cfg.AdminAddr, "admin-listen", cfg.AdminAddr, "HTTP admin API listen address (empty disables)")
+	flag.StringVar(&cfg.AdminTokenFile, "admin-token-file", cfg.AdminTokenFile, "file holding the bearer token admin requests must carry")
+	flag.StringVar(&cfg.AdminTLSCertFile, "admin-tls-cert", cfg.AdminTLSCertFile, "admin API certificate (PEM); enables TLS")
+	flag.StringVar(&cfg.AdminTLSKeyFile, "admin-tls-key", cfg.AdminTLSKeyFile, "admin API private key (PEM)")
+	flag.StringVar(&cfg.AdminClientCAFile, "admin-tls-client-ca", cfg.AdminClientCAFile, "CA bundle verifying operator certificates, accepted in place of the admin token")
+	flag.StringVar(&cfg.ConfigStorePath, "config-store", cfg.ConfigStorePath, "file persisting managed agent configs (empty keeps them in memory)")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "server certificate (PEM); enables TLS")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "server private key (PEM)")
+	flag.StringVar(&cfg.TLSClientCAFile, "tls-client-ca", cfg.TLSClientCAFile, "CA bundle verifying agent certificates")
+	flag.StringVar(&cfg.TLSClientAuth, "tls-client-auth", cfg.TLSClientAuth, "agent certificates: none, optional or require")
+	flag.StringVar(&cfg.Enrollment, "enrollment", cfg.Enrollment, "agent enrollment: off or required")
+	flag.StringVar(&cfg.EnrollStorePath, "enroll-store", cfg.EnrollStorePath, "file persisting bootstrap tokens and enrollments")
+	flag.StringVar(&cfg.AuditLogPath, "audit-log", cfg.AuditLogPath, "file appended with every audited agent action, as JSON lines")
+	flag.StringVar(&cfg.ArtifactDir, "artifact-dir", cfg.ArtifactDir, "directory storing files agents upload, such as support bundles (empty keeps the latest in memory)")
+	flag.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "log format: text or json")
+	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "default log level: debug, info, warn or error")
+	flag.StringVar(&cfg.Timezone, "timezone", cfg.Timezone, "IANA timezone log times are shown in")
+	logLevels := flag.String("log-levels", "", "per component log levels, e.g. metrics=warn,hb=debug")
 	flag.Parse()
 
+	levels, err := logging.ParseLevels(*logLevels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-log-levels: %v\n", err)
+		os.Exit(2)
+	}
+	cfg.LogLevels = levels
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -24,12 +51,13 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigCh
-		log.Printf("signal received: %v", sig)
+		slog.Info("signal received", "signal", sig.String())
 		cancel()
 	}()
 
 	app := collector.New(cfg)
 	if err := app.Run(ctx); err != nil {
-		log.Fatalf("collector exited with error: %v", err)
+		slog.Error("collector exited with error", "err", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+)
+
+type alertState int
+
+const (
+	alertOK alertState = iota
+	alertPending
+	alertFiring
+)
+
+type ruleState struct {
+	rule  config.AlertRule
+	state alertState
+	since time.Time // start of the pending or firing state
+
+	last    float64 // previous value, for increase rules
+	hasLast bool
+	lastInc time.Time
+}
+
+// alertChange is a rule that started or stopped firing.
+type alertChange struct {
+	rule   config.AlertRule
+	firing bool
+	value  float64
+	found  bool // whether the metric was in the sample
+	since  time.Time
+}
+
+// alerter evaluates alert rules against the sample stream. It is driven
+// from the collection loop and is not safe for concurrent use.
+type alerter struct {
+	rules []*ruleState
+}
+
+// newAlerter builds an alerter for rules, carrying over the state of rules
+// that are unchanged in prev so a reload does not re-fire them.
+func newAlerter(rules []config.AlertRule, prev *alerter) *alerter {
+	old := make(map[string]*ruleState)
+	if prev != nil {
+		for _, rs := range prev.rules {
+			old[rs.rule.Name] = rs
+		}
+	}
+	a := &alerter{}
+	for _, r := range rules {
+		if rs, ok := old[r.Name]; ok && reflect.DeepEqual(rs.rule, r) {
+			a.rules = append(a.rules, rs)
+			continue
+		}
+		a.rules = append(a.rules, &ruleState{rule: r})
+	}
+	return a
+}
+
+// evaluate steps every rule with a sample. Rules on metrics of collectors
+// that off reports as switched off keep their state, since the metric is
+// missing only because it was not collected.
+func (a *alerter) evaluate(ts time.Time, points []MetricPoint, off func(string) bool) []alertChange {
+	if len(a.rules) == 0 {
+		return nil
+	}
+	values := make(map[string]float64, len(points))
+	for _, p := range points {
+		values[p.Name] = p.Value
+	}
+
+	var out []alertChange
+	for _, rs := range a.rules {
+		if off != nil && off(metricCollector(rs.rule.Metric)) {
+			continue
+		}
+		v, ok := values[rs.rule.Metric]
+		if fired, changed := rs.step(ts, v, ok); changed {
+			out = append(out, alertChange{rule: rs.rule, firing: fired, value: v, found: ok, since: rs.since})
+		}
+	}
+	return out
+}
+
+// metricCollector names the collector a metric comes from, as the governor
+// switches them off.
+func metricCollector(metric string) string {
+	prefix, _, _ := strings.Cut(metric, ".")
+	if prefix == "proc" {
+		return "procs"
+	}
+	return prefix
+}
+
+// step advances the rule by one sample and reports whether it is now
+// firing and whether that changed.
+func (rs *ruleState) step(ts time.Time, v float64, ok bool) (bool, bool) {
+	r := rs.rule
+	was := rs.state == alertFiring
+
+	switch r.Op {
+	case "increase":
+		inc := ok && rs.hasLast && v > rs.last
+		if ok {
+			rs.last, rs.hasLast = v, true
+		}
+		switch {
+		case inc:
+			rs.lastInc = ts
+			if !was {
+				rs.state, rs.since = alertFiring, ts
+			}
+		case was && ts.Sub(rs.lastInc) >= r.For.Duration:
+			rs.state, rs.since = alertOK, ts
+		}
+		return rs.state == alertFiring, was != (rs.state == alertFiring)
+
+	case "absent":
+		rs.hold(ts, !ok, ok)
+
+	default:
+		// a missing metric says nothing about a threshold
+		if !ok {
+			return was, false
+		}
+		rs.hold(ts, breached(r.Op, v, r.Value), cleared(r, v))
+	}
+	return rs.state == alertFiring, was != (rs.state == alertFiring)
+}
+
+// hold moves through pending to firing while cond holds for the rule's
+// duration; a firing rule resolves once clear holds.
+func (rs *ruleState) hold(ts time.Time, cond, clear bool) {
+	switch rs.state {
+	case alertFiring:
+		if clear {
+			rs.state, rs.since = alertOK, ts
+		}
+		return
+	case alertOK:
+		if !cond {
+			return
+		}
+		rs.state, rs.since = alertPending, ts
+	case alertPending:
+		if !cond {
+			rs.state, rs.since = alertOK, ts
+			return
+		}
+	}
+	if ts.Sub(rs.since) >= rs.rule.For.Duration {
+		rs.state, rs.since = alertFiring, ts
+	}
+}
+
+func breached(op string, v, limit float64) bool {
+	switch op {
+	case ">":
+		return v > limit
+	case ">=":
+		return v >= limit
+	case "<":
+		return v < limit
+	case "<=":
+		return v <= limit
+	}
+	return false
+}
+
+// cleared reports whether v is back on the good side of the rule's clear
+// value.
+func cleared(r config.AlertRule, v float64) bool {
+	limit := r.Value
+	if r.Clear != nil {
+		limit = *r.Clear
+	}
+	return !breached(r.Op, v, limit)
+}
+
+// event describes the change for the collector.
+func (c alertChange) event() *pb.Event {
+	r := c.rule
+	ev := &pb.Event{
+		Type: "alert",
+		Attributes: map[string]string{
+			"rule":   r.Name,
+			"metric": r.Metric,
+			"op":     r.Op,
+			"since":  c.since.UTC().Format(time.RFC3339),
+		},
+	}
+	if c.found {
+		ev.Attributes["value"] = strconv.FormatFloat(c.value, 'g', -1, 64)
+	}
+	switch r.Op {
+	case "increase", "absent":
+	default:
+		ev.Attributes["threshold"] = strconv.FormatFloat(r.Value, 'g', -1, 64)
+	}
+
+	if !c.firing {
+		ev.Severity = pb.Event_INFO
+		ev.Attributes["state"] = "resolved"
+		ev.Message = fmt.Sprintf("%s resolved", r.Name)
+		return ev
+	}
+	ev.Severity = pb.Event_WARNING
+	if r.Severity == "critical" {
+		ev.Severity = pb.Event_CRITICAL
+	}
+	ev.Attributes["state"] = "firing"
+	switch r.Op {
+	case "increase":
+		ev.Message = fmt.Sprintf("%s firing: %s increased to %g", r.Name, r.Metric, round2(c.value))
+	case "absent":
+		ev.Message = fmt.Sprintf("%s firing: %s absent for %s", r.Name, r.Metric, r.For.Duration)
+	default:
+		ev.Message = fmt.Sprintf("%s firing: %s %g %s %g for %s", r.Name, r.Metric, round2(c.value), r.Op, r.Value, r.For.Duration)
+	}
+	return ev
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+func TestAlerterThresholdForAndHysteresis(t *testing.T) {
+	clear := 85.0
+	a := newAlerter([]config.AlertRule{{
+		Name: "disk-full", Metric: "disk.used_percent", Op: ">", Value: 90,
+		Clear: &clear, For: config.Duration{Duration: 5 * time.Minute},
+	}}, nil)
+
+	t0 := time.Now()
+	steps := []struct {
+		at     time.Duration
+		v      float64
+		change string // "", "firing" or "resolved"
+	}{
+		{0, 95, ""},
+		{2 * time.Minute, 80, ""}, // dips before For: pending resets
+		{3 * time.Minute, 95, ""},
+		{7 * time.Minute, 96, ""},
+		{8 * time.Minute, 97, "firing"},
+		{9 * time.Minute, 88, ""}, // below value but above clear
+		{10 * time.Minute, 84, "resolved"},
+	}
+	for _, s := range steps {
+		chs := a.evaluate(t0.Add(s.at), []MetricPoint{{Name: "disk.used_percent", Value: s.v}}, nil)
+		got := ""
+		if len(chs) == 1 {
+			got = "resolved"
+			if chs[0].firing {
+				got = "firing"
+			}
+		}
+		if got != s.change || len(chs) > 1 {
+			t.Fatalf("at %s v=%g: got %q (%d changes), want %q", s.at, s.v, got, len(chs), s.change)
+		}
+	}
+
+	// a missing metric leaves a threshold rule alone
+	if chs := a.evaluate(t0.Add(11*time.Minute), nil, nil); len(chs) != 0 {
+		t.Fatalf("missing metric changed state: %v", chs)
+	}
+}
+
+func TestAlerterIncreaseAndAbsent(t *testing.T) {
+	rules := []config.AlertRule{
+		{Name: "oom", Metric: "mem.oom_kills", Op: "increase", For: config.Duration{Duration: time.Minute}},
+		{Name: "nginx", Metric: "proc.running.nginx", Op: "<", Value: 1},
+		{Name: "disk-gone", Metric: "disk.used_percent", Op: "absent"},
+	}
+	a := newAlerter(rules, nil)
+	t0 := time.Now()
+	sample := func(oom, nginx float64) []MetricPoint {
+		return []MetricPoint{{Name: "mem.oom_kills", Value: oom}, {Name: "proc.running.nginx", Value: nginx}}
+	}
+
+	names := func(chs []alertChange) map[string]bool {
+		m := map[string]bool{}
+		for _, c := range chs {
+			m[c.rule.Name] = c.firing
+		}
+		return m
+	}
+
+	got := names(a.evaluate(t0, sample(3, 2), nil))
+	if len(got) != 1 || !got["disk-gone"] {
+		t.Fatalf("first sample: %v", got)
+	}
+	got = names(a.evaluate(t0.Add(10*time.Second), sample(4, 0), nil))
+	if len(got) != 2 || !got["oom"] || !got["nginx"] {
+		t.Fatalf("oom and nginx should fire: %v", got)
+	}
+	got = names(a.evaluate(t0.Add(30*time.Second), sample(4, 1), nil))
+	if v, ok := got["nginx"]; len(got) != 1 || !ok || v {
+		t.Fatalf("only nginx should resolve: %v", got)
+	}
+	got = names(a.evaluate(t0.Add(80*time.Second), append(sample(4, 1), MetricPoint{Name: "disk.used_percent", Value: 1}), nil))
+	if len(got) != 2 || got["oom"] || got["disk-gone"] {
+		t.Fatalf("oom and disk-gone should resolve: %v", got)
+	}
+
+	// unchanged rules keep their state across a reload, changed ones reset
+	a.evaluate(t0.Add(90*time.Second), sample(5, 1), nil)
+	rules[0].For.Duration = 2 * time.Minute
+	b := newAlerter(rules, a)
+	if b.rules[0].state != alertOK || b.rules[1] != a.rules[1] {
+		t.Fatalf("reload did not reset the changed rule and keep the others")
+	}
+}
+
+func TestAlerterHoldsDisabledCollectors(t *testing.T) {
+	a := newAlerter([]config.AlertRule{
+		{Name: "disk-gone", Metric: "disk.used_percent", Op: "absent"},
+		{Name: "procs-gone", Metric: "proc.count", Op: "absent"},
+		{Name: "mem-gone", Metric: "mem.used_percent", Op: "absent"},
+	}, nil)
+	throttled := func(name string) bool { return name == "disk" || name == "procs" }
+	t0 := time.Now()
+
+	chs := a.evaluate(t0, nil, throttled)
+	if len(chs) != 1 || chs[0].rule.Name != "mem-gone" {
+		t.Fatalf("only mem-gone should fire while disk and procs are off: %+v", chs)
+	}
+	if chs := a.evaluate(t0.Add(time.Second), nil, nil); len(chs) != 2 {
+		t.Fatalf("disk-gone and procs-gone should fire once collected: %+v", chs)
+	}
+	// firing rules are held too, rather than resolved or re-fired
+	points := []MetricPoint{{Name: "mem.used_percent", Value: 1}}
+	if chs := a.evaluate(t0.Add(2*time.Second), points, throttled); len(chs) != 1 || chs[0].rule.Name != "mem-gone" || chs[0].firing {
+		t.Fatalf("only mem-gone should resolve: %+v", chs)
+	}
+}
@@ -0,0 +1,174 @@
+package agent
+
+import (
+	"strings"
+	"time"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// batcher accumulates metrics across ticks and optionally pre-aggregates
+// them. It is not safe for concurrent use; GRPCOut drives it from the
+// collection loop.
+type batcher struct {
+	maxPoints int
+	maxBytes  int
+	interval  time.Duration
+
+	window time.Duration
+	rules  []config.AggregateRule
+
+	pending []*pb.Metric
+	bytes   int
+	first   time.Time
+
+	winStart time.Time
+	winOrder []string
+	win      map[string]*aggState
+}
+
+type aggState struct {
+	unit               string
+	fns                []string
+	min, max, sum, val float64
+	n                  int
+	last               time.Time
+}
+
+func newBatcher(cfg config.BatchConfig) *batcher {
+	b := &batcher{
+		maxPoints: cfg.MaxPoints,
+		maxBytes:  cfg.MaxBytes,
+		interval:  cfg.FlushInterval.Duration,
+		window:    cfg.Aggregate.Window.Duration,
+		rules:     cfg.Aggregate.Rules,
+		win:       make(map[string]*aggState),
+	}
+	if b.maxPoints <= 0 && b.maxBytes <= 0 && b.interval <= 0 && b.window <= 0 {
+		return nil
+	}
+	return b
+}
+
+func (b *batcher) add(ts time.Time, metrics []MetricPoint) {
+	if b.window > 0 {
+		if start := ts.Truncate(b.window); !start.Equal(b.winStart) {
+			b.closeWindow()
+			b.winStart = start
+		}
+	}
+
+	for _, m := range metrics {
+		if fns := b.functions(m.Name); fns != nil {
+			b.aggregate(ts, m, fns)
+			continue
+		}
+		b.push(ts, m.Name, m.Value, m.Unit)
+	}
+}
+
+// ready reports whether the pending points should be flushed at now.
+func (b *batcher) ready(now time.Time) bool {
+	if len(b.pending) == 0 {
+		return false
+	}
+	if b.maxPoints > 0 && len(b.pending) >= b.maxPoints {
+		return true
+	}
+	if b.maxBytes > 0 && b.bytes >= b.maxBytes {
+		return true
+	}
+	if b.interval > 0 {
+		return now.Sub(b.first) >= b.interval
+	}
+	// only aggregation is configured: ship whenever a window closes
+	return b.maxPoints <= 0 && b.maxBytes <= 0
+}
+
+// take returns the pending points and the time of the oldest one. When
+// final is set, open aggregation windows are closed first.
+func (b *batcher) take(final bool) ([]*pb.Metric, time.Time) {
+	if final {
+		b.closeWindow()
+	}
+	out, first := b.pending, b.first
+	b.pending, b.bytes, b.first = nil, 0, time.Time{}
+	return out, first
+}
+
+func (b *batcher) push(ts time.Time, name string, v float64, unit string) {
+	if len(b.pending) == 0 {
+		b.first = ts
+	}
+	b.pending = append(b.pending, &pb.Metric{
+		Name:  name,
+		Value: v,
+		Unit:  unit,
+		Time:  timestamppb.New(ts),
+	})
+	// rough wire size: strings plus value, timestamp and framing
+	b.bytes += len(name) + len(unit) + 24
+}
+
+func (b *batcher) functions(name string) []string {
+	if b.window <= 0 {
+		return nil
+	}
+	for _, r := range b.rules {
+		if matchMetric(r.Match, name) {
+			return r.Functions
+		}
+	}
+	return nil
+}
+
+func (b *batcher) aggregate(ts time.Time, m MetricPoint, fns []string) {
+	st := b.win[m.Name]
+	if st == nil {
+		st = &aggState{unit: m.Unit, fns: fns, min: m.Value, max: m.Value}
+		b.win[m.Name] = st
+		b.winOrder = append(b.winOrder, m.Name)
+	}
+	st.min = min(st.min, m.Value)
+	st.max = max(st.max, m.Value)
+	st.sum += m.Value
+	st.val = m.Value
+	st.n++
+	st.last = ts
+}
+
+// closeWindow emits one point per function as "<name>.<fn>", stamped with
+// the time of the last sample in the window.
+func (b *batcher) closeWindow() {
+	for _, name := range b.winOrder {
+		st := b.win[name]
+		for _, fn := range st.fns {
+			var v float64
+			switch fn {
+			case "min":
+				v = st.min
+			case "max":
+				v = st.max
+			case "avg":
+				v = st.sum / float64(st.n)
+			case "last":
+				v = st.val
+			}
+			b.push(st.last, name+"."+fn, v, st.unit)
+		}
+	}
+	b.winOrder = b.winOrder[:0]
+	clear(b.win)
+}
+
+func matchMetric(pattern, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+	return pattern == name
+}
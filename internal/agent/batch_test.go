@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+func TestBatcher_AggregatesOverWindow(t *testing.T) {
+	b := newBatcher(config.BatchConfig{
+		FlushInterval: config.Duration{Duration: 10 * time.Second},
+		Aggregate: config.AggregateConfig{
+			Window: config.Duration{Duration: 10 * time.Second},
+			Rules:  []config.AggregateRule{{Match: "cpu.*", Functions: []string{"min", "max", "avg", "last"}}},
+		},
+	})
+
+	base := time.Unix(1700000000, 0) // aligned to 10s
+	for i, v := range []float64{10, 30, 20} {
+		ts := base.Add(time.Duration(i) * time.Second)
+		b.add(ts, []MetricPoint{{Name: "cpu.usage", Value: v, Unit: "%"}, {Name: "proc.count", Value: 5}})
+		if b.ready(ts) {
+			t.Fatalf("flushed early at tick %d", i)
+		}
+	}
+
+	// first sample of the next window closes the previous one
+	next := base.Add(10 * time.Second)
+	b.add(next, []MetricPoint{{Name: "cpu.usage", Value: 99}})
+	if !b.ready(next) {
+		t.Fatal("expected flush after interval")
+	}
+
+	got, first := b.take(false)
+	if !first.Equal(base) {
+		t.Errorf("first = %v, want %v", first, base)
+	}
+
+	want := map[string]float64{"cpu.usage.min": 10, "cpu.usage.max": 30, "cpu.usage.avg": 20, "cpu.usage.last": 20}
+	var procs int
+	for _, m := range got {
+		if m.Name == "proc.count" {
+			procs++
+			continue
+		}
+		v, ok := want[m.Name]
+		if !ok {
+			t.Errorf("unexpected metric %q", m.Name)
+			continue
+		}
+		if m.Value != v {
+			t.Errorf("%s = %v, want %v", m.Name, m.Value, v)
+		}
+		if !m.Time.AsTime().Equal(base.Add(2 * time.Second)) {
+			t.Errorf("%s stamped %v", m.Name, m.Time.AsTime())
+		}
+		delete(want, m.Name)
+	}
+	if len(want) != 0 || procs != 3 {
+		t.Errorf("missing %v, proc points %d", want, procs)
+	}
+
+	rest, _ := b.take(true)
+	if len(rest) != 4 || rest[3].Name != "cpu.usage.last" || rest[3].Value != 99 {
+		t.Errorf("final take: %v", rest)
+	}
+}
+
+func TestBatcher_DisabledWithoutLimits(t *testing.T) {
+	if b := newBatcher(config.BatchConfig{Compression: "gzip"}); b != nil {
+		t.Fatal("expected nil batcher")
+	}
+}
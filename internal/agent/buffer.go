@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go-agent/internal/spool"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// EnableBuffer makes SendMetrics keep batches the collector did not accept
+// in q and resend them, oldest first and with their original timestamps,
+// once sends succeed again. The queue is closed together with o.
+func (o *GRPCOut) EnableBuffer(q *spool.Queue, replayBatch int) {
+	if replayBatch <= 0 {
+		replayBatch = 50
+	}
+	o.buf = q
+	o.replayBatch = replayBatch
+}
+
+// sendBuffered preserves ordering: while older batches are still queued the
+// new one is appended behind them instead of being sent first.
+func (o *GRPCOut) sendBuffered(ctx context.Context, mb *pb.MetricBatch) error {
+	if o.buf.Len() == 0 {
+		err := o.sendBatch(ctx, mb)
+		if err == nil {
+			return nil
+		}
+		if qerr := o.enqueue(mb); qerr != nil {
+			self.drop(len(mb.Metrics))
+			return errors.Join(err, qerr)
+		}
+		return fmt.Errorf("%w (buffered, depth=%d)", err, o.buf.Len())
+	}
+
+	if err := o.enqueue(mb); err != nil {
+		self.drop(len(mb.Metrics))
+		return err
+	}
+	return o.replay(ctx)
+}
+
+func (o *GRPCOut) enqueue(mb *pb.MetricBatch) error {
+	b, err := proto.Marshal(mb)
+	if err != nil {
+		return fmt.Errorf("marshal batch: %w", err)
+	}
+	if err := o.buf.Append(b, mb.GetTime().AsTime()); err != nil {
+		return fmt.Errorf("buffer batch: %w", err)
+	}
+	return nil
+}
+
+// replay resends up to replayBatch queued batches and stops at the first
+// failure so that order is kept.
+func (o *GRPCOut) replay(ctx context.Context) error {
+	for i := 0; i < o.replayBatch; i++ {
+		b, _, err := o.buf.Peek()
+		if errors.Is(err, spool.ErrEmpty) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var mb pb.MetricBatch
+		if err := proto.Unmarshal(b, &mb); err != nil {
+			_ = o.buf.Drop()
+			continue
+		}
+		if err := o.sendBatch(ctx, &mb); err != nil {
+			if status.Code(err) == codes.InvalidArgument {
+				// the collector will never accept it; do not block the queue
+				_ = o.buf.Drop()
+				self.drop(len(mb.Metrics))
+				continue
+			}
+			return fmt.Errorf("%w (buffered, depth=%d)", err, o.buf.Len())
+		}
+		if err := o.buf.Ack(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *GRPCOut) bufferMetrics() []MetricPoint {
+	st := o.buf.Stats()
+	return []MetricPoint{
+		{Name: "agent.buffer.depth", Value: float64(st.Depth), Unit: "count"},
+		{Name: "agent.buffer.bytes", Value: float64(st.Bytes), Unit: "bytes"},
+		{Name: "agent.buffer.dropped", Value: float64(st.Dropped), Unit: "count"},
+	}
+}
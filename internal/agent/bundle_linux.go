@@ -0,0 +1,310 @@
+//go:build linux
+
+package agent
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"go-agent/internal/config"
+	"go-agent/internal/logging"
+	pb "go-agent/proto/agentv1"
+)
+
+const (
+	// keepSamples is how many samples are kept for support bundles.
+	keepSamples = 60
+	// maxBundleFileBytes caps what is read of one /proc or cgroup file.
+	maxBundleFileBytes = 4 << 20
+)
+
+var bundleSpec = CommandSpec{
+	Name: "support-bundle",
+	Doc:  "gather /proc and cgroup files, the agent's recent logs, config, samples and command results into a tar.gz the collector stores; secrets are redacted",
+}
+
+// builtinRedact masks credentials wherever they appear in a bundle: values
+// of password-like keys, bearer tokens, passwords in URLs and private keys.
+var builtinRedact = []string{
+	`(?i)(?:password|passwd|secret|token|api[_-]?key|access[_-]?key|credentials?)["']?\s*[:=]\s*["']?([^\s"',;}]+)`,
+	`(?i)\bbearer\s+([A-Za-z0-9._~+/=-]+)`,
+	`://[^/\s:@]+:([^/\s@]+)@`,
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
+
+const redactedMark = "<redacted>"
+
+// bundlePolicy is the compiled commands.bundle config.
+type bundlePolicy struct {
+	proc   []string
+	cgroup []string
+	redact []*regexp.Regexp
+	max    int64
+}
+
+func newBundlePolicy(c config.BundleConfig) (*bundlePolicy, error) {
+	p := &bundlePolicy{proc: c.Proc, cgroup: c.Cgroup, max: c.MaxBytes}
+	for _, s := range append(builtinRedact[:len(builtinRedact):len(builtinRedact)], c.Redact...) {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("commands.bundle.redact: %w", err)
+		}
+		p.redact = append(p.redact, re)
+	}
+	return p, nil
+}
+
+// redactBytes masks every match of the policy's patterns in b and returns
+// the result with the number of matches. Matches that were already masked
+// are not counted again.
+func (p *bundlePolicy) redactBytes(b []byte) ([]byte, int) {
+	total := 0
+	for _, re := range p.redact {
+		locs := re.FindAllSubmatchIndex(b, -1)
+		if len(locs) == 0 {
+			continue
+		}
+		var out []byte
+		last := 0
+		for _, m := range locs {
+			start, end := m[0], m[1]
+			if len(m) > 2 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			out = append(out, b[last:start]...)
+			out = append(out, redactedMark...)
+			if string(b[start:end]) != redactedMark {
+				total++
+			}
+			last = end
+		}
+		b = append(out, b[last:]...)
+	}
+	return b, total
+}
+
+// redactString is redactBytes for one string.
+func (p *bundlePolicy) redactString(s string) (string, int) {
+	b, n := p.redactBytes([]byte(s))
+	if n == 0 {
+		return s, 0
+	}
+	return string(b), n
+}
+
+// redactLog is redactString as logging.SetRecentRedact takes it.
+func (p *bundlePolicy) redactLog(s string) string {
+	s, _ = p.redactString(s)
+	return s
+}
+
+// redactRecords masks the arguments, errors and output of command records.
+// This must happen before they are encoded: JSON escapes the quotes around
+// a secret such as password: "hunter2", and the patterns then miss it.
+func (p *bundlePolicy) redactRecords(recs []commandRecord) ([]commandRecord, int) {
+	total := 0
+	for i := range recs {
+		for _, s := range []*string{&recs[i].Args, &recs[i].Error, &recs[i].Output} {
+			var n int
+			*s, n = p.redactString(*s)
+			total += n
+		}
+	}
+	return recs, total
+}
+
+// sampleRecord is one collection tick as kept for support bundles.
+type sampleRecord struct {
+	Time    time.Time          `json:"time"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// sampleRing keeps the latest samples. The collection loop adds to it
+// while commands read it.
+type sampleRing struct {
+	mu   sync.Mutex
+	recs []sampleRecord // oldest first
+}
+
+func (s *sampleRing) add(ts time.Time, points []MetricPoint) {
+	rec := sampleRecord{Time: ts.UTC(), Metrics: make(map[string]float64, len(points))}
+	for _, m := range points {
+		rec.Metrics[m.Name] = m.Value
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recs = append(s.recs, rec)
+	if n := len(s.recs); n > 2*keepSamples {
+		s.recs = append(s.recs[:0], s.recs[n-keepSamples:]...)
+	}
+}
+
+func (s *sampleRing) all() []sampleRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sampleRecord(nil), s.recs[max(len(s.recs)-keepSamples, 0):]...)
+}
+
+// bundleManifest is the first file of a bundle.
+type bundleManifest struct {
+	Host    string       `json:"host"`
+	Created time.Time    `json:"created"`
+	Files   []bundleFile `json:"files"`
+	// Errors maps the files that could not be gathered to the reason.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type bundleFile struct {
+	Name       string `json:"name"`
+	Bytes      int    `json:"bytes"`
+	Redactions int    `json:"redactions,omitempty"`
+}
+
+// bundleItem is one file to gather: read returns its content and how many
+// secrets it already masked. The content is redacted again as a whole.
+type bundleItem struct {
+	name string
+	read func() ([]byte, int, error)
+}
+
+// raw adapts a reader of content that is only redacted as a whole.
+func raw(read func() ([]byte, error)) func() ([]byte, int, error) {
+	return func() ([]byte, int, error) {
+		b, err := read()
+		return b, 0, err
+	}
+}
+
+var errBundleTooLarge = errors.New("bundle exceeds commands.bundle.max_bytes")
+
+func (r *Runner) bundleCommand(ctx context.Context, _ Args, p *Progress) CommandOutcome {
+	bp := r.policy.Load().bundle
+	host, _ := os.Hostname()
+	now := time.Now().UTC()
+	dir := fmt.Sprintf("support-bundle-%s-%s", host, now.Format("20060102T150405Z"))
+
+	items := []bundleItem{
+		// log records are redacted as they are written, see logging.SetRecentRedact
+		{"agent/log.txt", raw(func() ([]byte, error) { return logging.Recent(), nil })},
+		{"agent/config.json", raw(func() ([]byte, error) { return json.MarshalIndent(r.effective.Load().Redacted(), "", "  ") })},
+		{"agent/samples.json", raw(func() ([]byte, error) { return json.MarshalIndent(r.samples.all(), "", "  ") })},
+		{"agent/commands.json", func() ([]byte, int, error) {
+			recs, n := bp.redactRecords(r.pool.finished())
+			b, err := json.MarshalIndent(recs, "", "  ")
+			return b, n, err
+		}},
+	}
+	for _, f := range bp.proc {
+		items = append(items, bundleItem{path.Join("proc", f), raw(readLimited(filepath.Join("/proc", f)))})
+	}
+	cgroups := map[string]string{"root": "/sys/fs/cgroup"}
+	if cg, err := selfCgroupPathV2(); err == nil && cg != "/" {
+		cgroups["self"] = filepath.Join("/sys/fs/cgroup", cg)
+	}
+	for _, which := range []string{"root", "self"} {
+		base, ok := cgroups[which]
+		if !ok {
+			continue
+		}
+		for _, f := range bp.cgroup {
+			items = append(items, bundleItem{path.Join("cgroup", which, f), raw(readLimited(filepath.Join(base, f)))})
+		}
+	}
+
+	// the manifest comes first, so it is gathered before it is written
+	man := bundleManifest{Host: host, Created: now, Errors: map[string]string{}}
+	type gathered struct {
+		name string
+		data []byte
+	}
+	var files []gathered
+	for i, it := range items {
+		if err := ctx.Err(); err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+		b, n, err := it.read()
+		if err != nil {
+			man.Errors[it.name] = err.Error()
+			continue
+		}
+		b, m := bp.redactBytes(b)
+		files = append(files, gathered{it.name, b})
+		man.Files = append(man.Files, bundleFile{Name: it.name, Bytes: len(b), Redactions: n + m})
+		p.Set(i * 50 / len(items))
+	}
+	mb, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	files = append([]gathered{{"MANIFEST.json", mb}}, files...)
+
+	p.Artifact(dir + ".tar.gz")
+	lw := &limitWriter{w: p, n: bp.max}
+	zw := gzip.NewWriter(lw)
+	tw := tar.NewWriter(zw)
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+		hdr := &tar.Header{
+			Name:    dir + "/" + f.name,
+			Mode:    0o644,
+			Size:    int64(len(f.data)),
+			ModTime: now,
+			Format:  tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+		p.Set(50 + i*50/len(files))
+	}
+	if err := tw.Close(); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	if err := zw.Close(); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	commandLog.Info("support bundle built", "files", len(files), "bytes", bp.max-lw.n, "missing", len(man.Errors))
+	return CommandOutcome{Status: pb.CommandResult_OK}
+}
+
+// readLimited returns a reader of the first maxBundleFileBytes of a file;
+// files in /proc and cgroupfs report no size, so it cannot be checked first.
+func readLimited(name string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, maxBundleFileBytes))
+	}
+}
+
+// limitWriter fails once more than n bytes were written through it.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > l.n {
+		return 0, errBundleTooLarge
+	}
+	l.n -= int64(len(b))
+	return l.w.Write(b)
+}
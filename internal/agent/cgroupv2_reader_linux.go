@@ -47,6 +47,21 @@ func (r *CgroupV2Reader) MemMax() (limit uint64, unlimited bool, err error) {
 	return v, false, err
 }
 
+// OOMKills returns the oom_kill count from memory.events.
+func (r *CgroupV2Reader) OOMKills() (uint64, error) {
+	s, err := r.readFile("memory.events")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return util.ParseUint(fields[1])
+		}
+	}
+	return 0, errors.New("oom_kill not found in memory.events")
+}
+
 func (r *CgroupV2Reader) CPUUsageUsec() (uint64, error) {
 	s, err := r.readFile("cpu.stat")
 	if err != nil {
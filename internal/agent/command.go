@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go-agent/internal/config"
+	"go-agent/internal/logging"
+	pb "go-agent/proto/agentv1"
+)
+
+// Argument types accepted in a command's args_json.
+const (
+	ArgString   = "string"
+	ArgInt      = "int"
+	ArgNumber   = "number"
+	ArgBool     = "bool"
+	ArgDuration = "duration" // a Go duration string such as "30s"
+	ArgStrings  = "strings"  // a list of strings
+)
+
+type ArgSpec struct {
+	Name     string
+	Type     string
+	Required bool
+	Doc      string
+	// Enum restricts a string argument to these values.
+	Enum []string
+}
+
+type CommandSpec struct {
+	Name string
+	Doc  string
+	Args []ArgSpec
+	// Immediate commands start at once instead of waiting for a free
+	// worker. Meant for quick control commands such as cancel.
+	Immediate bool
+}
+
+// Args holds decoded and validated command arguments. Absent optional
+// arguments read as the zero value.
+type Args map[string]any
+
+func (a Args) Has(name string) bool { _, ok := a[name]; return ok }
+
+func (a Args) String(name string) string          { v, _ := a[name].(string); return v }
+func (a Args) Int(name string) int64              { v, _ := a[name].(int64); return v }
+func (a Args) Number(name string) float64         { v, _ := a[name].(float64); return v }
+func (a Args) Bool(name string) bool              { v, _ := a[name].(bool); return v }
+func (a Args) Duration(name string) time.Duration { v, _ := a[name].(time.Duration); return v }
+func (a Args) Strings(name string) []string       { v, _ := a[name].([]string); return v }
+
+type CommandOutcome struct {
+	Status pb.CommandResult_Status
+	Output string
+	Error  string
+}
+
+// CommandFunc runs a command. It must return soon after ctx ends, which
+// happens on timeout and on cancel. Progress and output reported through
+// p are streamed to the collector while the command runs; the outcome's
+// output follows them.
+type CommandFunc func(ctx context.Context, args Args, p *Progress) CommandOutcome
+
+type registeredCommand struct {
+	spec CommandSpec
+	fn   CommandFunc
+}
+
+// commandRegistry maps command names to handlers. Commands are registered
+// while the agent starts and the registry is read-only afterwards.
+type commandRegistry struct {
+	cmds map[string]registeredCommand
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{cmds: make(map[string]registeredCommand)}
+}
+
+func (r *commandRegistry) register(spec CommandSpec, fn CommandFunc) {
+	if _, dup := r.cmds[spec.Name]; dup {
+		panic("agent: command registered twice: " + spec.Name)
+	}
+	r.cmds[spec.Name] = registeredCommand{spec: spec, fn: fn}
+}
+
+func (r *commandRegistry) spec(name string) (CommandSpec, bool) {
+	rc, ok := r.cmds[name]
+	return rc.spec, ok
+}
+
+// run decodes and validates the arguments of cmd before calling its
+// handler.
+func (r *commandRegistry) run(ctx context.Context, cmd *pb.Command, p *Progress) CommandOutcome {
+	rc, ok := r.cmds[cmd.GetName()]
+	if !ok {
+		return CommandOutcome{Status: pb.CommandResult_UNKNOWN_COMMAND, Error: fmt.Sprintf("unknown command %q", cmd.GetName())}
+	}
+	args, err := decodeArgs(rc.spec, cmd.GetArgsJson())
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: err.Error()}
+	}
+	return rc.fn(ctx, args, p)
+}
+
+// specs lists the registered commands by name, for the collector.
+func (r *commandRegistry) specs() []*pb.CommandSpec {
+	out := make([]*pb.CommandSpec, 0, len(r.cmds))
+	for _, rc := range r.cmds {
+		cs := &pb.CommandSpec{Name: rc.spec.Name, Description: rc.spec.Doc}
+		for _, a := range rc.spec.Args {
+			cs.Args = append(cs.Args, &pb.ArgSpec{
+				Name:        a.Name,
+				Type:        a.Type,
+				Required:    a.Required,
+				Description: a.Doc,
+				Enum:        a.Enum,
+			})
+		}
+		out = append(out, cs)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// decodeArgs checks args_json against spec and converts every argument to
+// its Go type. All problems are reported together.
+func decodeArgs(spec CommandSpec, argsJSON string) (Args, error) {
+	raw := map[string]json.RawMessage{}
+	if s := strings.TrimSpace(argsJSON); s != "" {
+		if err := json.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, fmt.Errorf("args_json must be a JSON object: %w", err)
+		}
+	}
+
+	var errs []error
+	for name := range raw {
+		if !slices.ContainsFunc(spec.Args, func(a ArgSpec) bool { return a.Name == name }) {
+			errs = append(errs, fmt.Errorf("%s: unknown argument", name))
+		}
+	}
+
+	args := make(Args, len(spec.Args))
+	for _, a := range spec.Args {
+		b, ok := raw[a.Name]
+		if !ok || bytes.Equal(b, []byte("null")) {
+			if a.Required {
+				errs = append(errs, fmt.Errorf("%s: required", a.Name))
+			}
+			continue
+		}
+		v, err := decodeArg(a, b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Name, err))
+			continue
+		}
+		args[a.Name] = v
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return nil, errors.Join(errs...)
+	}
+	return args, nil
+}
+
+func decodeArg(a ArgSpec, b json.RawMessage) (any, error) {
+	switch a.Type {
+	case ArgString:
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		if len(a.Enum) > 0 && !slices.Contains(a.Enum, s) {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(a.Enum, ", "))
+		}
+		return s, nil
+	case ArgInt:
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		return n, nil
+	case ArgNumber:
+		var f float64
+		if err := json.Unmarshal(b, &f); err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return f, nil
+	case ArgBool:
+		var v bool
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return v, nil
+	case ArgDuration:
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, errors.New(`must be a duration string like "30s"`)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf(`must be a duration string like "30s": %q`, s)
+		}
+		return d, nil
+	case ArgStrings:
+		var l []string
+		if err := json.Unmarshal(b, &l); err != nil {
+			return nil, errors.New("must be a list of strings")
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("unsupported argument type %q", a.Type)
+}
+
+// commandPolicy is what the commands section of the local config allows
+// commands to touch.
+type commandPolicy struct {
+	exec    *execPolicy
+	files   *filePolicy
+	bundle  *bundlePolicy
+	process *processPolicy
+	signing *signingPolicy
+}
+
+func newCommandPolicy(c config.CommandsConfig) (*commandPolicy, error) {
+	exec, err := newExecPolicy(c.Exec)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := newBundlePolicy(c.Bundle)
+	if err != nil {
+		return nil, err
+	}
+	process, err := newProcessPolicy(c.Process)
+	if err != nil {
+		return nil, err
+	}
+	signing, err := newSigningPolicy(c.Signing)
+	if err != nil {
+		return nil, err
+	}
+	return &commandPolicy{exec: exec, files: newFilePolicy(c.Files), bundle: bundle, process: process, signing: signing}, nil
+}
+
+// registerBuiltinCommands adds the commands that need nothing but the
+// agent process itself.
+func registerBuiltinCommands(r *commandRegistry) {
+	r.register(CommandSpec{Name: "ping", Doc: "check that the agent runs commands"},
+		func(ctx context.Context, args Args, p *Progress) CommandOutcome {
+			return CommandOutcome{Status: pb.CommandResult_OK, Output: "pong"}
+		})
+
+	r.register(CommandSpec{
+		Name: "log.level",
+		Doc:  "change the agent's log level; the output lists the resulting levels",
+		Args: []ArgSpec{
+			{Name: "level", Type: ArgString, Required: true, Enum: []string{"debug", "info", "warn", "error"}},
+			{Name: "component", Type: ArgString, Doc: "component to change; empty changes the default"},
+		},
+	}, func(ctx context.Context, args Args, p *Progress) CommandOutcome {
+		if err := logging.SetLevel(args.String("component"), args.String("level")); err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+		out, _ := json.Marshal(logging.Levels())
+		commandLog.Info("log level changed", "component", args.String("component"), "level", args.String("level"))
+		return CommandOutcome{Status: pb.CommandResult_OK, Output: string(out)}
+	})
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	pb "go-agent/proto/agentv1"
+)
+
+func TestCommandRegistryValidatesArgs(t *testing.T) {
+	r := newCommandRegistry()
+	var got Args
+	r.register(CommandSpec{
+		Name: "demo",
+		Args: []ArgSpec{
+			{Name: "mode", Type: ArgString, Required: true, Enum: []string{"fast", "slow"}},
+			{Name: "n", Type: ArgInt},
+			{Name: "ratio", Type: ArgNumber},
+			{Name: "force", Type: ArgBool},
+			{Name: "wait", Type: ArgDuration},
+		},
+	}, func(ctx context.Context, args Args, p *Progress) CommandOutcome {
+		got = args
+		return CommandOutcome{Status: pb.CommandResult_OK}
+	})
+
+	run := func(name, args string) CommandOutcome {
+		return r.run(context.Background(), &pb.Command{Name: name, ArgsJson: args}, newProgress(0))
+	}
+
+	res := run("demo", `{"mode":"fast","n":3,"ratio":0.5,"force":true,"wait":"2s"}`)
+	if res.Status != pb.CommandResult_OK {
+		t.Fatalf("valid args rejected: %+v", res)
+	}
+	if got.String("mode") != "fast" || got.Int("n") != 3 || got.Number("ratio") != 0.5 ||
+		!got.Bool("force") || got.Duration("wait") != 2*time.Second {
+		t.Fatalf("decoded args = %v", got)
+	}
+
+	for _, tc := range []struct{ args, want string }{
+		{``, "mode: required"},
+		{`[1]`, "must be a JSON object"},
+		{`{"mode":"medium"}`, "mode: must be one of fast, slow"},
+		{`{"mode":"fast","n":1.5}`, "n: must be an integer"},
+		{`{"mode":"fast","wait":"soon"}`, "wait: must be a duration"},
+		{`{"mode":"fast","extra":1}`, "extra: unknown argument"},
+	} {
+		res := run("demo", tc.args)
+		if res.Status != pb.CommandResult_INVALID_ARGS || !strings.Contains(res.Error, tc.want) {
+			t.Errorf("args %s: got %v %q, want INVALID_ARGS containing %q", tc.args, res.Status, res.Error, tc.want)
+		}
+	}
+
+	if res := run("nope", `{}`); res.Status != pb.CommandResult_UNKNOWN_COMMAND {
+		t.Fatalf("unknown command: %v", res.Status)
+	}
+}
+
+func TestSplitOutput(t *testing.T) {
+	if got := splitOutput("", 4); len(got) != 1 || got[0] != "" {
+		t.Fatalf("empty output = %q, want one empty chunk", got)
+	}
+	s := "abcdé€fg" // é and € are multi-byte
+	got := splitOutput(s, 4)
+	if strings.Join(got, "") != s {
+		t.Fatalf("chunks %q do not add up to %q", got, s)
+	}
+	for _, c := range got {
+		if len(c) > 4 || !utf8.ValidString(c) {
+			t.Fatalf("bad chunk %q in %q", c, got)
+		}
+	}
+}
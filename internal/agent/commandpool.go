@@ -0,0 +1,602 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// commandChunkSize bounds the output carried by one CommandResult;
+	// longer output is split across several.
+	commandChunkSize = 256 << 10
+	// progressInterval is how often a running command's progress and new
+	// output are sent.
+	progressInterval = 2 * time.Second
+	// keepaliveInterval is the longest a running command stays silent, so
+	// the collector knows it is still alive.
+	keepaliveInterval = 30 * time.Second
+	// finalRetry is how long the final result of a command is retried
+	// while the collector cannot be reached, backing off up to
+	// maxFinalBackoff between attempts.
+	finalRetry      = 15 * time.Minute
+	maxFinalBackoff = 30 * time.Second
+	// keepRecent is how many finished commands are remembered for support
+	// bundles, each with up to keepOutputBytes of its output.
+	keepRecent      = 20
+	keepOutputBytes = 64 << 10
+)
+
+var (
+	errCancelled = errors.New("cancelled")
+	errTimedOut  = errors.New("timed out")
+	errStopping  = errors.New("agent stopping")
+)
+
+// Progress is how a running command reports on itself. Output written to
+// it is sent to the collector in pieces while the command runs.
+type Progress struct {
+	mu      sync.Mutex
+	percent uint32
+	out     strings.Builder // written since the last update
+	changed bool
+	// artifact names the file the output is stored as when it is binary.
+	artifact string
+	// head is the start of the text output, total the bytes written.
+	head  strings.Builder
+	total int
+	// full is signalled when enough output is pending to fill a chunk.
+	full chan struct{}
+	// Write blocks while limit bytes are pending, until they are taken;
+	// 0 means no limit.
+	limit   int
+	drained *sync.Cond
+}
+
+func newProgress(limit int) *Progress {
+	p := &Progress{full: make(chan struct{}, 1), limit: limit}
+	p.drained = sync.NewCond(&p.mu)
+	return p
+}
+
+// Set records how far the command is, in percent.
+func (p *Progress) Set(percent int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v := uint32(min(max(percent, 0), 100))
+	if v != p.percent {
+		p.percent, p.changed = v, true
+	}
+}
+
+// Artifact declares that the command writes binary data, which the
+// collector stores as a file with the given name rather than as text. It
+// must be called before the first Write, and the command's outcome must
+// then have no Output.
+func (p *Progress) Artifact(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.artifact = name
+}
+
+func (p *Progress) artifactName() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.artifact
+}
+
+func (p *Progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.limit > 0 && p.out.Len() >= p.limit {
+		p.drained.Wait()
+	}
+	p.out.Write(b)
+	p.changed = true
+	if n := keepOutputBytes - p.head.Len(); p.artifact == "" && n > 0 {
+		p.head.Write(b[:min(n, len(b))])
+	}
+	p.total += len(b)
+	if p.out.Len() >= commandChunkSize {
+		select {
+		case p.full <- struct{}{}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+// take returns what was reported since the last call.
+func (p *Progress) take() (percent uint32, out string, changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out, changed = p.out.String(), p.changed
+	p.out.Reset()
+	p.changed = false
+	p.drained.Broadcast()
+	return p.percent, out, changed
+}
+
+type commandJob struct {
+	cmd     *pb.Command
+	timeout time.Duration
+	start   time.Time
+
+	// ctx and cancel are set when the job leaves the queue.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	progress *Progress
+	// chunk is the next chunk number; only the goroutine running the job
+	// sends, so it needs no lock.
+	chunk uint32
+}
+
+// commandReporter is where a command's results and audit events go,
+// normally the current gRPC output.
+type commandReporter interface {
+	ReportCommandResult(ctx context.Context, res *pb.CommandResult) error
+	ReportEvent(ctx context.Context, ev *pb.Event) error
+}
+
+// commandPool runs commands off the collection loop, a limited number at a
+// time, and streams their results through the current gRPC output.
+type commandPool struct {
+	reg *commandRegistry
+
+	ctx  context.Context
+	stop context.CancelCauseFunc
+	wg   sync.WaitGroup
+
+	mu     sync.Mutex
+	out    commandReporter
+	cfg    config.CommandsConfig
+	queue  []*commandJob
+	jobs   map[string]*commandJob // queued or running, by command id
+	active int
+	recent []commandRecord // oldest first
+}
+
+// commandRecord is a finished command as kept for support bundles.
+type commandRecord struct {
+	CommandID string    `json:"command_id"`
+	Name      string    `json:"name"`
+	Args      string    `json:"args,omitempty"`
+	Start     time.Time `json:"start"`
+	Duration  string    `json:"duration"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	// Output is the start of the text output; OutputBytes counts all of
+	// it, or the data of an artifact.
+	Output      string `json:"output,omitempty"`
+	OutputBytes int    `json:"output_bytes"`
+	Artifact    string `json:"artifact,omitempty"`
+}
+
+func newCommandPool(reg *commandRegistry) *commandPool {
+	ctx, stop := context.WithCancelCause(context.Background())
+	return &commandPool{
+		reg:  reg,
+		ctx:  ctx,
+		stop: stop,
+		out:  (*GRPCOut)(nil),
+		cfg:  config.Default().Commands,
+		jobs: make(map[string]*commandJob),
+	}
+}
+
+func (p *commandPool) configure(cfg config.CommandsConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg = cfg
+	p.startLocked()
+}
+
+func (p *commandPool) setOutput(o commandReporter) {
+	p.mu.Lock()
+	p.out = o
+	p.mu.Unlock()
+}
+
+func (p *commandPool) output() commandReporter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.out
+}
+
+// submit queues cmd, or starts it at once if it is immediate. A command
+// already queued or running, as when the collector delivers it again, is
+// ignored.
+func (p *commandPool) submit(cmd *pb.Command) {
+	id := cmd.GetCommandId()
+	// a fast writer waits for its output to be sent rather than piling
+	// it up in memory
+	j := &commandJob{cmd: cmd, progress: newProgress(2 * commandChunkSize)}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, dup := p.jobs[id]; dup {
+		commandLog.Debug("already queued or running", "command_id", id)
+		return
+	}
+	j.timeout = p.timeoutLocked(cmd)
+	if out, ok := expired(cmd, time.Now()); ok {
+		p.detach(j, out)
+		return
+	}
+
+	spec, _ := p.reg.spec(cmd.GetName())
+	if spec.Immediate {
+		p.jobs[id] = j
+		p.launchLocked(j)
+		return
+	}
+	if len(p.queue) >= p.cfg.Queue && p.active >= p.cfg.Workers {
+		p.detach(j, CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf("command queue full (%d waiting)", len(p.queue))})
+		return
+	}
+	p.jobs[id] = j
+	p.queue = append(p.queue, j)
+	p.startLocked()
+}
+
+func (p *commandPool) timeoutLocked(cmd *pb.Command) time.Duration {
+	d := p.cfg.Timeout.Duration
+	if s := cmd.GetTimeoutSeconds(); s > 0 {
+		d = time.Duration(s) * time.Second
+	}
+	return min(d, p.cfg.MaxTimeout.Duration)
+}
+
+type commandIDKey struct{}
+
+// commandID returns the id of the command whose handler got ctx.
+func commandID(ctx context.Context) string {
+	id, _ := ctx.Value(commandIDKey{}).(string)
+	return id
+}
+
+// startLocked moves queued jobs to free workers. Jobs whose command
+// expired while they waited are dropped.
+func (p *commandPool) startLocked() {
+	for p.active < p.cfg.Workers && len(p.queue) > 0 {
+		j := p.queue[0]
+		p.queue = p.queue[1:]
+		if out, ok := expired(j.cmd, time.Now()); ok {
+			delete(p.jobs, j.cmd.GetCommandId())
+			p.detach(j, out)
+			continue
+		}
+		p.active++
+		p.launchLocked(j)
+	}
+}
+
+// expired returns the outcome of cmd if its expiry has passed, by when the
+// collector no longer expects it to start.
+func expired(cmd *pb.Command, now time.Time) (CommandOutcome, bool) {
+	if cmd.GetExpires() == nil || !now.After(cmd.GetExpires().AsTime()) {
+		return CommandOutcome{}, false
+	}
+	return CommandOutcome{
+		Status: pb.CommandResult_EXPIRED,
+		Error:  fmt.Sprintf("expired at %s before it could start", cmd.GetExpires().AsTime().UTC().Format(time.RFC3339)),
+	}, true
+}
+
+func (p *commandPool) launchLocked(j *commandJob) {
+	ctx, cancel := context.WithCancelCause(p.ctx)
+	ctx, stopTimer := context.WithTimeoutCause(ctx, j.timeout, errTimedOut)
+	j.ctx = context.WithValue(ctx, commandIDKey{}, j.cmd.GetCommandId())
+	j.cancel = func(cause error) {
+		cancel(cause)
+		stopTimer()
+	}
+	p.wg.Add(1)
+	go p.run(j)
+}
+
+func (p *commandPool) run(j *commandJob) {
+	defer p.wg.Done()
+	defer p.done(j)
+	defer j.cancel(nil)
+
+	j.start = time.Now()
+	commandLog.Debug("started", "command_id", j.cmd.GetCommandId(), "name", j.cmd.GetName(), "timeout", j.timeout)
+	p.send(j, CommandOutcome{Status: pb.CommandResult_RUNNING}, 0, false)
+
+	stopped := make(chan struct{})
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		p.stream(j, stopped)
+	}()
+	out := p.reg.run(j.ctx, j.cmd, j.progress)
+	close(stopped)
+	<-streamed
+
+	if j.ctx.Err() != nil {
+		switch cause := context.Cause(j.ctx); cause {
+		case errTimedOut:
+			out.Status, out.Error = pb.CommandResult_TIMED_OUT, fmt.Sprintf("timed out after %s", j.timeout)
+		case errCancelled, errStopping:
+			out.Status, out.Error = pb.CommandResult_CANCELLED, cause.Error()
+		}
+	}
+	p.remember(j, out)
+	percent, pending, _ := j.progress.take()
+	out.Output = pending + out.Output
+	p.send(j, out, percent, true)
+	commandLog.Info("finished",
+		"command_id", j.cmd.GetCommandId(),
+		"name", j.cmd.GetName(),
+		"status", out.Status.String(),
+		"duration", time.Since(j.start).Round(time.Millisecond),
+	)
+}
+
+// stream sends progress updates for j until stopped is closed.
+func (p *commandPool) stream(j *commandJob, stopped <-chan struct{}) {
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-j.progress.full:
+		case <-t.C:
+		}
+		percent, out, changed := j.progress.take()
+		if !changed && time.Since(last) < keepaliveInterval {
+			continue
+		}
+		p.send(j, CommandOutcome{Status: pb.CommandResult_RUNNING, Output: out}, percent, false)
+		last = time.Now()
+	}
+}
+
+// remember keeps out, the final outcome of j, among the recent commands.
+// Its Output is what the command returned besides what it wrote.
+func (p *commandPool) remember(j *commandJob, out CommandOutcome) {
+	rec := commandRecord{
+		CommandID: j.cmd.GetCommandId(),
+		Name:      j.cmd.GetName(),
+		Args:      j.cmd.GetArgsJson(),
+		Start:     j.start.UTC(),
+		Duration:  time.Since(j.start).Round(time.Millisecond).String(),
+		Status:    out.Status.String(),
+		Error:     out.Error,
+	}
+	j.progress.mu.Lock()
+	rec.Artifact = j.progress.artifact
+	rec.OutputBytes = j.progress.total + len(out.Output)
+	if rec.Artifact == "" {
+		head := j.progress.head.String()
+		rec.Output = head + out.Output[:min(keepOutputBytes-len(head), len(out.Output))]
+		rec.Output = strings.ToValidUTF8(rec.Output, "\uFFFD")
+	}
+	j.progress.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recent = append(p.recent, rec)
+	if n := len(p.recent); n > keepRecent {
+		p.recent = append([]commandRecord(nil), p.recent[n-keepRecent:]...)
+	}
+}
+
+// finished returns the recently finished commands, oldest first.
+func (p *commandPool) finished() []commandRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.recent)
+}
+
+func (p *commandPool) done(j *commandJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.jobs, j.cmd.GetCommandId())
+	if spec, _ := p.reg.spec(j.cmd.GetName()); !spec.Immediate {
+		p.active--
+	}
+	p.startLocked()
+}
+
+// reportEvent sends ev through the current output, for commands that
+// leave an audit trail.
+func (p *commandPool) reportEvent(ctx context.Context, ev *pb.Event) {
+	if err := p.output().ReportEvent(ctx, ev); err != nil {
+		errLimit.Log(commandLog, slog.LevelWarn, "event not sent", "type", ev.GetType(), "err", err)
+	}
+}
+
+// queued reports whether a command with the given id is queued or running.
+func (p *commandPool) queued(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.jobs[id]
+	return ok
+}
+
+// reject reports out as the final outcome of cmd, which is not run.
+func (p *commandPool) reject(cmd *pb.Command, out CommandOutcome) {
+	p.detach(&commandJob{cmd: cmd, progress: newProgress(0)}, out)
+}
+
+// detach reports a final outcome for a job that never ran, without
+// blocking the caller.
+func (p *commandPool) detach(j *commandJob, out CommandOutcome) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.send(j, out, 0, true)
+	}()
+}
+
+// send reports out for j, split into chunks. All but the last chunk of a
+// final outcome carry RUNNING.
+func (p *commandPool) send(j *commandJob, out CommandOutcome, percent uint32, final bool) {
+	ctx := context.WithoutCancel(p.ctx)
+	artifact := j.progress.artifactName()
+	var pieces []string
+	if artifact != "" {
+		pieces = splitBytes(out.Output, commandChunkSize)
+	} else {
+		pieces = splitOutput(out.Output, commandChunkSize)
+	}
+	for i, piece := range pieces {
+		last := final && i == len(pieces)-1
+		res := &pb.CommandResult{
+			CommandId: j.cmd.GetCommandId(),
+			Status:    pb.CommandResult_RUNNING,
+			Chunk:     j.chunk,
+			More:      !last,
+			Progress:  percent,
+		}
+		if artifact != "" {
+			res.Artifact, res.Data = artifact, []byte(piece)
+		} else {
+			res.Output = strings.ToValidUTF8(piece, "\uFFFD")
+		}
+		if last {
+			res.Status, res.Error = out.Status, out.Error
+		}
+		if err := p.report(ctx, res, final); err != nil {
+			// the chunk number is not used up, so the stream stays
+			// contiguous and the next update carries on from here
+			commandLog.Error("report failed", "command_id", res.CommandId, "chunk", res.Chunk, "err", err)
+			return
+		}
+		j.chunk++
+	}
+}
+
+// report sends res through the current output. The chunks of a final
+// outcome are retried with backoff while the collector is unreachable,
+// since nothing would report how the command ended otherwise; the pool
+// closing ends the retries.
+func (p *commandPool) report(ctx context.Context, res *pb.CommandResult, retry bool) error {
+	deadline := time.Now().Add(finalRetry)
+	backoff := time.Second
+	for {
+		err := p.output().ReportCommandResult(ctx, res)
+		if err == nil || !retry || !transient(err) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		commandLog.Warn("result not sent, retrying", "command_id", res.CommandId, "chunk", res.Chunk, "in", backoff, "err", err)
+		select {
+		case <-p.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxFinalBackoff)
+	}
+}
+
+// transient reports whether a call failed only because the collector could
+// not be reached or did not know the agent yet.
+func transient(err error) bool {
+	if errors.Is(err, ErrNotRegistered) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.NotFound:
+		return true
+	}
+	return false
+}
+
+// cancel aborts the command with the given id, whether queued or running.
+func (p *commandPool) cancel(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j, ok := p.jobs[id]
+	if !ok {
+		return fmt.Errorf("no command %q is queued or running", id)
+	}
+	if j.cancel != nil {
+		j.cancel(errCancelled)
+		return nil
+	}
+	delete(p.jobs, id)
+	for i, q := range p.queue {
+		if q == j {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			break
+		}
+	}
+	p.detach(j, CommandOutcome{Status: pb.CommandResult_CANCELLED, Error: "cancelled before it started"})
+	return nil
+}
+
+// close cancels every command and waits until their results are sent.
+func (p *commandPool) close() {
+	p.mu.Lock()
+	for _, j := range p.queue {
+		delete(p.jobs, j.cmd.GetCommandId())
+		p.detach(j, CommandOutcome{Status: pb.CommandResult_CANCELLED, Error: errStopping.Error()})
+	}
+	p.queue = nil
+	p.mu.Unlock()
+	p.stop(errStopping)
+	p.wg.Wait()
+}
+
+var cancelSpec = CommandSpec{
+	Name: "cancel",
+	Doc:  "abort a queued or running command",
+	Args: []ArgSpec{
+		{Name: "command_id", Type: ArgString, Required: true, Doc: "id of the command to abort"},
+	},
+	Immediate: true,
+}
+
+func (p *commandPool) cancelCommand(ctx context.Context, args Args, _ *Progress) CommandOutcome {
+	id := args.String("command_id")
+	if err := p.cancel(id); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	commandLog.Info("cancel requested", "target", id)
+	return CommandOutcome{Status: pb.CommandResult_OK, Output: "cancelled " + id}
+}
+
+// splitOutput cuts s into pieces of at most n bytes without splitting a
+// UTF-8 sequence. It always returns at least one piece.
+func splitOutput(s string, n int) []string {
+	var out []string
+	for len(s) > n {
+		cut := n
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = n
+		}
+		out = append(out, s[:cut])
+		s = s[cut:]
+	}
+	return append(out, s)
+}
+
+// splitBytes cuts s into pieces of at most n bytes. It always returns at
+// least one piece.
+func splitBytes(s string, n int) []string {
+	var out []string
+	for len(s) > n {
+		out = append(out, s[:n])
+		s = s[n:]
+	}
+	return append(out, s)
+}
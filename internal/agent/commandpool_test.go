@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// resultLog records every result message and the final one per command.
+type resultLog struct {
+	mu    sync.Mutex
+	msgs  map[string][]*pb.CommandResult
+	final chan *pb.CommandResult
+}
+
+func newResultLog() *resultLog {
+	return &resultLog{msgs: map[string][]*pb.CommandResult{}, final: make(chan *pb.CommandResult, 16)}
+}
+
+func (l *resultLog) ReportCommandResult(ctx context.Context, res *pb.CommandResult) error {
+	l.mu.Lock()
+	l.msgs[res.CommandId] = append(l.msgs[res.CommandId], res)
+	l.mu.Unlock()
+	if !res.More {
+		l.final <- res
+	}
+	return nil
+}
+
+func (l *resultLog) ReportEvent(ctx context.Context, ev *pb.Event) error { return nil }
+
+func (l *resultLog) next(t *testing.T) *pb.CommandResult {
+	t.Helper()
+	select {
+	case res := <-l.final:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result")
+		return nil
+	}
+}
+
+func (l *resultLog) output(id string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b strings.Builder
+	for i, res := range l.msgs[id] {
+		if res.Chunk != uint32(i) {
+			panic(fmt.Sprintf("chunk %d at %d", res.Chunk, i))
+		}
+		b.WriteString(res.Output)
+	}
+	return b.String()
+}
+
+func TestCommandPool(t *testing.T) {
+	reg := newCommandRegistry()
+	started := make(chan string, 4)
+	reg.register(CommandSpec{Name: "wait"}, func(ctx context.Context, args Args, p *Progress) CommandOutcome {
+		fmt.Fprint(p, "waiting;")
+		p.Set(50)
+		started <- "wait"
+		<-ctx.Done()
+		return CommandOutcome{Status: pb.CommandResult_OK, Output: "done"}
+	})
+	pool := newCommandPool(reg)
+	reg.register(cancelSpec, pool.cancelCommand)
+	results := newResultLog()
+	pool.setOutput(results)
+	pool.configure(config.CommandsConfig{
+		Workers:    1,
+		Queue:      1,
+		Timeout:    config.Duration{Duration: time.Minute},
+		MaxTimeout: config.Duration{Duration: time.Minute},
+	})
+	defer pool.close()
+
+	pool.submit(&pb.Command{CommandId: "a", Name: "wait", TimeoutSeconds: 1})
+	<-started
+	pool.submit(&pb.Command{CommandId: "b", Name: "wait"}) // queued behind a
+	pool.submit(&pb.Command{CommandId: "c", Name: "wait"}) // queue full
+	if res := results.next(t); res.CommandId != "c" || res.Status != pb.CommandResult_ERROR {
+		t.Fatalf("over the queue limit: %+v", res)
+	}
+
+	res := results.next(t)
+	if res.CommandId != "a" || res.Status != pb.CommandResult_TIMED_OUT {
+		t.Fatalf("a: %+v", res)
+	}
+	if got := results.output("a"); got != "waiting;done" {
+		t.Fatalf("a output = %q", got)
+	}
+
+	<-started
+	pool.submit(&pb.Command{CommandId: "x", Name: "cancel", ArgsJson: `{"command_id":"b"}`})
+	for range 2 {
+		res := results.next(t)
+		switch res.CommandId {
+		case "x":
+			if res.Status != pb.CommandResult_OK {
+				t.Fatalf("cancel: %+v", res)
+			}
+		case "b":
+			if res.Status != pb.CommandResult_CANCELLED || res.Progress != 50 {
+				t.Fatalf("b: %+v", res)
+			}
+		default:
+			t.Fatalf("unexpected result %+v", res)
+		}
+	}
+
+	pool.submit(&pb.Command{CommandId: "y", Name: "cancel", ArgsJson: `{"command_id":"b"}`})
+	if res := results.next(t); res.Status != pb.CommandResult_ERROR {
+		t.Fatalf("cancel of a finished command: %+v", res)
+	}
+}
+
+// flakyLog fails the first fail results as if the collector were away.
+type flakyLog struct {
+	*resultLog
+	mu   sync.Mutex
+	fail int
+}
+
+func (l *flakyLog) ReportCommandResult(ctx context.Context, res *pb.CommandResult) error {
+	l.mu.Lock()
+	if l.fail > 0 {
+		l.fail--
+		l.mu.Unlock()
+		return ErrNotRegistered
+	}
+	l.mu.Unlock()
+	return l.resultLog.ReportCommandResult(ctx, res)
+}
+
+func TestCommandPoolRetriesFinalResult(t *testing.T) {
+	reg := newCommandRegistry()
+	reg.register(CommandSpec{Name: "quick", Immediate: true}, func(ctx context.Context, args Args, p *Progress) CommandOutcome {
+		return CommandOutcome{Status: pb.CommandResult_OK, Output: "done"}
+	})
+	pool := newCommandPool(reg)
+	results := &flakyLog{resultLog: newResultLog(), fail: 2}
+	pool.setOutput(results)
+	defer pool.close()
+
+	// the RUNNING update is lost, the final result is retried once
+	pool.submit(&pb.Command{CommandId: "q", Name: "quick"})
+	if res := results.next(t); res.Status != pb.CommandResult_OK || res.Chunk != 0 {
+		t.Fatalf("final result: %+v", res)
+	}
+}
+
+func TestCommandPoolDropsExpired(t *testing.T) {
+	reg := newCommandRegistry()
+	started := make(chan struct{}, 1)
+	reg.register(CommandSpec{Name: "wait"}, func(ctx context.Context, args Args, p *Progress) CommandOutcome {
+		started <- struct{}{}
+		<-ctx.Done()
+		return CommandOutcome{Status: pb.CommandResult_OK}
+	})
+	pool := newCommandPool(reg)
+	reg.register(cancelSpec, pool.cancelCommand)
+	results := newResultLog()
+	pool.setOutput(results)
+	pool.configure(config.CommandsConfig{
+		Workers:    1,
+		Queue:      1,
+		Timeout:    config.Duration{Duration: time.Minute},
+		MaxTimeout: config.Duration{Duration: time.Minute},
+	})
+	defer pool.close()
+
+	pool.submit(&pb.Command{CommandId: "late", Name: "wait", Expires: timestamppb.New(time.Now().Add(-time.Second))})
+	if res := results.next(t); res.CommandId != "late" || res.Status != pb.CommandResult_EXPIRED {
+		t.Fatalf("expired on arrival: %+v", res)
+	}
+
+	pool.submit(&pb.Command{CommandId: "a", Name: "wait"})
+	<-started
+	pool.submit(&pb.Command{CommandId: "b", Name: "wait", Expires: timestamppb.New(time.Now().Add(50 * time.Millisecond))})
+	time.Sleep(100 * time.Millisecond)
+	pool.submit(&pb.Command{CommandId: "x", Name: "cancel", ArgsJson: `{"command_id":"a"}`})
+	got := map[string]pb.CommandResult_Status{}
+	for range 3 {
+		res := results.next(t)
+		got[res.CommandId] = res.Status
+	}
+	if got["b"] != pb.CommandResult_EXPIRED || got["a"] != pb.CommandResult_CANCELLED {
+		t.Fatalf("results = %v", got)
+	}
+}
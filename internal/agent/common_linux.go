@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -77,6 +78,42 @@ func (c *CommonEnv) calcDiskUsagePercent(s diskStat) (float64, bool) {
 	return usage, true
 }
 
+func (c *CommonEnv) CountProcesses(names []string) (map[string]int, error) {
+	out := make(map[string]int, len(names))
+	for _, n := range names {
+		out[n] = 0
+	}
+	dir := filepath.Join(c.procRoot, "proc")
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range des {
+		if !isPID(de.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, de.Name(), "comm"))
+		if err != nil {
+			// the process exited meanwhile
+			continue
+		}
+		comm := strings.TrimSpace(string(b))
+		if n, ok := out[comm]; ok {
+			out[comm] = n + 1
+		}
+	}
+	return out, nil
+}
+
+func isPID(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '0' || name[i] > '9' {
+			return false
+		}
+	}
+	return name != ""
+}
+
 func (c *CommonEnv) readProcCount() (int, bool) {
 	d, err := os.Open(filepath.Join(c.procRoot, "proc"))
 	if err != nil {
@@ -62,7 +62,14 @@ func (e *ContainerEnv) Mem(ctx context.Context) (MemStats, error) {
 	if err != nil {
 		return MemStats{}, err
 	}
-	return e.calcCgroupMem(sample)
+	ms, err := e.calcCgroupMem(sample)
+	if err != nil {
+		return ms, err
+	}
+	if n, err := e.r.OOMKills(); err == nil {
+		ms.OOMKills, ms.OOMKillsValid = n, true
+	}
+	return ms, nil
 }
 
 func (e *ContainerEnv) calcCgroupMem(s cgroupMemSample) (MemStats, error) {
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+// debugServer serves net/http/pprof on a loopback address, for profiling
+// the agent from the node itself.
+type debugServer struct {
+	cfg config.DebugConfig
+	srv *http.Server
+}
+
+func startDebug(cfg config.DebugConfig) (*debugServer, error) {
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	// "localhost" is whatever the resolver says, so check what was bound
+	if ip := lis.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		_ = lis.Close()
+		return nil, fmt.Errorf("%s is not a loopback address", lis.Addr())
+	}
+	d := &debugServer{cfg: cfg}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	d.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := d.srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			debugLog.Error("serve failed", "err", err)
+		}
+	}()
+	debugLog.Info("serving pprof", "addr", lis.Addr().String())
+	return d, nil
+}
+
+func (d *debugServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return d.srv.Shutdown(ctx)
+}
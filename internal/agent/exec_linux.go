@@ -0,0 +1,277 @@
+//go:build linux
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+)
+
+// execPath is the PATH programs run with; the agent's own is not passed on.
+const execPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+var execSpec = CommandSpec{
+	Name: "exec",
+	Doc:  "run a program allowed by the agent's commands.exec config; the output has stdout, stderr and the exit code",
+	Args: []ArgSpec{
+		{Name: "program", Type: ArgString, Required: true, Doc: "absolute path, or the file name of an allowed program"},
+		{Name: "args", Type: ArgStrings},
+	},
+}
+
+// execPolicy is the compiled commands.exec config.
+type execPolicy struct {
+	rules []execRule
+	// cred is who programs run as; nil keeps the agent's identity.
+	cred *syscall.Credential
+	// user, uid and gid are the identity programs actually run with.
+	user     string
+	uid, gid uint32
+	env      []string
+	max      int64
+}
+
+type execRule struct {
+	path string
+	args []*regexp.Regexp
+}
+
+func newExecPolicy(c config.ExecConfig) (*execPolicy, error) {
+	p := &execPolicy{max: c.MaxOutputBytes, uid: uint32(os.Geteuid()), gid: uint32(os.Getegid())}
+	for _, r := range c.Allow {
+		er := execRule{path: r.Path}
+		for _, a := range r.Args {
+			re, err := regexp.Compile(`^(?:` + a + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("commands.exec.allow: %w", err)
+			}
+			er.args = append(er.args, re)
+		}
+		p.rules = append(p.rules, er)
+	}
+
+	env := map[string]string{"PATH": execPath, "LANG": "C", "HOME": "/"}
+	maps.Copy(env, c.Env)
+	for _, k := range slices.Sorted(maps.Keys(env)) {
+		p.env = append(p.env, k+"="+env[k])
+	}
+
+	// the identity is only resolved when exec is enabled, so that a
+	// missing user does not stop agents that never run programs
+	if len(p.rules) > 0 && p.uid == 0 {
+		if c.User == "" {
+			return nil, errors.New("commands.exec: user must be set for an agent running as root")
+		}
+		cred, err := lookupCredential(c.User, c.Group)
+		if err != nil {
+			return nil, fmt.Errorf("commands.exec: %w", err)
+		}
+		p.cred, p.uid, p.gid = cred, cred.Uid, cred.Gid
+	}
+	p.user = strconv.FormatUint(uint64(p.uid), 10)
+	if u, err := user.LookupId(p.user); err == nil {
+		p.user = u.Username
+	}
+	return p, nil
+}
+
+// lookupCredential resolves a user and group given by name or id. The
+// credential has no supplementary groups.
+func lookupCredential(userName, groupName string) (*syscall.Credential, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("unknown user %q", userName)
+		}
+	}
+	gid := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gid = g.Gid
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %q: non-numeric uid %q", userName, u.Uid)
+	}
+	g, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("group %q: non-numeric gid %q", groupName, gid)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(g), Groups: []uint32{}}, nil
+}
+
+// match returns the path of the program a rule allows with args. A program
+// given by file name matches rules by the base name of their path.
+func (p *execPolicy) match(program string, args []string) (string, bool) {
+	for _, r := range p.rules {
+		if program != r.path && (strings.Contains(program, "/") || program != filepath.Base(r.path)) {
+			continue
+		}
+		if len(args) != len(r.args) {
+			continue
+		}
+		ok := true
+		for i, re := range r.args {
+			if !re.MatchString(args[i]) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return r.path, true
+		}
+	}
+	return "", false
+}
+
+type execResult struct {
+	Path            string   `json:"path"`
+	Args            []string `json:"args"`
+	User            string   `json:"user"`
+	UID             uint32   `json:"uid"`
+	GID             uint32   `json:"gid"`
+	ExitCode        int      `json:"exit_code"`
+	Stdout          string   `json:"stdout"`
+	Stderr          string   `json:"stderr"`
+	StdoutTruncated bool     `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool     `json:"stderr_truncated,omitempty"`
+	DurationMS      int64    `json:"duration_ms"`
+}
+
+// run starts the program in its own process group, which is killed when
+// ctx ends or the agent dies, with nothing on stdin.
+func (p *execPolicy) run(ctx context.Context, path string, args []string) (execResult, error) {
+	res := execResult{Path: path, Args: args, User: p.user, UID: p.uid, GID: p.gid, ExitCode: -1}
+	stdout, stderr := &cappedBuffer{max: p.max}, &cappedBuffer{max: p.max}
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = p.env
+	cmd.Dir = "/"
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Pdeathsig:  syscall.SIGKILL,
+		Credential: p.cred,
+	}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+
+	// Pdeathsig fires when the thread that forked the program exits, not
+	// the agent, so that thread is kept until the program is gone
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	start := time.Now()
+	err := cmd.Run()
+	res.DurationMS = time.Since(start).Milliseconds()
+	res.Stdout, res.StdoutTruncated = stdout.String(), stdout.dropped > 0
+	res.Stderr, res.StderrTruncated = stderr.String(), stderr.dropped > 0
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// a non-zero exit is reported through the exit code
+		err = nil
+	}
+	return res, err
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the
+// rest.
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	max     int64
+	dropped int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	keep := min(int64(len(p)), max(b.max-int64(b.buf.Len()), 0))
+	b.buf.Write(p[:keep])
+	b.dropped += int64(len(p)) - keep
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string { return b.buf.String() }
+
+func (r *Runner) execCommand(ctx context.Context, args Args, _ *Progress) CommandOutcome {
+	pol := r.policy.Load().exec
+	program, argv := args.String("program"), args.Strings("args")
+	if argv == nil {
+		argv = []string{}
+	}
+
+	audit := &pb.Event{
+		Type:     "audit.exec",
+		Severity: pb.Event_INFO,
+		Attributes: map[string]string{
+			"command_id": commandID(ctx),
+			"program":    program,
+			"args":       mustJSON(argv),
+			"user":       pol.user,
+			"uid":        strconv.FormatUint(uint64(pol.uid), 10),
+			"gid":        strconv.FormatUint(uint64(pol.gid), 10),
+		},
+	}
+	path, ok := pol.match(program, argv)
+	if !ok {
+		audit.Severity = pb.Event_WARNING
+		audit.Message = fmt.Sprintf("exec refused: %s", program)
+		audit.Attributes["outcome"] = "refused"
+		r.pool.reportEvent(ctx, audit)
+		commandLog.Warn("exec refused", "program", program, "args", argv)
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: "not allowed by commands.exec.allow"}
+	}
+	audit.Attributes["path"] = path
+
+	commandLog.Info("exec", "path", path, "args", argv, "user", pol.user, "uid", pol.uid)
+	res, err := pol.run(ctx, path, argv)
+	audit.Attributes["duration_ms"] = strconv.FormatInt(res.DurationMS, 10)
+	if err != nil {
+		audit.Severity = pb.Event_WARNING
+		audit.Message = fmt.Sprintf("exec %s failed: %v", path, err)
+		audit.Attributes["outcome"] = "failed"
+		r.pool.reportEvent(ctx, audit)
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	audit.Message = fmt.Sprintf("exec %s: exit %d", path, res.ExitCode)
+	audit.Attributes["outcome"] = "exited"
+	audit.Attributes["exit_code"] = strconv.Itoa(res.ExitCode)
+	r.pool.reportEvent(ctx, audit)
+
+	out := CommandOutcome{Status: pb.CommandResult_OK, Output: mustJSON(res)}
+	if res.ExitCode != 0 {
+		out.Status, out.Error = pb.CommandResult_ERROR, fmt.Sprintf("exit status %d", res.ExitCode)
+	}
+	return out
+}
+
+func mustJSON(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+func TestExecPolicyMatch(t *testing.T) {
+	pol, err := newExecPolicy(config.ExecConfig{
+		Allow: []config.ExecRule{
+			{Path: "/usr/bin/df"},
+			{Path: "/usr/bin/df", Args: []string{"-h"}},
+			{Path: "/usr/bin/journalctl", Args: []string{"-u", "[a-z0-9.-]+", "-n", "[0-9]{1,4}"}},
+		},
+		User:           "nobody",
+		MaxOutputBytes: 1 << 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 && (pol.uid == 0 || pol.user != "nobody") {
+		t.Fatalf("programs of a root agent run as %s (%d)", pol.user, pol.uid)
+	}
+	for _, tc := range []struct {
+		program string
+		args    []string
+		want    string
+	}{
+		{"df", nil, "/usr/bin/df"},
+		{"/usr/bin/df", []string{"-h"}, "/usr/bin/df"},
+		{"journalctl", []string{"-u", "kubelet", "-n", "200"}, "/usr/bin/journalctl"},
+		{"df", []string{"-h", "/"}, ""},
+		{"/tmp/df", nil, ""},
+		{"./df", nil, ""},
+		{"journalctl", []string{"-u", "kubelet; rm -rf /", "-n", "200"}, ""},
+		{"journalctl", []string{"-u", "kubelet", "-n", "20000"}, ""},
+	} {
+		got, ok := pol.match(tc.program, tc.args)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("match(%q, %q) = %q, %v; want %q", tc.program, tc.args, got, ok, tc.want)
+		}
+	}
+}
+
+func TestExecPolicyRun(t *testing.T) {
+	pol, err := newExecPolicy(config.ExecConfig{MaxOutputBytes: 8, Env: map[string]string{"GREETING": "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := pol.run(context.Background(), "/bin/sh", []string{"-c", `echo "$GREETING $HOSTNAME"; echo oops >&2; exit 3`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ExitCode != 3 || res.Stdout != "hi \n" || res.Stderr != "oops\n" || res.StdoutTruncated {
+		t.Fatalf("result = %+v", res)
+	}
+
+	res, _ = pol.run(context.Background(), "/bin/sh", []string{"-c", "echo 0123456789"})
+	if res.Stdout != "01234567" || !res.StdoutTruncated {
+		t.Fatalf("output not capped: %+v", res)
+	}
+
+	// the whole process group goes, including children holding stdout
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	res, _ = pol.run(ctx, "/bin/sh", []string{"-c", "sleep 30 & sleep 30"})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("kill took %s", d)
+	}
+	if res.ExitCode != -1 || strings.TrimSpace(res.Stdout) != "" {
+		t.Fatalf("killed run = %+v", res)
+	}
+}
@@ -0,0 +1,366 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+)
+
+var fileReadSpec = CommandSpec{
+	Name: "file.read",
+	Doc:  "return a file's content, all of it, a range, or its last lines; output is streamed",
+	Args: []ArgSpec{
+		{Name: "path", Type: ArgString, Required: true, Doc: "absolute path under one of the agent's commands.files.roots"},
+		{Name: "offset", Type: ArgInt, Doc: "first byte to read"},
+		{Name: "length", Type: ArgInt, Doc: "bytes to read; default up to the end"},
+		{Name: "tail", Type: ArgInt, Doc: "read only the last this many lines; excludes offset and length"},
+		{Name: "encoding", Type: ArgString, Enum: []string{"text", "base64"}, Doc: "base64 for binary files; default text"},
+	},
+}
+
+var fileListSpec = CommandSpec{
+	Name: "file.list",
+	Doc:  "list a directory as JSON lines with type, size, mode and modification time",
+	Args: []ArgSpec{
+		{Name: "path", Type: ArgString, Required: true, Doc: "absolute path under one of the agent's commands.files.roots"},
+		{Name: "pattern", Type: ArgString, Doc: `only entries whose name matches this glob, e.g. "*.log"`},
+		{Name: "recursive", Type: ArgBool, Doc: "descend into subdirectories"},
+		{Name: "max_entries", Type: ArgInt, Doc: "stop after this many entries; at most the agent's limit"},
+	},
+}
+
+// filePolicy is the compiled commands.files config.
+type filePolicy struct {
+	roots      []string
+	maxRead    int64
+	maxEntries int
+}
+
+func newFilePolicy(c config.FilesConfig) *filePolicy {
+	roots := slices.Clone(c.Roots)
+	// the longest root wins when roots are nested
+	slices.SortFunc(roots, func(a, b string) int { return len(b) - len(a) })
+	return &filePolicy{roots: roots, maxRead: c.MaxReadBytes, maxEntries: c.MaxListEntries}
+}
+
+var errNotAllowed = errors.New("not under any of commands.files.roots")
+
+// openRoot opens the allowed root containing name and returns name relative
+// to it. Everything opened through the root stays inside it, even when a
+// symlink points elsewhere.
+func (fp *filePolicy) openRoot(name string) (*os.Root, string, error) {
+	if !filepath.IsAbs(name) || filepath.Clean(name) != name {
+		return nil, "", errors.New("path must be clean and absolute")
+	}
+	for _, r := range fp.roots {
+		rel, err := filepath.Rel(r, name)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		root, err := os.OpenRoot(r)
+		if err != nil {
+			return nil, "", err
+		}
+		return root, rel, nil
+	}
+	return nil, "", errNotAllowed
+}
+
+func (r *Runner) fileReadCommand(ctx context.Context, args Args, p *Progress) CommandOutcome {
+	fp := r.policy.Load().files
+	offset, length, tail := args.Int("offset"), args.Int("length"), args.Int("tail")
+	switch {
+	case offset < 0 || length < 0 || tail < 0:
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: "offset, length and tail must not be negative"}
+	case tail > 0 && (args.Has("offset") || args.Has("length")):
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: "tail excludes offset and length"}
+	case length > fp.maxRead:
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: fmt.Sprintf("length: at most %d bytes (commands.files.max_read_bytes)", fp.maxRead)}
+	}
+
+	root, rel, err := fp.openRoot(args.String("path"))
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	defer root.Close()
+	f, err := root.Open(rel)
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	// devices and pipes may never end
+	if !info.Mode().IsRegular() {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf("not a regular file (%s)", info.Mode().Type())}
+	}
+
+	// files such as those in /proc report size 0 and are read until EOF
+	size := info.Size()
+	unknown := size == 0
+	var src io.Reader
+	n := fp.maxRead
+	switch {
+	case tail > 0 && unknown:
+		src = &tailReader{r: f, lines: int(tail), max: fp.maxRead}
+	case tail > 0:
+		start, err := tailOffset(f, size, int(tail), fp.maxRead)
+		if err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+		src = io.NewSectionReader(f, start, size-start)
+	case unknown:
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+		src = f
+		if length > 0 {
+			n = length
+		}
+	default:
+		want := max(size-offset, 0)
+		if length > 0 {
+			want = min(want, length)
+		}
+		if want > fp.maxRead {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf(
+				"would read %d bytes, more than commands.files.max_read_bytes (%d); narrow with offset and length, or use tail", want, fp.maxRead)}
+		}
+		src = io.NewSectionReader(f, offset, want)
+		n = want
+	}
+
+	var w io.Writer = p
+	var enc io.WriteCloser
+	if args.String("encoding") == "base64" {
+		enc = base64.NewEncoder(base64.StdEncoding, p)
+		w = enc
+	}
+	copied, err := io.Copy(w, io.LimitReader(ctxReader{ctx, src}, n))
+	if enc != nil {
+		enc.Close()
+	}
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	if unknown && tail == 0 && length == 0 && copied == n {
+		// the file may have gone on; check with one byte more
+		if m, _ := io.CopyN(io.Discard, src, 1); m > 0 {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf("output truncated at %d bytes (commands.files.max_read_bytes)", n)}
+		}
+	}
+	commandLog.Info("file read", "path", args.String("path"), "bytes", copied)
+	return CommandOutcome{Status: pb.CommandResult_OK}
+}
+
+// tailOffset returns where the last lines lines of r begin, reading back
+// at most max bytes. A final newline does not start another line.
+func tailOffset(r io.ReaderAt, size int64, lines int, max int64) (int64, error) {
+	const block = 64 << 10
+	buf := make([]byte, block)
+	end := size
+	if size > 0 {
+		if _, err := r.ReadAt(buf[:1], size-1); err != nil {
+			return 0, err
+		}
+		if buf[0] == '\n' {
+			end--
+		}
+	}
+	for pos := end; pos > 0 && size-pos < max; {
+		n := min(int64(block), pos)
+		pos -= n
+		b := buf[:n]
+		if _, err := r.ReadAt(b, pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(b) - 1; i >= 0; i-- {
+			if b[i] != '\n' {
+				continue
+			}
+			if lines--; lines == 0 {
+				return pos + int64(i) + 1, nil
+			}
+		}
+	}
+	return size - min(size, max), nil
+}
+
+// tailReader yields the last lines of a stream of unknown length, keeping at
+// most max bytes.
+type tailReader struct {
+	r     io.Reader
+	lines int
+	max   int64
+	buf   *bytes.Reader
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	if t.buf == nil {
+		var all []byte
+		chunk := make([]byte, 32<<10)
+		for {
+			n, err := t.r.Read(chunk)
+			all = append(all, chunk[:n]...)
+			if over := int64(len(all)) - t.max; over > 0 {
+				all = all[over:]
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		start, _ := tailOffset(bytes.NewReader(all), int64(len(all)), t.lines, t.max)
+		t.buf = bytes.NewReader(all[start:])
+	}
+	return t.buf.Read(p)
+}
+
+// ctxReader stops reading once ctx ends.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type fileEntry struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	// Target is where a symlink points; it is not followed.
+	Target string `json:"target,omitempty"`
+}
+
+func (r *Runner) fileListCommand(ctx context.Context, args Args, p *Progress) CommandOutcome {
+	fp := r.policy.Load().files
+	limit := fp.maxEntries
+	if args.Has("max_entries") {
+		if n := args.Int("max_entries"); n < 1 || n > int64(fp.maxEntries) {
+			return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: fmt.Sprintf("max_entries: must be between 1 and %d", fp.maxEntries)}
+		}
+		limit = int(args.Int("max_entries"))
+	}
+	pattern := args.String("pattern")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: fmt.Sprintf("pattern: %v", err)}
+	}
+
+	dir := args.String("path")
+	root, rel, err := fp.openRoot(dir)
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	defer root.Close()
+	fsys := root.FS()
+	if info, err := fs.Stat(fsys, filepath.ToSlash(rel)); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	} else if !info.IsDir() {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: "not a directory"}
+	}
+
+	base := filepath.ToSlash(rel)
+	count := 0
+	errFull := errors.New("full")
+	enc := json.NewEncoder(p)
+	walkErr := fs.WalkDir(fsys, base, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// unreadable subdirectories are skipped, not fatal
+			if name != base {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if name == base {
+			return nil
+		}
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, d.Name()); !ok {
+				return skipUnlessRecursive(d, args.Bool("recursive"))
+			}
+		}
+		if count == limit {
+			return errFull
+		}
+		info, err := d.Info()
+		if err != nil {
+			// removed meanwhile
+			return nil
+		}
+		sub := name
+		if base != "." {
+			sub = strings.TrimPrefix(name[len(base):], "/")
+		}
+		full := filepath.Join(dir, sub)
+		e := fileEntry{
+			Path:    full,
+			Type:    fileType(info.Mode()),
+			Size:    info.Size(),
+			Mode:    info.Mode().String(),
+			ModTime: info.ModTime().UTC(),
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			e.Target, _ = os.Readlink(full)
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		count++
+		return skipUnlessRecursive(d, args.Bool("recursive"))
+	})
+	switch {
+	case errors.Is(walkErr, errFull):
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf("more than %d entries; narrow with pattern or raise max_entries", limit)}
+	case walkErr != nil:
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: walkErr.Error()}
+	}
+	commandLog.Info("directory listed", "path", dir, "entries", count)
+	return CommandOutcome{Status: pb.CommandResult_OK}
+}
+
+func skipUnlessRecursive(d fs.DirEntry, recursive bool) error {
+	if d.IsDir() && !recursive {
+		return fs.SkipDir
+	}
+	return nil
+}
+
+func fileType(m fs.FileMode) string {
+	switch {
+	case m.IsRegular():
+		return "file"
+	case m.IsDir():
+		return "dir"
+	case m&fs.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "other"
+}
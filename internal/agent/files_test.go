@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+)
+
+func TestTailOffset(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		lines int
+		max   int64
+		want  string
+	}{
+		{"a\nb\nc\n", 2, 100, "b\nc\n"},
+		{"a\nb\nc", 2, 100, "b\nc"},
+		{"a\nb\nc\n", 5, 100, "a\nb\nc\n"},
+		{"a\nb\nc\n", 1, 100, "c\n"},
+		{"aaaa\nbbbb\n", 2, 6, "\nbbbb\n"},
+		{"", 3, 100, ""},
+	} {
+		r := strings.NewReader(tc.in)
+		start, err := tailOffset(r, int64(len(tc.in)), tc.lines, tc.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tc.in[start:]; got != tc.want {
+			t.Errorf("tail %d of %q (max %d) = %q; want %q", tc.lines, tc.in, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestFileCommands(t *testing.T) {
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "allowed")
+	must(t, os.MkdirAll(filepath.Join(allowed, "sub"), 0o755))
+	must(t, os.WriteFile(filepath.Join(allowed, "app.log"), []byte("one\ntwo\nthree\n"), 0o644))
+	must(t, os.WriteFile(filepath.Join(allowed, "sub", "old.log"), []byte("x"), 0o644))
+	must(t, os.WriteFile(filepath.Join(dir, "secret"), []byte("s3cret"), 0o600))
+	must(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(allowed, "escape")))
+
+	r := &Runner{}
+	pol, err := newCommandPolicy(config.CommandsConfig{Files: config.FilesConfig{
+		Roots: []string{allowed}, MaxReadBytes: 1 << 10, MaxListEntries: 10,
+	}})
+	must(t, err)
+	r.policy.Store(pol)
+
+	run := func(fn CommandFunc, args Args) (CommandOutcome, string) {
+		p := newProgress(0)
+		out := fn(context.Background(), args, p)
+		_, streamed, _ := p.take()
+		return out, streamed
+	}
+
+	for _, tc := range []struct {
+		args Args
+		want string
+	}{
+		{Args{"path": filepath.Join(allowed, "app.log")}, "one\ntwo\nthree\n"},
+		{Args{"path": filepath.Join(allowed, "app.log"), "offset": int64(4), "length": int64(3)}, "two"},
+		{Args{"path": filepath.Join(allowed, "app.log"), "tail": int64(1)}, "three\n"},
+		{Args{"path": filepath.Join(allowed, "app.log"), "length": int64(3), "encoding": "base64"}, "b25l"},
+	} {
+		out, got := run(r.fileReadCommand, tc.args)
+		if out.Status != pb.CommandResult_OK || got != tc.want {
+			t.Errorf("file.read %v = %v %q; want %q", tc.args, out, got, tc.want)
+		}
+	}
+
+	for _, path := range []string{
+		filepath.Join(dir, "secret"),
+		filepath.Join(allowed, "escape"),
+		filepath.Join(allowed, "..", "secret"),
+		"app.log",
+	} {
+		if out, got := run(r.fileReadCommand, Args{"path": path}); out.Status == pb.CommandResult_OK || got != "" {
+			t.Errorf("file.read %s = %v %q; want refused", path, out, got)
+		}
+	}
+
+	out, got := run(r.fileListCommand, Args{"path": allowed, "recursive": true, "pattern": "*.log"})
+	if out.Status != pb.CommandResult_OK {
+		t.Fatalf("file.list: %v", out)
+	}
+	if !strings.Contains(got, `"path":"`+filepath.Join(allowed, "app.log")+`"`) ||
+		!strings.Contains(got, `"path":"`+filepath.Join(allowed, "sub", "old.log")+`"`) ||
+		strings.Count(got, "\n") != 2 {
+		t.Fatalf("file.list output:\n%s", got)
+	}
+	if out, _ := run(r.fileListCommand, Args{"path": allowed, "max_entries": int64(1)}); out.Status != pb.CommandResult_ERROR {
+		t.Fatalf("file.list over max_entries: %v", out)
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
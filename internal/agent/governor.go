@@ -0,0 +1,153 @@
+package agent
+
+import (
+	"math"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+// throttleSteps are the degradation levels the governor moves through,
+// one step per evaluation window while the agent is over budget.
+var throttleSteps = []struct {
+	factor time.Duration // interval multiplier
+	off    []string      // collectors switched off
+}{
+	{1, nil},
+	{2, nil},
+	{4, []string{"procs"}},
+	{8, []string{"procs", "disk"}},
+}
+
+const (
+	// budgetWindow is the shortest span CPU use is averaged over.
+	budgetWindow = 10 * time.Second
+	// relaxRatio is how far below budget usage must fall before the
+	// governor steps back down, so it does not flap around the limit.
+	relaxRatio = 0.7
+)
+
+// usageFunc reports the agent's cumulative CPU time and current memory.
+type usageFunc func() (cpu time.Duration, mem uint64, err error)
+
+// governor keeps the agent within its resource budget. It is driven from
+// the collection loop and is not safe for concurrent use.
+type governor struct {
+	cfg   config.BudgetConfig
+	base  time.Duration
+	usage usageFunc
+
+	level  int
+	reason string
+
+	lastAt  time.Time
+	lastCPU time.Duration
+	cpuPct  float64
+	mem     uint64
+
+	memLimit bool // we set the runtime memory limit
+}
+
+func newGovernor(usage usageFunc) *governor {
+	return &governor{usage: usage}
+}
+
+// configure applies a budget and the configured interval. Removing the
+// budget clears any throttling right away.
+func (g *governor) configure(cfg config.BudgetConfig, interval time.Duration) {
+	g.cfg, g.base = cfg, interval
+	if !g.enabled() {
+		g.level, g.reason = 0, ""
+		g.lastAt = time.Time{}
+	}
+
+	// an operator-set GOMEMLIMIT wins over the budget
+	if os.Getenv("GOMEMLIMIT") != "" {
+		return
+	}
+	switch {
+	case cfg.MemoryBytes > 0:
+		// leave headroom for memory the Go runtime does not account for
+		debug.SetMemoryLimit(cfg.MemoryBytes / 10 * 9)
+		g.memLimit = true
+	case g.memLimit:
+		debug.SetMemoryLimit(math.MaxInt64)
+		g.memLimit = false
+	}
+}
+
+func (g *governor) enabled() bool {
+	return g.cfg.CPUPercent > 0 || g.cfg.MemoryBytes > 0
+}
+
+// interval is the collection interval at the current level.
+func (g *governor) interval() time.Duration {
+	d := g.base * throttleSteps[g.level].factor
+	limit := g.cfg.MaxInterval.Duration
+	if limit <= 0 {
+		limit = g.base * throttleSteps[len(throttleSteps)-1].factor
+	}
+	return max(min(d, limit), g.base)
+}
+
+// disabled reports whether the named collector is off at the current level.
+func (g *governor) disabled(name string) bool {
+	return slices.Contains(throttleSteps[g.level].off, name)
+}
+
+// observe measures usage and moves at most one level per window. It
+// reports whether the level changed.
+func (g *governor) observe(now time.Time) bool {
+	if !g.enabled() {
+		return false
+	}
+	cpu, mem, err := g.usage()
+	if err != nil {
+		return false
+	}
+	if g.lastAt.IsZero() {
+		g.lastAt, g.lastCPU = now, cpu
+		return false
+	}
+	elapsed := now.Sub(g.lastAt)
+	if elapsed < max(budgetWindow, g.interval()) {
+		return false
+	}
+	g.cpuPct = 100 * float64(cpu-g.lastCPU) / float64(elapsed)
+	g.mem = mem
+	g.lastAt, g.lastCPU = now, cpu
+
+	var over []string
+	relaxed := true
+	if b := g.cfg.CPUPercent; b > 0 {
+		if g.cpuPct > b {
+			over = append(over, "cpu")
+		}
+		relaxed = relaxed && g.cpuPct < b*relaxRatio
+	}
+	if b := float64(g.cfg.MemoryBytes); b > 0 {
+		if float64(mem) > b {
+			over = append(over, "memory")
+		}
+		relaxed = relaxed && float64(mem) < b*relaxRatio
+	}
+
+	prev := g.level
+	switch {
+	case len(over) > 0:
+		g.reason = strings.Join(over, ",")
+		if g.level < len(throttleSteps)-1 {
+			g.level++
+		}
+	case relaxed && g.level > 0:
+		g.level--
+		if g.level == 0 {
+			g.reason = ""
+		}
+	}
+	return g.level != prev
+}
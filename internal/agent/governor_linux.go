@@ -0,0 +1,40 @@
+//go:build linux
+
+package agent
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// selfUsage measures the agent through its own cgroup when it runs in a
+// container, where that cgroup holds nothing but the agent, and through
+// its process counters otherwise.
+func selfUsage(env RuntimeEnv) usageFunc {
+	if c, ok := env.(*ContainerEnv); ok && c.r != nil {
+		return func() (time.Duration, uint64, error) {
+			usec, err := c.r.CPUUsageUsec()
+			if err != nil {
+				return 0, 0, err
+			}
+			mem, err := c.r.MemCurrent()
+			if err != nil {
+				return 0, 0, err
+			}
+			return time.Duration(usec) * time.Microsecond, mem, nil
+		}
+	}
+	return processUsage
+}
+
+func processUsage() (time.Duration, uint64, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0, err
+	}
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return cpu, rssBytes(&ms), nil
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+func TestGovernorStepsUpAndDown(t *testing.T) {
+	var cpu time.Duration
+	g := newGovernor(func() (time.Duration, uint64, error) { return cpu, 1 << 20, nil })
+	g.configure(config.BudgetConfig{CPUPercent: 10}, time.Second)
+
+	now := time.Now()
+	g.observe(now)
+
+	// 50% of a core over each window: one level per window up to the top
+	for want := 1; want <= 4; want++ {
+		win := max(budgetWindow, g.interval())
+		cpu += win / 2
+		now = now.Add(win)
+		changed := g.observe(now)
+		if want < len(throttleSteps) {
+			if !changed || g.level != want {
+				t.Fatalf("window %d: level=%d changed=%t", want, g.level, changed)
+			}
+		} else if changed {
+			t.Fatalf("level went past the last step")
+		}
+	}
+	if g.interval() != 8*time.Second || !g.disabled("procs") || !g.disabled("disk") || g.disabled("cpu") {
+		t.Fatalf("top level: interval=%s procs=%t disk=%t", g.interval(), g.disabled("procs"), g.disabled("disk"))
+	}
+	if g.reason != "cpu" {
+		t.Fatalf("reason = %q", g.reason)
+	}
+
+	// 8% is under budget but not relaxed enough to step down
+	win := g.interval() + budgetWindow
+	cpu += win * 8 / 100
+	now = now.Add(win)
+	if g.observe(now) {
+		t.Fatalf("stepped down at 8%% of a 10%% budget")
+	}
+
+	for g.level > 0 {
+		win := max(budgetWindow, g.interval())
+		cpu += win / 100
+		now = now.Add(win)
+		if !g.observe(now) {
+			t.Fatalf("did not step down from level %d", g.level)
+		}
+	}
+	if g.reason != "" || g.interval() != time.Second {
+		t.Fatalf("after recovery: reason=%q interval=%s", g.reason, g.interval())
+	}
+}
+
+func TestGovernorMaxIntervalAndDisable(t *testing.T) {
+	g := newGovernor(func() (time.Duration, uint64, error) { return 0, 1 << 40, nil })
+	g.configure(config.BudgetConfig{MemoryBytes: 1 << 30, MaxInterval: config.Duration{Duration: 3 * time.Second}}, time.Second)
+	defer g.configure(config.BudgetConfig{}, time.Second)
+
+	now := time.Now()
+	g.observe(now)
+	for range 3 {
+		now = now.Add(time.Minute)
+		g.observe(now)
+	}
+	if g.level != 3 || g.reason != "memory" || g.interval() != 3*time.Second {
+		t.Fatalf("level=%d reason=%q interval=%s", g.level, g.reason, g.interval())
+	}
+
+	g.configure(config.BudgetConfig{}, time.Second)
+	if g.level != 0 || g.interval() != time.Second || g.observe(now.Add(time.Hour)) {
+		t.Fatalf("disabling the budget did not reset the governor")
+	}
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+// healthServer serves /healthz (liveness: the collection loop runs) and
+// /readyz (readiness: metrics reach the collector) for Kubernetes probes.
+// Both return the agent's own metrics in the body.
+type healthServer struct {
+	listen string
+	// maxSendAge changes with the config without a new listener.
+	maxSendAge atomic.Int64
+	srv        *http.Server
+}
+
+type healthReport struct {
+	Status  string             `json:"status"`
+	Reason  string             `json:"reason,omitempty"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+func startHealth(cfg config.HealthConfig) (*healthServer, error) {
+	lis, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	h := &healthServer{listen: cfg.Listen}
+	h.maxSendAge.Store(int64(cfg.MaxSendAge.Duration))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.write(w, self.alive)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.write(w, func(now time.Time) (bool, string) {
+			return self.ready(now, time.Duration(h.maxSendAge.Load()))
+		})
+	})
+	h.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := h.srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			healthLog.Error("serve failed", "err", err)
+		}
+	}()
+	healthLog.Info("listening", "addr", lis.Addr().String())
+	return h, nil
+}
+
+func (h *healthServer) write(w http.ResponseWriter, check func(time.Time) (bool, string)) {
+	now := time.Now()
+	ok, reason := check(now)
+	rep := healthReport{Status: "ok", Reason: reason, Metrics: make(map[string]float64)}
+	for _, p := range self.points(now) {
+		rep.Metrics[p.Name] = p.Value
+	}
+
+	code := http.StatusOK
+	if !ok {
+		rep.Status, code = "fail", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(rep)
+}
+
+func (h *healthServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return h.srv.Shutdown(ctx)
+}
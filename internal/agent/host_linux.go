@@ -79,6 +79,7 @@ func (e *HostEnv) Mem(ctx context.Context) (MemStats, error) {
 
 	ret.UsedBytes = (curr.totalKB - curr.availableKB) * 1024
 	ret.LimitBytes = curr.totalKB * 1024
+	ret.OOMKills, ret.OOMKillsValid = e.readOOMKills()
 
 	percent, ok := e.calcMemUsagePercent(curr)
 	if !ok {
@@ -136,6 +137,25 @@ func (e *HostEnv) readMem() hostMemSample {
 	}
 }
 
+// readOOMKills reads the oom_kill counter from /proc/vmstat, present since
+// Linux 4.13.
+func (e *HostEnv) readOOMKills() (uint64, bool) {
+	f, err := os.Open(filepath.Join(e.procRoot, "proc", "vmstat"))
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "oom_kill "); ok {
+			n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
 func (e *HostEnv) calcMemUsagePercent(s hostMemSample) (float64, bool) {
 	if !s.valid || s.totalKB == 0 || s.availableKB > s.totalKB {
 		return 0, false
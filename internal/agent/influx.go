@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+// InfluxOut writes samples as InfluxDB line protocol to a file, a UDP
+// listener or an HTTP write endpoint.
+type InfluxOut struct {
+	transport string
+	tags      map[string]string
+
+	file *os.File
+	udp  *udpWriter
+
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewInfluxOut(oc config.OutputConfig) (*InfluxOut, error) {
+	o := &InfluxOut{transport: oc.Transport, tags: oc.Tags}
+
+	switch oc.Transport {
+	case "file":
+		f, err := os.OpenFile(oc.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open influx file: %w", err)
+		}
+		o.file = f
+	case "udp":
+		w, err := newUDPWriter(oc.Addr, oc.MaxPacketSize)
+		if err != nil {
+			return nil, fmt.Errorf("dial influx udp: %w", err)
+		}
+		o.udp = w
+	case "http":
+		o.url = oc.URL
+		o.token = oc.Token
+		o.client = &http.Client{Timeout: 5 * time.Second}
+	default:
+		return nil, fmt.Errorf("unknown influx transport %q", oc.Transport)
+	}
+
+	return o, nil
+}
+
+func (o *InfluxOut) Name() string { return "influx/" + o.transport }
+
+func (o *InfluxOut) Write(ctx context.Context, c Collected) error {
+	payload := AppendInfluxLines(nil, c.TS, sampleTags(c, o.tags), ToMetricPoints(c))
+	if len(payload) == 0 {
+		return nil
+	}
+
+	switch {
+	case o.file != nil:
+		_, err := o.file.Write(payload)
+		return err
+	case o.udp != nil:
+		return o.udp.Write(payload)
+	default:
+		return o.post(ctx, payload)
+	}
+}
+
+func (o *InfluxOut) post(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if o.token != "" {
+		req.Header.Set("Authorization", "Token "+o.token)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("influx write: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (o *InfluxOut) Close() error {
+	switch {
+	case o.file != nil:
+		return o.file.Close()
+	case o.udp != nil:
+		return o.udp.Close()
+	default:
+		o.client.CloseIdleConnections()
+		return nil
+	}
+}
+
+// AppendInfluxLines encodes points as line protocol. The metric name is split
+// at the first dot into measurement and field key ("cpu.usage" becomes
+// measurement "cpu", field "usage"), so related metrics share one line.
+// Non-finite values are dropped since line protocol cannot represent them.
+func AppendInfluxLines(buf []byte, ts time.Time, tags map[string]string, points []MetricPoint) []byte {
+	type line struct {
+		measurement string
+		fields      []MetricPoint
+	}
+
+	var lines []*line
+	index := make(map[string]*line)
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		measurement, field, ok := strings.Cut(p.Name, ".")
+		if !ok || field == "" {
+			measurement, field = p.Name, "value"
+		}
+		l := index[measurement]
+		if l == nil {
+			l = &line{measurement: measurement}
+			index[measurement] = l
+			lines = append(lines, l)
+		}
+		l.fields = append(l.fields, MetricPoint{Name: field, Value: p.Value})
+	}
+	if len(lines) == 0 {
+		return buf
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var tagSet []byte
+	for _, k := range keys {
+		tagSet = append(tagSet, ',')
+		tagSet = appendInfluxEscaped(tagSet, k, influxTagEscaper)
+		tagSet = append(tagSet, '=')
+		tagSet = appendInfluxEscaped(tagSet, tags[k], influxTagEscaper)
+	}
+
+	for _, l := range lines {
+		buf = appendInfluxEscaped(buf, l.measurement, influxMeasurementEscaper)
+		buf = append(buf, tagSet...)
+		buf = append(buf, ' ')
+		for i, f := range l.fields {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendInfluxEscaped(buf, f.Name, influxTagEscaper)
+			buf = append(buf, '=')
+			buf = strconv.AppendFloat(buf, f.Value, 'f', -1, 64)
+		}
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, ts.UnixNano(), 10)
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+// Line breaks cannot be escaped in line protocol, so they are written as
+// escaped spaces.
+var (
+	// measurements escape commas and spaces
+	influxMeasurementEscaper = strings.NewReplacer(
+		",", `\,`,
+		" ", `\ `,
+		"\n", `\ `,
+		"\r", `\ `,
+	)
+	// tag keys, tag values and field keys also escape equals signs
+	influxTagEscaper = strings.NewReplacer(
+		",", `\,`,
+		"=", `\=`,
+		" ", `\ `,
+		"\n", `\ `,
+		"\r", `\ `,
+	)
+)
+
+func appendInfluxEscaped(buf []byte, s string, r *strings.Replacer) []byte {
+	if !strings.ContainsAny(s, ", =\n\r") {
+		return append(buf, s...)
+	}
+	return append(buf, r.Replace(s)...)
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAppendInfluxLines_Escaping(t *testing.T) {
+	ts := time.Unix(1700000000, 5)
+
+	cases := []struct {
+		name   string
+		tags   map[string]string
+		points []MetricPoint
+		want   string
+	}{
+		{
+			name:   "groups fields by measurement",
+			tags:   map[string]string{"host": "node-1"},
+			points: []MetricPoint{{Name: "mem.used_percent", Value: 42.5}, {Name: "cpu.usage", Value: 3}, {Name: "mem.used_bytes", Value: 1024}},
+			want: "mem,host=node-1 used_percent=42.5,used_bytes=1024 1700000000000000005\n" +
+				"cpu,host=node-1 usage=3 1700000000000000005\n",
+		},
+		{
+			name:   "tags sorted, empty values dropped",
+			tags:   map[string]string{"z": "1", "a": "2", "empty": ""},
+			points: []MetricPoint{{Name: "cpu.usage", Value: 1}},
+			want:   "cpu,a=2,z=1 usage=1 1700000000000000005\n",
+		},
+		{
+			name:   "measurement escapes comma and space but not equals",
+			points: []MetricPoint{{Name: "my cpu,x=y.usage", Value: 1}},
+			want:   `my\ cpu\,x=y usage=1 1700000000000000005` + "\n",
+		},
+		{
+			name:   "tag key, tag value and field key escape comma equals space",
+			tags:   map[string]string{"a b": "c=d,e"},
+			points: []MetricPoint{{Name: "disk.used percent=x,y", Value: 1}},
+			want:   `disk,a\ b=c\=d\,e used\ percent\=x\,y=1 1700000000000000005` + "\n",
+		},
+		{
+			name:   "backslashes and quotes pass through",
+			tags:   map[string]string{"path": `C:\data "x"`},
+			points: []MetricPoint{{Name: "disk.used_percent", Value: 1}},
+			want:   `disk,path=C:\data\ "x" used_percent=1 1700000000000000005` + "\n",
+		},
+		{
+			name:   "line breaks become spaces",
+			tags:   map[string]string{"note": "a\nb\r\nc"},
+			points: []MetricPoint{{Name: "my\ncpu.usage", Value: 1}},
+			want:   `my\ cpu,note=a\ b\ \ c usage=1 1700000000000000005` + "\n",
+		},
+		{
+			name:   "name without dot uses value field",
+			points: []MetricPoint{{Name: "uptime", Value: 7}},
+			want:   "uptime value=7 1700000000000000005\n",
+		},
+		{
+			name:   "non-finite values dropped",
+			points: []MetricPoint{{Name: "mem.used_percent", Value: math.NaN()}, {Name: "cpu.usage", Value: math.Inf(1)}},
+			want:   "",
+		},
+		{
+			name:   "large values are not in exponent form",
+			points: []MetricPoint{{Name: "mem.used_bytes", Value: 17179869184}},
+			want:   "mem used_bytes=17179869184 1700000000000000005\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(AppendInfluxLines(nil, ts, tc.tags, tc.points))
+			if got != tc.want {
+				t.Errorf("got  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
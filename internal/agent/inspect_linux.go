@@ -0,0 +1,190 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxCmdline bounds the command line kept per process.
+const maxCmdline = 512
+
+func (c *CommonEnv) Processes() ([]ProcessInfo, error) {
+	dir := filepath.Join(c.procRoot, "proc")
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	page := uint64(os.Getpagesize())
+
+	var out []ProcessInfo
+	for _, de := range des {
+		if !isPID(de.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, de.Name(), "stat"))
+		if err != nil {
+			// the process exited meanwhile
+			continue
+		}
+		p, err := parseProcStat(string(b), page)
+		if err != nil {
+			continue
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, de.Name(), "cmdline")); err == nil {
+			p.Cmdline = cleanCmdline(b)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+// parseProcStat reads /proc/<pid>/stat. The name is in parentheses and may
+// itself contain spaces and parentheses, so fields are counted from the
+// last ')'.
+func parseProcStat(s string, page uint64) (ProcessInfo, error) {
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return ProcessInfo{}, fmt.Errorf("malformed stat %q", s)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(s[:open]))
+	if err != nil {
+		return ProcessInfo{}, fmt.Errorf("malformed stat %q", s)
+	}
+	// f[0] is field 3 (state) of proc(5)
+	f := strings.Fields(s[end+1:])
+	if len(f) < 22 {
+		return ProcessInfo{}, fmt.Errorf("short stat for pid %d", pid)
+	}
+	utime, _ := strconv.ParseUint(f[11], 10, 64)
+	stime, _ := strconv.ParseUint(f[12], 10, 64)
+	threads, _ := strconv.Atoi(f[17])
+	rss, _ := strconv.ParseInt(f[21], 10, 64)
+	if rss < 0 {
+		rss = 0
+	}
+	return ProcessInfo{
+		PID:      pid,
+		Name:     s[open+1 : end],
+		State:    f[0],
+		Threads:  threads,
+		RSSBytes: uint64(rss) * page,
+		CPUTicks: utime + stime,
+	}, nil
+}
+
+func cleanCmdline(b []byte) string {
+	s := strings.TrimRight(strings.ReplaceAll(string(b), "\x00", " "), " ")
+	if len(s) > maxCmdline {
+		s = s[:maxCmdline]
+	}
+	return s
+}
+
+// tcpStates names the st column of /proc/net/tcp.
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+func (c *CommonEnv) Sockets() (SocketStats, error) {
+	st := SocketStats{TCP: map[string]int{}}
+	found := false
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open(filepath.Join(c.procRoot, "proc", "net", proto))
+		if err != nil {
+			// IPv6 may be disabled
+			continue
+		}
+		err = readSocketTable(f, proto, &st)
+		f.Close()
+		if err != nil {
+			return SocketStats{}, fmt.Errorf("%s: %w", proto, err)
+		}
+		found = true
+	}
+	if !found {
+		return SocketStats{}, fmt.Errorf("no socket tables under %s", filepath.Join(c.procRoot, "proc", "net"))
+	}
+	sort.Slice(st.Listeners, func(i, j int) bool {
+		a, b := st.Listeners[i], st.Listeners[j]
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		if a.Proto != b.Proto {
+			return a.Proto < b.Proto
+		}
+		return a.Addr < b.Addr
+	})
+	return st, nil
+}
+
+// readSocketTable adds one /proc/net/{tcp,udp}[6] table to st.
+func readSocketTable(f *os.File, proto string, st *SocketStats) error {
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if strings.HasPrefix(proto, "udp") {
+			st.UDP++
+			continue
+		}
+		state, ok := tcpStates[fields[3]]
+		if !ok {
+			state = "UNKNOWN"
+		}
+		st.TCP[state]++
+		if state != "LISTEN" {
+			continue
+		}
+		addr, port, err := parseSocketAddr(fields[1])
+		if err != nil {
+			return err
+		}
+		st.Listeners = append(st.Listeners, Listener{Proto: proto, Addr: addr, Port: port})
+	}
+	return sc.Err()
+}
+
+// parseSocketAddr decodes an address such as "0100007F:1F90". The address
+// is written as 32-bit words in host byte order.
+func parseSocketAddr(s string) (string, int, error) {
+	hexIP, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed address %q", s)
+	}
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return "", 0, fmt.Errorf("malformed address %q", s)
+	}
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed port in %q", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.NativeEndian.Uint32(raw[i:]))
+	}
+	return ip.String(), int(port), nil
+}
@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	stat := "42 (my (odd) proc) S 1 42 42 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 7 0 1000 10000000 300 18446744073709551615"
+	p, err := parseProcStat(stat, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ProcessInfo{PID: 42, Name: "my (odd) proc", State: "S", Threads: 7, RSSBytes: 300 * 4096, CPUTicks: 300}
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	if _, err := parseProcStat("42 (short) S 1", 4096); err == nil {
+		t.Fatal("short stat accepted")
+	}
+}
+
+func TestParseSocketAddr(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		addr string
+		port int
+	}{
+		{"0100007F:1F90", "127.0.0.1", 8080},
+		{"00000000:0016", "0.0.0.0", 22},
+		{"00000000000000000000000001000000:01BB", "::1", 443},
+	} {
+		addr, port, err := parseSocketAddr(tc.in)
+		if err != nil || addr != tc.addr || port != tc.port {
+			t.Errorf("parseSocketAddr(%q) = %s, %d, %v; want %s, %d", tc.in, addr, port, err, tc.addr, tc.port)
+		}
+	}
+	if _, _, err := parseSocketAddr("zz:0016"); err == nil {
+		t.Error("malformed address accepted")
+	}
+}
+
+func TestTopProcesses(t *testing.T) {
+	before := []ProcessInfo{{PID: 1, CPUTicks: 100}, {PID: 2, CPUTicks: 100}}
+	after := []ProcessInfo{
+		{PID: 1, CPUTicks: 150, RSSBytes: 10},
+		{PID: 2, CPUTicks: 110, RSSBytes: 30},
+		{PID: 3, CPUTicks: 500, RSSBytes: 20}, // started during the window
+	}
+	byCPU, byMem := topProcesses(before, after, time.Second, 2)
+	if len(byCPU) != 2 || byCPU[0].PID != 1 || byCPU[0].CPUPercent != 50 || byCPU[1].PID != 2 || byCPU[1].CPUPercent != 10 {
+		t.Fatalf("by CPU = %+v", byCPU)
+	}
+	if len(byMem) != 2 || byMem[0].PID != 2 || byMem[1].PID != 3 {
+		t.Fatalf("by memory = %+v", byMem)
+	}
+}
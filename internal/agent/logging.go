@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"os"
+	"time"
+
+	"go-agent/internal/config"
+	"go-agent/internal/logging"
+)
+
+// Component loggers. Levels can be set per component in the log config or
+// at runtime with the log.level command.
+var (
+	collectLog  = logging.For("collect")
+	sampleLog   = logging.For("sample")
+	registerLog = logging.For("register")
+	hbLog       = logging.For("hb")
+	metricsLog  = logging.For("metrics")
+	commandLog  = logging.For("command")
+	configLog   = logging.For("config")
+	reloadLog   = logging.For("reload")
+	outputLog   = logging.For("output")
+	stateLog    = logging.For("state")
+	healthLog   = logging.For("health")
+	debugLog    = logging.For("debug")
+	budgetLog   = logging.For("budget")
+	alertLog    = logging.For("alert")
+
+	// errLimit keeps failures that recur on every tick from flooding the
+	// log.
+	errLimit = logging.NewLimiter(time.Minute)
+)
+
+// SetupLogging applies the log section of the config and tags every record
+// with the host name. It is called at start and again when the log section
+// changes on reload, which also resets levels changed with log.level.
+func SetupLogging(lc config.LogConfig) error {
+	if err := logging.Setup(logging.Options{
+		Format:   lc.Format,
+		Level:    lc.Level,
+		Levels:   lc.Levels,
+		Timezone: lc.Timezone,
+	}); err != nil {
+		return err
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		logging.SetField("host", hostname)
+	}
+	return nil
+}
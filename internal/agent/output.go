@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"go-agent/internal/config"
+)
+
+const defaultMaxPacketSize = 1432
+
+// Output is a metric sink fed with every collected sample.
+type Output interface {
+	Name() string
+	Write(ctx context.Context, c Collected) error
+	Close() error
+}
+
+// BuildOutputs creates the line-oriented sinks described by cfg. gRPC outputs
+// are skipped here because they also carry heartbeats and commands and are
+// wired separately.
+func BuildOutputs(cfgs []config.OutputConfig) ([]Output, error) {
+	var outs []Output
+	for i, oc := range cfgs {
+		if oc.Type == config.OutputGRPC {
+			continue
+		}
+		o, err := newOutput(oc)
+		if err != nil {
+			CloseOutputs(outs)
+			return nil, fmt.Errorf("outputs[%d]: %w", i, err)
+		}
+		outs = append(outs, o)
+	}
+	return outs, nil
+}
+
+func newOutput(oc config.OutputConfig) (Output, error) {
+	switch oc.Type {
+	case config.OutputInflux:
+		return NewInfluxOut(oc)
+	case config.OutputStatsD:
+		return NewStatsDOut(oc)
+	default:
+		return nil, fmt.Errorf("unknown output type %q", oc.Type)
+	}
+}
+
+func CloseOutputs(outs []Output) {
+	for _, o := range outs {
+		_ = o.Close()
+	}
+}
+
+// sampleTags returns the tags attached to every point of a sample. Static
+// tags from config win over detected ones.
+func sampleTags(c Collected, static map[string]string) map[string]string {
+	tags := make(map[string]string, 4+len(static))
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		tags["host"] = hostname
+	}
+	if c.K8s.Valid {
+		tags["namespace"] = c.K8s.Namespace
+		tags["pod"] = c.K8s.PodName
+		if c.K8s.NodeName != "" {
+			tags["node"] = c.K8s.NodeName
+		}
+	}
+	for k, v := range static {
+		tags[k] = v
+	}
+	return tags
+}
+
+// udpWriter sends newline separated payloads, splitting them on line
+// boundaries so that no datagram exceeds max bytes.
+type udpWriter struct {
+	conn net.Conn
+	max  int
+}
+
+func newUDPWriter(addr string, max int) (*udpWriter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if max <= 0 {
+		max = defaultMaxPacketSize
+	}
+	return &udpWriter{conn: conn, max: max}, nil
+}
+
+func (w *udpWriter) Write(payload []byte) error {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > w.max {
+			n = bytes.LastIndexByte(payload[:w.max], '\n') + 1
+			if n <= 0 {
+				// a single line larger than the limit is sent on its own
+				n = bytes.IndexByte(payload, '\n') + 1
+				if n <= 0 {
+					n = len(payload)
+				}
+			}
+		}
+		if _, err := w.conn.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+func (w *udpWriter) Close() error {
+	return w.conn.Close()
+}
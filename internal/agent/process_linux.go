@@ -0,0 +1,682 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// pfKthread is PF_KTHREAD in the flags of /proc/<pid>/stat.
+	pfKthread = 0x00200000
+	// freezeWait bounds how long cgroup.freeze and cgroup.thaw wait for
+	// the kernel to report the new state.
+	freezeWait = 10 * time.Second
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+// I/O scheduling classes of ioprio_set(2).
+const (
+	ioprioClassNone = iota
+	ioprioClassRT
+	ioprioClassBE
+	ioprioClassIdle
+
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+var ioprioClasses = map[string]int{"best-effort": ioprioClassBE, "idle": ioprioClassIdle}
+
+// targetArgs select the processes of proc.signal and proc.renice.
+var targetArgs = []ArgSpec{
+	{Name: "pid", Type: ArgInt, Doc: "the process; excludes name"},
+	{Name: "name", Type: ArgString, Doc: "every process with this name (/proc/<pid>/comm); excludes pid"},
+	{Name: "cmdline", Type: ArgString, Doc: "with name, only the processes whose command line this regular expression matches"},
+}
+
+var procSignalSpec = CommandSpec{
+	Name: "proc.signal",
+	Doc:  "send a signal allowed by the agent's commands.process config to one process or to all with a name; the output lists each process and what became of it",
+	Args: append(slices.Clip(targetArgs),
+		ArgSpec{Name: "signal", Type: ArgString, Required: true, Doc: `e.g. "TERM" or "HUP"`},
+		ArgSpec{Name: "dry_run", Type: ArgBool, Doc: "only list the processes that would be signalled"},
+	),
+}
+
+var procReniceSpec = CommandSpec{
+	Name: "proc.renice",
+	Doc:  "change the nice value and I/O priority of every thread of one process or of all with a name, as allowed by commands.process; the output has the values before and after",
+	Args: append(slices.Clip(targetArgs),
+		ArgSpec{Name: "nice", Type: ArgInt, Doc: "-20 to 19; no lower than commands.process.min_nice"},
+		ArgSpec{Name: "ionice_class", Type: ArgString, Enum: []string{"best-effort", "idle"}},
+		ArgSpec{Name: "ionice_level", Type: ArgInt, Doc: "0 (highest) to 7 for best-effort; default 4"},
+		ArgSpec{Name: "dry_run", Type: ArgBool, Doc: "only list the processes and their current priorities"},
+	),
+}
+
+var cgroupFreezeSpec = CommandSpec{
+	Name: "cgroup.freeze",
+	Doc:  "freeze a cgroup v2 allowed by commands.process.cgroups, with every cgroup below it; the output lists the processes frozen",
+	Args: []ArgSpec{
+		{Name: "path", Type: ArgString, Required: true, Doc: `relative to /sys/fs/cgroup, e.g. "system.slice/app.service"`},
+		{Name: "dry_run", Type: ArgBool, Doc: "only list the processes that would be frozen"},
+	},
+}
+
+var cgroupThawSpec = CommandSpec{
+	Name: "cgroup.thaw",
+	Doc:  "thaw a cgroup frozen by cgroup.freeze",
+	Args: cgroupFreezeSpec.Args,
+}
+
+// signals are those commands.process.signals may name.
+var signals = map[string]syscall.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT, "KILL": syscall.SIGKILL, "USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2, "TERM": syscall.SIGTERM, "CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP, "TSTP": syscall.SIGTSTP, "WINCH": syscall.SIGWINCH,
+}
+
+func signalName(s string) string {
+	return strings.TrimPrefix(strings.ToUpper(s), "SIG")
+}
+
+// processPolicy is the compiled commands.process config.
+type processPolicy struct {
+	names []*regexp.Regexp
+	// uids, if not nil, are the users whose processes may be acted on.
+	uids    map[uint32]bool
+	signals map[string]syscall.Signal
+	renice  bool
+	minNice int
+	cgroups []string
+	max     int
+}
+
+func newProcessPolicy(c config.ProcessConfig) (*processPolicy, error) {
+	p := &processPolicy{renice: c.Renice, minNice: c.MinNice, cgroups: c.Cgroups, max: c.MaxProcesses, signals: map[string]syscall.Signal{}}
+	for _, s := range c.Names {
+		re, err := regexp.Compile(`^(?:` + s + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("commands.process.names: %w", err)
+		}
+		p.names = append(p.names, re)
+	}
+	for _, s := range c.Signals {
+		sig, ok := signals[signalName(s)]
+		if !ok {
+			return nil, fmt.Errorf("commands.process.signals: unknown signal %q", s)
+		}
+		p.signals[signalName(s)] = sig
+	}
+	// users are only resolved when processes may be acted on, so that a
+	// missing user does not stop agents that never do
+	if len(c.Users) > 0 && len(p.names) > 0 {
+		p.uids = map[uint32]bool{}
+		for _, name := range c.Users {
+			uid, err := lookupUID(name)
+			if err != nil {
+				return nil, fmt.Errorf("commands.process.users: %w", err)
+			}
+			p.uids[uid] = true
+		}
+	}
+	return p, nil
+}
+
+func lookupUID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(id), err
+}
+
+func (pp *processPolicy) nameAllowed(name string) bool {
+	return slices.ContainsFunc(pp.names, func(re *regexp.Regexp) bool { return re.MatchString(name) })
+}
+
+// protected tells why a process may not be acted on, or returns "".
+func (pp *processPolicy) protected(t procTarget) string {
+	switch {
+	case t.PID == 1:
+		return "pid 1"
+	case t.PID == os.Getpid():
+		return "the agent itself"
+	case t.flags&pfKthread != 0:
+		return "kernel thread"
+	case !pp.nameAllowed(t.Name):
+		return "name not in commands.process.names"
+	case pp.uids != nil && !pp.uids[t.UID]:
+		return "user not in commands.process.users"
+	}
+	return ""
+}
+
+// procTarget is a process a command acts on, and what became of it.
+type procTarget struct {
+	PID     int    `json:"pid"`
+	Name    string `json:"name"`
+	UID     uint32 `json:"uid"`
+	Cmdline string `json:"cmdline,omitempty"`
+	// Nice and IONice are the priorities before a renice, NewNice and
+	// NewIONice after it.
+	Nice      *int   `json:"nice,omitempty"`
+	IONice    string `json:"ionice,omitempty"`
+	NewNice   *int   `json:"new_nice,omitempty"`
+	NewIONice string `json:"new_ionice,omitempty"`
+	// Outcome is what was done, "gone" for a process that exited first,
+	// or why it was left alone.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	flags uint64
+	// start is the start time in clock ticks, which tells a process
+	// apart from a later one with the same pid.
+	start uint64
+}
+
+// procResult is the output of the process commands.
+type procResult struct {
+	DryRun    bool         `json:"dry_run,omitempty"`
+	Signal    string       `json:"signal,omitempty"`
+	Cgroup    string       `json:"cgroup,omitempty"`
+	Frozen    *bool        `json:"frozen,omitempty"`
+	Processes []procTarget `json:"processes"`
+	// Skipped are processes that matched but are protected.
+	Skipped []procTarget `json:"skipped,omitempty"`
+}
+
+var errGone = errors.New("process exited")
+
+// readProc reads what the commands need of a process from /proc.
+func readProc(pid int) (procTarget, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	b, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return procTarget{}, errGone
+	}
+	if err != nil {
+		return procTarget{}, err
+	}
+	s := string(b)
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return procTarget{}, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	// f[0] is field 3 (state) of proc(5)
+	f := strings.Fields(s[end+1:])
+	if len(f) < 20 {
+		return procTarget{}, fmt.Errorf("short stat for pid %d", pid)
+	}
+	t := procTarget{PID: pid, Name: s[open+1 : end]}
+	t.flags, _ = strconv.ParseUint(f[6], 10, 64)
+	nice, _ := strconv.Atoi(f[16])
+	t.Nice = &nice
+	t.start, _ = strconv.ParseUint(f[19], 10, 64)
+	if b, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		t.Cmdline = cleanCmdline(b)
+	}
+	if t.UID, err = procUID(dir); err != nil {
+		return procTarget{}, err
+	}
+	return t, nil
+}
+
+// procUID returns the effective user of a process, as ps shows it.
+func procUID(dir string) (uint32, error) {
+	f, err := os.Open(filepath.Join(dir, "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if rest, ok := strings.CutPrefix(sc.Text(), "Uid:"); ok {
+			ids := strings.Fields(rest)
+			if len(ids) < 2 {
+				break
+			}
+			uid, err := strconv.ParseUint(ids[1], 10, 32)
+			return uint32(uid), err
+		}
+	}
+	return 0, fmt.Errorf("no Uid in %s/status", dir)
+}
+
+// sameProc reports whether t still runs under its pid.
+func sameProc(t procTarget) bool {
+	cur, err := readProc(t.PID)
+	return err == nil && cur.start == t.start
+}
+
+// targets finds the processes selected by the pid, name and cmdline
+// arguments. Matches the policy protects are returned apart; a pid that
+// is protected, or more matches than allowed, fail the command with the
+// outcome returned.
+func (pp *processPolicy) targets(args Args) (match, skipped []procTarget, fail *CommandOutcome) {
+	invalid := func(msg string) *CommandOutcome {
+		return &CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: msg}
+	}
+	failed := func(msg string) *CommandOutcome {
+		return &CommandOutcome{Status: pb.CommandResult_ERROR, Error: msg}
+	}
+	if args.Has("pid") == args.Has("name") {
+		return nil, nil, invalid("exactly one of pid and name is required")
+	}
+	if args.Has("pid") {
+		if args.Has("cmdline") {
+			return nil, nil, invalid("cmdline needs name")
+		}
+		t, err := readProc(int(args.Int("pid")))
+		if err != nil {
+			return nil, nil, failed(err.Error())
+		}
+		if why := pp.protected(t); why != "" {
+			return nil, nil, failed(fmt.Sprintf("pid %d (%s): %s", t.PID, t.Name, why))
+		}
+		return []procTarget{t}, nil, nil
+	}
+
+	name := args.String("name")
+	if !pp.nameAllowed(name) {
+		return nil, nil, failed(fmt.Sprintf("%q is not in commands.process.names", name))
+	}
+	var cmdline *regexp.Regexp
+	if args.Has("cmdline") {
+		re, err := regexp.Compile(args.String("cmdline"))
+		if err != nil {
+			return nil, nil, invalid("cmdline: " + err.Error())
+		}
+		cmdline = re
+	}
+	des, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, nil, failed(err.Error())
+	}
+	for _, de := range des {
+		if !isPID(de.Name()) {
+			continue
+		}
+		pid, _ := strconv.Atoi(de.Name())
+		t, err := readProc(pid)
+		if err != nil || t.Name != name || cmdline != nil && !cmdline.MatchString(t.Cmdline) {
+			continue
+		}
+		if why := pp.protected(t); why != "" {
+			t.Outcome = "skipped: " + why
+			skipped = append(skipped, t)
+			continue
+		}
+		match = append(match, t)
+	}
+	if len(match) == 0 {
+		return nil, nil, failed(fmt.Sprintf("no process named %q may be acted on (%d protected)", name, len(skipped)))
+	}
+	if len(match) > pp.max {
+		return nil, nil, failed(fmt.Sprintf("%d processes match; commands.process.max_processes is %d", len(match), pp.max))
+	}
+	return match, skipped, nil
+}
+
+// finish turns a result into an outcome, failed if any process failed,
+// and audits what was done.
+func (r *Runner) finish(ctx context.Context, action string, res procResult) CommandOutcome {
+	out := CommandOutcome{Status: pb.CommandResult_OK, Output: mustJSON(res)}
+	var pids []string
+	failed := 0
+	for _, t := range res.Processes {
+		pids = append(pids, strconv.Itoa(t.PID))
+		if t.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		out.Status, out.Error = pb.CommandResult_ERROR, fmt.Sprintf("%d of %d processes failed", failed, len(res.Processes))
+	}
+	if res.DryRun {
+		return out
+	}
+	audit := &pb.Event{
+		Type:     "audit.process",
+		Severity: pb.Event_INFO,
+		Message:  fmt.Sprintf("%s: %d processes", action, len(res.Processes)),
+		Attributes: map[string]string{
+			"command_id": commandID(ctx),
+			"action":     action,
+			"pids":       strings.Join(pids, ","),
+			"failed":     strconv.Itoa(failed),
+		},
+	}
+	if res.Cgroup != "" {
+		audit.Attributes["cgroup"] = res.Cgroup
+	}
+	if failed > 0 {
+		audit.Severity = pb.Event_WARNING
+	}
+	r.pool.reportEvent(ctx, audit)
+	commandLog.Info(action, "pids", pids, "failed", failed)
+	return out
+}
+
+func (r *Runner) procSignalCommand(ctx context.Context, args Args, _ *Progress) CommandOutcome {
+	pp := r.policy.Load().process
+	name := signalName(args.String("signal"))
+	sig, ok := pp.signals[name]
+	if !ok {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf("signal %q is not in commands.process.signals", args.String("signal"))}
+	}
+	match, skipped, fail := pp.targets(args)
+	if fail != nil {
+		return *fail
+	}
+	res := procResult{DryRun: args.Bool("dry_run"), Signal: "SIG" + name, Skipped: skipped}
+	for _, t := range match {
+		t.Nice = nil
+		switch {
+		case res.DryRun:
+			t.Outcome = "would signal"
+		default:
+			t.Outcome = "signalled"
+			if err := signalProc(t, sig); errors.Is(err, errGone) {
+				t.Outcome = "gone"
+			} else if err != nil {
+				t.Outcome, t.Error = "failed", err.Error()
+			}
+		}
+		res.Processes = append(res.Processes, t)
+	}
+	return r.finish(ctx, "signal "+res.Signal, res)
+}
+
+// signalProc signals t through a pidfd, so that a process that took over
+// its pid after the check cannot be hit.
+func signalProc(t procTarget, sig syscall.Signal) error {
+	fd, err := unix.PidfdOpen(t.PID, 0)
+	if errors.Is(err, unix.ESRCH) {
+		return errGone
+	}
+	if errors.Is(err, unix.ENOSYS) {
+		// before Linux 5.3 the window between check and kill remains
+		if !sameProc(t) {
+			return errGone
+		}
+		return syscall.Kill(t.PID, sig)
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if !sameProc(t) {
+		return errGone
+	}
+	if err := unix.PidfdSendSignal(fd, sig, nil, 0); errors.Is(err, unix.ESRCH) {
+		return errGone
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *Runner) procReniceCommand(ctx context.Context, args Args, _ *Progress) CommandOutcome {
+	pp := r.policy.Load().process
+	if !pp.renice {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: "not allowed by commands.process.renice"}
+	}
+	nice, class, level := int(args.Int("nice")), args.String("ionice_class"), args.Int("ionice_level")
+	switch {
+	case !args.Has("nice") && class == "":
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: "nice or ionice_class is required"}
+	case args.Has("nice") && (nice < pp.minNice || nice > 19):
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: fmt.Sprintf("nice must be between %d (commands.process.min_nice) and 19", pp.minNice)}
+	case args.Has("ionice_level") && class != "best-effort":
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: "ionice_level needs ionice_class best-effort"}
+	case level < 0 || level > 7:
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: "ionice_level must be between 0 and 7"}
+	}
+	if class == "best-effort" && !args.Has("ionice_level") {
+		level = 4
+	}
+	ioprio := -1
+	if class != "" {
+		ioprio = ioprioClasses[class]<<ioprioClassShift | int(level)
+	}
+
+	match, skipped, fail := pp.targets(args)
+	if fail != nil {
+		return *fail
+	}
+	res := procResult{DryRun: args.Bool("dry_run"), Skipped: skipped}
+	for _, t := range match {
+		t.IONice = ioprioString(t.PID)
+		if res.DryRun {
+			t.Outcome = "would renice"
+			res.Processes = append(res.Processes, t)
+			continue
+		}
+		t.Outcome = "reniced"
+		if err := reniceProc(t, args.Has("nice"), nice, ioprio); errors.Is(err, errGone) {
+			t.Outcome = "gone"
+		} else if err != nil {
+			t.Outcome, t.Error = "failed", err.Error()
+		}
+		if cur, err := readProc(t.PID); err == nil && cur.start == t.start {
+			t.NewNice, t.NewIONice = cur.Nice, ioprioString(t.PID)
+		}
+		res.Processes = append(res.Processes, t)
+	}
+	return r.finish(ctx, "renice", res)
+}
+
+// reniceProc sets the nice value, and the I/O priority unless ioprio is
+// negative, of every thread of t: both apply to single threads.
+func reniceProc(t procTarget, setNice bool, nice, ioprio int) error {
+	if !sameProc(t) {
+		return errGone
+	}
+	des, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(t.PID), "task"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return errGone
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, de := range des {
+		tid, err := strconv.Atoi(de.Name())
+		if err != nil {
+			continue
+		}
+		if setNice {
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil && !errors.Is(err, unix.ESRCH) {
+				errs = append(errs, fmt.Errorf("thread %d: nice: %w", tid, err))
+			}
+		}
+		if ioprio >= 0 {
+			if _, _, e := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); e != 0 && e != unix.ESRCH {
+				errs = append(errs, fmt.Errorf("thread %d: ionice: %w", tid, e))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ioprioString describes a thread's I/O priority as ionice(1) does.
+func ioprioString(tid int) string {
+	v, _, e := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(tid), 0)
+	if e != 0 {
+		return ""
+	}
+	class, level := int(v)>>ioprioClassShift, int(v)&(1<<ioprioClassShift-1)
+	switch class {
+	case ioprioClassNone:
+		return "none"
+	case ioprioClassRT:
+		return fmt.Sprintf("realtime/%d", level)
+	case ioprioClassBE:
+		return fmt.Sprintf("best-effort/%d", level)
+	case ioprioClassIdle:
+		return "idle"
+	}
+	return strconv.Itoa(int(v))
+}
+
+// cgroupDir checks a cgroup path against the policy and returns its
+// directory.
+func (pp *processPolicy) cgroupDir(p string) (string, error) {
+	p = strings.TrimPrefix(p, "/")
+	if !filepath.IsLocal(p) || filepath.Clean(p) != p {
+		return "", errors.New("path must be a clean path relative to /sys/fs/cgroup")
+	}
+	if !slices.ContainsFunc(pp.cgroups, func(c string) bool { return p == c || strings.HasPrefix(p, c+"/") }) {
+		return "", fmt.Errorf("%s is not under commands.process.cgroups", p)
+	}
+	self, err := selfCgroupPathV2()
+	if err != nil {
+		return "", fmt.Errorf("agent cgroup: %w", err)
+	}
+	if self = strings.TrimPrefix(self, "/"); self == p || strings.HasPrefix(self, p+"/") {
+		return "", fmt.Errorf("%s holds the agent", p)
+	}
+	dir := filepath.Join(cgroupRoot, p)
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.freeze")); err != nil {
+		return "", fmt.Errorf("%s: not a cgroup v2 that can be frozen: %w", p, err)
+	}
+	return dir, nil
+}
+
+// cgroupProcs lists the processes of the cgroup at dir and below.
+func cgroupProcs(dir string) ([]procTarget, error) {
+	out := []procTarget{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(filepath.Join(p, "cgroup.procs"))
+		if err != nil {
+			// removed meanwhile
+			return nil
+		}
+		for _, s := range strings.Fields(string(b)) {
+			pid, _ := strconv.Atoi(s)
+			if t, err := readProc(pid); err == nil {
+				t.Nice = nil
+				out = append(out, t)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+// cgroupFrozen reads the frozen key of cgroup.events.
+func cgroupFrozen(dir string) (bool, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "cgroup.events"))
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "frozen "); ok {
+			return v == "1", nil
+		}
+	}
+	return false, errors.New("no frozen key in cgroup.events")
+}
+
+func (r *Runner) cgroupFreezeCommand(ctx context.Context, args Args, _ *Progress) CommandOutcome {
+	return r.setFrozen(ctx, args, true)
+}
+
+func (r *Runner) cgroupThawCommand(ctx context.Context, args Args, _ *Progress) CommandOutcome {
+	return r.setFrozen(ctx, args, false)
+}
+
+func (r *Runner) setFrozen(ctx context.Context, args Args, freeze bool) CommandOutcome {
+	pp := r.policy.Load().process
+	dir, err := pp.cgroupDir(args.String("path"))
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	procs, err := cgroupProcs(dir)
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	for _, t := range procs {
+		if t.PID == 1 || t.PID == os.Getpid() {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf("cgroup holds pid %d (%s)", t.PID, t.Name)}
+		}
+	}
+	action, done := "thaw", "thawed"
+	if freeze {
+		action, done = "freeze", "frozen"
+	}
+	res := procResult{DryRun: args.Bool("dry_run"), Cgroup: strings.TrimPrefix(dir, cgroupRoot+"/"), Processes: procs}
+	if res.DryRun {
+		for i := range res.Processes {
+			res.Processes[i].Outcome = "would be " + done
+		}
+		frozen, err := cgroupFrozen(dir)
+		if err == nil {
+			res.Frozen = &frozen
+		}
+		return r.finish(ctx, action, res)
+	}
+
+	val := "0"
+	if freeze {
+		val = "1"
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.freeze"), []byte(val), 0); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	// the kernel reports the new state once every task has reached it
+	wait, cancel := context.WithTimeout(ctx, freezeWait)
+	defer cancel()
+	frozen, err := cgroupFrozen(dir)
+	for err == nil && frozen != freeze && wait.Err() == nil {
+		select {
+		case <-wait.Done():
+		case <-time.After(50 * time.Millisecond):
+		}
+		frozen, err = cgroupFrozen(dir)
+	}
+	res.Frozen = &frozen
+	for i := range res.Processes {
+		res.Processes[i].Outcome = done
+		if err != nil || frozen != freeze {
+			res.Processes[i].Outcome = "pending"
+		}
+	}
+	out := r.finish(ctx, action, res)
+	switch {
+	case err != nil:
+		out.Status, out.Error = pb.CommandResult_ERROR, err.Error()
+	case frozen != freeze && !freeze:
+		out.Status, out.Error = pb.CommandResult_ERROR, "still frozen; is a parent cgroup frozen?"
+	case frozen != freeze:
+		out.Status, out.Error = pb.CommandResult_ERROR, fmt.Sprintf("not frozen after %s", freezeWait)
+	}
+	return out
+}
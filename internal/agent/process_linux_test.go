@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+)
+
+func TestProcessCommands(t *testing.T) {
+	cmd := exec.Command("sleep", "987.654")
+	must(t, cmd.Start())
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+
+	cfg := config.Default()
+	cfg.Commands.Process = config.ProcessConfig{
+		Names:        []string{"sleep"},
+		Signals:      []string{"TERM"},
+		Renice:       true,
+		Cgroups:      []string{"system.slice"},
+		MaxProcesses: 4,
+	}
+	pol, err := newCommandPolicy(cfg.Commands)
+	must(t, err)
+	r := &Runner{pool: newCommandPool(newCommandRegistry())}
+	r.pool.setOutput(newResultLog())
+	r.policy.Store(pol)
+	ctx := context.Background()
+
+	run := func(fn CommandFunc, spec CommandSpec, args string) (CommandOutcome, procResult) {
+		t.Helper()
+		a, err := decodeArgs(spec, args)
+		must(t, err)
+		out := fn(ctx, a, newProgress(0))
+		var res procResult
+		if out.Status == pb.CommandResult_OK {
+			must(t, json.Unmarshal([]byte(out.Output), &res))
+		}
+		return out, res
+	}
+
+	out, res := run(r.procSignalCommand, procSignalSpec, `{"name":"sleep","cmdline":"987\\.654","signal":"TERM","dry_run":true}`)
+	if out.Status != pb.CommandResult_OK || len(res.Processes) != 1 || res.Processes[0].PID != pid || res.Processes[0].Outcome != "would signal" {
+		t.Fatalf("dry run: %+v", out)
+	}
+
+	out, res = run(r.procReniceCommand, procReniceSpec, `{"pid":`+strconv.Itoa(pid)+`,"nice":7,"ionice_class":"idle"}`)
+	if out.Status != pb.CommandResult_OK || *res.Processes[0].NewNice != 7 || res.Processes[0].NewIONice != "idle" {
+		t.Fatalf("renice: %+v", out)
+	}
+
+	for _, args := range []string{
+		`{"pid":1,"signal":"TERM"}`,
+		`{"pid":` + strconv.Itoa(os.Getpid()) + `,"signal":"TERM"}`,
+		`{"name":"bash","signal":"TERM"}`,
+		`{"pid":` + strconv.Itoa(pid) + `,"signal":"KILL"}`,
+		`{"pid":` + strconv.Itoa(pid) + `,"name":"sleep","signal":"TERM"}`,
+	} {
+		if out, _ := run(r.procSignalCommand, procSignalSpec, args); out.Status == pb.CommandResult_OK {
+			t.Errorf("%s allowed", args)
+		}
+	}
+	if out, _ := run(r.procReniceCommand, procReniceSpec, `{"pid":`+strconv.Itoa(pid)+`,"nice":-5}`); out.Status == pb.CommandResult_OK {
+		t.Error("nice below min_nice allowed")
+	}
+
+	out, res = run(r.procSignalCommand, procSignalSpec, `{"pid":`+strconv.Itoa(pid)+`,"signal":"SIGTERM"}`)
+	if out.Status != pb.CommandResult_OK || res.Processes[0].Outcome != "signalled" {
+		t.Fatalf("signal: %+v", out)
+	}
+	var exit *exec.ExitError
+	if err := cmd.Wait(); !errors.As(err, &exit) || exit.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+		t.Fatalf("sleep ended with %v", err)
+	}
+
+	for _, p := range []string{"user.slice", "system.slice/../user.slice", "/"} {
+		if _, err := pol.process.cgroupDir(p); err == nil {
+			t.Errorf("cgroup %s allowed", p)
+		}
+	}
+}
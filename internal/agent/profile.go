@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	pb "go-agent/proto/agentv1"
+)
+
+const (
+	maxCPUProfile = 10 * time.Minute
+	maxTrace      = time.Minute
+	// maxProfileBytes caps one profile or trace sent to the collector.
+	maxProfileBytes = 64 << 20
+	// mutexFraction and blockRate are the sampling rates used while a
+	// mutex or block profile is taken.
+	mutexFraction = 5
+	blockRate     = int(10 * time.Microsecond)
+)
+
+var pprofCPUSpec = CommandSpec{
+	Name: "pprof.cpu",
+	Doc:  "profile the agent's CPU use for a while; the pprof file is stored by the collector",
+	Args: []ArgSpec{
+		{Name: "duration", Type: ArgDuration, Doc: "how long to profile; default 30s, at most 10m and the command's timeout"},
+	},
+}
+
+var pprofProfileSpec = CommandSpec{
+	Name: "pprof.profile",
+	Doc:  "take one of the agent's runtime profiles; the pprof file is stored by the collector",
+	Args: []ArgSpec{
+		{Name: "profile", Type: ArgString, Required: true, Enum: []string{"heap", "allocs", "goroutine", "mutex", "block", "threadcreate"}},
+		{Name: "duration", Type: ArgDuration, Doc: "mutex and block: how long to sample contention for; default 10s"},
+		{Name: "gc", Type: ArgBool, Doc: "heap: collect garbage first, so the profile shows only live memory"},
+		{Name: "text", Type: ArgBool, Doc: "goroutine: every goroutine's stack as text instead of pprof"},
+	},
+}
+
+var pprofTraceSpec = CommandSpec{
+	Name: "pprof.trace",
+	Doc:  "record an execution trace of the agent for `go tool trace`; the file is stored by the collector",
+	Args: []ArgSpec{
+		{Name: "duration", Type: ArgDuration, Doc: "how long to trace; default 5s, at most 1m"},
+	},
+}
+
+// sampling serializes the mutex and block profiles, which change
+// process-wide sampling rates while they run.
+var sampling sync.Mutex
+
+func (r *Runner) pprofCPUCommand(ctx context.Context, args Args, p *Progress) CommandOutcome {
+	d, out := profileDuration(ctx, args, 30*time.Second, maxCPUProfile)
+	if out != nil {
+		return *out
+	}
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	err := waitProgress(ctx, d, p)
+	pprof.StopCPUProfile()
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	return sendProfile(p, "cpu", ".pprof", buf.Bytes())
+}
+
+func (r *Runner) pprofProfileCommand(ctx context.Context, args Args, p *Progress) CommandOutcome {
+	name := args.String("profile")
+	debug, ext := 0, ".pprof"
+	switch name {
+	case "heap":
+		if args.Bool("gc") {
+			runtime.GC()
+		}
+	case "goroutine":
+		if args.Bool("text") {
+			debug, ext = 2, ".txt"
+		}
+	case "mutex", "block":
+		d, out := profileDuration(ctx, args, 10*time.Second, maxCPUProfile)
+		if out != nil {
+			return *out
+		}
+		if !sampling.TryLock() {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: "a mutex or block profile is already being taken"}
+		}
+		defer sampling.Unlock()
+		if name == "mutex" {
+			prev := runtime.SetMutexProfileFraction(mutexFraction)
+			defer runtime.SetMutexProfileFraction(prev)
+		} else {
+			runtime.SetBlockProfileRate(blockRate)
+			defer runtime.SetBlockProfileRate(0)
+		}
+		if err := waitProgress(ctx, d, p); err != nil {
+			return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+		}
+	}
+	var buf bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&buf, debug); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	return sendProfile(p, name, ext, buf.Bytes())
+}
+
+func (r *Runner) pprofTraceCommand(ctx context.Context, args Args, p *Progress) CommandOutcome {
+	d, out := profileDuration(ctx, args, 5*time.Second, maxTrace)
+	if out != nil {
+		return *out
+	}
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	err := waitProgress(ctx, d, p)
+	trace.Stop()
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	return sendProfile(p, "trace", ".trace", buf.Bytes())
+}
+
+// profileDuration returns the duration argument, or def, checked against
+// max and the time left before the command times out.
+func profileDuration(ctx context.Context, args Args, def, max time.Duration) (time.Duration, *CommandOutcome) {
+	d := def
+	if args.Has("duration") {
+		d = args.Duration("duration")
+	}
+	invalid := func(msg string) (time.Duration, *CommandOutcome) {
+		return 0, &CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: msg}
+	}
+	switch dl, ok := ctx.Deadline(); {
+	case d <= 0 || d > max:
+		return invalid(fmt.Sprintf("duration must be between 0 and %s", max))
+	case ok && time.Until(dl) < d+time.Second:
+		return invalid(fmt.Sprintf("duration exceeds the command's timeout (%s left); ask for a longer timeout", time.Until(dl).Round(time.Second)))
+	}
+	return d, nil
+}
+
+// waitProgress waits for d, reporting progress, unless ctx ends first.
+func waitProgress(ctx context.Context, d time.Duration, p *Progress) error {
+	start := time.Now()
+	done := time.NewTimer(d)
+	defer done.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-done.C:
+			return nil
+		case <-tick.C:
+			p.Set(int(time.Since(start) * 100 / d))
+		}
+	}
+}
+
+// sendProfile writes data to p as an artifact named after the profile,
+// the host and the time.
+func sendProfile(p *Progress, kind, ext string, data []byte) CommandOutcome {
+	if len(data) > maxProfileBytes {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: fmt.Sprintf("%s is %d bytes, over the limit of %d", kind, len(data), maxProfileBytes)}
+	}
+	host, _ := os.Hostname()
+	p.Artifact(fmt.Sprintf("%s-%s-%s%s", kind, host, time.Now().UTC().Format("20060102T150405Z"), ext))
+	if _, err := p.Write(data); err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	commandLog.Info("profile taken", "profile", kind, "bytes", len(data))
+	return CommandOutcome{Status: pb.CommandResult_OK}
+}
@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "go-agent/proto/agentv1"
+)
+
+func TestProfileCommands(t *testing.T) {
+	r := &Runner{}
+	ctx := context.Background()
+	for _, tc := range []struct {
+		fn       CommandFunc
+		spec     CommandSpec
+		args     string
+		prefix   string
+		contains string
+	}{
+		{r.pprofCPUCommand, pprofCPUSpec, `{"duration":"200ms"}`, "cpu-", "\x1f\x8b"},
+		{r.pprofProfileCommand, pprofProfileSpec, `{"profile":"heap","gc":true}`, "heap-", "\x1f\x8b"},
+		{r.pprofProfileCommand, pprofProfileSpec, `{"profile":"mutex","duration":"100ms"}`, "mutex-", "\x1f\x8b"},
+		{r.pprofProfileCommand, pprofProfileSpec, `{"profile":"goroutine","text":true}`, "goroutine-", "TestProfileCommands"},
+		{r.pprofTraceCommand, pprofTraceSpec, `{"duration":"100ms"}`, "trace-", "go 1."},
+	} {
+		args, err := decodeArgs(tc.spec, tc.args)
+		must(t, err)
+		p := newProgress(0)
+		if out := tc.fn(ctx, args, p); out.Status != pb.CommandResult_OK {
+			t.Fatalf("%s %s: %+v", tc.spec.Name, tc.args, out)
+		}
+		_, data, _ := p.take()
+		if !strings.HasPrefix(p.artifactName(), tc.prefix) || !strings.Contains(data, tc.contains) {
+			t.Errorf("%s %s: artifact %q, %d bytes", tc.spec.Name, tc.args, p.artifactName(), len(data))
+		}
+	}
+
+	short, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	args, err := decodeArgs(pprofCPUSpec, `{"duration":"1m"}`)
+	must(t, err)
+	if out := r.pprofCPUCommand(short, args, newProgress(0)); out.Status != pb.CommandResult_INVALID_ARGS {
+		t.Errorf("profile longer than the timeout: %+v", out)
+	}
+}
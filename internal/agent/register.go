@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"time"
+
+	"go-agent/internal/logging"
+	"go-agent/internal/state"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrNotRegistered = errors.New("agent not registered with collector yet")
+
+	errRegisterBackoff = errors.New("re-register suppressed by backoff")
+)
+
+// registerLoop performs the initial registration, retrying until it
+// succeeds so that an unreachable collector at startup is not fatal.
+func (o *GRPCOut) registerLoop(ctx context.Context) {
+	for {
+		err := o.reregister(ctx)
+		if err == nil {
+			close(o.registered)
+			return
+		}
+
+		o.regMu.Lock()
+		wait := time.Until(o.regNext)
+		o.regMu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Registered is closed once the first registration succeeded.
+func (o *GRPCOut) Registered() <-chan struct{} {
+	return o.registered
+}
+
+// register announces the agent, reusing the persisted identity if there is
+// one, and stores whatever identity the collector hands back.
+func (o *GRPCOut) register(ctx context.Context) error {
+	hostname, _ := os.Hostname()
+	req := &pb.RegisterRequest{Hostname: hostname, AgentId: o.AgentID(), Labels: o.labels}
+	if len(o.signing.PublicKeys) > 0 {
+		req.RequiresSignedCommands = true
+		req.MaxSignedTtlSeconds = uint32(o.signing.MaxTTL.Seconds())
+	}
+	if o.commands != nil {
+		req.Commands = o.commands.specs()
+	}
+	if req.AgentId == "" && o.state != nil {
+		req.AgentId = o.state.Get().AgentID
+	}
+	if o.cli.Credential() == "" && o.state != nil {
+		o.cli.SetCredential(o.state.Get().Credential)
+	}
+	token, err := o.bootstrapToken()
+	if err != nil {
+		return err
+	}
+	if o.cli.Credential() == "" {
+		req.BootstrapToken = token
+	}
+
+	err = o.registerOnce(ctx, req)
+	if status.Code(err) == codes.Unauthenticated && o.cli.Credential() != "" && token != "" {
+		// the collector no longer knows the credential; enroll again
+		registerLog.Warn("credential rejected, enrolling with bootstrap token")
+		o.cli.SetCredential("")
+		req.BootstrapToken = token
+		err = o.registerOnce(ctx, req)
+	}
+	if status.Code(err) == codes.InvalidArgument && req.AgentId != "" {
+		// a corrupt or foreign identity; start over with a fresh one
+		registerLog.Warn("stored agent_id rejected, requesting a new one", "agent_id", req.AgentId)
+		req.AgentId = ""
+		err = o.registerOnce(ctx, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	id := o.cli.Id.GetAgentId()
+	o.id.Store(id)
+	cred := o.cli.Id.GetCredential()
+	if cred != "" {
+		o.cli.SetCredential(cred)
+		registerLog.Info("enrolled, credential issued")
+	}
+
+	if o.state != nil {
+		err := o.state.Update(func(s *state.State) {
+			s.AgentID = id
+			s.Hostname = hostname
+			s.RegisteredAt = time.Now().UTC()
+			if cred != "" {
+				s.Credential = cred
+			}
+		})
+		if err != nil {
+			stateLog.Error("save failed", "err", err)
+		}
+	}
+	return nil
+}
+
+// bootstrapToken is read on every registration so that a token mounted
+// from a secret can be replaced without restarting the agent.
+func (o *GRPCOut) bootstrapToken() (string, error) {
+	if o.enroll.BootstrapTokenFile == "" {
+		return o.enroll.BootstrapToken, nil
+	}
+	b, err := os.ReadFile(o.enroll.BootstrapTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("read bootstrap token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (o *GRPCOut) registerOnce(ctx context.Context, req *pb.RegisterRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, o.timeouts.Register.Duration)
+	defer cancel()
+
+	return o.cli.Register(ctx, req)
+}
+
+// call runs fn and, if the collector lost track of this agent (NotFound) or
+// could not be reached (Unavailable), registers again and retries fn once.
+// Re-registration attempts are spaced by exponential backoff.
+func (o *GRPCOut) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	if o.AgentID() == "" {
+		return ErrNotRegistered
+	}
+
+	err := fn(ctx)
+	switch status.Code(err) {
+	case codes.NotFound, codes.Unavailable:
+	default:
+		return err
+	}
+
+	if rerr := o.reregister(ctx); rerr != nil {
+		if errors.Is(rerr, errRegisterBackoff) {
+			return err
+		}
+		return fmt.Errorf("%w (re-register: %v)", err, rerr)
+	}
+	return fn(ctx)
+}
+
+func (o *GRPCOut) reregister(ctx context.Context) error {
+	o.regMu.Lock()
+	defer o.regMu.Unlock()
+
+	now := time.Now()
+	if now.Before(o.regNext) {
+		return errRegisterBackoff
+	}
+
+	if err := o.register(ctx); err != nil {
+		wait := o.nextBackoff()
+		o.regNext = now.Add(wait)
+		registerLog.Warn("register failed", "retry_in", wait.Round(time.Millisecond), "err", err)
+		return err
+	}
+
+	o.regBackoff, o.regNext = 0, time.Time{}
+	logging.SetField("agent_id", o.AgentID())
+	registerLog.Info("registered")
+	return nil
+}
+
+// nextBackoff grows the registration backoff and returns it with jitter
+// applied, so that a fleet does not re-register in lockstep.
+func (o *GRPCOut) nextBackoff() time.Duration {
+	r := o.retry
+	if o.regBackoff == 0 {
+		o.regBackoff = r.InitialBackoff.Duration
+	} else {
+		o.regBackoff = time.Duration(float64(o.regBackoff) * r.Multiplier)
+	}
+	o.regBackoff = min(o.regBackoff, r.MaxBackoff.Duration)
+
+	if j := int64(float64(o.regBackoff) * r.Jitter); j > 0 {
+		return o.regBackoff + time.Duration(rand.Int64N(j))
+	}
+	return o.regBackoff
+}
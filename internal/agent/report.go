@@ -3,26 +3,30 @@ package agent
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"math"
 	"os"
+	"slices"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"go-agent/internal/config"
+	"go-agent/internal/spool"
+	"go-agent/internal/state"
+	"go-agent/internal/tlsutil"
 	"go-agent/internal/transport"
 	pb "go-agent/proto/agentv1"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-var (
-	loc = mustLoadLocation("Asia/Seoul")
-)
-
 var counter atomic.Int64
 
 type Collected struct {
 	Seq int64
-	TS  time.Time
+	// TS is the sample time in UTC.
+	TS time.Time
 
 	CPU  CPUStats
 	Mem  MemStats
@@ -30,14 +34,9 @@ type Collected struct {
 	Proc ProcStats
 
 	K8s KubernetesMeta
-}
 
-func mustLoadLocation(src string) *time.Location {
-	l, err := time.LoadLocation(src)
-	if err != nil {
-		panic(err)
-	}
-	return l
+	// Self holds the agent's own agent.* metrics.
+	Self []MetricPoint
 }
 
 func formatBytes(b uint64) string {
@@ -60,103 +59,223 @@ func formatBytes(b uint64) string {
 }
 
 type GRPCOut struct {
-	cli *transport.Client
+	cli  *transport.Client
+	id   atomic.Value // string
+	stop context.CancelFunc
+	// done is closed by Close once started.
+	done <-chan struct{}
+
+	labels   map[string]string
+	commands *commandRegistry
+	signing  config.SigningConfig
+	enroll   config.EnrollmentConfig
+	rev      atomic.Value // configRevision
+
+	timeouts config.TimeoutConfig
+	retry    config.RetryConfig
+
+	state      *state.Store
+	registered chan struct{}
+	regMu      sync.Mutex
+	regBackoff time.Duration
+	regNext    time.Time
+
+	buf         *spool.Queue
+	replayBatch int
+
+	batch *batcher
+}
+
+type GRPCOptions struct {
+	Collector config.CollectorConfig
+	Batch     config.BatchConfig
+	// State persists the agent identity; nil keeps it in memory only.
+	State  *state.Store
+	Labels map[string]string
+	// Commands are run on the collector's behalf and advertised to it at
+	// registration.
+	Commands *commandRegistry
+	// Signing is advertised at registration, so that the collector queues
+	// only commands the agent will accept.
+	Signing config.SigningConfig
+}
+
+type configRevision struct {
+	name    string
+	version int64
 }
 
-func NewGRPCOut(ctx context.Context, addr string) (*GRPCOut, error) {
-	cli, err := transport.New(transport.Options{Addr: addr})
+// NewGRPCOut sets up the collector client; nothing is sent before Start.
+func NewGRPCOut(opt GRPCOptions) (*GRPCOut, error) {
+	cc := opt.Collector
+	topt := transport.Options{
+		Endpoints:      cc.Endpoints,
+		LoadBalancing:  cc.LoadBalancing,
+		Compression:    opt.Batch.Compression,
+		ConnectTimeout: cc.Timeouts.Connect.Duration,
+		MaxBackoff:     cc.Retry.MaxBackoff.Duration,
+	}
+	if cc.TLS.Enabled {
+		r, err := tlsutil.NewReloader(tlsutil.Files{
+			CertFile: cc.TLS.CertFile,
+			KeyFile:  cc.TLS.KeyFile,
+			CAFile:   cc.TLS.CAFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+		topt.TLS = tlsutil.ClientConfig(r, cc.TLS.ServerName)
+	}
+	cli, err := transport.New(topt)
 	if err != nil {
 		return nil, err
 	}
-	hostname, _ := os.Hostname()
-	if err := cli.Register(ctx, &pb.RegisterRequest{Hostname: hostname}); err != nil {
-		_ = cli.Close()
-		return nil, fmt.Errorf("register failed: %w", err)
+
+	o := &GRPCOut{
+		cli:        cli,
+		labels:     opt.Labels,
+		commands:   opt.Commands,
+		signing:    opt.Signing,
+		enroll:     cc.Enrollment,
+		timeouts:   cc.Timeouts,
+		retry:      cc.Retry,
+		state:      opt.State,
+		registered: make(chan struct{}),
+		batch:      newBatcher(opt.Batch),
 	}
+	return o, nil
+}
 
-	return &GRPCOut{cli: cli}, nil
+// Start connects lazily: registration runs in the background and is
+// retried with backoff until it succeeds, ctx ends or o is closed. Until
+// then sends fail with ErrNotRegistered (and are buffered if a buffer is
+// enabled).
+func (o *GRPCOut) Start(ctx context.Context) {
+	ctx, o.stop = context.WithCancel(ctx)
+	o.done = ctx.Done()
+	go o.registerLoop(ctx)
 }
 
 func (o *GRPCOut) Close() error {
+	q, err := o.close()
+	if q != nil {
+		_ = q.Close()
+	}
+	return err
+}
+
+// close is Close without closing the buffer, which is returned for the
+// client taking over its directory.
+func (o *GRPCOut) close() (*spool.Queue, error) {
 	if o == nil || o.cli == nil {
-		return nil
+		return nil, nil
 	}
-	return o.cli.Close()
+	if o.stop != nil {
+		o.stop()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeouts.Metrics.Duration)
+	defer cancel()
+	if err := o.Flush(ctx); err != nil {
+		metricsLog.Error("final flush failed", "err", err)
+	}
+	return o.buf, o.cli.Close()
 }
 
 func (o *GRPCOut) AgentID() string {
-	if o == nil || o.cli == nil || o.cli.Id == nil {
+	if o == nil {
 		return ""
 	}
-	return o.cli.Id.AgentId
+	id, _ := o.id.Load().(string)
+	return id
+}
+
+// SetConfigRevision records the collector-managed config in effect, which
+// heartbeats report back. An empty name means local config only.
+func (o *GRPCOut) SetConfigRevision(name string, version int64) {
+	o.rev.Store(configRevision{name: name, version: version})
 }
 
 func (o *GRPCOut) SendHeartbeat(ctx context.Context) (*pb.HeartbeatResponse, error) {
-	if o.cli == nil {
+	if o == nil || o.cli == nil {
 		return nil, nil
 	}
-	agentID := o.AgentID()
 	hostname, _ := os.Hostname()
+	rev, _ := o.rev.Load().(configRevision)
+	level, reason := self.throttle()
+
+	var resp *pb.HeartbeatResponse
+	err := o.call(ctx, func(ctx context.Context) error {
+		hb := &pb.Heartbeat{
+			AgentId:       o.AgentID(),
+			Hostname:      hostname,
+			Time:          timestamppb.Now(),
+			ConfigName:    rev.name,
+			ConfigVersion: rev.version,
+			BudgetLevel:   uint32(level),
+			BudgetReason:  reason,
+		}
 
-	hb := &pb.Heartbeat{
-		AgentId:  agentID,
-		Hostname: hostname,
-		Time:     timestamppb.Now(),
-	}
-
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
+		ctx, cancel := context.WithTimeout(ctx, o.timeouts.Heartbeat.Duration)
+		defer cancel()
 
-	return o.cli.SendHeartbeat(ctx, hb)
+		var err error
+		resp, err = o.cli.SendHeartbeat(ctx, hb)
+		return err
+	})
+	return resp, err
 }
 
-func (o *GRPCOut) HandleAndReportCommand(ctx context.Context, cmd *pb.Command) error {
-	if o.cli == nil {
+// ReportCommandResult sends one result message, filling in agent id and
+// time.
+func (o *GRPCOut) ReportCommandResult(ctx context.Context, res *pb.CommandResult) error {
+	if o == nil || o.cli == nil {
 		return nil
 	}
-	res := o.handleCommand(cmd)
-	return o.ReportCommandResult(ctx, cmd, res)
+	res.Time = timestamppb.Now()
+	return o.call(ctx, func(ctx context.Context) error {
+		res.AgentId = o.AgentID()
+
+		ctx, cancel := context.WithTimeout(ctx, o.timeouts.Command.Duration)
+		defer cancel()
+
+		return o.cli.ReportCommandResult(ctx, res)
+	})
 }
 
-func (o *GRPCOut) ReportCommandResult(ctx context.Context, cmd *pb.Command, out CommandOutcome) error {
+// ReportEvent delivers ev to the collector, filling in agent id and time.
+func (o *GRPCOut) ReportEvent(ctx context.Context, ev *pb.Event) error {
 	if o == nil || o.cli == nil {
 		return nil
 	}
-
-	res := &pb.CommandResult{
-		AgentId:   o.AgentID(),
-		CommandId: "",
-		Time:      timestamppb.Now(),
-		Status:    out.Status,
-		Output:    out.Output,
-		Error:     out.Error,
-	}
-
-	if cmd != nil {
-		res.CommandId = cmd.GetCommandId()
+	if ev.Time == nil {
+		ev.Time = timestamppb.Now()
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
-	defer cancel()
+	return o.call(ctx, func(ctx context.Context) error {
+		ev.AgentId = o.AgentID()
 
-	return o.cli.ReportCommandResult(ctx, res)
-}
+		ctx, cancel := context.WithTimeout(ctx, o.timeouts.Command.Duration)
+		defer cancel()
 
-type CommandOutcome struct {
-	Status pb.CommandResult_Status
-	Output string
-	Error  string
+		return o.cli.ReportEvent(ctx, ev)
+	})
 }
 
-func (o *GRPCOut) handleCommand(cmd *pb.Command) CommandOutcome {
-	switch cmd.GetName() {
-	case "ping":
-		return CommandOutcome{Status: pb.CommandResult_OK, Output: "pong"}
-	case "snapshot":
-		return CommandOutcome{Status: pb.CommandResult_OK, Output: "snapshot triggered"}
-	default:
-		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: "unknown command"}
+// AckConfig tells the collector whether a config document was applied.
+func (o *GRPCOut) AckConfig(ctx context.Context, ack *pb.ConfigAck) error {
+	if o == nil || o.cli == nil {
+		return nil
 	}
+	ack.Time = timestamppb.Now()
+
+	return o.call(ctx, func(ctx context.Context) error {
+		ack.AgentId = o.AgentID()
+
+		ctx, cancel := context.WithTimeout(ctx, o.timeouts.Command.Duration)
+		defer cancel()
+
+		return o.cli.AckConfig(ctx, ack)
+	})
 }
 
 type MetricPoint struct {
@@ -165,62 +284,154 @@ type MetricPoint struct {
 	Unit  string
 }
 
-func (o *GRPCOut) SendMetrics(ctx context.Context, metrics []MetricPoint) error {
-	if o.cli == nil {
+func (o *GRPCOut) SendMetrics(ctx context.Context, ts time.Time, metrics []MetricPoint) error {
+	if o == nil || o.cli == nil {
 		return nil
 	}
-	agentID := o.AgentID()
-	pbMetrics := make([]*pb.Metric, 0, len(metrics))
+	if o.batch == nil {
+		pbMetrics := make([]*pb.Metric, 0, len(metrics))
+		for _, m := range metrics {
+			pbMetrics = append(pbMetrics, &pb.Metric{
+				Name:  m.Name,
+				Value: m.Value,
+				Unit:  m.Unit,
+			})
+		}
+		return o.ship(ctx, ts, pbMetrics)
+	}
 
-	for _, m := range metrics {
-		pbMetrics = append(pbMetrics, &pb.Metric{
-			Name:  m.Name,
-			Value: m.Value,
-			Unit:  m.Unit,
-		})
+	o.batch.add(ts, metrics)
+	if !o.batch.ready(ts) {
+		return nil
+	}
+	pbMetrics, first := o.batch.take(false)
+	return o.ship(ctx, first, pbMetrics)
+}
+
+// Flush sends whatever the batcher still holds, closing open aggregation
+// windows. It is called on shutdown.
+func (o *GRPCOut) Flush(ctx context.Context) error {
+	if o == nil || o.cli == nil || o.batch == nil {
+		return nil
+	}
+	pbMetrics, first := o.batch.take(true)
+	if len(pbMetrics) == 0 {
+		return nil
+	}
+	return o.ship(ctx, first, pbMetrics)
+}
+
+func (o *GRPCOut) ship(ctx context.Context, ts time.Time, pbMetrics []*pb.Metric) error {
+	if o.buf != nil {
+		for _, m := range o.bufferMetrics() {
+			pbMetrics = append(pbMetrics, &pb.Metric{Name: m.Name, Value: m.Value, Unit: m.Unit})
+		}
 	}
 
 	mb := &pb.MetricBatch{
-		AgentId: agentID,
-		Time:    timestamppb.Now(),
+		AgentId: o.AgentID(),
+		Time:    timestamppb.New(ts),
 		Metrics: pbMetrics,
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
+	if o.buf != nil {
+		return o.sendBuffered(ctx, mb)
+	}
+	err := o.sendBatch(ctx, mb)
+	if err != nil {
+		self.drop(len(mb.Metrics))
+	}
+	return err
+}
+
+func (o *GRPCOut) sendBatch(ctx context.Context, mb *pb.MetricBatch) error {
+	start := time.Now()
+	err := o.call(ctx, func(ctx context.Context) error {
+		mb.AgentId = o.AgentID()
 
-	return o.cli.SendMetrics(ctx, mb)
+		ctx, cancel := context.WithTimeout(ctx, o.timeouts.Metrics.Duration)
+		defer cancel()
+
+		return o.cli.SendMetrics(ctx, mb)
+	})
+	self.observeSend(time.Since(start), err)
+	return err
 }
 
 func Collect(ctx context.Context, env RuntimeEnv) Collected {
-	seq := counter.Add(1)
-	ts := time.Now().In(loc)
+	return collect(ctx, env, collectOptions{})
+}
+
+type collectOptions struct {
+	// off reports collectors switched off by the resource governor.
+	off func(name string) bool
+	// watch names processes to count individually.
+	watch []string
+	// aside is a reading taken outside the collection loop, such as a
+	// snapshot: it has no Seq and leaves the agent's own stats alone.
+	aside bool
+}
+
+// collect samples env as directed by opts.
+func collect(ctx context.Context, env RuntimeEnv, opts collectOptions) Collected {
+	off := opts.off
+	if off == nil {
+		off = func(string) bool { return false }
+	}
+	observe, skip := observeCollect, self.skipCollect
+	if opts.aside {
+		observe = func(string, time.Time) time.Time { return time.Now() }
+		skip = func(string) {}
+	}
 
 	var out Collected
-	out.Seq, out.TS = seq, ts
+	if !opts.aside {
+		out.Seq = counter.Add(1)
+	}
+	out.TS = time.Now().UTC()
 
+	start := time.Now()
 	if cpu, err := env.CPU(ctx); err != nil {
-		fmt.Printf("CPU Error: %v\n", err)
+		errLimit.Log(collectLog, slog.LevelWarn, "cpu collection failed", "err", err)
 	} else {
 		out.CPU = cpu
 	}
+	start = observe("cpu", start)
 
 	if mem, err := env.Mem(ctx); err != nil {
-		fmt.Printf("Mem Error: %v\n", err)
+		errLimit.Log(collectLog, slog.LevelWarn, "mem collection failed", "err", err)
 	} else {
 		out.Mem = mem
 	}
+	start = observe("mem", start)
 
-	if disk, err := env.Disk(ctx); err != nil {
-		fmt.Printf("Disk Error: %v\n", err)
+	if !off("disk") {
+		if disk, err := env.Disk(ctx); err != nil {
+			errLimit.Log(collectLog, slog.LevelWarn, "disk collection failed", "err", err)
+		} else {
+			out.Disk = disk
+		}
+		start = observe("disk", start)
 	} else {
-		out.Disk = disk
+		skip("disk")
 	}
 
-	if proc, err := env.Procs(ctx); err != nil {
-		fmt.Printf("Proc Error: %v\n", err)
+	if !off("procs") {
+		if proc, err := env.Procs(ctx); err != nil {
+			errLimit.Log(collectLog, slog.LevelWarn, "procs collection failed", "err", err)
+		} else {
+			out.Proc = proc
+		}
+		if pc, ok := env.(ProcessCounter); ok && len(opts.watch) > 0 && out.Proc.Valid {
+			if running, err := pc.CountProcesses(opts.watch); err != nil {
+				errLimit.Log(collectLog, slog.LevelWarn, "process count failed", "err", err)
+			} else {
+				out.Proc.Running = running
+			}
+		}
+		start = observe("procs", start)
 	} else {
-		out.Proc = proc
+		skip("procs")
 	}
 
 	if kp, ok := env.(K8sMetaProvider); ok {
@@ -228,11 +439,19 @@ func Collect(ctx context.Context, env RuntimeEnv) Collected {
 		if err == nil {
 			out.K8s = meta
 		}
+		observe("k8s", start)
 	}
 
+	out.Self = self.points(time.Now())
 	return out
 }
 
+func observeCollect(name string, start time.Time) time.Time {
+	now := time.Now()
+	self.observeCollect(name, now.Sub(start))
+	return now
+}
+
 func ToMetricPoints(c Collected) []MetricPoint {
 	metrics := make([]MetricPoint, 0, 8)
 
@@ -245,6 +464,9 @@ func ToMetricPoints(c Collected) []MetricPoint {
 			metrics = append(metrics, MetricPoint{Name: "mem.used_percent", Value: c.Mem.UsedPercent, Unit: "%"})
 		}
 		metrics = append(metrics, MetricPoint{Name: "mem.used_bytes", Value: float64(c.Mem.UsedBytes), Unit: "bytes"})
+		if c.Mem.OOMKillsValid {
+			metrics = append(metrics, MetricPoint{Name: "mem.oom_kills", Value: float64(c.Mem.OOMKills), Unit: "count"})
+		}
 	}
 
 	if c.Disk.Valid {
@@ -253,47 +475,46 @@ func ToMetricPoints(c Collected) []MetricPoint {
 
 	if c.Proc.Valid {
 		metrics = append(metrics, MetricPoint{Name: "proc.count", Value: float64(c.Proc.Count), Unit: "count"})
+		for _, name := range slices.Sorted(maps.Keys(c.Proc.Running)) {
+			metrics = append(metrics, MetricPoint{Name: "proc.running." + name, Value: float64(c.Proc.Running[name]), Unit: "count"})
+		}
 	}
 
+	metrics = append(metrics, c.Self...)
+
 	return metrics
 }
 
 func GRPCSend(ctx context.Context, out *GRPCOut, c Collected) {
 	metrics := ToMetricPoints(c)
-	if err := out.SendMetrics(ctx, metrics); err != nil {
-		log.Printf("[metrics] send failed: %v", err)
+	if err := out.SendMetrics(ctx, c.TS, metrics); err != nil {
+		errLimit.Log(metricsLog, slog.LevelWarn, "send failed", "err", err)
 	}
 }
 
+// ConsoleOut logs a one-line summary of the sample on the "sample"
+// component.
 func ConsoleOut(ctx context.Context, env RuntimeEnv, c Collected) {
-	cpuStr := "    N/A"
+	args := []any{"seq", c.Seq}
 	if c.CPU.Valid {
-		cpuStr = fmt.Sprintf("%7.2f%%", c.CPU.UsagePercent)
+		args = append(args, "cpu_pct", round2(c.CPU.UsagePercent))
 	}
-
-	memStr := "    N/A"
 	if c.Mem.Valid {
 		if math.IsNaN(c.Mem.UsedPercent) {
-			memStr = fmt.Sprintf(" N/A (%s)", formatBytes(c.Mem.UsedBytes))
+			args = append(args, "mem_used", formatBytes(c.Mem.UsedBytes))
 		} else {
-			memStr = fmt.Sprintf("%7.2f%%", c.Mem.UsedPercent)
+			args = append(args, "mem_pct", round2(c.Mem.UsedPercent))
 		}
 	}
-
-	diskStr := "    N/A"
 	if c.Disk.Valid {
-		diskStr = fmt.Sprintf("%7.2f%%", c.Disk.UsedPercent)
+		args = append(args, "disk_pct", round2(c.Disk.UsedPercent))
 	}
-
-	procStr := "    N/A"
 	if c.Proc.Valid {
-		procStr = fmt.Sprintf("%6d", c.Proc.Count)
+		args = append(args, "procs", c.Proc.Count)
 	}
+	sampleLog.InfoContext(ctx, "sample", args...)
+}
 
-	ts := c.TS.Format("2006-01-02 15:04:05.000 MST")
-
-	fmt.Printf(
-		"[Seq:%6d] [Time:%s] CPU:%8s  Mem:%-10s  Disk:%7s  Procs:%6s\n",
-		c.Seq, ts, cpuStr, memStr, diskStr, procStr,
-	)
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
 }
@@ -0,0 +1,708 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go-agent/internal/config"
+	"go-agent/internal/logging"
+	"go-agent/internal/spool"
+	"go-agent/internal/state"
+	pb "go-agent/proto/agentv1"
+)
+
+// Runner drives the collection loop and applies configuration reloads.
+// The runtime environment, and with it collector state such as CPU deltas,
+// is kept across reloads; only the outputs affected by a change are rebuilt.
+type Runner struct {
+	path  string
+	env   RuntimeEnv
+	cfg   config.Config
+	files []string
+
+	state  *state.Store
+	remote *state.RemoteConfig // collector-managed layer, nil if none
+
+	grpc *GRPCOut
+	// bufferErr is why the configured buffer is not in use. Only starting
+	// falls back to sending unbuffered; a reload that cannot open the
+	// buffer fails.
+	bufferErr error
+	started   bool
+
+	outs     []outputEntry
+	watcher  *configWatcher
+	health   *healthServer
+	debug    *debugServer
+	gov      *governor
+	alerts   *alerter
+	commands *commandRegistry
+	pool     *commandPool
+	// policy and effective, the config in effect, are read by running
+	// commands while the config may be reloaded.
+	policy    atomic.Pointer[commandPolicy]
+	effective atomic.Pointer[config.Config]
+	// samples are the latest samples, for support bundles.
+	samples sampleRing
+	// seen maps the ids of signed commands accepted to their expiry; it is
+	// only used by the collection loop.
+	seen map[string]time.Time
+}
+
+type outputEntry struct {
+	cfg config.OutputConfig
+	out Output
+}
+
+// grpcKeys are the top-level config keys that require reconnecting to the
+// collector when they change.
+var grpcKeys = []string{"state_dir", "labels", "collector", "buffer", "batch"}
+
+// NewRunner sets up outputs for cfg, which was loaded from files (path being
+// the file named on the command line). A collector-managed config persisted
+// by an earlier run is layered on top if it still applies; otherwise the
+// agent starts on cfg alone.
+func NewRunner(ctx context.Context, env RuntimeEnv, path string, cfg config.Config, files []string) (*Runner, error) {
+	r := &Runner{path: path, env: env, files: files, gov: newGovernor(selfUsage(env))}
+	r.commands = newCommandRegistry()
+	registerBuiltinCommands(r.commands)
+	r.commands.register(snapshotSpec, r.snapshotCommand)
+	r.pool = newCommandPool(r.commands)
+	r.commands.register(cancelSpec, r.pool.cancelCommand)
+	r.commands.register(execSpec, r.execCommand)
+	r.commands.register(fileReadSpec, r.fileReadCommand)
+	r.commands.register(fileListSpec, r.fileListCommand)
+	r.commands.register(bundleSpec, r.bundleCommand)
+	r.commands.register(procSignalSpec, r.procSignalCommand)
+	r.commands.register(procReniceSpec, r.procReniceCommand)
+	r.commands.register(cgroupFreezeSpec, r.cgroupFreezeCommand)
+	r.commands.register(cgroupThawSpec, r.cgroupThawCommand)
+	r.commands.register(pprofCPUSpec, r.pprofCPUCommand)
+	r.commands.register(pprofProfileSpec, r.pprofProfileCommand)
+	r.commands.register(pprofTraceSpec, r.pprofTraceCommand)
+	if err := r.apply(ctx, cfg); err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.cfg = cfg
+
+	if r.state == nil || r.state.Get().Config == nil {
+		r.started = true
+		return r, nil
+	}
+	r.remote = r.state.Get().Config
+	rcfg, rfiles, err := r.load()
+	if err == nil {
+		err = r.apply(ctx, rcfg)
+	}
+	if err != nil {
+		configLog.Warn("managed config not applied, using local config", "config", r.remote.Name, "version", r.remote.Version, "err", err)
+		r.remote = nil
+		r.started = true
+		return r, nil
+	}
+	r.cfg, r.files = rcfg, rfiles
+	r.grpc.SetConfigRevision(r.remote.Name, r.remote.Version)
+	configLog.Info("using managed config", "config", r.remote.Name, "version", r.remote.Version)
+	r.started = true
+	return r, nil
+}
+
+// load reads the local files with the managed layer, if any, on top.
+func (r *Runner) load() (config.Config, []string, error) {
+	var ov *config.Overlay
+	if r.remote != nil {
+		ov = &config.Overlay{Name: r.remote.Name, Format: r.remote.Format, Body: []byte(r.remote.Body)}
+	}
+	return config.LoadWithOverlay(r.path, ov)
+}
+
+// Run collects every interval until ctx ends. A value on reload, or a change
+// to a watched config file, reloads the configuration.
+func (r *Runner) Run(ctx context.Context, reload <-chan struct{}) {
+	ticker := time.NewTicker(r.gov.interval())
+	defer ticker.Stop()
+
+	for {
+		var watch <-chan struct{}
+		if r.watcher != nil {
+			watch = r.watcher.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			r.reload(ctx)
+			ticker.Reset(r.gov.interval())
+		case <-watch:
+			r.reload(ctx)
+			ticker.Reset(r.gov.interval())
+		case <-ticker.C:
+			r.tick(ctx)
+			if r.gov.observe(time.Now()) {
+				r.throttled(ctx)
+				ticker.Reset(r.gov.interval())
+			}
+			self.observeBudget(r.gov)
+		}
+	}
+}
+
+func (r *Runner) tick(ctx context.Context) {
+	c := collect(ctx, r.env, collectOptions{off: r.gov.disabled, watch: r.cfg.Procs.Watch})
+	ConsoleOut(ctx, r.env, c)
+	points := ToMetricPoints(c)
+	r.samples.add(c.TS, points)
+	for _, ch := range r.alerts.evaluate(c.TS, points, r.gov.disabled) {
+		r.reportAlert(ctx, ch)
+	}
+	for _, e := range r.outs {
+		if err := e.out.Write(ctx, c); err != nil {
+			self.outputError()
+			errLimit.Log(outputLog, slog.LevelWarn, "write failed", "output", e.out.Name(), "err", err)
+		}
+	}
+
+	defer func() {
+		self.observeTick(time.Now(), r.gov.interval(), r.grpc != nil, r.grpc.AgentID() != "")
+	}()
+	if r.grpc == nil {
+		return
+	}
+	res, err := r.grpc.SendHeartbeat(ctx)
+	if err != nil {
+		if !errors.Is(err, ErrNotRegistered) {
+			errLimit.Log(hbLog, slog.LevelWarn, "heartbeat failed", "err", err)
+		}
+	} else {
+		if res.GetConfig() != nil {
+			r.applyRemote(ctx, res.GetConfig())
+			if r.grpc == nil {
+				return
+			}
+		}
+		for _, cmd := range res.Commands {
+			if r.admit(ctx, cmd) {
+				r.pool.submit(cmd)
+			}
+		}
+	}
+	GRPCSend(ctx, r.grpc, c)
+}
+
+// reload loads the config again and applies it. A config that fails to load
+// or validate is rejected and the agent keeps running on the current one.
+func (r *Runner) reload(ctx context.Context) {
+	cfg, files, err := r.load()
+	if err != nil {
+		reloadLog.Error("rejected, keeping current config", "err", err)
+		r.reportReload(ctx, pb.Event_WARNING, "rejected", err.Error(), nil)
+		return
+	}
+	r.files = files
+	if r.watcher != nil {
+		r.watcher.Set(files)
+	}
+
+	changed := config.Diff(r.cfg, cfg)
+	if len(changed) == 0 {
+		reloadLog.Info("no changes")
+		r.reportReload(ctx, pb.Event_INFO, "unchanged", "", nil)
+		return
+	}
+
+	if err := r.apply(ctx, cfg); err != nil {
+		reloadLog.Error("apply failed", "err", err)
+		r.reportReload(ctx, pb.Event_WARNING, "failed", err.Error(), changed)
+		return
+	}
+	r.cfg = cfg
+	reloadLog.Info("applied", "changed", strings.Join(changed, ","))
+	r.reportReload(ctx, pb.Event_INFO, "applied", "", changed)
+}
+
+// applyRemote switches to the config document pushed by the collector, or
+// back to the local config when ac has no name. A document that does not
+// load or apply is rejected and the current config stays in effect. Either
+// way the outcome is acknowledged; if applying reconnected to the collector
+// the ack may be lost, but the next heartbeat reports the revision anyway.
+func (r *Runner) applyRemote(ctx context.Context, ac *pb.AgentConfig) {
+	var remote *state.RemoteConfig
+	if ac.GetName() != "" {
+		remote = &state.RemoteConfig{
+			Name:    ac.GetName(),
+			Version: ac.GetVersion(),
+			Format:  ac.GetFormat(),
+			Body:    string(ac.GetBody()),
+		}
+	}
+
+	prev := r.remote
+	r.remote = remote
+	cfg, files, err := r.load()
+	if err == nil {
+		err = r.apply(ctx, cfg)
+	}
+	ack := &pb.ConfigAck{Name: ac.GetName(), Version: ac.GetVersion()}
+	if err != nil {
+		r.remote = prev
+		configLog.Error("managed config rejected", "config", ac.GetName(), "version", ac.GetVersion(), "err", err)
+		ack.Error = err.Error()
+		r.ackConfig(ctx, ack)
+		return
+	}
+
+	r.cfg, r.files = cfg, files
+	if r.watcher != nil {
+		r.watcher.Set(files)
+	}
+	if r.state != nil {
+		if err := r.state.Update(func(s *state.State) { s.Config = remote }); err != nil {
+			configLog.Error("persist managed config failed", "err", err)
+		}
+	}
+	if r.grpc != nil {
+		r.grpc.SetConfigRevision(ac.GetName(), ac.GetVersion())
+	}
+	if remote == nil {
+		configLog.Info("managed config removed, using local config")
+	} else {
+		configLog.Info("applied managed config", "config", remote.Name, "version", remote.Version)
+	}
+	ack.Applied = true
+	r.ackConfig(ctx, ack)
+}
+
+func (r *Runner) ackConfig(ctx context.Context, ack *pb.ConfigAck) {
+	if r.grpc == nil {
+		return
+	}
+	if err := r.grpc.AckConfig(ctx, ack); err != nil && !errors.Is(err, ErrNotRegistered) {
+		configLog.Warn("ack failed", "err", err)
+	}
+}
+
+// apply moves the runner from r.cfg to cfg. Everything that can fail is
+// built before anything is switched, so that a config that does not apply
+// leaves the runner as it was.
+func (r *Runner) apply(ctx context.Context, cfg config.Config) error {
+	changed := config.Diff(r.cfg, cfg)
+
+	var pol *commandPolicy
+	if r.policy.Load() == nil || slices.Contains(changed, "commands") {
+		p, err := newCommandPolicy(cfg.Commands)
+		if err != nil {
+			return err
+		}
+		pol = p
+	}
+	health, err := r.nextHealth(cfg.Health)
+	if err != nil {
+		return err
+	}
+	debug, err := r.nextDebug(cfg.Debug)
+	if err != nil {
+		r.discard(health, nil, nil, nil)
+		return err
+	}
+	outs, err := r.reconcileOutputs(cfg.Outputs)
+	if err != nil {
+		r.discard(health, debug, nil, nil)
+		return err
+	}
+	st := r.state
+	if slices.Contains(changed, "state_dir") {
+		st = openState(cfg.StateDir)
+	}
+	// commands.signing is advertised at registration
+	restart := r.grpc == nil && cfg.HasOutput(config.OutputGRPC) ||
+		r.grpc != nil && !cfg.HasOutput(config.OutputGRPC) ||
+		slices.ContainsFunc(changed, func(k string) bool { return slices.Contains(grpcKeys, k) }) ||
+		len(r.cfg.Commands.Signing.PublicKeys) > 0 != (len(cfg.Commands.Signing.PublicKeys) > 0) ||
+		r.cfg.Commands.Signing.MaxTTL != cfg.Commands.Signing.MaxTTL
+	var (
+		grpc      *GRPCOut
+		takeOver  bool
+		bufferErr error
+	)
+	if restart && cfg.HasOutput(config.OutputGRPC) {
+		if grpc, err = buildGRPC(cfg, st, r.commands); err != nil {
+			r.discard(health, debug, outs.built, nil)
+			return err
+		}
+		if takeOver, err = r.nextBuffer(grpc, cfg.Buffer); err != nil {
+			if r.started {
+				r.discard(health, debug, outs.built, grpc)
+				return err
+			}
+			// better unbuffered than not connected at all
+			metricsLog.Error("buffer open failed, sending unbuffered", "err", err)
+			bufferErr = err
+		}
+	}
+	// last, as it switches the global logger
+	if slices.Contains(changed, "log") {
+		if err := SetupLogging(cfg.Log); err != nil {
+			r.discard(health, debug, outs.built, grpc)
+			return err
+		}
+	}
+
+	if pol != nil {
+		r.policy.Store(pol)
+		// support bundles include the recent log
+		logging.SetRecentRedact(pol.bundle.redactLog)
+	}
+	if health != r.health {
+		if r.health != nil {
+			_ = r.health.Close()
+		}
+		r.health = health
+	}
+	if r.health != nil {
+		r.health.maxSendAge.Store(int64(cfg.Health.MaxSendAge.Duration))
+	}
+	if debug != r.debug {
+		if r.debug != nil {
+			_ = r.debug.Close()
+		}
+		r.debug = debug
+	}
+	for _, e := range outs.stale {
+		_ = e.out.Close()
+	}
+	r.outs = outs.next
+	r.gov.configure(cfg.Budget, cfg.Interval.Duration)
+	r.pool.configure(cfg.Commands)
+
+	if r.alerts == nil || slices.Contains(changed, "alerts") {
+		r.alerts = newAlerter(cfg.Alerts.Rules, r.alerts)
+	}
+	r.state = st
+	if restart {
+		if takeOver {
+			q, _ := r.grpc.close()
+			// the size bound is checked on every append, so a failure
+			// here is retried then
+			_ = q.SetLimits(bufferOptions(cfg.Buffer))
+			grpc.EnableBuffer(q, cfg.Buffer.ReplayBatch)
+		} else {
+			_ = r.grpc.Close()
+		}
+		r.grpc, r.bufferErr = grpc, bufferErr
+		if r.grpc != nil {
+			if r.remote != nil {
+				r.grpc.SetConfigRevision(r.remote.Name, r.remote.Version)
+			}
+			r.grpc.Start(ctx)
+		}
+		r.pool.setOutput(r.grpc)
+	}
+
+	r.setWatch(cfg.Reload)
+	r.effective.Store(&cfg)
+	return nil
+}
+
+// discard closes what apply built for a config it then rejected.
+func (r *Runner) discard(health *healthServer, debug *debugServer, outs []outputEntry, grpc *GRPCOut) {
+	if health != nil && health != r.health {
+		_ = health.Close()
+	}
+	if debug != nil && debug != r.debug {
+		_ = debug.Close()
+	}
+	for _, e := range outs {
+		_ = e.out.Close()
+	}
+	_ = grpc.Close()
+}
+
+// nextHealth returns the health server for hc: the current one if it
+// listens on the same address, else a new one. The current one is left
+// running.
+func (r *Runner) nextHealth(hc config.HealthConfig) (*healthServer, error) {
+	if hc.Listen == "" {
+		return nil, nil
+	}
+	if r.health != nil && r.health.listen == hc.Listen {
+		return r.health, nil
+	}
+	h, err := startHealth(hc)
+	if err != nil {
+		return nil, fmt.Errorf("health: %w", err)
+	}
+	return h, nil
+}
+
+func (r *Runner) nextDebug(dc config.DebugConfig) (*debugServer, error) {
+	if dc.Listen == "" {
+		return nil, nil
+	}
+	if r.debug != nil && r.debug.cfg == dc {
+		return r.debug, nil
+	}
+	d, err := startDebug(dc)
+	if err != nil {
+		return nil, fmt.Errorf("debug: %w", err)
+	}
+	return d, nil
+}
+
+// outputPlan is what reconcileOutputs arrives at: next replaces r.outs,
+// built were opened for it and stale are to be closed once it is in use.
+type outputPlan struct {
+	next, built, stale []outputEntry
+}
+
+// reconcileOutputs keeps outputs whose config is unchanged and builds new
+// ones. Nothing is closed unless building fails, in which case the new
+// ones are.
+func (r *Runner) reconcileOutputs(cfgs []config.OutputConfig) (outputPlan, error) {
+	used := make([]bool, len(r.outs))
+	var plan outputPlan
+	for i, oc := range cfgs {
+		if oc.Type == config.OutputGRPC {
+			continue
+		}
+		reused := false
+		for j, e := range r.outs {
+			if !used[j] && reflect.DeepEqual(e.cfg, oc) {
+				used[j] = true
+				plan.next = append(plan.next, e)
+				reused = true
+				break
+			}
+		}
+		if reused {
+			continue
+		}
+		o, err := newOutput(oc)
+		if err != nil {
+			for _, e := range plan.built {
+				_ = e.out.Close()
+			}
+			return outputPlan{}, fmt.Errorf("outputs[%d]: %w", i, err)
+		}
+		e := outputEntry{cfg: oc, out: o}
+		plan.built = append(plan.built, e)
+		plan.next = append(plan.next, e)
+	}
+
+	for j, e := range r.outs {
+		if !used[j] {
+			plan.stale = append(plan.stale, e)
+		}
+	}
+	return plan, nil
+}
+
+func openState(dir string) *state.Store {
+	if dir == "" {
+		return nil
+	}
+	st, err := state.Open(filepath.Join(dir, "state.json"))
+	if err != nil {
+		stateLog.Error("load failed, identity will not persist", "err", err)
+		return nil
+	}
+	return st
+}
+
+// setWatch starts, stops or reconfigures watching the config files. A
+// watch that cannot be set up is logged; reloads still work on SIGHUP.
+func (r *Runner) setWatch(rc config.ReloadConfig) {
+	if !rc.Watch || r.path == "" {
+		if r.watcher != nil {
+			_ = r.watcher.Close()
+			r.watcher = nil
+		}
+		return
+	}
+	if r.watcher != nil && r.watcher.debounce == rc.Debounce.Duration {
+		return
+	}
+	if r.watcher != nil {
+		_ = r.watcher.Close()
+	}
+	w, err := newConfigWatcher(r.files, rc.Debounce.Duration)
+	if err != nil {
+		r.watcher = nil
+		reloadLog.Warn("file watch disabled", "err", err)
+		return
+	}
+	r.watcher = w
+}
+
+func (r *Runner) reportReload(ctx context.Context, sev pb.Event_Severity, result, msg string, changed []string) {
+	if r.grpc == nil {
+		return
+	}
+	ev := &pb.Event{
+		Type:     "config.reload",
+		Severity: sev,
+		Message:  msg,
+		Attributes: map[string]string{
+			"result": result,
+			"config": r.path,
+		},
+	}
+	if len(changed) > 0 {
+		ev.Attributes["changed"] = strings.Join(changed, ",")
+	}
+	if r.bufferErr != nil {
+		ev.Attributes["buffer"] = "disabled: " + r.bufferErr.Error()
+	}
+	g := r.grpc
+	err := g.ReportEvent(ctx, ev)
+	if errors.Is(err, ErrNotRegistered) {
+		// a reload that reconnected to the collector reports once the new
+		// connection registered
+		go func() {
+			select {
+			case <-g.Registered():
+			case <-g.done:
+				return
+			}
+			if err := g.ReportEvent(ctx, ev); err != nil {
+				reloadLog.Warn("report failed", "err", err)
+			}
+		}()
+		return
+	}
+	if err != nil {
+		reloadLog.Warn("report failed", "err", err)
+	}
+}
+
+// reportAlert logs an alert change and sends it to the collector right
+// away rather than leaving detection to the server side.
+func (r *Runner) reportAlert(ctx context.Context, ch alertChange) {
+	ev := ch.event()
+	if ch.firing {
+		alertLog.Warn(ev.Message, "rule", ch.rule.Name, "severity", ev.Severity.String())
+	} else {
+		alertLog.Info(ev.Message, "rule", ch.rule.Name)
+	}
+	if r.grpc == nil {
+		return
+	}
+	if err := r.grpc.ReportEvent(ctx, ev); err != nil && !errors.Is(err, ErrNotRegistered) {
+		alertLog.Warn("report failed", "rule", ch.rule.Name, "err", err)
+	}
+}
+
+// throttled logs and reports a change of the governor's level.
+func (r *Runner) throttled(ctx context.Context) {
+	step := throttleSteps[r.gov.level]
+	args := []any{
+		"level", r.gov.level,
+		"reason", r.gov.reason,
+		"interval", r.gov.interval().String(),
+		"disabled", strings.Join(step.off, ","),
+		"cpu_pct", round2(r.gov.cpuPct),
+		"mem_bytes", r.gov.mem,
+	}
+	if r.gov.level > 0 {
+		budgetLog.Warn("over resource budget, throttling", args...)
+	} else {
+		budgetLog.Info("back within resource budget", args...)
+	}
+
+	if r.grpc == nil {
+		return
+	}
+	ev := &pb.Event{
+		Type:     "agent.budget",
+		Severity: pb.Event_INFO,
+		Message:  "back within resource budget",
+		Attributes: map[string]string{
+			"level":     strconv.Itoa(r.gov.level),
+			"interval":  r.gov.interval().String(),
+			"disabled":  strings.Join(step.off, ","),
+			"cpu_pct":   strconv.FormatFloat(r.gov.cpuPct, 'f', 2, 64),
+			"mem_bytes": strconv.FormatUint(r.gov.mem, 10),
+		},
+	}
+	if r.gov.level > 0 {
+		ev.Severity = pb.Event_WARNING
+		ev.Message = "over resource budget, throttling"
+		ev.Attributes["reason"] = r.gov.reason
+	}
+	if err := r.grpc.ReportEvent(ctx, ev); err != nil && !errors.Is(err, ErrNotRegistered) {
+		budgetLog.Warn("report failed", "err", err)
+	}
+}
+
+func (r *Runner) Close() {
+	if r.watcher != nil {
+		_ = r.watcher.Close()
+	}
+	if r.health != nil {
+		_ = r.health.Close()
+	}
+	if r.debug != nil {
+		_ = r.debug.Close()
+	}
+	for _, e := range r.outs {
+		_ = e.out.Close()
+	}
+	// commands report their results through the gRPC output
+	r.pool.close()
+	if r.grpc != nil {
+		_ = r.grpc.Close()
+	}
+}
+
+// buildGRPC sets up the collector client for cfg without starting it.
+func buildGRPC(cfg config.Config, st *state.Store, cmds *commandRegistry) (*GRPCOut, error) {
+	g, err := NewGRPCOut(GRPCOptions{
+		Collector: cfg.Collector,
+		Batch:     cfg.Batch,
+		State:     st,
+		Labels:    cfg.Labels,
+		Commands:  cmds,
+		Signing:   cfg.Commands.Signing,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("collector: %w", err)
+	}
+	return g, nil
+}
+
+// nextBuffer enables the buffer bc configures on g. A buffer in the
+// directory the current client uses is not opened twice: takeOver reports
+// that g is to take it over once the current client is closed.
+func (r *Runner) nextBuffer(g *GRPCOut, bc config.BufferConfig) (takeOver bool, err error) {
+	if bc.Dir == "" {
+		return false, nil
+	}
+	if r.grpc != nil && r.grpc.buf != nil && r.cfg.Buffer.Dir == bc.Dir {
+		return true, nil
+	}
+	q, err := spool.Open(bufferOptions(bc))
+	if err != nil {
+		return false, fmt.Errorf("buffer: %w", err)
+	}
+	g.EnableBuffer(q, bc.ReplayBatch)
+	return false, nil
+}
+
+func bufferOptions(bc config.BufferConfig) spool.Options {
+	return spool.Options{
+		Dir:          bc.Dir,
+		MaxBytes:     bc.MaxBytes,
+		MaxAge:       bc.MaxAge.Duration,
+		SegmentBytes: bc.SegmentBytes,
+	}
+}
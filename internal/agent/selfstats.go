@@ -0,0 +1,208 @@
+package agent
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// self tracks the agent's own health. It is fed by the collection loop and
+// the outputs, reported as agent.* metrics and served on /healthz and
+// /readyz.
+var self = newSelfStats()
+
+type selfStats struct {
+	mu sync.Mutex
+
+	started  time.Time
+	interval time.Duration
+	lastTick time.Time
+	collect  map[string]time.Duration
+
+	grpc       bool
+	registered bool
+
+	sendLatency  time.Duration
+	sendErrors   uint64
+	lastSend     time.Time
+	outputErrors uint64
+	dropped      uint64
+
+	budget       bool
+	budgetLevel  int
+	budgetReason string
+	cpuPercent   float64
+	memBytes     uint64
+}
+
+func newSelfStats() *selfStats {
+	return &selfStats{started: time.Now(), collect: make(map[string]time.Duration)}
+}
+
+func (s *selfStats) observeCollect(name string, d time.Duration) {
+	s.mu.Lock()
+	s.collect[name] = d
+	s.mu.Unlock()
+}
+
+// skipCollect forgets the duration of a collector that was switched off.
+func (s *selfStats) skipCollect(name string) {
+	s.mu.Lock()
+	delete(s.collect, name)
+	s.mu.Unlock()
+}
+
+// observeBudget records the governor's last measurement and level.
+func (s *selfStats) observeBudget(g *governor) {
+	s.mu.Lock()
+	s.budget = g.enabled()
+	s.budgetLevel, s.budgetReason = g.level, g.reason
+	s.cpuPercent, s.memBytes = g.cpuPct, g.mem
+	s.mu.Unlock()
+}
+
+// throttle returns the current degradation level and its reason.
+func (s *selfStats) throttle() (int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.budgetLevel, s.budgetReason
+}
+
+// observeTick records a completed loop iteration and the collector link
+// state at that point.
+func (s *selfStats) observeTick(at time.Time, interval time.Duration, grpc, registered bool) {
+	s.mu.Lock()
+	s.lastTick, s.interval = at, interval
+	s.grpc, s.registered = grpc, registered
+	s.mu.Unlock()
+}
+
+func (s *selfStats) observeSend(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.sendErrors++
+		return
+	}
+	s.sendLatency = d
+	s.lastSend = time.Now()
+}
+
+func (s *selfStats) outputError() {
+	s.mu.Lock()
+	s.outputErrors++
+	s.mu.Unlock()
+}
+
+// drop counts samples that were given up on without being buffered.
+func (s *selfStats) drop(n int) {
+	s.mu.Lock()
+	s.dropped += uint64(n)
+	s.mu.Unlock()
+}
+
+func (s *selfStats) points(now time.Time) []MetricPoint {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var pause time.Duration
+	if ms.NumGC > 0 {
+		pause = time.Duration(ms.PauseNs[(ms.NumGC+255)%256])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]MetricPoint, 0, len(s.collect)+10)
+	for _, name := range []string{"cpu", "mem", "disk", "procs", "k8s"} {
+		if d, ok := s.collect[name]; ok {
+			out = append(out, MetricPoint{Name: "agent.collect." + name + ".duration_ms", Value: ms64(d), Unit: "ms"})
+		}
+	}
+	out = append(out,
+		MetricPoint{Name: "agent.goroutines", Value: float64(runtime.NumGoroutine()), Unit: "count"},
+		MetricPoint{Name: "agent.rss_bytes", Value: float64(rssBytes(&ms)), Unit: "bytes"},
+		MetricPoint{Name: "agent.gc.pause_ms", Value: ms64(pause), Unit: "ms"},
+		MetricPoint{Name: "agent.output.errors", Value: float64(s.outputErrors), Unit: "count"},
+		MetricPoint{Name: "agent.samples.dropped", Value: float64(s.dropped), Unit: "count"},
+	)
+	if s.budget {
+		out = append(out,
+			MetricPoint{Name: "agent.budget.level", Value: float64(s.budgetLevel), Unit: "count"},
+			MetricPoint{Name: "agent.budget.cpu_percent", Value: s.cpuPercent, Unit: "%"},
+			MetricPoint{Name: "agent.budget.mem_bytes", Value: float64(s.memBytes), Unit: "bytes"},
+		)
+	}
+	if s.grpc {
+		out = append(out,
+			MetricPoint{Name: "agent.send.latency_ms", Value: ms64(s.sendLatency), Unit: "ms"},
+			MetricPoint{Name: "agent.send.errors", Value: float64(s.sendErrors), Unit: "count"},
+		)
+		if !s.lastSend.IsZero() {
+			out = append(out, MetricPoint{Name: "agent.send.last_success_age", Value: now.Sub(s.lastSend).Seconds(), Unit: "s"})
+		}
+	}
+	return out
+}
+
+// alive reports whether the collection loop is still turning. It is given
+// three intervals, and at least 10s, before it is considered stuck.
+func (s *selfStats) alive(now time.Time) (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.lastTick
+	if last.IsZero() {
+		last = s.started
+	}
+	limit := max(3*s.interval, 10*time.Second)
+	if age := now.Sub(last); age > limit {
+		return false, "no collection for " + age.Round(time.Second).String()
+	}
+	return true, ""
+}
+
+// ready additionally requires, when the gRPC output is used, a registered
+// agent that delivered metrics within maxSendAge.
+func (s *selfStats) ready(now time.Time, maxSendAge time.Duration) (bool, string) {
+	if ok, why := s.alive(now); !ok {
+		return false, why
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.grpc {
+		return true, ""
+	}
+	if !s.registered {
+		return false, "not registered with collector"
+	}
+	if s.lastSend.IsZero() {
+		return false, "no metrics delivered yet"
+	}
+	if age := now.Sub(s.lastSend); maxSendAge > 0 && age > maxSendAge {
+		return false, "last successful send " + age.Round(time.Second).String() + " ago"
+	}
+	return true, ""
+}
+
+func ms64(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// rssBytes reads the resident set size from /proc, falling back to the
+// memory the Go runtime obtained from the OS.
+func rssBytes(ms *runtime.MemStats) uint64 {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err == nil {
+		if f := bytes.Fields(b); len(f) > 1 {
+			if pages, err := strconv.ParseUint(string(f[1]), 10, 64); err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	return ms.Sys
+}
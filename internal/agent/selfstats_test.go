@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSelfStats_Readiness(t *testing.T) {
+	s := newSelfStats()
+	now := s.started.Add(time.Second)
+
+	if ok, _ := s.alive(now); !ok {
+		t.Fatal("not alive right after start")
+	}
+	if ok, _ := s.alive(s.started.Add(11 * time.Second)); ok {
+		t.Fatal("alive although the loop never ran")
+	}
+
+	s.observeTick(now, time.Second, true, false)
+	if ok, why := s.ready(now, time.Minute); ok || why != "not registered with collector" {
+		t.Fatalf("ready = %t, %q", ok, why)
+	}
+
+	s.observeTick(now, time.Second, true, true)
+	s.observeSend(time.Millisecond, errors.New("unavailable"))
+	if ok, _ := s.ready(now, time.Minute); ok {
+		t.Fatal("ready without a successful send")
+	}
+
+	s.observeSend(time.Millisecond, nil)
+	if ok, why := s.ready(time.Now(), time.Minute); !ok {
+		t.Fatalf("not ready after a send: %s", why)
+	}
+	if ok, _ := s.ready(time.Now().Add(2*time.Minute), time.Hour); ok {
+		t.Fatal("ready although the loop stalled")
+	}
+}
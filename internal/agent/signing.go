@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"go-agent/internal/cmdsign"
+	"go-agent/internal/config"
+	"go-agent/internal/state"
+	pb "go-agent/proto/agentv1"
+)
+
+// signingSkew is how far the collector's clock may be off from ours when
+// checking a command's expiry.
+const signingSkew = time.Minute
+
+var errReplayed = errors.New("command id was already used")
+
+// signingPolicy is the compiled commands.signing config. Without keys
+// commands need no signature.
+type signingPolicy struct {
+	keys   []ed25519.PublicKey
+	maxTTL time.Duration
+}
+
+func newSigningPolicy(c config.SigningConfig) (*signingPolicy, error) {
+	p := &signingPolicy{maxTTL: c.MaxTTL.Duration}
+	for i, s := range c.PublicKeys {
+		k, err := cmdsign.ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("commands.signing.public_keys[%d]: %w", i, err)
+		}
+		p.keys = append(p.keys, k)
+	}
+	return p, nil
+}
+
+// verify checks that cmd was signed for agentID by a trusted key and that
+// it is neither expired nor expiring further out than max_ttl.
+func (p *signingPolicy) verify(agentID string, cmd *pb.Command, now time.Time) error {
+	if cmd.GetExpires() == nil {
+		return errors.New("command has no expiry")
+	}
+	exp := cmd.GetExpires().AsTime()
+	if err := cmdsign.Verify(p.keys, cmd.GetSignature(), agentID, cmd.GetCommandId(), cmd.GetName(), cmd.GetArgsJson(), exp.Unix()); err != nil {
+		return err
+	}
+	if now.After(exp.Add(signingSkew)) {
+		return fmt.Errorf("command expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if exp.Sub(now) > p.maxTTL+signingSkew {
+		return fmt.Errorf("command expires at %s, beyond commands.signing.max_ttl (%s)", exp.UTC().Format(time.RFC3339), p.maxTTL)
+	}
+	return nil
+}
+
+// admit checks cmd against commands.signing before it is queued. A command
+// that fails is reported as BAD_SIGNATURE, audited and never run.
+func (r *Runner) admit(ctx context.Context, cmd *pb.Command) bool {
+	sp := r.policy.Load().signing
+	// a redelivered command is ignored by the pool
+	if len(sp.keys) == 0 || r.pool.queued(cmd.GetCommandId()) {
+		return true
+	}
+	now := time.Now()
+	err := sp.verify(r.grpc.AgentID(), cmd, now)
+	if err == nil {
+		err = r.markSeen(cmd.GetCommandId(), cmd.GetExpires().AsTime().Add(signingSkew), now)
+	}
+	if err == nil {
+		return true
+	}
+
+	commandLog.Warn("command refused", "command_id", cmd.GetCommandId(), "name", cmd.GetName(), "err", err)
+	r.pool.reportEvent(ctx, &pb.Event{
+		Type:     "audit.signature",
+		Severity: pb.Event_WARNING,
+		Message:  fmt.Sprintf("%s refused: %v", cmd.GetName(), err),
+		Attributes: map[string]string{
+			"command_id": cmd.GetCommandId(),
+			"name":       cmd.GetName(),
+			"args":       cmd.GetArgsJson(),
+		},
+	})
+	r.pool.reject(cmd, CommandOutcome{Status: pb.CommandResult_BAD_SIGNATURE, Error: err.Error()})
+	return false
+}
+
+// markSeen records that the command with the given id is accepted, or
+// fails if it was before. Ids are kept until expires, in the state file
+// when there is one; a command cannot be replayed past its expiry anyway.
+func (r *Runner) markSeen(id string, expires, now time.Time) error {
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+		if r.state != nil {
+			maps.Copy(r.seen, r.state.Get().SeenCommands)
+		}
+	}
+	if _, ok := r.seen[id]; ok {
+		return errReplayed
+	}
+	maps.DeleteFunc(r.seen, func(_ string, exp time.Time) bool { return exp.Before(now) })
+	r.seen[id] = expires
+	if r.state != nil {
+		seen := maps.Clone(r.seen)
+		if err := r.state.Update(func(s *state.State) { s.SeenCommands = seen }); err != nil {
+			// the id is still remembered until the agent restarts
+			stateLog.Warn("seen command ids not saved", "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-agent/internal/cmdsign"
+	"go-agent/internal/config"
+	"go-agent/internal/state"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAdmitSigned(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	cfg := config.Default()
+	cfg.Commands.Signing.PublicKeys = []string{cmdsign.EncodePublicKey(pub)}
+	cfg.Commands.Signing.MaxTTL = config.Duration{Duration: time.Hour}
+	pol, err := newCommandPolicy(cfg.Commands)
+	must(t, err)
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	st, err := state.Open(statePath)
+	must(t, err)
+	results := newResultLog()
+	r := &Runner{pool: newCommandPool(newCommandRegistry()), grpc: &GRPCOut{}, state: st}
+	r.grpc.id.Store("a1")
+	r.pool.setOutput(results)
+	r.pool.configure(cfg.Commands)
+	defer r.pool.close()
+	r.policy.Store(pol)
+
+	sign := func(id, agent string, exp time.Time) *pb.Command {
+		cmd := &pb.Command{CommandId: id, Name: "ping", ArgsJson: "{}", Expires: timestamppb.New(exp.Truncate(time.Second))}
+		cmd.Signature = cmdsign.Sign(priv, agent, id, cmd.Name, cmd.ArgsJson, cmd.Expires.AsTime().Unix())
+		return cmd
+	}
+	now := time.Now()
+	ok := sign("c1", "a1", now.Add(10*time.Minute))
+	if !r.admit(context.Background(), ok) {
+		t.Fatal("valid command refused")
+	}
+
+	tampered := sign("c2", "a1", now.Add(10*time.Minute))
+	tampered.ArgsJson = `{"x":1}`
+	unsigned := &pb.Command{CommandId: "c3", Name: "ping", Expires: timestamppb.New(now.Add(time.Minute))}
+	for name, cmd := range map[string]*pb.Command{
+		"replayed":        ok,
+		"tampered":        tampered,
+		"unsigned":        unsigned,
+		"other agent":     sign("c4", "a2", now.Add(10*time.Minute)),
+		"expired":         sign("c5", "a1", now.Add(-10*time.Minute)),
+		"beyond max_ttl":  sign("c6", "a1", now.Add(2*time.Hour)),
+		"no expiry given": {CommandId: "c7", Name: "ping", Signature: ok.Signature},
+	} {
+		if r.admit(context.Background(), cmd) {
+			t.Errorf("%s command admitted", name)
+			continue
+		}
+		if res := results.next(t); res.Status != pb.CommandResult_BAD_SIGNATURE || res.CommandId != cmd.CommandId {
+			t.Errorf("%s: %+v", name, res)
+		}
+	}
+
+	// a restarted agent still refuses the replay
+	st, err = state.Open(statePath)
+	must(t, err)
+	r.state, r.seen = st, nil
+	if r.admit(context.Background(), ok) {
+		t.Error("replay admitted after restart")
+	}
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	pb "go-agent/proto/agentv1"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc. Linux exports
+// it as 100 on every architecture.
+const clockTicks = 100
+
+const (
+	defaultSnapshotTop    = 10
+	maxSnapshotTop        = 100
+	defaultSnapshotWindow = time.Second
+	maxSnapshotWindow     = 10 * time.Second
+)
+
+// Snapshot is the output of the snapshot command: a one-off reading of
+// every collector, including the ones too costly to run each interval.
+type Snapshot struct {
+	Time time.Time       `json:"time"`
+	Host string          `json:"host"`
+	Env  string          `json:"env"`
+	K8s  *KubernetesMeta `json:"k8s,omitempty"`
+
+	Metrics map[string]float64 `json:"metrics"`
+
+	// CPUWindow is the span over which CPU shares were measured.
+	CPUWindow string         `json:"cpu_window"`
+	TopCPU    []ProcessUsage `json:"top_cpu,omitempty"`
+	TopMemory []ProcessUsage `json:"top_memory,omitempty"`
+	Sockets   *SocketStats   `json:"sockets,omitempty"`
+
+	// Errors maps the parts that could not be read to the reason.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type ProcessUsage struct {
+	ProcessInfo
+	CPUPercent float64 `json:"cpu_percent"`
+}
+
+var snapshotSpec = CommandSpec{
+	Name: "snapshot",
+	Doc:  "collect every metric now, with the top processes and socket tables, and return them as JSON",
+	Args: []ArgSpec{
+		{Name: "top", Type: ArgInt, Doc: fmt.Sprintf("processes listed by CPU and by memory (default %d, at most %d)", defaultSnapshotTop, maxSnapshotTop)},
+		{Name: "cpu_window", Type: ArgDuration, Doc: fmt.Sprintf("span over which CPU usage is measured (default %s, at most %s)", defaultSnapshotWindow, maxSnapshotWindow)},
+	},
+}
+
+// snapshotCommand runs on a freshly detected environment so that its CPU
+// window does not disturb the deltas of the collection loop. Kubernetes
+// metadata still comes from the runner's environment, which caches it.
+func (r *Runner) snapshotCommand(ctx context.Context, args Args, p *Progress) CommandOutcome {
+	top, window := int64(defaultSnapshotTop), defaultSnapshotWindow
+	if args.Has("top") {
+		top = args.Int("top")
+	}
+	if args.Has("cpu_window") {
+		window = args.Duration("cpu_window")
+	}
+	if top < 1 || top > maxSnapshotTop {
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: fmt.Sprintf("top: must be between 1 and %d", maxSnapshotTop)}
+	}
+	if window <= 0 || window > maxSnapshotWindow {
+		return CommandOutcome{Status: pb.CommandResult_INVALID_ARGS, Error: fmt.Sprintf("cpu_window: must be positive and at most %s", maxSnapshotWindow)}
+	}
+
+	s, err := takeSnapshot(ctx, DetectEnv(), int(top), window)
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	if kp, ok := r.env.(K8sMetaProvider); ok {
+		if meta, err := kp.K8sMeta(ctx); err != nil {
+			s.Errors["k8s"] = err.Error()
+		} else if meta.Valid {
+			s.K8s = &meta
+		}
+	}
+	out, err := json.Marshal(s)
+	if err != nil {
+		return CommandOutcome{Status: pb.CommandResult_ERROR, Error: err.Error()}
+	}
+	commandLog.Info("snapshot taken", "bytes", len(out), "processes", len(s.TopCPU), "window", window)
+	return CommandOutcome{Status: pb.CommandResult_OK, Output: string(out)}
+}
+
+// takeSnapshot reads env twice, window apart, so that CPU usage of the
+// whole environment and of every process covers the same span.
+func takeSnapshot(ctx context.Context, env RuntimeEnv, top int, window time.Duration) (Snapshot, error) {
+	s := Snapshot{
+		Env:       env.Kind(),
+		CPUWindow: window.String(),
+		Errors:    map[string]string{},
+	}
+	s.Host, _ = os.Hostname()
+
+	pl, _ := env.(ProcessLister)
+	var before []ProcessInfo
+	if pl != nil {
+		var err error
+		if before, err = pl.Processes(); err != nil {
+			s.Errors["processes"] = err.Error()
+			pl = nil
+		}
+	}
+	_, _ = env.CPU(ctx) // the first reading only sets the baseline
+
+	t := time.NewTimer(window)
+	select {
+	case <-ctx.Done():
+		t.Stop()
+		return Snapshot{}, ctx.Err()
+	case <-t.C:
+	}
+
+	c := collect(ctx, env, collectOptions{aside: true})
+	s.Time = c.TS
+	s.Metrics = make(map[string]float64)
+	for _, p := range ToMetricPoints(c) {
+		s.Metrics[p.Name] = p.Value
+	}
+
+	if pl != nil {
+		after, err := pl.Processes()
+		if err != nil {
+			s.Errors["processes"] = err.Error()
+		} else {
+			s.TopCPU, s.TopMemory = topProcesses(before, after, window, top)
+		}
+	}
+	if sr, ok := env.(SocketReader); ok {
+		if st, err := sr.Sockets(); err != nil {
+			s.Errors["sockets"] = err.Error()
+		} else {
+			s.Sockets = &st
+		}
+	}
+	return s, nil
+}
+
+// topProcesses ranks the processes in after by CPU used since before and by
+// resident memory, keeping n of each.
+func topProcesses(before, after []ProcessInfo, window time.Duration, n int) (byCPU, byMem []ProcessUsage) {
+	prev := make(map[int]uint64, len(before))
+	for _, p := range before {
+		prev[p.PID] = p.CPUTicks
+	}
+	all := make([]ProcessUsage, 0, len(after))
+	for _, p := range after {
+		u := ProcessUsage{ProcessInfo: p}
+		// a process started during the window has no baseline
+		if t, ok := prev[p.PID]; ok && p.CPUTicks >= t {
+			u.CPUPercent = round2(float64(p.CPUTicks-t) / clockTicks / window.Seconds() * 100)
+		}
+		all = append(all, u)
+	}
+
+	pick := func(less func(a, b ProcessUsage) bool) []ProcessUsage {
+		sort.SliceStable(all, func(i, j int) bool { return less(all[i], all[j]) })
+		return append([]ProcessUsage(nil), all[:min(n, len(all))]...)
+	}
+	byCPU = pick(func(a, b ProcessUsage) bool {
+		if a.CPUPercent != b.CPUPercent {
+			return a.CPUPercent > b.CPUPercent
+		}
+		return a.RSSBytes > b.RSSBytes
+	})
+	byMem = pick(func(a, b ProcessUsage) bool { return a.RSSBytes > b.RSSBytes })
+	return byCPU, byMem
+}
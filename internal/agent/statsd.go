@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-agent/internal/config"
+)
+
+// StatsDOut sends every metric as a StatsD gauge over UDP. With DogStatsD
+// enabled the sample tags are appended using the "|#key:value" extension.
+type StatsDOut struct {
+	udp       *udpWriter
+	prefix    string
+	dogstatsd bool
+	tags      map[string]string
+}
+
+func NewStatsDOut(oc config.OutputConfig) (*StatsDOut, error) {
+	w, err := newUDPWriter(oc.Addr, oc.MaxPacketSize)
+	if err != nil {
+		return nil, fmt.Errorf("dial statsd: %w", err)
+	}
+	return &StatsDOut{
+		udp:       w,
+		prefix:    oc.Prefix,
+		dogstatsd: oc.DogStatsD,
+		tags:      oc.Tags,
+	}, nil
+}
+
+func (o *StatsDOut) Name() string { return "statsd" }
+
+func (o *StatsDOut) Write(ctx context.Context, c Collected) error {
+	var tags map[string]string
+	if o.dogstatsd {
+		tags = sampleTags(c, o.tags)
+	}
+	payload := AppendStatsDGauges(nil, o.prefix, tags, ToMetricPoints(c))
+	if len(payload) == 0 {
+		return nil
+	}
+	return o.udp.Write(payload)
+}
+
+func (o *StatsDOut) Close() error {
+	return o.udp.Close()
+}
+
+// AppendStatsDGauges encodes points as "name:value|g" lines. Tags are only
+// emitted when non-empty (DogStatsD). A leading sign on a gauge value means
+// "adjust by" in StatsD, so negative values are preceded by a reset to zero.
+func AppendStatsDGauges(buf []byte, prefix string, tags map[string]string, points []MetricPoint) []byte {
+	var tagSuffix []byte
+	if len(tags) > 0 {
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			if k != "" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			if i == 0 {
+				tagSuffix = append(tagSuffix, "|#"...)
+			} else {
+				tagSuffix = append(tagSuffix, ',')
+			}
+			tagSuffix = append(tagSuffix, statsdTagKeyEscaper.Replace(k)...)
+			if v := tags[k]; v != "" {
+				tagSuffix = append(tagSuffix, ':')
+				tagSuffix = append(tagSuffix, statsdTagEscaper.Replace(v)...)
+			}
+		}
+	}
+
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		name := statsdNameEscaper.Replace(prefix + p.Name)
+		if p.Value < 0 {
+			buf = appendStatsDLine(buf, name, 0, tagSuffix)
+		}
+		buf = appendStatsDLine(buf, name, p.Value, tagSuffix)
+	}
+	return buf
+}
+
+func appendStatsDLine(buf []byte, name string, v float64, tagSuffix []byte) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, ':')
+	buf = strconv.AppendFloat(buf, v, 'f', -1, 64)
+	buf = append(buf, "|g"...)
+	buf = append(buf, tagSuffix...)
+	return append(buf, '\n')
+}
+
+var (
+	// ':' '|' '@' delimit the metric name from value, type and sample rate
+	statsdNameEscaper = strings.NewReplacer(
+		":", "_",
+		"|", "_",
+		"@", "_",
+		"#", "_",
+		" ", "_",
+		"\n", "_",
+	)
+	// DogStatsD tags are separated by ',' and the tag block ends at '|'
+	statsdTagEscaper = strings.NewReplacer(
+		",", "_",
+		"|", "_",
+		" ", "_",
+		"\n", "_",
+	)
+	// a ':' in the key would be read as the key/value separator
+	statsdTagKeyEscaper = strings.NewReplacer(
+		":", "_",
+		",", "_",
+		"|", "_",
+		" ", "_",
+		"\n", "_",
+	)
+)
@@ -0,0 +1,52 @@
+package agent
+
+import "testing"
+
+func TestAppendStatsDGauges(t *testing.T) {
+	cases := []struct {
+		name   string
+		prefix string
+		tags   map[string]string
+		points []MetricPoint
+		want   string
+	}{
+		{
+			name:   "plain gauges",
+			prefix: "agent.",
+			points: []MetricPoint{{Name: "cpu.usage", Value: 12.5}, {Name: "proc.count", Value: 300}},
+			want:   "agent.cpu.usage:12.5|g\nagent.proc.count:300|g\n",
+		},
+		{
+			name:   "dogstatsd tags sorted",
+			tags:   map[string]string{"pod": "web-1", "host": "node-1", "standalone": ""},
+			points: []MetricPoint{{Name: "cpu.usage", Value: 1}},
+			want:   "cpu.usage:1|g|#host:node-1,pod:web-1,standalone\n",
+		},
+		{
+			name:   "reserved characters in names and tags",
+			tags:   map[string]string{"a:b": "c,d|e f"},
+			points: []MetricPoint{{Name: "disk:used|pct@x#y z", Value: 1}},
+			want:   "disk_used_pct_x_y_z:1|g|#a_b:c_d_e_f\n",
+		},
+		{
+			name:   "tag values may contain colons",
+			tags:   map[string]string{"addr": "10.0.0.1:80"},
+			points: []MetricPoint{{Name: "cpu.usage", Value: 1}},
+			want:   "cpu.usage:1|g|#addr:10.0.0.1:80\n",
+		},
+		{
+			name:   "negative gauge is reset first",
+			points: []MetricPoint{{Name: "temp", Value: -3}},
+			want:   "temp:0|g\ntemp:-3|g\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(AppendStatsDGauges(nil, tc.prefix, tc.tags, tc.points))
+			if got != tc.want {
+				t.Errorf("got  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -5,17 +5,17 @@ import (
 )
 
 type KubernetesMeta struct {
-	Namespace string
-	PodName   string
-	PodUID    string
-	PodIP     string
+	Namespace string `json:"namespace"`
+	PodName   string `json:"pod_name"`
+	PodUID    string `json:"pod_uid,omitempty"`
+	PodIP     string `json:"pod_ip,omitempty"`
 
-	NodeName string
-	NodeUID  string
+	NodeName string `json:"node_name,omitempty"`
+	NodeUID  string `json:"node_uid,omitempty"`
 
-	NodeLabels map[string]string
+	NodeLabels map[string]string `json:"node_labels,omitempty"`
 
-	Valid bool
+	Valid bool `json:"-"`
 }
 
 type K8sMetaProvider interface {
@@ -33,6 +33,11 @@ type MemStats struct {
 	LimitBytes  uint64
 	UsedPercent float64
 
+	// OOMKills counts processes killed for lack of memory since boot, or
+	// since the container started.
+	OOMKills      uint64
+	OOMKillsValid bool
+
 	Valid bool
 }
 
@@ -46,10 +51,18 @@ type DiskStats struct {
 
 type ProcStats struct {
 	Count int
+	// Running counts the processes of every watched name.
+	Running map[string]int
 
 	Valid bool
 }
 
+// ProcessCounter counts running processes by name, as shown in
+// /proc/<pid>/comm (at most 15 characters).
+type ProcessCounter interface {
+	CountProcesses(names []string) (map[string]int, error)
+}
+
 type RuntimeEnv interface {
 	Kind() string
 	CPU(ctx context.Context) (CPUStats, error)
@@ -57,3 +70,38 @@ type RuntimeEnv interface {
 	Disk(ctx context.Context) (DiskStats, error)
 	Procs(ctx context.Context) (ProcStats, error)
 }
+
+// ProcessInfo describes one process. CPUTicks is the user plus system time
+// in clock ticks, so a CPU share needs two readings.
+type ProcessInfo struct {
+	PID      int    `json:"pid"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Threads  int    `json:"threads"`
+	RSSBytes uint64 `json:"rss_bytes"`
+	Cmdline  string `json:"cmdline,omitempty"`
+	CPUTicks uint64 `json:"-"`
+}
+
+// ProcessLister reads every running process.
+type ProcessLister interface {
+	Processes() ([]ProcessInfo, error)
+}
+
+type Listener struct {
+	Proto string `json:"proto"`
+	Addr  string `json:"addr"`
+	Port  int    `json:"port"`
+}
+
+// SocketStats summarises the socket tables of the agent's network
+// namespace.
+type SocketStats struct {
+	TCP       map[string]int `json:"tcp"` // by state, e.g. "ESTABLISHED"
+	UDP       int            `json:"udp"`
+	Listeners []Listener     `json:"listeners"`
+}
+
+type SocketReader interface {
+	Sockets() (SocketStats, error)
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configWatcher signals on C when one of the loaded config files changes.
+// It watches the parent directories rather than the files so that editors
+// replacing a file and Kubernetes swapping the ConfigMap "..data" symlink
+// are both seen.
+type configWatcher struct {
+	C chan struct{}
+
+	w        *fsnotify.Watcher
+	debounce time.Duration
+
+	mu    sync.Mutex
+	dirs  map[string]bool
+	names map[string]bool
+	timer *time.Timer
+	done  chan struct{}
+}
+
+func newConfigWatcher(files []string, debounce time.Duration) (*configWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	cw := &configWatcher{
+		C:        make(chan struct{}, 1),
+		w:        w,
+		debounce: debounce,
+		dirs:     make(map[string]bool),
+		names:    make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+	cw.Set(files)
+	go cw.loop()
+	return cw, nil
+}
+
+// Set replaces the watched file set, e.g. after includes changed.
+func (cw *configWatcher) Set(files []string) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	dirs := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, f := range files {
+		dirs[filepath.Dir(f)] = true
+		names[filepath.Clean(f)] = true
+	}
+	for d := range cw.dirs {
+		if !dirs[d] {
+			_ = cw.w.Remove(d)
+		}
+	}
+	for d := range dirs {
+		if cw.dirs[d] {
+			continue
+		}
+		if err := cw.w.Add(d); err != nil {
+			reloadLog.Warn("watch failed", "dir", d, "err", err)
+			delete(dirs, d)
+		}
+	}
+	cw.dirs, cw.names = dirs, names
+}
+
+func (cw *configWatcher) Close() error {
+	close(cw.done)
+	cw.mu.Lock()
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	cw.mu.Unlock()
+	return cw.w.Close()
+}
+
+func (cw *configWatcher) loop() {
+	for {
+		select {
+		case <-cw.done:
+			return
+		case ev, ok := <-cw.w.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod || !cw.relevant(ev.Name) {
+				continue
+			}
+			cw.schedule()
+		case err, ok := <-cw.w.Errors:
+			if !ok {
+				return
+			}
+			reloadLog.Warn("watch error", "err", err)
+		}
+	}
+}
+
+// relevant matches the loaded files, other config files in the same
+// directories (a glob include may pick them up) and ConfigMap swaps.
+func (cw *configWatcher) relevant(name string) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.names[filepath.Clean(name)] {
+		return true
+	}
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, "..") {
+		return true
+	}
+	switch filepath.Ext(base) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func (cw *configWatcher) schedule() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.timer != nil {
+		cw.timer.Stop()
+	}
+	cw.timer = time.AfterFunc(cw.debounce, func() {
+		select {
+		case cw.C <- struct{}{}:
+		default:
+		}
+	})
+}
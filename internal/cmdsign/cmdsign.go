@@ -0,0 +1,118 @@
+// Package cmdsign signs commands with an operator's ed25519 key and
+// verifies them on the agent, so that only someone holding the key can
+// have an agent run a command, whoever delivers it.
+package cmdsign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// prefix starts every signed message so a signature made for
+// anything else cannot pass as a command's.
+const prefix = "go-agent command v1\x00"
+
+// Message returns the bytes signed for a command: its target agent, id,
+// name, arguments and expiry in Unix seconds. Every string is length
+// prefixed so fields cannot run into each other.
+func Message(agentID, commandID, name, argsJSON string, expires int64) []byte {
+	b := []byte(prefix)
+	for _, f := range []string{agentID, commandID, name, argsJSON} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(f)))
+		b = append(b, f...)
+	}
+	return binary.BigEndian.AppendUint64(b, uint64(expires))
+}
+
+// Sign signs a command with key.
+func Sign(key ed25519.PrivateKey, agentID, commandID, name, argsJSON string, expires int64) []byte {
+	return ed25519.Sign(key, Message(agentID, commandID, name, argsJSON, expires))
+}
+
+var ErrBadSignature = errors.New("signature does not match any trusted key")
+
+// Verify checks sig against each of keys.
+func Verify(keys []ed25519.PublicKey, sig []byte, agentID, commandID, name, argsJSON string, expires int64) error {
+	if len(sig) == 0 {
+		return errors.New("command is not signed")
+	}
+	msg := Message(agentID, commandID, name, argsJSON, expires)
+	for _, k := range keys {
+		if ed25519.Verify(k, msg, sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// GenerateKey returns a new key pair with the private key PEM encoded as
+// PKCS#8, the same format `openssl genpkey -algorithm ed25519` writes.
+func GenerateKey() (ed25519.PublicKey, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// LoadPrivateKey reads a PKCS#8 PEM ed25519 private key.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	ek, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	return ek, nil
+}
+
+// EncodePublicKey returns the form agents are configured with: the 32 raw
+// key bytes in standard base64.
+func EncodePublicKey(k ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(k)
+}
+
+// ParsePublicKey accepts what EncodePublicKey returns or a PEM "PUBLIC
+// KEY" block, as `openssl pkey -pubout` writes.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	if blk, _ := pem.Decode([]byte(s)); blk != nil {
+		k, err := x509.ParsePKIXPublicKey(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ek, ok := k.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 key")
+		}
+		return ek, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes; want %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
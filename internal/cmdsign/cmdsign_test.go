@@ -0,0 +1,52 @@
+package cmdsign
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	pub, pemKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pemKey, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	priv, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePublicKey(EncodePublicKey(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := GenerateKey()
+	keys := []ed25519.PublicKey{other, parsed}
+
+	sig := Sign(priv, "a1", "c1", "exec", `{"argv":["ls"]}`, 1700000000)
+	if err := Verify(keys, sig, "a1", "c1", "exec", `{"argv":["ls"]}`, 1700000000); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ agent, id, name, args string }{
+		{"a2", "c1", "exec", `{"argv":["ls"]}`},
+		{"a1", "c2", "exec", `{"argv":["ls"]}`},
+		{"a1", "c1", "file.read", `{"argv":["ls"]}`},
+		{"a1", "c1", "exec", `{"argv":["rm"]}`},
+		// moving bytes between fields changes the message
+		{"a1c", "1", "exec", `{"argv":["ls"]}`},
+	} {
+		if err := Verify(keys, sig, tc.agent, tc.id, tc.name, tc.args, 1700000000); err == nil {
+			t.Errorf("%+v verified", tc)
+		}
+	}
+	if err := Verify(keys, sig, "a1", "c1", "exec", `{"argv":["ls"]}`, 1700000001); err == nil {
+		t.Error("changed expiry verified")
+	}
+	if err := Verify(keys, nil, "a1", "c1", "exec", `{"argv":["ls"]}`, 1700000000); err == nil {
+		t.Error("unsigned command verified")
+	}
+}
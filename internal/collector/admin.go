@@ -0,0 +1,420 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-agent/internal/config"
+	"go-agent/internal/logging"
+	"go-agent/internal/tlsutil"
+)
+
+// adminServer is the HTTP API operators use to manage the collector.
+//
+//	GET    /v1/agents                   connected agents and their config revisions
+//	GET    /v1/agents/{id}/commands     commands an agent supports, with arguments
+//	GET    /v1/agents/{id}/results      an agent's latest command results, newest first
+//	GET    /v1/agents/{id}/artifacts    files an agent uploaded, newest first
+//	GET    /v1/agents/{id}/artifacts/{command_id}
+//	                                    download the file a command uploaded
+//	DELETE /v1/agents/{id}/artifacts/{command_id}
+//	                                    remove it
+//	POST   /v1/commands                 queue a command (EnqueueRequest) for one agent
+//	                                    (agent_id), agents by label (selector), all,
+//	                                    or as signed by the operator (signed)
+//	GET    /v1/commands                 queued and finished commands, newest first;
+//	                                    ?agent_id=, batch_id=, name=, state=, limit= filter
+//	GET    /v1/commands/{id}            one command with its result
+//	GET    /v1/audit                    latest audited agent actions; ?agent_id= filters
+//	GET    /v1/configs                  latest version of every config document
+//	GET    /v1/configs/{name}           all versions of one document
+//	PUT    /v1/configs/{name}           store a new version (ConfigDoc as JSON)
+//	DELETE /v1/configs/{name}           remove a document
+//	GET    /v1/log-levels               the collector's log levels per component
+//	PUT    /v1/log-levels               change one: {"component", "level"}
+//
+// With enrollment enabled:
+//
+//	GET    /v1/tokens                   bootstrap tokens (without secrets)
+//	POST   /v1/tokens                   mint a token: {"ttl", "max_uses", "labels"}
+//	DELETE /v1/tokens/{id}              delete a token
+//	GET    /v1/enrollments              enrolled agents
+//	DELETE /v1/enrollments/{agent_id}   revoke an agent
+//
+// Every route requires the bearer token from AdminTokenFile or a client
+// certificate verified against AdminClientCAFile. Without either the API
+// may only listen on a loopback address.
+type adminServer struct {
+	h         *Handler
+	configs   *ConfigStore
+	enroll    *EnrollStore
+	audit     *AuditLog
+	artifacts *ArtifactStore
+	token     []byte
+	certs     bool
+	srv       *http.Server
+	lis       net.Listener
+}
+
+func newAdminServer(cfg Config, h *Handler, configs *ConfigStore, enroll *EnrollStore, audit *AuditLog, artifacts *ArtifactStore) (*adminServer, error) {
+	a := &adminServer{h: h, configs: configs, enroll: enroll, audit: audit, artifacts: artifacts}
+	if cfg.AdminTokenFile != "" {
+		b, err := os.ReadFile(cfg.AdminTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("admin token: %w", err)
+		}
+		if a.token = bytes.TrimSpace(b); len(a.token) == 0 {
+			return nil, fmt.Errorf("admin token: %s is empty", cfg.AdminTokenFile)
+		}
+	}
+	var tc *tls.Config
+	if cfg.AdminTLSCertFile != "" || cfg.AdminTLSKeyFile != "" || cfg.AdminClientCAFile != "" {
+		r, err := tlsutil.NewReloader(tlsutil.Files{
+			CertFile: cfg.AdminTLSCertFile,
+			KeyFile:  cfg.AdminTLSKeyFile,
+			CAFile:   cfg.AdminClientCAFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+		auth := tlsutil.ClientAuthNone
+		if cfg.AdminClientCAFile != "" {
+			// optional so that operators may also use the token
+			auth, a.certs = tlsutil.ClientAuthOptional, true
+		}
+		if tc, err = tlsutil.ServerConfig(r, auth); err != nil {
+			return nil, err
+		}
+	}
+
+	lis, err := net.Listen("tcp", cfg.AdminAddr)
+	if err != nil {
+		return nil, err
+	}
+	if a.token == nil && !a.certs {
+		// "localhost" is whatever the resolver says, so check what was bound
+		if ip := lis.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+			_ = lis.Close()
+			return nil, fmt.Errorf("%s is not a loopback address; set an admin token or client ca", lis.Addr())
+		}
+		adminLog.Warn("admin API has no authentication; any local user may use it", "addr", lis.Addr().String())
+	}
+	if tc != nil {
+		lis = tls.NewListener(lis, tc)
+	}
+	a.lis = lis
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/agents", a.listAgents)
+	mux.HandleFunc("GET /v1/agents/{agent_id}/commands", a.agentCommands)
+	mux.HandleFunc("GET /v1/agents/{agent_id}/results", a.agentResults)
+	mux.HandleFunc("GET /v1/agents/{agent_id}/artifacts", a.listArtifacts)
+	mux.HandleFunc("GET /v1/agents/{agent_id}/artifacts/{command_id}", a.getArtifact)
+	mux.HandleFunc("DELETE /v1/agents/{agent_id}/artifacts/{command_id}", a.deleteArtifact)
+	mux.HandleFunc("POST /v1/commands", a.enqueueCommand)
+	mux.HandleFunc("GET /v1/commands", a.listCommands)
+	mux.HandleFunc("GET /v1/commands/{id}", a.getCommand)
+	mux.HandleFunc("GET /v1/audit", a.listAudit)
+	mux.HandleFunc("GET /v1/configs", a.listConfigs)
+	mux.HandleFunc("GET /v1/configs/{name}", a.getConfig)
+	mux.HandleFunc("PUT /v1/configs/{name}", a.putConfig)
+	mux.HandleFunc("DELETE /v1/configs/{name}", a.deleteConfig)
+	mux.HandleFunc("GET /v1/log-levels", a.getLogLevels)
+	mux.HandleFunc("PUT /v1/log-levels", a.setLogLevel)
+	if enroll != nil {
+		mux.HandleFunc("GET /v1/tokens", a.listTokens)
+		mux.HandleFunc("POST /v1/tokens", a.mintToken)
+		mux.HandleFunc("DELETE /v1/tokens/{id}", a.deleteToken)
+		mux.HandleFunc("GET /v1/enrollments", a.listEnrollments)
+		mux.HandleFunc("DELETE /v1/enrollments/{agent_id}", a.revokeAgent)
+	}
+	a.srv = &http.Server{Handler: a.authorize(mux), ReadHeaderTimeout: 10 * time.Second}
+	return a, nil
+}
+
+// authorize passes requests carrying the admin token or a verified client
+// certificate, and every request when neither is configured.
+func (a *adminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token == nil && !a.certs {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the TLS config has already verified any certificate presented
+		if a.certs && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && a.token != nil &&
+			subtle.ConstantTimeCompare([]byte(tok), a.token) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="collector"`)
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid credentials"))
+	})
+}
+
+func (a *adminServer) Serve() error {
+	if err := a.srv.Serve(a.lis); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (a *adminServer) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = a.srv.Shutdown(ctx)
+}
+
+func (a *adminServer) listAgents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.h.Agents())
+}
+
+func (a *adminServer) agentCommands(w http.ResponseWriter, r *http.Request) {
+	cmds, ok := a.h.AgentCommands(r.PathValue("agent_id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("unknown agent"))
+		return
+	}
+	writeJSON(w, http.StatusOK, cmds)
+}
+
+func (a *adminServer) agentResults(w http.ResponseWriter, r *http.Request) {
+	res, ok := a.h.AgentResults(r.PathValue("agent_id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("unknown agent"))
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *adminServer) listArtifacts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.artifacts.List(r.PathValue("agent_id")))
+}
+
+func (a *adminServer) getArtifact(w http.ResponseWriter, r *http.Request) {
+	art, f, err := a.artifacts.Open(r.PathValue("agent_id"), r.PathValue("command_id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": art.Name}))
+	w.Header().Set("X-Content-SHA256", art.SHA256)
+	http.ServeContent(w, r, art.Name, art.Created, f)
+}
+
+func (a *adminServer) deleteArtifact(w http.ResponseWriter, r *http.Request) {
+	if err := a.artifacts.Delete(r.PathValue("agent_id"), r.PathValue("command_id")); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) enqueueCommand(w http.ResponseWriter, r *http.Request) {
+	var req EnqueueRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	b, err := a.h.Enqueue(req)
+	switch {
+	case errors.Is(err, ErrUnknownAgent):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrCommandExists):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeJSON(w, http.StatusAccepted, b)
+	}
+}
+
+func (a *adminServer) listCommands(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := CommandFilter{
+		AgentID: q.Get("agent_id"),
+		BatchID: q.Get("batch_id"),
+		Name:    q.Get("name"),
+		State:   q.Get("state"),
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a non-negative integer"))
+			return
+		}
+		f.Limit = n
+	}
+	writeJSON(w, http.StatusOK, a.h.queue.List(f))
+}
+
+func (a *adminServer) getCommand(w http.ResponseWriter, r *http.Request) {
+	c, err := a.h.queue.Get(r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (a *adminServer) listAudit(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.audit.Recent(r.URL.Query().Get("agent_id")))
+}
+
+func (a *adminServer) listConfigs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.configs.Latest())
+}
+
+func (a *adminServer) getConfig(w http.ResponseWriter, r *http.Request) {
+	hist, err := a.configs.History(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, hist)
+}
+
+func (a *adminServer) putConfig(w http.ResponseWriter, r *http.Request) {
+	var d ConfigDoc
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&d); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.Name = r.PathValue("name")
+
+	d, err := a.configs.Put(d)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	configLog.Info("stored", "config", d.Name, "version", d.Version)
+	writeJSON(w, http.StatusOK, d)
+}
+
+func (a *adminServer) deleteConfig(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := a.configs.Delete(name); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	configLog.Info("deleted", "config", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) listTokens(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.enroll.Tokens())
+}
+
+func (a *adminServer) mintToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		TTL     config.Duration   `json:"ttl"`
+		MaxUses int               `json:"max_uses"`
+		Labels  map[string]string `json:"labels"`
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t, token, err := a.enroll.Mint(req.TTL.Duration, req.MaxUses, req.Labels)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	enrollLog.Info("minted token", "token", t.ID, "expires", t.ExpiresAt.Format(time.RFC3339), "max_uses", t.MaxUses)
+	writeJSON(w, http.StatusOK, struct {
+		BootstrapToken
+		Token string `json:"token"`
+	}{t, token})
+}
+
+func (a *adminServer) deleteToken(w http.ResponseWriter, r *http.Request) {
+	if err := a.enroll.DeleteToken(r.PathValue("id")); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) listEnrollments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.enroll.Enrollments())
+}
+
+func (a *adminServer) revokeAgent(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("agent_id")
+	if err := a.enroll.Revoke(id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	a.h.Forget(id)
+	enrollLog.Info("revoked", "agent_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) getLogLevels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logging.Levels())
+}
+
+// setLogLevel changes the collector's own log level; an empty component
+// changes the default.
+func (a *adminServer) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Component string `json:"component"`
+		Level     string `json:"level"`
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := logging.SetLevel(req.Component, req.Level); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	adminLog.Info("log level changed", "component", req.Component, "level", req.Level)
+	writeJSON(w, http.StatusOK, logging.Levels())
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrNoConfig) || errors.Is(err, ErrNoToken) || errors.Is(err, ErrNotEnrolled) || errors.Is(err, ErrNoArtifact) || errors.Is(err, ErrNoCommand) {
+		status = http.StatusNotFound
+	}
+	writeError(w, status, err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,89 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "go-agent/proto/agentv1"
+)
+
+func TestAdminAuth(t *testing.T) {
+	h := &Handler{agents: map[string]*AgentState{}, queue: newCommandQueue()}
+	if _, err := newAdminServer(Config{AdminAddr: "0.0.0.0:0"}, h, nil, nil, nil, nil); err == nil || !strings.Contains(err.Error(), "not a loopback address") {
+		t.Fatalf("unauthenticated admin API on all interfaces: %v", err)
+	}
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAdminServer(Config{AdminAddr: "0.0.0.0:0", AdminTokenFile: tokenFile}, h, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.lis.Close()
+
+	for _, tc := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer nope", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/v1/agents", nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		a.srv.Handler.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("authorization %q: status %d; want %d", tc.auth, w.Code, tc.want)
+		}
+	}
+}
+
+// a document without the grpc output would leave the agent unable to
+// receive the next one
+func TestConfigKeepsCollectorOutput(t *testing.T) {
+	configs, err := OpenConfigStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{agents: map[string]*AgentState{"a": {Hostname: "web1"}}, queue: newCommandQueue(), configs: configs}
+	a, err := newAdminServer(Config{AdminAddr: "127.0.0.1:0"}, h, configs, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.lis.Close()
+
+	put := func(body string) int {
+		req := httptest.NewRequest("PUT", "/v1/configs/fleet", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		a.srv.Handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := put(`{"body": "{\"outputs\": [{\"type\": \"statsd\", \"addr\": \"127.0.0.1:8125\"}]}"}`); code != http.StatusBadRequest {
+		t.Fatalf("document without the grpc output: status %d", code)
+	}
+	res, err := h.SendHeartbeat(context.Background(), &pb.Heartbeat{AgentId: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.GetConfig().GetName() != "" {
+		t.Fatalf("pushed %v", res.GetConfig())
+	}
+
+	if code := put(`{"body": "{\"outputs\": [{\"type\": \"grpc\"}, {\"type\": \"statsd\", \"addr\": \"127.0.0.1:8125\"}]}"}`); code != http.StatusOK {
+		t.Fatalf("document with the grpc output: status %d", code)
+	}
+	if res, err = h.SendHeartbeat(context.Background(), &pb.Heartbeat{AgentId: "a"}); err != nil || res.GetConfig().GetName() != "fleet" {
+		t.Fatalf("pushed %v, %v", res.GetConfig(), err)
+	}
+}
@@ -2,7 +2,10 @@ package collector
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+
+	"go-agent/internal/logging"
 )
 
 type App struct {
@@ -14,21 +17,71 @@ func New(cfg Config) *App {
 }
 
 func (a *App) Run(ctx context.Context) error {
-	log.Printf("collector starting, listen=%s", a.cfg.ListenAddr)
+	if err := logging.Setup(logging.Options{
+		Format:   a.cfg.LogFormat,
+		Level:    a.cfg.LogLevel,
+		Levels:   a.cfg.LogLevels,
+		Timezone: a.cfg.Timezone,
+	}); err != nil {
+		return err
+	}
+	slog.Info("collector starting", "listen", a.cfg.ListenAddr)
+
+	configs, err := OpenConfigStore(a.cfg.ConfigStorePath)
+	if err != nil {
+		return err
+	}
+	var enroll *EnrollStore
+	switch a.cfg.Enrollment {
+	case "", "off":
+	case "required":
+		enroll, err = OpenEnrollStore(a.cfg.EnrollStorePath)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown enrollment mode %q", a.cfg.Enrollment)
+	}
+	audit, err := OpenAuditLog(a.cfg.AuditLogPath)
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+	artifacts, err := OpenArtifactStore(a.cfg.ArtifactDir)
+	if err != nil {
+		return err
+	}
+	h := NewHandler(configs, enroll, audit, artifacts)
 
-	srv, err := newGRPCServer(a.cfg)
+	srv, err := newGRPCServer(a.cfg, h)
 	if err != nil {
 		return err
 	}
 
-	errCh := make(chan error, 1)
+	errCh := make(chan error, 2)
 	go func() {
 		errCh <- srv.Serve()
 	}()
 
+	var admin *adminServer
+	if a.cfg.AdminAddr != "" {
+		admin, err = newAdminServer(a.cfg, h, configs, enroll, audit, artifacts)
+		if err != nil {
+			srv.GracefulStop()
+			return fmt.Errorf("admin listen %s: %w", a.cfg.AdminAddr, err)
+		}
+		adminLog.Info("listening", "addr", a.cfg.AdminAddr)
+		go func() {
+			errCh <- admin.Serve()
+		}()
+	}
+
 	select {
 	case <-ctx.Done():
-		log.Printf("collector shutting down (context cancelled)")
+		slog.Info("collector shutting down")
+		if admin != nil {
+			admin.Shutdown()
+		}
 		srv.GracefulStop()
 		return nil
 	case err := <-errCh:
@@ -0,0 +1,222 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxArtifactBytes caps one artifact an agent uploads.
+	maxArtifactBytes = 256 << 20
+	// keepArtifacts is how many artifacts are kept in memory when no
+	// directory is configured.
+	keepArtifacts = 20
+)
+
+var ErrNoArtifact = errors.New("no such artifact")
+
+// Artifact is a file an agent uploaded as a command's output, such as a
+// support bundle.
+type Artifact struct {
+	AgentID   string    `json:"agent_id"`
+	CommandID string    `json:"command_id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Created   time.Time `json:"created"`
+}
+
+// ArtifactStore keeps uploaded artifacts. With a directory every artifact
+// is a file at <dir>/<agent_id>/<command_id>/<name> and survives restarts;
+// without one only the latest are kept, in memory.
+type ArtifactStore struct {
+	dir string
+
+	mu   sync.Mutex
+	list []Artifact // oldest first
+	data map[string][]byte
+}
+
+func OpenArtifactStore(dir string) (*ArtifactStore, error) {
+	s := &ArtifactStore{dir: dir, data: make(map[string][]byte)}
+	if dir == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("artifact dir: %w", err)
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 || filepath.Ext(parts[2]) == ".tmp" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := fileSHA256(p)
+		if err != nil {
+			return err
+		}
+		s.list = append(s.list, Artifact{
+			AgentID:   parts[0],
+			CommandID: parts[1],
+			Name:      parts[2],
+			Size:      info.Size(),
+			SHA256:    sum,
+			Created:   info.ModTime().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read artifact dir: %w", err)
+	}
+	sort.Slice(s.list, func(i, j int) bool { return s.list[i].Created.Before(s.list[j].Created) })
+	return s, nil
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Put stores data as the artifact of a command, replacing an earlier
+// upload for the same command.
+func (s *ArtifactStore) Put(agentID, commandID, name string, data []byte) (Artifact, error) {
+	if !validArtifactName(agentID) || !validArtifactName(commandID) || !validArtifactName(name) {
+		return Artifact{}, fmt.Errorf("invalid artifact name %q", filepath.Join(agentID, commandID, name))
+	}
+	sum := sha256.Sum256(data)
+	a := Artifact{
+		AgentID:   agentID,
+		CommandID: commandID,
+		Name:      name,
+		Size:      int64(len(data)),
+		SHA256:    hex.EncodeToString(sum[:]),
+		Created:   time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dir != "" {
+		d := filepath.Join(s.dir, agentID, commandID)
+		if err := os.RemoveAll(d); err != nil {
+			return Artifact{}, err
+		}
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			return Artifact{}, err
+		}
+		tmp := filepath.Join(d, name+".tmp")
+		if err := os.WriteFile(tmp, data, 0o600); err != nil {
+			return Artifact{}, err
+		}
+		if err := os.Rename(tmp, filepath.Join(d, name)); err != nil {
+			return Artifact{}, err
+		}
+	}
+	s.removeLocked(agentID, commandID)
+	s.list = append(s.list, a)
+	if s.dir == "" {
+		s.data[agentID+"/"+commandID] = data
+		if len(s.list) > keepArtifacts {
+			old := s.list[0]
+			s.removeLocked(old.AgentID, old.CommandID)
+		}
+	}
+	return a, nil
+}
+
+// validArtifactName accepts what can safely be one path element.
+func validArtifactName(s string) bool {
+	return s != "" && s != "." && s != ".." && filepath.Base(s) == s && len(s) <= 255
+}
+
+func (s *ArtifactStore) removeLocked(agentID, commandID string) {
+	for i, a := range s.list {
+		if a.AgentID == agentID && a.CommandID == commandID {
+			s.list = append(s.list[:i], s.list[i+1:]...)
+			break
+		}
+	}
+	delete(s.data, agentID+"/"+commandID)
+}
+
+// List returns the artifacts, newest first, optionally only those of one
+// agent.
+func (s *ArtifactStore) List(agentID string) []Artifact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Artifact{}
+	for i := len(s.list) - 1; i >= 0; i-- {
+		if agentID == "" || s.list[i].AgentID == agentID {
+			out = append(out, s.list[i])
+		}
+	}
+	return out
+}
+
+// Open returns an artifact's metadata and content; the caller closes it.
+func (s *ArtifactStore) Open(agentID, commandID string) (Artifact, io.ReadSeekCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.list {
+		if a.AgentID != agentID || a.CommandID != commandID {
+			continue
+		}
+		if s.dir == "" {
+			return a, nopCloser{bytes.NewReader(s.data[agentID+"/"+commandID])}, nil
+		}
+		f, err := os.Open(filepath.Join(s.dir, agentID, commandID, a.Name))
+		if err != nil {
+			return Artifact{}, nil, err
+		}
+		return a, f, nil
+	}
+	return Artifact{}, nil, ErrNoArtifact
+}
+
+type nopCloser struct{ io.ReadSeeker }
+
+func (nopCloser) Close() error { return nil }
+
+// Delete removes an artifact.
+func (s *ArtifactStore) Delete(agentID, commandID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.list {
+		if a.AgentID != agentID || a.CommandID != commandID {
+			continue
+		}
+		if s.dir != "" && validArtifactName(agentID) && validArtifactName(commandID) {
+			if err := os.RemoveAll(filepath.Join(s.dir, agentID, commandID)); err != nil {
+				return err
+			}
+		}
+		s.removeLocked(agentID, commandID)
+		return nil
+	}
+	return ErrNoArtifact
+}
@@ -0,0 +1,104 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pb "go-agent/proto/agentv1"
+)
+
+// auditPrefix marks the event types agents send for actions that must be
+// audited, such as running a program.
+const auditPrefix = "audit."
+
+// keepAudit is how many audit records are kept in memory.
+const keepAudit = 1000
+
+// AuditRecord is an action an agent took on an operator's behalf.
+type AuditRecord struct {
+	Time       time.Time         `json:"time"`
+	AgentID    string            `json:"agent_id"`
+	Hostname   string            `json:"hostname,omitempty"`
+	Action     string            `json:"action"`
+	Severity   string            `json:"severity"`
+	Message    string            `json:"message"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// AuditLog keeps the latest records in memory. If path is set every record
+// is also appended there, one JSON object per line.
+type AuditLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	recent []AuditRecord // oldest first
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{}
+	if path == "" {
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	l.f = f
+	return l, nil
+}
+
+func auditRecord(ev *pb.Event, hostname string) AuditRecord {
+	return AuditRecord{
+		Time:       ev.GetTime().AsTime().UTC(),
+		AgentID:    ev.GetAgentId(),
+		Hostname:   hostname,
+		Action:     strings.TrimPrefix(ev.GetType(), auditPrefix),
+		Severity:   ev.GetSeverity().String(),
+		Message:    ev.GetMessage(),
+		Attributes: ev.GetAttributes(),
+	}
+}
+
+func (l *AuditLog) Record(r AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent = append(l.recent, r)
+	if n := len(l.recent); n > keepAudit {
+		l.recent = append([]AuditRecord(nil), l.recent[n-keepAudit:]...)
+	}
+	if l.f == nil {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+// Recent returns the records kept in memory, newest first, optionally only
+// those of one agent.
+func (l *AuditLog) Recent(agentID string) []AuditRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []AuditRecord{}
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		if agentID == "" || l.recent[i].AgentID == agentID {
+			out = append(out, l.recent[i])
+		}
+	}
+	return out
+}
+
+func (l *AuditLog) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
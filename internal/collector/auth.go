@@ -0,0 +1,78 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go-agent/internal/tlsutil"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// peerIdentity returns the identity of the verified client certificate on
+// ctx's connection, or "" if there is none.
+func peerIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+	// the server's VerifyConnection rejects unverified certificates, so
+	// the leaf can be trusted here
+	return tlsutil.Identity(info.State.PeerCertificates[0])
+}
+
+type agentScoped interface {
+	GetAgentId() string
+}
+
+// bearerToken returns the credential from "authorization: Bearer ..."
+// metadata.
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md.Get("authorization") {
+		if tok, ok := strings.CutPrefix(v, "Bearer "); ok {
+			return tok
+		}
+	}
+	return ""
+}
+
+// authorize checks that calls for an agent_id carry that agent's credential
+// (when enrollment is on) and come from the client certificate it
+// registered with (when mutual TLS is used). Register does its own checks
+// since it is where both are established.
+func (h *Handler) authorize(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if r, ok := req.(agentScoped); ok && info.FullMethod != pb.CollectorService_Register_FullMethodName {
+		if h.enroll != nil {
+			_, err := h.enroll.Authenticate(r.GetAgentId(), bearerToken(ctx))
+			if errors.Is(err, ErrAgentRevoked) {
+				return nil, status.Error(codes.PermissionDenied, err.Error())
+			}
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+		}
+
+		h.mu.Lock()
+		st, known := h.agents[r.GetAgentId()]
+		denied := known && st.Identity != "" && st.Identity != peerIdentity(ctx)
+		h.mu.Unlock()
+		if denied {
+			return nil, status.Error(codes.PermissionDenied, "client certificate does not match agent_id")
+		}
+	}
+	return handler(ctx, req)
+}
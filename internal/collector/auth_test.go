@@ -0,0 +1,85 @@
+package collector
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorize(t *testing.T) {
+	enroll, err := OpenEnrollStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := enroll.Mint(time.Hour, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := map[string]string{}
+	for _, id := range []string{"a", "revoked"} {
+		if _, creds[id], err = enroll.Enroll(token, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enroll.Revoke("revoked"); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{
+		agents: map[string]*AgentState{
+			"a":       {Identity: "spiffe://a"},
+			"revoked": {},
+		},
+		enroll: enroll,
+	}
+
+	withCred := func(ctx context.Context, cred string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+cred))
+	}
+	withCert := func(ctx context.Context, cn string) context.Context {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		return peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}}})
+	}
+	bg := context.Background()
+
+	for _, tc := range []struct {
+		name   string
+		ctx    context.Context
+		method string
+		agent  string
+		want   codes.Code
+	}{
+		{"credential and certificate", withCert(withCred(bg, creds["a"]), "spiffe://a"), "", "a", codes.OK},
+		{"no credential", withCert(bg, "spiffe://a"), "", "a", codes.Unauthenticated},
+		{"another agent's credential", withCert(withCred(bg, creds["revoked"]), "spiffe://a"), "", "a", codes.Unauthenticated},
+		{"wrong credential", withCert(withCred(bg, "nope"), "spiffe://a"), "", "a", codes.Unauthenticated},
+		{"revoked", withCred(bg, creds["revoked"]), "", "revoked", codes.PermissionDenied},
+		{"no certificate", withCred(bg, creds["a"]), "", "a", codes.PermissionDenied},
+		{"another certificate", withCert(withCred(bg, creds["a"]), "spiffe://b"), "", "a", codes.PermissionDenied},
+		{"register checks on its own", bg, pb.CollectorService_Register_FullMethodName, "a", codes.OK},
+	} {
+		method := tc.method
+		if method == "" {
+			method = pb.CollectorService_SendHeartbeat_FullMethodName
+		}
+		called := false
+		_, err := h.authorize(tc.ctx, &pb.Heartbeat{AgentId: tc.agent}, &grpc.UnaryServerInfo{FullMethod: method},
+			func(ctx context.Context, req any) (any, error) {
+				called = true
+				return nil, nil
+			})
+		if got := status.Code(err); got != tc.want || called != (tc.want == codes.OK) {
+			t.Errorf("%s: code %s, handler called %v; want %s", tc.name, got, called, tc.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package collector
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "go-agent/proto/agentv1"
+)
+
+// CommandSpec is the admin view of a command an agent supports.
+type CommandSpec struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Args        []ArgSpec `json:"args,omitempty"`
+}
+
+type ArgSpec struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Required    bool     `json:"required,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+}
+
+func commandSpecs(in []*pb.CommandSpec) []CommandSpec {
+	out := make([]CommandSpec, 0, len(in))
+	for _, c := range in {
+		cs := CommandSpec{Name: c.GetName(), Description: c.GetDescription()}
+		for _, a := range c.GetArgs() {
+			cs.Args = append(cs.Args, ArgSpec{
+				Name:        a.GetName(),
+				Type:        a.GetType(),
+				Required:    a.GetRequired(),
+				Description: a.GetDescription(),
+				Enum:        a.GetEnum(),
+			})
+		}
+		out = append(out, cs)
+	}
+	return out
+}
+
+// AgentCommands returns the commands an agent advertised, and whether the
+// agent is known.
+func (h *Handler) AgentCommands(agentID string) ([]CommandSpec, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.agents[agentID]
+	if !ok {
+		return nil, false
+	}
+	return st.Commands, true
+}
+
+const (
+	// maxResultBytes caps the reassembled output of one command.
+	maxResultBytes = 16 << 20
+	// keepResults is how many finished results are kept per agent.
+	keepResults = 20
+	// partialTTL drops a streamed result that went silent. Agents send an
+	// update at least every 30s while a command runs.
+	partialTTL = 2 * time.Minute
+	// logOutputBytes is the largest output written to the log verbatim.
+	logOutputBytes = 1024
+)
+
+// CommandResult is a command's result as reported by the agent. While the
+// command runs the status is RUNNING and output holds what it printed so
+// far.
+type CommandResult struct {
+	CommandID string `json:"command_id"`
+	Status    string `json:"status"`
+	Progress  uint32 `json:"progress,omitempty"`
+	Output    string `json:"output,omitempty"`
+	// Artifact is the file the command uploaded, stored for download.
+	Artifact *Artifact `json:"artifact,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+
+	// data is the artifact's content until it is stored.
+	data []byte
+}
+
+// partialResult collects the chunks of a result still being streamed.
+type partialResult struct {
+	next     uint32
+	buf      strings.Builder
+	artifact string
+	data     bytes.Buffer
+	progress uint32
+	updated  time.Time
+}
+
+// addChunk appends res to the result it belongs to and returns the result
+// once its last chunk is in. A repeated chunk, as sent when a call is
+// retried, is ignored. Called with h.mu held.
+func (h *Handler) addChunk(res *pb.CommandResult, now time.Time) (*CommandResult, error) {
+	key := res.GetAgentId() + "/" + res.GetCommandId()
+	p := h.partials[key]
+	switch {
+	case p == nil && res.GetChunk() != 0:
+		return nil, status.Errorf(codes.FailedPrecondition, "chunk %d without the chunks before it", res.GetChunk())
+	case p != nil && res.GetChunk() < p.next:
+		return nil, nil
+	case p != nil && res.GetChunk() > p.next:
+		delete(h.partials, key)
+		return nil, status.Errorf(codes.FailedPrecondition, "chunk %d out of order, expected %d", res.GetChunk(), p.next)
+	}
+
+	if p == nil {
+		p = &partialResult{}
+		if res.GetMore() {
+			h.partials[key] = p
+		}
+	}
+	if p.buf.Len()+len(res.GetOutput()) > maxResultBytes {
+		delete(h.partials, key)
+		return nil, status.Errorf(codes.ResourceExhausted, "output exceeds %d bytes", maxResultBytes)
+	}
+	if p.data.Len()+len(res.GetData()) > maxArtifactBytes {
+		delete(h.partials, key)
+		return nil, status.Errorf(codes.ResourceExhausted, "artifact exceeds %d bytes", maxArtifactBytes)
+	}
+	p.buf.WriteString(res.GetOutput())
+	p.data.Write(res.GetData())
+	if res.GetArtifact() != "" {
+		p.artifact = res.GetArtifact()
+	}
+	p.next++
+	p.progress = res.GetProgress()
+	p.updated = now
+	if res.GetMore() {
+		return nil, nil
+	}
+	delete(h.partials, key)
+	r := &CommandResult{
+		CommandID: res.GetCommandId(),
+		Status:    res.GetStatus().String(),
+		Output:    p.buf.String(),
+		Error:     res.GetError(),
+		Time:      now,
+	}
+	if p.artifact != "" {
+		r.Artifact = &Artifact{AgentID: res.GetAgentId(), CommandID: res.GetCommandId(), Name: p.artifact}
+		r.data = p.data.Bytes()
+	}
+	return r, nil
+}
+
+// AgentResults returns the commands an agent is running followed by its
+// most recent results, newest first, and whether the agent is known.
+func (h *Handler) AgentResults(agentID string) ([]CommandResult, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st, ok := h.agents[agentID]
+	if !ok {
+		return nil, false
+	}
+	var out []CommandResult
+	for key, p := range h.partials {
+		id, ok := strings.CutPrefix(key, agentID+"/")
+		if !ok {
+			continue
+		}
+		out = append(out, CommandResult{
+			CommandID: id,
+			Status:    pb.CommandResult_RUNNING.String(),
+			Progress:  p.progress,
+			Output:    p.buf.String(),
+			Time:      p.updated,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Time.After(out[j].Time) })
+	for i := len(st.Results) - 1; i >= 0; i-- {
+		out = append(out, st.Results[i])
+	}
+	return out, true
+}
@@ -2,10 +2,59 @@ package collector
 
 type Config struct {
 	ListenAddr string
+	// AdminAddr serves the HTTP admin API; empty disables it.
+	AdminAddr string
+	// AdminTokenFile holds the bearer token admin requests must carry.
+	AdminTokenFile string
+	// AdminTLSCertFile and AdminTLSKeyFile serve the admin API over TLS;
+	// AdminClientCAFile also accepts client certificates it verifies in
+	// place of the token.
+	AdminTLSCertFile  string
+	AdminTLSKeyFile   string
+	AdminClientCAFile string
+	// ConfigStorePath persists managed agent configs; empty keeps them in
+	// memory only.
+	ConfigStorePath string
+
+	// TLSCertFile and TLSKeyFile enable TLS on the gRPC listener.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile verifies agent certificates when TLSClientAuth is
+	// "optional" or "require".
+	TLSClientCAFile string
+	TLSClientAuth   string
+
+	// Enrollment is "off" or "required". When required, agents enroll
+	// with a bootstrap token and authenticate with the credential issued
+	// to them.
+	Enrollment string
+	// EnrollStorePath persists tokens and enrollments; empty keeps them in
+	// memory only, so every agent must re-enroll after a restart.
+	EnrollStorePath string
+	// AuditLogPath is appended with every action agents audit, such as
+	// programs run; empty keeps only the latest records in memory.
+	AuditLogPath string
+	// ArtifactDir stores files agents upload, such as support bundles;
+	// empty keeps only the latest in memory.
+	ArtifactDir string
+
+	// LogFormat is "text" or "json"; LogLevel is the default level and
+	// LogLevels overrides it per component.
+	LogFormat string
+	LogLevel  string
+	LogLevels map[string]string
+	// Timezone is the IANA zone log times are shown in; empty means UTC.
+	Timezone string
 }
 
 func DefaultConfig() Config {
 	return Config{
-		ListenAddr: ":50051",
+		ListenAddr:    ":50051",
+		AdminAddr:     "127.0.0.1:8080",
+		TLSClientAuth: "none",
+		Enrollment:    "off",
+		LogFormat:     "text",
+		LogLevel:      "info",
+		Timezone:      "UTC",
 	}
 }
@@ -0,0 +1,202 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go-agent/internal/config"
+)
+
+// ConfigDoc is one version of a managed agent config. A document targets
+// agents by hostname or by labels (all must match); one with neither
+// targets every agent.
+type ConfigDoc struct {
+	Name      string            `json:"name"`
+	Version   int64             `json:"version"`
+	Hostnames []string          `json:"hostnames,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Format    string            `json:"format"`
+	Body      string            `json:"body"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+var ErrNoConfig = errors.New("no such config")
+
+// ConfigStore keeps every version of every document. If path is set the
+// store is persisted there after each change.
+type ConfigStore struct {
+	path string
+
+	mu   sync.Mutex
+	docs map[string][]ConfigDoc // by name, oldest version first
+}
+
+func OpenConfigStore(path string) (*ConfigStore, error) {
+	s := &ConfigStore{path: path, docs: make(map[string][]ConfigDoc)}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config store: %w", err)
+	}
+	var all []ConfigDoc
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, fmt.Errorf("parse config store %s: %w", path, err)
+	}
+	for _, d := range all {
+		s.docs[d.Name] = append(s.docs[d.Name], d)
+	}
+	return s, nil
+}
+
+// Put validates d as an overlay on the agent defaults and stores it as the
+// next version of d.Name.
+func (s *ConfigStore) Put(d ConfigDoc) (ConfigDoc, error) {
+	if d.Name == "" {
+		return ConfigDoc{}, errors.New("name is required")
+	}
+	if d.Format == "" {
+		d.Format = "json"
+	}
+	if d.Format != "json" && d.Format != "yaml" {
+		return ConfigDoc{}, fmt.Errorf("unknown format %q", d.Format)
+	}
+	ov := &config.Overlay{Name: d.Name, Format: d.Format, Body: []byte(d.Body)}
+	if _, _, err := config.LoadWithOverlay("", ov); err != nil {
+		return ConfigDoc{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hist := s.docs[d.Name]
+	d.Version = 1
+	if len(hist) > 0 {
+		d.Version = hist[len(hist)-1].Version + 1
+	}
+	d.CreatedAt = time.Now().UTC()
+	s.docs[d.Name] = append(hist, d)
+	if err := s.save(); err != nil {
+		s.docs[d.Name] = hist
+		return ConfigDoc{}, err
+	}
+	return d, nil
+}
+
+// Delete removes all versions of name. Agents it was applied to fall back
+// to another matching document or their local config.
+func (s *ConfigStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hist, ok := s.docs[name]
+	if !ok {
+		return ErrNoConfig
+	}
+	delete(s.docs, name)
+	if err := s.save(); err != nil {
+		s.docs[name] = hist
+		return err
+	}
+	return nil
+}
+
+// Latest returns the current version of every document, sorted by name.
+func (s *ConfigStore) Latest() []ConfigDoc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]ConfigDoc, 0, len(s.docs))
+	for _, hist := range s.docs {
+		out = append(out, hist[len(hist)-1])
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *ConfigStore) History(name string) ([]ConfigDoc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hist, ok := s.docs[name]
+	if !ok {
+		return nil, ErrNoConfig
+	}
+	return slices.Clone(hist), nil
+}
+
+// Match picks the document for an agent: a hostname match wins over a
+// label match, more matching labels win over fewer, and a document without
+// selectors is the fallback. Ties go to the lowest name.
+func (s *ConfigStore) Match(hostname string, labels map[string]string) (ConfigDoc, bool) {
+	best, bestScore := ConfigDoc{}, -1
+	for _, d := range s.Latest() {
+		score := -1
+		switch {
+		case slices.Contains(d.Hostnames, hostname):
+			score = 1 << 16
+		case len(d.Labels) > 0 && labelsMatch(d.Labels, labels):
+			score = len(d.Labels)
+		case len(d.Hostnames) == 0 && len(d.Labels) == 0:
+			score = 0
+		}
+		if score > bestScore {
+			best, bestScore = d, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+func labelsMatch(want, have map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ConfigStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	var all []ConfigDoc
+	for _, name := range sortedNames(s.docs) {
+		all = append(all, s.docs[name]...)
+	}
+	b, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("write config store: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("write config store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write config store: %w", err)
+	}
+	return nil
+}
+
+func sortedNames(m map[string][]ConfigDoc) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,296 @@
+package collector
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoToken        = errors.New("no such token")
+	ErrTokenInvalid   = errors.New("bootstrap token invalid, expired or used up")
+	ErrNotEnrolled    = errors.New("agent not enrolled")
+	ErrBadCredential  = errors.New("invalid credential")
+	ErrAgentRevoked   = errors.New("agent revoked")
+	errEnrollConflict = errors.New("agent_id already enrolled")
+)
+
+// BootstrapToken lets agents enroll. The secret part is only shown when the
+// token is minted; the store keeps its hash.
+type BootstrapToken struct {
+	ID         string            `json:"id"`
+	SecretHash string            `json:"secret_hash"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	MaxUses    int               `json:"max_uses"` // 0 means unlimited
+	Uses       int               `json:"uses"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// Enrollment is an agent that has been issued a credential.
+type Enrollment struct {
+	AgentID        string            `json:"agent_id"`
+	TokenID        string            `json:"token_id"`
+	CredentialHash string            `json:"credential_hash"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	EnrolledAt     time.Time         `json:"enrolled_at"`
+	RevokedAt      *time.Time        `json:"revoked_at,omitempty"`
+}
+
+// EnrollStore holds bootstrap tokens and enrollments. If path is set the
+// store is persisted there after each change.
+type EnrollStore struct {
+	path string
+
+	mu       sync.Mutex
+	tokens   map[string]*BootstrapToken
+	enrolled map[string]*Enrollment
+}
+
+type enrollFile struct {
+	Tokens      []*BootstrapToken `json:"tokens"`
+	Enrollments []*Enrollment     `json:"enrollments"`
+}
+
+func OpenEnrollStore(path string) (*EnrollStore, error) {
+	s := &EnrollStore{
+		path:     path,
+		tokens:   make(map[string]*BootstrapToken),
+		enrolled: make(map[string]*Enrollment),
+	}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read enroll store: %w", err)
+	}
+	var f enrollFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parse enroll store %s: %w", path, err)
+	}
+	for _, t := range f.Tokens {
+		s.tokens[t.ID] = t
+	}
+	for _, e := range f.Enrollments {
+		s.enrolled[e.AgentID] = e
+	}
+	return s, nil
+}
+
+// Mint creates a token valid for ttl and returns it with its full
+// "<id>.<secret>" value, which cannot be recovered later.
+func (s *EnrollStore) Mint(ttl time.Duration, maxUses int, labels map[string]string) (BootstrapToken, string, error) {
+	if ttl <= 0 {
+		return BootstrapToken{}, "", errors.New("ttl must be > 0")
+	}
+	if maxUses < 0 {
+		return BootstrapToken{}, "", errors.New("max_uses must be >= 0")
+	}
+	id, err := randomString(6)
+	if err != nil {
+		return BootstrapToken{}, "", err
+	}
+	secret, err := randomString(24)
+	if err != nil {
+		return BootstrapToken{}, "", err
+	}
+	now := time.Now().UTC()
+	t := &BootstrapToken{
+		ID:         id,
+		SecretHash: hashSecret(secret),
+		Labels:     labels,
+		MaxUses:    maxUses,
+		ExpiresAt:  now.Add(ttl),
+		CreatedAt:  now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[id] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, id)
+		return BootstrapToken{}, "", err
+	}
+	return *t, id + "." + secret, nil
+}
+
+func (s *EnrollStore) Tokens() []BootstrapToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]BootstrapToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func (s *EnrollStore) DeleteToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrNoToken
+	}
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+	return nil
+}
+
+// Enroll consumes one use of token and issues a credential for agentID.
+// An agent that is already enrolled must authenticate with its credential
+// instead.
+func (s *EnrollStore) Enroll(token, agentID string) (Enrollment, string, error) {
+	id, secret, _ := strings.Cut(token, ".")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || !secretMatches(secret, t.SecretHash) ||
+		time.Now().After(t.ExpiresAt) || t.MaxUses > 0 && t.Uses >= t.MaxUses {
+		return Enrollment{}, "", ErrTokenInvalid
+	}
+	if _, ok := s.enrolled[agentID]; ok {
+		return Enrollment{}, "", errEnrollConflict
+	}
+
+	cred, err := randomString(32)
+	if err != nil {
+		return Enrollment{}, "", err
+	}
+	e := &Enrollment{
+		AgentID:        agentID,
+		TokenID:        t.ID,
+		CredentialHash: hashSecret(cred),
+		Labels:         t.Labels,
+		EnrolledAt:     time.Now().UTC(),
+	}
+	t.Uses++
+	s.enrolled[agentID] = e
+	if err := s.save(); err != nil {
+		t.Uses--
+		delete(s.enrolled, agentID)
+		return Enrollment{}, "", err
+	}
+	return *e, cred, nil
+}
+
+// Authenticate checks cred against agentID's enrollment.
+func (s *EnrollStore) Authenticate(agentID, cred string) (Enrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrolled[agentID]
+	if !ok {
+		return Enrollment{}, ErrNotEnrolled
+	}
+	if !secretMatches(cred, e.CredentialHash) {
+		return Enrollment{}, ErrBadCredential
+	}
+	if e.RevokedAt != nil {
+		return Enrollment{}, ErrAgentRevoked
+	}
+	return *e, nil
+}
+
+func (s *EnrollStore) Enrollments() []Enrollment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]Enrollment, 0, len(s.enrolled))
+	for _, e := range s.enrolled {
+		out = append(out, *e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].EnrolledAt.Before(out[j].EnrolledAt) })
+	return out
+}
+
+// Revoke permanently rejects agentID's credential.
+func (s *EnrollStore) Revoke(agentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.enrolled[agentID]
+	if !ok {
+		return ErrNotEnrolled
+	}
+	if e.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	e.RevokedAt = &now
+	if err := s.save(); err != nil {
+		e.RevokedAt = nil
+		return err
+	}
+	return nil
+}
+
+func (s *EnrollStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	var f enrollFile
+	for _, t := range s.tokens {
+		f.Tokens = append(f.Tokens, t)
+	}
+	for _, e := range s.enrolled {
+		f.Enrollments = append(f.Enrollments, e)
+	}
+	sort.Slice(f.Tokens, func(i, j int) bool { return f.Tokens[i].ID < f.Tokens[j].ID })
+	sort.Slice(f.Enrollments, func(i, j int) bool { return f.Enrollments[i].AgentID < f.Enrollments[j].AgentID })
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("write enroll store: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("write enroll store: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("write enroll store: %w", err)
+	}
+	return nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func secretMatches(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(hash)) == 1
+}
@@ -5,8 +5,12 @@ import (
 	"net"
 	"time"
 
+	"go-agent/internal/tlsutil"
+	_ "go-agent/internal/transport/zstd"
 	pb "go-agent/proto/agentv1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip"
 )
 
 type grpcServer struct {
@@ -15,15 +19,32 @@ type grpcServer struct {
 	s    *grpc.Server
 }
 
-func newGRPCServer(cfg Config) (*grpcServer, error) {
+func newGRPCServer(cfg Config, h *Handler) (*grpcServer, error) {
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(h.authorize)}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		r, err := tlsutil.NewReloader(tlsutil.Files{
+			CertFile: cfg.TLSCertFile,
+			KeyFile:  cfg.TLSKeyFile,
+			CAFile:   cfg.TLSClientCAFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+		tc, err := tlsutil.ServerConfig(r, tlsutil.ClientAuth(cfg.TLSClientAuth))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tc)))
+	} else if cfg.TLSClientAuth != "" && cfg.TLSClientAuth != string(tlsutil.ClientAuthNone) {
+		return nil, fmt.Errorf("client auth %q needs a tls cert and key", cfg.TLSClientAuth)
+	}
+
 	lis, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
 		return nil, fmt.Errorf("listen %s: %w", cfg.ListenAddr, err)
 	}
 
-	s := grpc.NewServer()
-	h := NewHandler()
-	h.Init()
+	s := grpc.NewServer(opts...)
 
 	pb.RegisterCollectorServiceServer(s, h)
 
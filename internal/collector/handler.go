@@ -2,7 +2,9 @@ package collector
 
 import (
 	"context"
-	"log"
+	"errors"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,16 +15,41 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-var (
-	loc = mustLoadLocation("Asia/Seoul")
-)
-
 type AgentState struct {
+	// Identity is the client certificate identity the agent registered
+	// with; empty without mutual TLS.
+	Identity  string
+	Hostname  string
+	Labels    map[string]string
 	FirstSeen time.Time
 	LastSeen  time.Time
 	BootId    string
 
-	Pending []*pb.Command
+	// Commands are the commands the agent advertised at registration.
+	Commands []CommandSpec
+	// RequiresSigned agents only run commands an operator signed, expiring
+	// at most MaxSignedTTL ahead; 0 means no limit was advertised.
+	RequiresSigned bool
+	MaxSignedTTL   time.Duration
+	// Results are the agent's latest command results, oldest first.
+	Results []CommandResult
+
+	// Config is the managed config revision the agent reports running.
+	Config ConfigRevision
+	// Rejected is the last revision the agent refused, with its reason;
+	// it is not pushed again until a newer version exists.
+	Rejected    *ConfigRevision
+	ConfigError string
+
+	// BudgetLevel is how far the agent has throttled itself to stay within
+	// its resource budget, 0 meaning not at all.
+	BudgetLevel  uint32
+	BudgetReason string
+}
+
+type ConfigRevision struct {
+	Name    string `json:"name"`
+	Version int64  `json:"version"`
 }
 
 type Handler struct {
@@ -31,34 +58,41 @@ type Handler struct {
 	mu     sync.Mutex
 	agents map[string]*AgentState
 	ttl    time.Duration
-}
+	// identities maps client certificate identities to agent ids. Entries
+	// outlive expired agents so a returning agent keeps its id.
+	identities map[string]string
+	// partials holds chunked command results still being received, by
+	// agent and command id.
+	partials map[string]*partialResult
+	// queue holds the commands sent to agents through the admin API and
+	// their progress.
+	queue *CommandQueue
 
-func mustLoadLocation(src string) *time.Location {
-	l, err := time.LoadLocation(src)
-	if err != nil {
-		panic(err)
-	}
-	return l
+	configs *ConfigStore
+	// enroll, if set, requires agents to enroll with a bootstrap token and
+	// authenticate every call with the credential they were issued.
+	enroll    *EnrollStore
+	audit     *AuditLog
+	artifacts *ArtifactStore
 }
 
-func NewHandler() *Handler {
+func NewHandler(configs *ConfigStore, enroll *EnrollStore, audit *AuditLog, artifacts *ArtifactStore) *Handler {
 	h := &Handler{
-		agents: make(map[string]*AgentState),
-		ttl:    60 * time.Second,
+		agents:     make(map[string]*AgentState),
+		ttl:        60 * time.Second,
+		identities: make(map[string]string),
+		partials:   make(map[string]*partialResult),
+		queue:      newCommandQueue(),
+		configs:    configs,
+		enroll:     enroll,
+		audit:      audit,
+		artifacts:  artifacts,
 	}
 	go h.gcLoop(10 * time.Second)
 
 	return h
 }
 
-func (h *Handler) Init() {
-	loc, err := time.LoadLocation("Asia/Seoul")
-	if err != nil {
-		panic(err)
-	}
-	time.Local = loc
-}
-
 func (h *Handler) gcLoop(interval time.Duration) {
 	t := time.NewTicker(interval)
 	defer t.Stop()
@@ -70,10 +104,17 @@ func (h *Handler) gcLoop(interval time.Duration) {
 		for agentID, st := range h.agents {
 			if now.Sub(st.LastSeen) > h.ttl {
 				delete(h.agents, agentID)
-				log.Printf("[gc] expired agent_id=%s", agentID)
+				gcLog.Info("expired", "agent_id", agentID)
+			}
+		}
+		for key, p := range h.partials {
+			if now.Sub(p.updated) > partialTTL {
+				delete(h.partials, key)
+				gcLog.Warn("dropped incomplete command result", "key", key, "chunks", p.next)
 			}
 		}
 		h.mu.Unlock()
+		h.queue.expire(now)
 	}
 }
 
@@ -82,26 +123,145 @@ func (h *Handler) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.Re
 		return nil, status.Error(codes.InvalidArgument, "hostname is required")
 	}
 
-	now := time.Now()
-	agentID := uuid.NewString()
+	agentID := req.GetAgentId()
+	if agentID != "" {
+		if _, err := uuid.Parse(agentID); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "malformed agent_id")
+		}
+	}
+
+	// a client certificate pins the agent identity: the same certificate
+	// always maps to the same agent_id, and no other one may claim it
+	ident := peerIdentity(ctx)
+	h.mu.Lock()
+	if bound, ok := h.identities[ident]; ident != "" && ok && bound != agentID {
+		if agentID != "" {
+			registerLog.Warn("identity bound to another agent_id", "identity", ident, "asked", agentID, "agent_id", bound)
+		}
+		agentID = bound
+	}
+	if st, ok := h.agents[agentID]; ok && st.Identity != "" && st.Identity != ident {
+		h.mu.Unlock()
+		return nil, status.Error(codes.PermissionDenied, "agent_id belongs to another client certificate")
+	}
+	h.mu.Unlock()
+
+	if agentID == "" {
+		agentID = uuid.NewString()
+	}
+
+	labels := req.GetLabels()
+	var cred string
+	if h.enroll != nil {
+		var preset map[string]string
+		var err error
+		preset, cred, err = h.authenticateRegister(ctx, req, agentID)
+		if err != nil {
+			return nil, err
+		}
+		labels = mergeLabels(labels, preset)
+	}
+
+	now := time.Now().UTC()
+	boot := &QueuedCommand{
+		CommandID: "boot-" + uuid.NewString(),
+		AgentID:   agentID,
+		Name:      "ping",
+	}
 
 	h.mu.Lock()
-	h.agents[agentID] = &AgentState{
-		FirstSeen: now,
-		LastSeen:  now,
-		BootId:    uuid.NewString(),
-		Pending: []*pb.Command{
-			{
-				CommandId: "boot-" + agentID,
-				Name:      "ping",
-				ArgsJson:  `{}`,
-			},
-		},
+	st, reattached := h.agents[agentID]
+	if reattached {
+		st.LastSeen = now
+		st.Identity = ident
+		st.Hostname = req.GetHostname()
+		st.Labels = labels
+		st.BootId = uuid.NewString()
+		st.Commands = commandSpecs(req.GetCommands())
+		st.RequiresSigned = req.GetRequiresSignedCommands()
+		st.MaxSignedTTL = time.Duration(req.GetMaxSignedTtlSeconds()) * time.Second
+	} else {
+		h.agents[agentID] = &AgentState{
+			Identity:  ident,
+			Hostname:  req.GetHostname(),
+			Labels:    labels,
+			FirstSeen: now,
+			LastSeen:  now,
+			BootId:    uuid.NewString(),
+			Commands:  commandSpecs(req.GetCommands()),
+
+			RequiresSigned: req.GetRequiresSignedCommands(),
+			MaxSignedTTL:   time.Duration(req.GetMaxSignedTtlSeconds()) * time.Second,
+		}
+	}
+	if ident != "" {
+		h.identities[ident] = agentID
 	}
 	h.mu.Unlock()
+	// an agent requiring signatures would only reject the collector's ping
+	if !req.GetRequiresSignedCommands() {
+		prepare(boot, defaultCommandTTL, now)
+		// the id is fresh, so it cannot be taken
+		_ = h.queue.add(now, boot)
+	}
 
-	log.Printf("[register] agent_id=%s host=%s", agentID, req.GetHostname())
-	return &pb.RegisterResponse{AgentId: agentID}, nil
+	registerLog.Info("registered", "agent_id", agentID, "host", req.GetHostname(), "identity", ident, "reattached", reattached)
+	return &pb.RegisterResponse{AgentId: agentID, Credential: cred}, nil
+}
+
+// authenticateRegister admits an agent that presents its credential, or
+// enrolls it with a bootstrap token. For a fresh enrollment it returns the
+// new credential; labels preset on the token are returned either way.
+func (h *Handler) authenticateRegister(ctx context.Context, req *pb.RegisterRequest, agentID string) (map[string]string, string, error) {
+	if cred := bearerToken(ctx); cred != "" {
+		e, err := h.enroll.Authenticate(agentID, cred)
+		if err == nil {
+			return e.Labels, "", nil
+		}
+		if errors.Is(err, ErrAgentRevoked) {
+			return nil, "", status.Error(codes.PermissionDenied, err.Error())
+		}
+		if req.GetBootstrapToken() == "" {
+			return nil, "", status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	if req.GetBootstrapToken() == "" {
+		return nil, "", status.Error(codes.Unauthenticated, "bootstrap token or credential required")
+	}
+
+	e, cred, err := h.enroll.Enroll(req.GetBootstrapToken(), agentID)
+	switch {
+	case errors.Is(err, errEnrollConflict):
+		return nil, "", status.Error(codes.PermissionDenied, "agent_id already enrolled, authenticate with its credential")
+	case errors.Is(err, ErrTokenInvalid):
+		return nil, "", status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		return nil, "", status.Error(codes.Internal, err.Error())
+	}
+	enrollLog.Info("enrolled", "agent_id", agentID, "token", e.TokenID)
+	return e.Labels, cred, nil
+}
+
+// mergeLabels overlays preset on the agent's own labels.
+func mergeLabels(own, preset map[string]string) map[string]string {
+	if len(preset) == 0 {
+		return own
+	}
+	out := make(map[string]string, len(own)+len(preset))
+	for k, v := range own {
+		out[k] = v
+	}
+	for k, v := range preset {
+		out[k] = v
+	}
+	return out
+}
+
+// Forget drops an agent's session state, e.g. after it was revoked.
+func (h *Handler) Forget(agentID string) {
+	h.mu.Lock()
+	delete(h.agents, agentID)
+	h.mu.Unlock()
 }
 
 func (h *Handler) ReportCommandResult(ctx context.Context, res *pb.CommandResult) (*pb.Ack, error) {
@@ -112,17 +272,123 @@ func (h *Handler) ReportCommandResult(ctx context.Context, res *pb.CommandResult
 		return nil, status.Error(codes.InvalidArgument, "command_id is required")
 	}
 
-	log.Printf("[cmd-result] agent_id=%s cmd_id=%s status=%s output=%q err=%q",
-		res.GetAgentId(),
-		res.GetCommandId(),
-		res.GetStatus().String(),
-		res.GetOutput(),
-		res.GetError(),
-	)
+	now := time.Now().UTC()
+	h.mu.Lock()
+	r, err := h.addChunk(res, now)
+	h.mu.Unlock()
+	if err != nil {
+		commandLog.Warn("result rejected", "agent_id", res.GetAgentId(), "command_id", res.GetCommandId(), "err", err)
+		return nil, err
+	}
+	if r == nil {
+		commandLog.Debug("progress",
+			"agent_id", res.GetAgentId(),
+			"command_id", res.GetCommandId(),
+			"chunk", res.GetChunk(),
+			"progress", res.GetProgress(),
+		)
+		h.queue.update(res.GetAgentId(), res, nil, now)
+		return &pb.Ack{Ok: true, Message: "update received"}, nil
+	}
+	if err := h.storeArtifact(r); err != nil {
+		commandLog.Error("artifact not stored", "agent_id", res.GetAgentId(), "command_id", r.CommandID, "err", err)
+		return nil, status.Error(codes.Internal, "artifact not stored")
+	}
+	h.queue.update(res.GetAgentId(), res, r, now)
+
+	h.mu.Lock()
+	if st, ok := h.agents[res.GetAgentId()]; ok {
+		st.Results = append(st.Results, *r)
+		if n := len(st.Results); n > keepResults {
+			st.Results = append([]CommandResult(nil), st.Results[n-keepResults:]...)
+		}
+	}
+	h.mu.Unlock()
+
+	attrs := []any{
+		"agent_id", res.GetAgentId(),
+		"command_id", r.CommandID,
+		"status", r.Status,
+		"err", r.Error,
+	}
+	if len(r.Output) <= logOutputBytes {
+		attrs = append(attrs, "output", r.Output)
+	} else {
+		attrs = append(attrs, "output_bytes", len(r.Output))
+	}
+	if r.Artifact != nil {
+		attrs = append(attrs, "artifact", r.Artifact.Name, "artifact_bytes", r.Artifact.Size)
+	}
+	commandLog.Info("result", attrs...)
 
 	return &pb.Ack{Ok: true, Message: "command result received"}, nil
 }
 
+// storeArtifact stores the artifact a successful command uploaded. That of
+// a failed command is incomplete and dropped.
+func (h *Handler) storeArtifact(r *CommandResult) error {
+	if r.Artifact == nil {
+		return nil
+	}
+	data := r.data
+	r.data = nil
+	if r.Status != pb.CommandResult_OK.String() {
+		commandLog.Info("incomplete artifact dropped", "agent_id", r.Artifact.AgentID, "command_id", r.CommandID, "bytes", len(data))
+		r.Artifact = nil
+		return nil
+	}
+	a, err := h.artifacts.Put(r.Artifact.AgentID, r.CommandID, r.Artifact.Name, data)
+	if err != nil {
+		return err
+	}
+	r.Artifact = &a
+	return nil
+}
+
+func (h *Handler) ReportEvent(ctx context.Context, ev *pb.Event) (*pb.Ack, error) {
+	if ev.GetAgentId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	if ev.GetType() == "" {
+		return nil, status.Error(codes.InvalidArgument, "type is required")
+	}
+
+	if strings.HasPrefix(ev.GetType(), auditPrefix) {
+		return h.recordAudit(ev)
+	}
+
+	eventLog.Info(ev.GetMessage(),
+		"agent_id", ev.GetAgentId(),
+		"type", ev.GetType(),
+		"severity", ev.GetSeverity().String(),
+		"attrs", ev.GetAttributes(),
+	)
+
+	return &pb.Ack{Ok: true, Message: "event received"}, nil
+}
+
+func (h *Handler) recordAudit(ev *pb.Event) (*pb.Ack, error) {
+	h.mu.Lock()
+	var hostname string
+	if st, ok := h.agents[ev.GetAgentId()]; ok {
+		hostname = st.Hostname
+	}
+	h.mu.Unlock()
+
+	rec := auditRecord(ev, hostname)
+	auditLog.Info(rec.Message,
+		"agent_id", rec.AgentID,
+		"hostname", rec.Hostname,
+		"action", rec.Action,
+		"attrs", rec.Attributes,
+	)
+	if err := h.audit.Record(rec); err != nil {
+		auditLog.Error("record failed", "err", err)
+		return nil, status.Error(codes.Internal, "audit record not stored")
+	}
+	return &pb.Ack{Ok: true, Message: "audit recorded"}, nil
+}
+
 func (h *Handler) SendHeartbeat(ctx context.Context, req *pb.Heartbeat) (*pb.HeartbeatResponse, error) {
 	agentID := req.GetAgentId()
 	if agentID == "" {
@@ -136,27 +402,142 @@ func (h *Handler) SendHeartbeat(ctx context.Context, req *pb.Heartbeat) (*pb.Hea
 		return nil, status.Error(codes.NotFound, "unknown agent_id")
 	}
 
-	st.LastSeen = time.Now()
+	now := time.Now().UTC()
+	st.LastSeen = now
+	st.Config = ConfigRevision{Name: req.GetConfigName(), Version: req.GetConfigVersion()}
+	st.BudgetLevel, st.BudgetReason = req.GetBudgetLevel(), req.GetBudgetReason()
 
-	cmds := st.Pending
-	st.Pending = nil
+	push := h.configFor(st)
 
 	h.mu.Unlock()
+	cmds := h.queue.deliver(agentID, now)
 
-	log.Printf("[hb] agent_id=%s host=%s cmds=%d", agentID, req.GetHostname(), len(cmds))
+	hbLog.Debug("heartbeat", "agent_id", agentID, "host", req.GetHostname(), "cmds", len(cmds), "config", req.GetConfigName(), "config_version", req.GetConfigVersion())
+	if push != nil {
+		configLog.Info("push", "agent_id", agentID, "config", push.GetName(), "version", push.GetVersion())
+	}
 
 	return &pb.HeartbeatResponse{
 		Ok:       true,
 		Commands: cmds,
+		Config:   push,
 	}, nil
 }
 
+// configFor returns the document st should switch to, an empty one if it
+// should drop its managed config, or nil if it is up to date.
+func (h *Handler) configFor(st *AgentState) *pb.AgentConfig {
+	if h.configs == nil {
+		return nil
+	}
+	doc, ok := h.configs.Match(st.Hostname, st.Labels)
+	want := ConfigRevision{Name: doc.Name, Version: doc.Version}
+	if want == st.Config || st.Rejected != nil && want == *st.Rejected {
+		return nil
+	}
+	if !ok {
+		return &pb.AgentConfig{}
+	}
+	return &pb.AgentConfig{
+		Name:    doc.Name,
+		Version: doc.Version,
+		Format:  doc.Format,
+		Body:    []byte(doc.Body),
+	}
+}
+
+func (h *Handler) AckConfig(ctx context.Context, ack *pb.ConfigAck) (*pb.Ack, error) {
+	agentID := ack.GetAgentId()
+	if agentID == "" {
+		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
+	}
+	rev := ConfigRevision{Name: ack.GetName(), Version: ack.GetVersion()}
+
+	h.mu.Lock()
+	st, ok := h.agents[agentID]
+	if !ok {
+		h.mu.Unlock()
+		return nil, status.Error(codes.NotFound, "unknown agent_id")
+	}
+	if ack.GetApplied() {
+		st.Config = rev
+		st.Rejected = nil
+		st.ConfigError = ""
+	} else {
+		st.Rejected = &rev
+		st.ConfigError = ack.GetError()
+	}
+	h.mu.Unlock()
+
+	configLog.Info("ack", "agent_id", agentID, "config", rev.Name, "version", rev.Version,
+		"applied", ack.GetApplied(), "err", ack.GetError())
+
+	return &pb.Ack{Ok: true, Message: "config ack received"}, nil
+}
+
 func (h *Handler) SendMetrics(ctx context.Context, req *pb.MetricBatch) (*pb.Ack, error) {
 	if req.GetAgentId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "agent_id is required")
 	}
 	for _, metric := range req.Metrics {
-		log.Printf("[%s][%s] %f", metric.Name, req.AgentId, metric.Value)
+		ts := req.GetTime()
+		if metric.GetTime() != nil {
+			ts = metric.GetTime()
+		}
+		metricsLog.Info("metric", "agent_id", req.AgentId, "name", metric.Name, "value", metric.Value, "time", ts.AsTime())
 	}
 	return &pb.Ack{Ok: true, Message: "metrics received"}, nil
 }
+
+// AgentInfo is the admin view of a connected agent.
+type AgentInfo struct {
+	AgentID  string            `json:"agent_id"`
+	Hostname string            `json:"hostname"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	LastSeen time.Time         `json:"last_seen"`
+	Config   ConfigRevision    `json:"config"`
+	// Target is the revision the agent should be on; empty if none.
+	Target      ConfigRevision  `json:"target"`
+	Rejected    *ConfigRevision `json:"rejected,omitempty"`
+	ConfigError string          `json:"config_error,omitempty"`
+	// Commands names the commands the agent supports.
+	Commands []string `json:"commands,omitempty"`
+	// RequiresSigned agents only run commands queued as signed.
+	RequiresSigned bool `json:"requires_signed,omitempty"`
+	// BudgetLevel is non-zero while the agent throttles itself.
+	BudgetLevel  uint32 `json:"budget_level,omitempty"`
+	BudgetReason string `json:"budget_reason,omitempty"`
+}
+
+func (h *Handler) Agents() []AgentInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make([]AgentInfo, 0, len(h.agents))
+	for id, st := range h.agents {
+		ai := AgentInfo{
+			AgentID:      id,
+			Hostname:     st.Hostname,
+			Labels:       st.Labels,
+			LastSeen:     st.LastSeen,
+			Config:       st.Config,
+			Rejected:     st.Rejected,
+			ConfigError:  st.ConfigError,
+			BudgetLevel:  st.BudgetLevel,
+			BudgetReason: st.BudgetReason,
+
+			RequiresSigned: st.RequiresSigned,
+		}
+		for _, c := range st.Commands {
+			ai.Commands = append(ai.Commands, c.Name)
+		}
+		if h.configs != nil {
+			if doc, ok := h.configs.Match(st.Hostname, st.Labels); ok {
+				ai.Target = ConfigRevision{Name: doc.Name, Version: doc.Version}
+			}
+		}
+		out = append(out, ai)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].AgentID < out[j].AgentID })
+	return out
+}
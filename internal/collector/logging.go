@@ -0,0 +1,19 @@
+package collector
+
+import "go-agent/internal/logging"
+
+// Component loggers; levels are set with -log-level/-log-levels or at
+// runtime through the admin API.
+var (
+	registerLog = logging.For("register")
+	enrollLog   = logging.For("enroll")
+	hbLog       = logging.For("hb")
+	configLog   = logging.For("config")
+	commandLog  = logging.For("command")
+	eventLog    = logging.For("event")
+	metricsLog  = logging.For("metrics")
+	adminLog    = logging.For("admin")
+	gcLog       = logging.For("gc")
+	auditLog    = logging.For("audit")
+	queueLog    = logging.For("queue")
+)
@@ -0,0 +1,534 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go-agent/internal/config"
+	pb "go-agent/proto/agentv1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Command states. A command is queued until an agent heartbeat picks it
+// up, delivered until the agent reports it running, and then ends in one
+// of the final states.
+const (
+	StateQueued    = "queued"
+	StateDelivered = "delivered"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateTimedOut  = "timed_out"
+	StateCancelled = "cancelled"
+	// StateExpired is a command the agent did not start before its
+	// deadline.
+	StateExpired = "expired"
+	// StateRejected is a command the agent refused because its signature
+	// did not verify, it had expired or its id was used before.
+	StateRejected = "rejected"
+)
+
+const (
+	// defaultCommandTTL is how long a command may wait for its agent to
+	// start it when the request sets no ttl.
+	defaultCommandTTL = 10 * time.Minute
+	maxCommandTTL     = 7 * 24 * time.Hour
+	// signingSkew is the clock skew agents allow when checking the expiry
+	// of signed commands.
+	signingSkew = time.Minute
+	// keepFinished is how long finished commands are kept, and
+	// maxTracked how many commands are tracked at most.
+	keepFinished = 24 * time.Hour
+	maxTracked   = 10000
+)
+
+var (
+	ErrUnknownAgent    = errors.New("unknown agent")
+	ErrNoCommand       = errors.New("no such command")
+	ErrCommandExists   = errors.New("command id already used")
+	errNoTargets       = errors.New("no connected agent matches and supports the command")
+	errAmbiguousTarget = errors.New("exactly one of agent_id, selector, all and signed must be set")
+)
+
+// QueuedCommand is a command sent to one agent through the admin API, with
+// its progress through the lifecycle.
+type QueuedCommand struct {
+	CommandID string `json:"command_id"`
+	// BatchID groups the commands of one request.
+	BatchID string          `json:"batch_id,omitempty"`
+	AgentID string          `json:"agent_id"`
+	Name    string          `json:"name"`
+	Args    json.RawMessage `json:"args"`
+	// TimeoutSeconds is how long the agent lets it run; 0 leaves it to
+	// the agent.
+	TimeoutSeconds uint32 `json:"timeout_seconds,omitempty"`
+	// Signed is set when the command carries a signature the operator
+	// made ahead of time.
+	Signed bool `json:"signed,omitempty"`
+
+	State       string     `json:"state"`
+	Progress    uint32     `json:"progress,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	// Error explains an expired command or a failure seen by the
+	// collector; the agent's own error is in Result.
+	Error  string         `json:"error,omitempty"`
+	Result *CommandResult `json:"result,omitempty"`
+
+	updated   time.Time
+	signature []byte
+}
+
+func (c *QueuedCommand) finished() bool {
+	switch c.State {
+	case StateQueued, StateDelivered, StateRunning:
+		return false
+	}
+	return true
+}
+
+func (c *QueuedCommand) proto() *pb.Command {
+	return &pb.Command{
+		CommandId:      c.CommandID,
+		Name:           c.Name,
+		ArgsJson:       string(c.Args),
+		TimeoutSeconds: c.TimeoutSeconds,
+		Expires:        timestamppb.New(c.ExpiresAt),
+		Signature:      c.signature,
+	}
+}
+
+// finalState maps the status an agent reported to a final state.
+func finalState(status pb.CommandResult_Status) string {
+	switch status {
+	case pb.CommandResult_OK:
+		return StateSucceeded
+	case pb.CommandResult_TIMED_OUT:
+		return StateTimedOut
+	case pb.CommandResult_CANCELLED:
+		return StateCancelled
+	case pb.CommandResult_BAD_SIGNATURE:
+		return StateRejected
+	case pb.CommandResult_EXPIRED:
+		return StateExpired
+	}
+	return StateFailed
+}
+
+// CommandQueue tracks the commands sent to agents, in memory. Commands
+// wait until a heartbeat of their agent collects them; finished ones are
+// kept for keepFinished.
+type CommandQueue struct {
+	mu      sync.Mutex
+	byID    map[string]*QueuedCommand
+	pending map[string][]*QueuedCommand // queued, by agent id, oldest first
+}
+
+func newCommandQueue() *CommandQueue {
+	return &CommandQueue{
+		byID:    make(map[string]*QueuedCommand),
+		pending: make(map[string][]*QueuedCommand),
+	}
+}
+
+// add queues cmds, which have everything but their state and times
+// set besides ExpiresAt. If one of their ids is taken none is queued.
+func (q *CommandQueue) add(now time.Time, cmds ...*QueuedCommand) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := make(map[string]bool, len(cmds))
+	for _, c := range cmds {
+		if _, dup := q.byID[c.CommandID]; dup || ids[c.CommandID] {
+			return fmt.Errorf("%w: %s", ErrCommandExists, c.CommandID)
+		}
+		ids[c.CommandID] = true
+	}
+	for _, c := range cmds {
+		c.State = StateQueued
+		c.CreatedAt, c.updated = now, now
+		q.byID[c.CommandID] = c
+		q.pending[c.AgentID] = append(q.pending[c.AgentID], c)
+	}
+	return nil
+}
+
+// prepare sets the expiry of c, a command the collector made up. Agents
+// see the expiry in whole seconds, so it is rounded up to one.
+func prepare(c *QueuedCommand, ttl time.Duration, now time.Time) {
+	if len(c.Args) == 0 {
+		c.Args = json.RawMessage(`{}`)
+	}
+	c.ExpiresAt = now.Add(ttl + time.Second - 1).Truncate(time.Second)
+}
+
+// deliver hands out the commands queued for an agent.
+func (q *CommandQueue) deliver(agentID string, now time.Time) []*pb.Command {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []*pb.Command
+	for _, c := range q.pending[agentID] {
+		c.State = StateDelivered
+		c.DeliveredAt, c.updated = &now, now
+		out = append(out, c.proto())
+	}
+	delete(q.pending, agentID)
+	return out
+}
+
+// update records a result message the agent sent for one of its commands;
+// results of commands the queue does not track are ignored. final is the
+// whole result once the last chunk is in.
+func (q *CommandQueue) update(agentID string, res *pb.CommandResult, final *CommandResult, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c, ok := q.byID[res.GetCommandId()]
+	if !ok || c.AgentID != agentID {
+		return
+	}
+	late := c.lateStart() && res.GetStatus() != pb.CommandResult_EXPIRED
+	if c.finished() && !late {
+		return
+	}
+	if c.State == StateQueued {
+		// delivered in a heartbeat response the collector did not see
+		// arrive, e.g. with round robin across collectors
+		q.unqueueLocked(c)
+	}
+	if late {
+		queueLog.Info("started after it expired", "agent_id", agentID, "command_id", c.CommandID)
+		c.FinishedAt, c.Error = nil, ""
+	}
+	if c.StartedAt == nil {
+		c.StartedAt = &now
+	}
+	c.updated = now
+	c.Progress = res.GetProgress()
+	if final == nil {
+		c.State = StateRunning
+		return
+	}
+	c.State = finalState(res.GetStatus())
+	c.FinishedAt = &now
+	c.Result = final
+}
+
+// lateStart reports whether c expired here after it was delivered, so
+// that an agent whose clock is behind the collector's may still have
+// started it.
+func (c *QueuedCommand) lateStart() bool {
+	return c.State == StateExpired && c.DeliveredAt != nil && c.Result == nil
+}
+
+func (q *CommandQueue) unqueueLocked(c *QueuedCommand) {
+	p := q.pending[c.AgentID]
+	for i, x := range p {
+		if x == c {
+			p = append(p[:i], p[i+1:]...)
+			break
+		}
+	}
+	if len(p) == 0 {
+		delete(q.pending, c.AgentID)
+	} else {
+		q.pending[c.AgentID] = p
+	}
+}
+
+// expire ends commands that did not start in time or whose agent went
+// silent while running them, and forgets old finished ones.
+func (q *CommandQueue) expire(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, c := range q.byID {
+		switch {
+		case (c.State == StateQueued || c.State == StateDelivered) && now.After(c.ExpiresAt):
+			if c.State == StateQueued {
+				q.unqueueLocked(c)
+			}
+			c.Error = fmt.Sprintf("not started by the agent within %s", c.ExpiresAt.Sub(c.CreatedAt))
+			c.State, c.FinishedAt, c.updated = StateExpired, &now, now
+			queueLog.Info("expired", "agent_id", c.AgentID, "command_id", id, "name", c.Name)
+		case c.State == StateRunning && now.Sub(c.updated) > partialTTL:
+			c.Error = fmt.Sprintf("no word from the agent for %s", now.Sub(c.updated).Round(time.Second))
+			c.State, c.FinishedAt, c.updated = StateFailed, &now, now
+		case c.finished() && now.Sub(c.updated) > keepFinished:
+			delete(q.byID, id)
+		}
+	}
+	if over := len(q.byID) - maxTracked; over > 0 {
+		var done []*QueuedCommand
+		for _, c := range q.byID {
+			if c.finished() {
+				done = append(done, c)
+			}
+		}
+		sort.Slice(done, func(i, j int) bool { return done[i].updated.Before(done[j].updated) })
+		for _, c := range done[:min(over, len(done))] {
+			delete(q.byID, c.CommandID)
+		}
+	}
+}
+
+// CommandFilter selects commands to list; empty fields match all.
+type CommandFilter struct {
+	AgentID string
+	BatchID string
+	Name    string
+	State   string
+	Limit   int
+}
+
+// List returns the tracked commands matching f, newest first.
+func (q *CommandQueue) List(f CommandFilter) []QueuedCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := []QueuedCommand{}
+	for _, c := range q.byID {
+		if f.AgentID != "" && c.AgentID != f.AgentID ||
+			f.BatchID != "" && c.BatchID != f.BatchID ||
+			f.Name != "" && c.Name != f.Name ||
+			f.State != "" && c.State != f.State {
+			continue
+		}
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.After(out[j].CreatedAt)
+		}
+		return out[i].CommandID < out[j].CommandID
+	})
+	if f.Limit > 0 && len(out) > f.Limit {
+		out = out[:f.Limit]
+	}
+	return out
+}
+
+func (q *CommandQueue) Get(id string) (QueuedCommand, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c, ok := q.byID[id]
+	if !ok {
+		return QueuedCommand{}, ErrNoCommand
+	}
+	return *c, nil
+}
+
+// EnqueueRequest asks for a command to be run on one agent, on the agents
+// whose labels include all of Selector, on all agents, or on the agents it
+// was signed for.
+type EnqueueRequest struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args"`
+	// Timeout is how long the command may run; unset leaves it to the
+	// agent.
+	Timeout config.Duration `json:"timeout"`
+	// TTL is how long the command may wait to be started. Signed
+	// commands carry their own expiry instead.
+	TTL config.Duration `json:"ttl"`
+
+	AgentID  string            `json:"agent_id"`
+	Selector map[string]string `json:"selector"`
+	All      bool              `json:"all"`
+	// Signed are the commands an operator signed for each agent.
+	Signed []SignedTarget `json:"signed"`
+}
+
+// SignedTarget is a command signed ahead of time for one agent, as
+// cmd/cmdsign does, so that the collector needs no signing key. The
+// signature covers the agent and command ids, the name, the compact JSON
+// of the args and the expiry in whole seconds.
+type SignedTarget struct {
+	AgentID   string    `json:"agent_id"`
+	CommandID string    `json:"command_id"`
+	Expires   time.Time `json:"expires"`
+	// Signature is base64 in JSON.
+	Signature []byte `json:"signature"`
+}
+
+// Batch is what an EnqueueRequest queued.
+type Batch struct {
+	BatchID  string          `json:"batch_id"`
+	Commands []QueuedCommand `json:"commands"`
+	// Unsupported lists matching agents that do not have the command.
+	Unsupported []string `json:"unsupported,omitempty"`
+	// NeedSignature lists matching agents that only run signed commands.
+	NeedSignature []string `json:"need_signature,omitempty"`
+}
+
+// Enqueue queues req's command for every connected agent it targets.
+func (h *Handler) Enqueue(req EnqueueRequest) (Batch, error) {
+	if req.Name == "" {
+		return Batch{}, errors.New("name is required")
+	}
+	if n := btoi(req.AgentID != "") + btoi(req.Selector != nil) + btoi(req.All) + btoi(req.Signed != nil); n != 1 {
+		return Batch{}, errAmbiguousTarget
+	}
+	if len(req.Args) > 0 {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(req.Args, &obj); err != nil || obj == nil {
+			return Batch{}, errors.New("args must be a JSON object")
+		}
+		// the form signatures are made over
+		var buf bytes.Buffer
+		_ = json.Compact(&buf, req.Args)
+		req.Args = buf.Bytes()
+	}
+	timeout := uint32(min(math.Ceil(req.Timeout.Seconds()), math.MaxUint32))
+	if req.Signed != nil {
+		return h.enqueueSigned(req, timeout)
+	}
+
+	ttl := req.TTL.Duration
+	if ttl == 0 {
+		ttl = defaultCommandTTL
+	}
+	if ttl > maxCommandTTL {
+		return Batch{}, fmt.Errorf("ttl must be at most %s", maxCommandTTL)
+	}
+
+	b := Batch{BatchID: uuid.NewString(), Commands: []QueuedCommand{}}
+	var targets []string
+	h.mu.Lock()
+	if req.AgentID != "" {
+		st, ok := h.agents[req.AgentID]
+		if !ok {
+			h.mu.Unlock()
+			return Batch{}, ErrUnknownAgent
+		}
+		if !supports(st, req.Name) {
+			h.mu.Unlock()
+			return Batch{}, fmt.Errorf("agent does not support command %q", req.Name)
+		}
+		if st.RequiresSigned {
+			h.mu.Unlock()
+			return Batch{}, errors.New("agent only runs signed commands")
+		}
+		targets = []string{req.AgentID}
+	}
+	for id, st := range h.agents {
+		if req.AgentID != "" || !req.All && !labelsMatch(req.Selector, st.Labels) {
+			continue
+		}
+		switch {
+		case !supports(st, req.Name):
+			b.Unsupported = append(b.Unsupported, id)
+		case st.RequiresSigned:
+			b.NeedSignature = append(b.NeedSignature, id)
+		default:
+			targets = append(targets, id)
+		}
+	}
+	h.mu.Unlock()
+	if len(targets) == 0 {
+		return Batch{}, errNoTargets
+	}
+	sort.Strings(targets)
+	sort.Strings(b.Unsupported)
+	sort.Strings(b.NeedSignature)
+
+	now := time.Now().UTC()
+	cmds := make([]*QueuedCommand, 0, len(targets))
+	for _, agentID := range targets {
+		c := &QueuedCommand{
+			CommandID:      uuid.NewString(),
+			BatchID:        b.BatchID,
+			AgentID:        agentID,
+			Name:           req.Name,
+			Args:           req.Args,
+			TimeoutSeconds: timeout,
+		}
+		prepare(c, ttl, now)
+		cmds = append(cmds, c)
+	}
+	if err := h.queue.add(now, cmds...); err != nil {
+		return Batch{}, err
+	}
+	for _, c := range cmds {
+		b.Commands = append(b.Commands, *c)
+	}
+	queueLog.Info("queued", "name", req.Name, "batch_id", b.BatchID, "agents", len(targets), "unsupported", len(b.Unsupported), "need_signature", len(b.NeedSignature))
+	return b, nil
+}
+
+// enqueueSigned queues the commands of req.Signed as they were signed.
+// The collector cannot check the signatures; the agents do.
+func (h *Handler) enqueueSigned(req EnqueueRequest, timeout uint32) (Batch, error) {
+	if len(req.Signed) == 0 {
+		return Batch{}, errNoTargets
+	}
+	if len(req.Args) == 0 {
+		req.Args = json.RawMessage(`{}`)
+	}
+	now := time.Now().UTC()
+	b := Batch{BatchID: uuid.NewString(), Commands: []QueuedCommand{}}
+	cmds := make([]*QueuedCommand, 0, len(req.Signed))
+	h.mu.Lock()
+	for _, s := range req.Signed {
+		st, ok := h.agents[s.AgentID]
+		switch {
+		case !ok:
+			h.mu.Unlock()
+			return Batch{}, fmt.Errorf("%w %q", ErrUnknownAgent, s.AgentID)
+		case !supports(st, req.Name):
+			h.mu.Unlock()
+			return Batch{}, fmt.Errorf("agent %s does not support command %q", s.AgentID, req.Name)
+		case s.CommandID == "" || len(s.Signature) == 0:
+			h.mu.Unlock()
+			return Batch{}, errors.New("signed commands need a command_id and signature")
+		case !s.Expires.After(now) || s.Expires.Sub(now) > maxCommandTTL:
+			h.mu.Unlock()
+			return Batch{}, fmt.Errorf("command %s: expires must be in the next %s", s.CommandID, maxCommandTTL)
+		case st.MaxSignedTTL > 0 && s.Expires.Sub(now) > st.MaxSignedTTL+signingSkew:
+			h.mu.Unlock()
+			return Batch{}, fmt.Errorf("command %s: agent %s accepts signed commands expiring at most %s ahead", s.CommandID, s.AgentID, st.MaxSignedTTL)
+		}
+		cmds = append(cmds, &QueuedCommand{
+			CommandID:      s.CommandID,
+			BatchID:        b.BatchID,
+			AgentID:        s.AgentID,
+			Name:           req.Name,
+			Args:           req.Args,
+			TimeoutSeconds: timeout,
+			Signed:         true,
+			ExpiresAt:      s.Expires.UTC(),
+			signature:      s.Signature,
+		})
+	}
+	h.mu.Unlock()
+	if err := h.queue.add(now, cmds...); err != nil {
+		return Batch{}, err
+	}
+	for _, c := range cmds {
+		b.Commands = append(b.Commands, *c)
+	}
+	queueLog.Info("queued signed", "name", req.Name, "batch_id", b.BatchID, "agents", len(cmds))
+	return b, nil
+}
+
+func supports(st *AgentState, name string) bool {
+	for _, c := range st.Commands {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+package collector
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	pb "go-agent/proto/agentv1"
+)
+
+func TestCommandQueue(t *testing.T) {
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	// step is one thing that happens to command "c", queued at t0 for
+	// agent "a" and expiring at t0+10m
+	type step struct {
+		at     time.Duration
+		op     string // deliver, result, expire
+		status pb.CommandResult_Status
+		agent  string
+	}
+	deliver := func(at time.Duration) step { return step{at: at, op: "deliver"} }
+	result := func(at time.Duration, s pb.CommandResult_Status) step { return step{at: at, op: "result", status: s} }
+	expire := func(at time.Duration) step { return step{at: at, op: "expire"} }
+
+	for _, tc := range []struct {
+		name    string
+		steps   []step
+		want    string // state, or "" if no longer tracked
+		pending bool   // still waiting to be delivered
+	}{
+		{"queued", nil, StateQueued, true},
+		{"delivered", []step{deliver(time.Second)}, StateDelivered, false},
+		{"running", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_RUNNING)}, StateRunning, false},
+		{"succeeded", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_OK)}, StateSucceeded, false},
+		{"failed", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_ERROR)}, StateFailed, false},
+		{"bad signature", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_BAD_SIGNATURE)}, StateRejected, false},
+		{"expired by the agent", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_EXPIRED)}, StateExpired, false},
+		{"result for another agent", []step{deliver(time.Second), {at: 2 * time.Second, op: "result", status: pb.CommandResult_OK, agent: "b"}}, StateDelivered, false},
+		{"result before delivery was seen", []step{result(time.Second, pb.CommandResult_OK)}, StateSucceeded, false},
+		{"not delivered in time", []step{expire(11 * time.Minute)}, StateExpired, false},
+		{"not started in time", []step{deliver(time.Second), expire(11 * time.Minute)}, StateExpired, false},
+		{"not expired yet", []step{deliver(time.Second), expire(9 * time.Minute)}, StateDelivered, false},
+		{"late start", []step{deliver(time.Second), expire(11 * time.Minute), result(11*time.Minute+time.Second, pb.CommandResult_RUNNING)}, StateRunning, false},
+		{"late result", []step{deliver(time.Second), expire(11 * time.Minute), result(11*time.Minute+time.Second, pb.CommandResult_OK)}, StateSucceeded, false},
+		{"late start reported expired", []step{deliver(time.Second), expire(11 * time.Minute), result(11*time.Minute+time.Second, pb.CommandResult_EXPIRED)}, StateExpired, false},
+		{"expired before delivery stays expired", []step{expire(11 * time.Minute), result(11*time.Minute+time.Second, pb.CommandResult_OK)}, StateExpired, false},
+		{"result after the final one", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_CANCELLED), result(3*time.Second, pb.CommandResult_OK)}, StateCancelled, false},
+		{"agent went silent", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_RUNNING), expire(2*time.Second + partialTTL + time.Second)}, StateFailed, false},
+		{"forgotten", []step{deliver(time.Second), result(2*time.Second, pb.CommandResult_OK), expire(2*time.Second + keepFinished + time.Second)}, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newCommandQueue()
+			c := &QueuedCommand{CommandID: "c", AgentID: "a", Name: "ping"}
+			prepare(c, 10*time.Minute, t0)
+			if err := q.add(t0, c); err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.steps {
+				now := t0.Add(s.at)
+				switch s.op {
+				case "deliver":
+					if got := q.deliver("a", now); len(got) != 1 || got[0].GetCommandId() != "c" || got[0].GetExpires() == nil {
+						t.Fatalf("deliver = %v", got)
+					}
+				case "result":
+					agent := s.agent
+					if agent == "" {
+						agent = "a"
+					}
+					res := &pb.CommandResult{CommandId: "c", Status: s.status, More: s.status == pb.CommandResult_RUNNING}
+					var final *CommandResult
+					if !res.More {
+						final = &CommandResult{CommandID: "c", Status: s.status.String(), Time: now}
+					}
+					q.update(agent, res, final, now)
+				case "expire":
+					q.expire(now)
+				}
+			}
+
+			got, err := q.Get("c")
+			switch {
+			case tc.want == "":
+				if !errors.Is(err, ErrNoCommand) {
+					t.Fatalf("Get = %+v, %v; want it forgotten", got, err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case got.State != tc.want:
+				t.Fatalf("state = %s; want %s", got.State, tc.want)
+			case got.finished() != (got.FinishedAt != nil):
+				t.Fatalf("state %s with finished_at %v", got.State, got.FinishedAt)
+			}
+			if pending := len(q.deliver("a", t0.Add(time.Hour))) > 0; pending != tc.pending {
+				t.Errorf("pending = %v; want %v", pending, tc.pending)
+			}
+		})
+	}
+}
+
+func TestEnqueueSigned(t *testing.T) {
+	h := &Handler{
+		agents: map[string]*AgentState{
+			"a": {Commands: []CommandSpec{{Name: "ping"}}, RequiresSigned: true, MaxSignedTTL: time.Hour},
+			"b": {Commands: []CommandSpec{{Name: "ping"}}},
+		},
+		queue: newCommandQueue(),
+	}
+	in := func(d time.Duration) time.Time { return time.Now().Add(d) }
+	target := func(agent, id string, expires time.Time) SignedTarget {
+		return SignedTarget{AgentID: agent, CommandID: id, Expires: expires, Signature: []byte("sig")}
+	}
+
+	b, err := h.Enqueue(EnqueueRequest{Name: "ping", Args: []byte(`{ "n" : 1 }`), Signed: []SignedTarget{target("a", "s1", in(time.Minute)), target("b", "s2", in(time.Minute))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Commands) != 2 || !b.Commands[0].Signed || string(b.Commands[0].Args) != `{"n":1}` {
+		t.Fatalf("batch = %+v", b)
+	}
+	if cmds := h.queue.deliver("a", time.Now()); len(cmds) != 1 || string(cmds[0].GetSignature()) != "sig" || cmds[0].GetArgsJson() != `{"n":1}` {
+		t.Fatalf("delivered = %v", cmds)
+	}
+
+	for _, tc := range []struct {
+		name string
+		req  EnqueueRequest
+		want string
+	}{
+		{"no targets", EnqueueRequest{Name: "ping", Signed: []SignedTarget{}}, errNoTargets.Error()},
+		{"unknown agent", EnqueueRequest{Name: "ping", Signed: []SignedTarget{target("x", "e1", in(time.Minute))}}, ErrUnknownAgent.Error()},
+		{"unsupported", EnqueueRequest{Name: "exec", Signed: []SignedTarget{target("a", "e2", in(time.Minute))}}, "does not support"},
+		{"no signature", EnqueueRequest{Name: "ping", Signed: []SignedTarget{{AgentID: "a", CommandID: "e3", Expires: in(time.Minute)}}}, "need a command_id and signature"},
+		{"no command id", EnqueueRequest{Name: "ping", Signed: []SignedTarget{target("a", "", in(time.Minute))}}, "need a command_id and signature"},
+		{"expired", EnqueueRequest{Name: "ping", Signed: []SignedTarget{target("a", "e4", in(-time.Minute))}}, "expires must be in the next"},
+		{"beyond the collector limit", EnqueueRequest{Name: "ping", Signed: []SignedTarget{target("b", "e5", in(maxCommandTTL+time.Hour))}}, "expires must be in the next"},
+		{"beyond the agent limit", EnqueueRequest{Name: "ping", Signed: []SignedTarget{target("a", "e6", in(2*time.Hour))}}, "at most 1h0m0s ahead"},
+		{"id taken", EnqueueRequest{Name: "ping", Signed: []SignedTarget{target("b", "e7", in(time.Minute)), target("a", "s1", in(time.Minute))}}, ErrCommandExists.Error()},
+		{"args not an object", EnqueueRequest{Name: "ping", Args: []byte(`[1]`), Signed: []SignedTarget{target("a", "e8", in(time.Minute))}}, "args must be a JSON object"},
+		{"unsigned for an agent requiring signatures", EnqueueRequest{Name: "ping", AgentID: "a"}, "only runs signed commands"},
+	} {
+		if _, err := h.Enqueue(tc.req); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v; want %q", tc.name, err, tc.want)
+		}
+	}
+	// a failed request queues none of its commands
+	if _, err := h.queue.Get("e7"); !errors.Is(err, ErrNoCommand) {
+		t.Errorf("e7 queued by a request that failed: %v", err)
+	}
+}
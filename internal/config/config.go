@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"time"
 )
 
@@ -12,46 +11,465 @@ type Duration struct {
 	time.Duration
 }
 
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON only parses; which values are in range is up to Validate,
+// since some durations take 0 to disable a feature.
 func (d *Duration) UnmarshalJSON(b []byte) error {
 	var s string
 	if err := json.Unmarshal(b, &s); err != nil {
-		return errors.New(`interval must be a string like "1s"`)
+		return errors.New(`expected a duration like "1s"`)
 	}
 	v, err := time.ParseDuration(s)
 	if err != nil {
-		return fmt.Errorf("invalid interval %q: %w", s, err)
-	}
-	if v <= 0 {
-		return errors.New("interval must be > 0")
+		return fmt.Errorf("invalid duration %q: %w", s, err)
 	}
 	d.Duration = v
 	return nil
 }
 
+const (
+	OutputGRPC   = "grpc"
+	OutputInflux = "influx"
+	OutputStatsD = "statsd"
+)
+
+// OutputConfig selects one metric sink. Fields that do not apply to the
+// chosen Type are ignored.
+type OutputConfig struct {
+	Type string `json:"type"`
+
+	// influx: "file", "udp" or "http"
+	Transport string `json:"transport,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Token     string `json:"token,omitempty"`
+
+	// statsd
+	Prefix    string `json:"prefix,omitempty"`
+	DogStatsD bool   `json:"dogstatsd,omitempty"`
+
+	// udp payload limit in bytes (influx udp, statsd)
+	MaxPacketSize int `json:"max_packet_size,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// BufferConfig controls the on-disk queue holding metric batches the
+// collector could not accept. Buffering is disabled while Dir is empty.
+type BufferConfig struct {
+	Dir          string   `json:"dir"`
+	MaxBytes     int64    `json:"max_bytes"`
+	MaxAge       Duration `json:"max_age"`
+	SegmentBytes int64    `json:"segment_bytes"`
+	// ReplayBatch caps how many buffered batches are resent per tick.
+	ReplayBatch int `json:"replay_batch"`
+}
+
+// BatchConfig groups several collection ticks into one MetricBatch RPC.
+// A batch is flushed when any configured limit is reached; with no limits
+// set every tick is sent on its own.
+type BatchConfig struct {
+	MaxPoints     int      `json:"max_points"`
+	MaxBytes      int      `json:"max_bytes"`
+	FlushInterval Duration `json:"flush_interval"`
+	// Compression is "", "gzip" or "zstd".
+	Compression string          `json:"compression"`
+	Aggregate   AggregateConfig `json:"aggregate"`
+}
+
+// AggregateConfig reduces matching metrics to min/max/avg/last over a
+// fixed, wall-clock aligned window before they are batched.
+type AggregateConfig struct {
+	Window Duration        `json:"window"`
+	Rules  []AggregateRule `json:"rules"`
+}
+
+type AggregateRule struct {
+	// Match is an exact metric name, a prefix pattern like "cpu.*" or "*".
+	Match     string   `json:"match"`
+	Functions []string `json:"functions"`
+}
+
+// CollectorConfig describes how the gRPC output reaches the collector.
+type CollectorConfig struct {
+	// Endpoints are "host:port" addresses. A single DNS name that resolves
+	// to several addresses is balanced across all of them.
+	Endpoints []string `json:"endpoints"`
+	// LoadBalancing is "pick_first" (use the first healthy endpoint, fail
+	// over in order) or "round_robin". Round robin needs collectors that
+	// share agent state; re-registration covers the gap otherwise.
+	LoadBalancing string           `json:"load_balancing"`
+	Timeouts      TimeoutConfig    `json:"timeouts"`
+	Retry         RetryConfig      `json:"retry"`
+	TLS           TLSConfig        `json:"tls"`
+	Enrollment    EnrollmentConfig `json:"enrollment"`
+}
+
+// EnrollmentConfig holds the bootstrap token presented on first
+// registration when the collector requires enrollment. The credential
+// issued in exchange is kept in state_dir.
+type EnrollmentConfig struct {
+	BootstrapToken string `json:"bootstrap_token"`
+	// BootstrapTokenFile is read at each registration attempt, e.g. a
+	// mounted Secret.
+	BootstrapTokenFile string `json:"bootstrap_token_file"`
+}
+
+// TLSConfig secures the collector connection. Files are re-read when they
+// change, so rotated certificates are picked up without a reload.
+type TLSConfig struct {
+	Enabled bool `json:"enabled"`
+	// CAFile verifies the collector; empty uses the system roots.
+	CAFile string `json:"ca_file"`
+	// CertFile and KeyFile are the client certificate for mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// ServerName overrides the name expected in the collector certificate.
+	ServerName string `json:"server_name"`
+}
+
+type TimeoutConfig struct {
+	Connect   Duration `json:"connect"`
+	Register  Duration `json:"register"`
+	Heartbeat Duration `json:"heartbeat"`
+	Metrics   Duration `json:"metrics"`
+	Command   Duration `json:"command"`
+}
+
+// RetryConfig is the backoff for (re-)registration and reconnects.
+type RetryConfig struct {
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	Multiplier     float64  `json:"multiplier"`
+	// Jitter is the fraction of the backoff added at random, 0..1.
+	Jitter float64 `json:"jitter"`
+}
+
+// ReloadConfig controls picking up configuration changes at runtime.
+// SIGHUP always triggers a reload; Watch adds reloading on file changes.
+type ReloadConfig struct {
+	Watch bool `json:"watch"`
+	// Debounce coalesces bursts of file events into one reload.
+	Debounce Duration `json:"debounce"`
+}
+
+// HealthConfig serves /healthz and /readyz for liveness and readiness
+// probes.
+type HealthConfig struct {
+	// Listen is the address to serve on, e.g. ":8081"; empty disables it.
+	Listen string `json:"listen"`
+	// MaxSendAge is how long the agent stays ready without a successful
+	// send to the collector.
+	MaxSendAge Duration `json:"max_send_age"`
+}
+
+// DebugConfig serves the agent's runtime profiles over HTTP.
+type DebugConfig struct {
+	// Listen is a loopback address, e.g. "127.0.0.1:6060", to serve
+	// net/http/pprof on under /debug/pprof/; empty disables it.
+	Listen string `json:"listen"`
+}
+
+// BudgetConfig bounds the agent's own resource use. When it is exceeded
+// the agent throttles itself step by step: longer intervals first, then
+// low-priority collectors are switched off.
+type BudgetConfig struct {
+	// CPUPercent is the share of one core the agent may use; 0 disables
+	// the CPU budget.
+	CPUPercent float64 `json:"cpu_percent"`
+	// MemoryBytes bounds the agent's resident memory and is also applied
+	// as the Go runtime soft memory limit; 0 disables it.
+	MemoryBytes int64 `json:"memory_bytes"`
+	// MaxInterval caps how far the interval is stretched; zero allows up
+	// to eight times the configured interval.
+	MaxInterval Duration `json:"max_interval"`
+}
+
+// CommandsConfig controls how commands sent by the collector are run.
+type CommandsConfig struct {
+	// Workers is how many commands run at once.
+	Workers int `json:"workers"`
+	// Queue bounds the commands waiting for a worker; more are refused.
+	Queue int `json:"queue"`
+	// Timeout applies to commands the collector sent without one.
+	Timeout Duration `json:"timeout"`
+	// MaxTimeout caps the timeout the collector may ask for.
+	MaxTimeout Duration `json:"max_timeout"`
+
+	Exec    ExecConfig    `json:"exec"`
+	Files   FilesConfig   `json:"files"`
+	Bundle  BundleConfig  `json:"bundle"`
+	Process ProcessConfig `json:"process"`
+
+	Signing SigningConfig `json:"signing"`
+}
+
+// SigningConfig makes the agent run only commands an operator signed.
+type SigningConfig struct {
+	// PublicKeys are the ed25519 keys a command may be signed with, as
+	// base64 of the raw key or a PEM public key. With none, commands need
+	// no signature.
+	PublicKeys []string `json:"public_keys"`
+	// MaxTTL is the furthest in the future a signed command may expire.
+	// The ids of commands run are remembered until they expire, so none
+	// runs twice.
+	MaxTTL Duration `json:"max_ttl"`
+}
+
+// BundleConfig selects what the support-bundle command gathers besides the
+// agent's own logs, config, recent samples and command results.
+type BundleConfig struct {
+	// Proc are paths under /proc, e.g. "meminfo" or "self/status".
+	Proc []string `json:"proc"`
+	// Cgroup are cgroup v2 file names, e.g. "memory.stat", read from the
+	// agent's own cgroup and from the root one.
+	Cgroup []string `json:"cgroup"`
+	// Redact are regular expressions masked in every file of the bundle,
+	// on top of built-in ones for passwords, tokens and private keys. Only
+	// the first group is masked in a pattern that has one.
+	Redact []string `json:"redact"`
+	// MaxBytes caps the compressed bundle.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// FilesConfig lets file.read and file.list see the trees under Roots.
+type FilesConfig struct {
+	// Roots are absolute directories. Nothing outside them can be read,
+	// not even through a symlink inside. Nothing is allowed by default.
+	Roots []string `json:"roots"`
+	// MaxReadBytes caps what one file.read returns.
+	MaxReadBytes int64 `json:"max_read_bytes"`
+	// MaxListEntries caps what one file.list returns.
+	MaxListEntries int `json:"max_list_entries"`
+}
+
+// ProcessConfig gates the commands that signal, renice and freeze
+// processes. Nothing is allowed by default, and PID 1, kernel threads and
+// the agent itself are never touched.
+type ProcessConfig struct {
+	// Names are regular expressions matching the whole name
+	// (/proc/<pid>/comm) of the processes that may be signalled or
+	// reniced.
+	Names []string `json:"names"`
+	// Users, if set, also requires those processes to run as one of these
+	// users, by name or id.
+	Users []string `json:"users"`
+	// Signals are what proc.signal may send, by name, e.g. "TERM".
+	Signals []string `json:"signals"`
+	// Renice allows proc.renice; MinNice is the lowest nice value it may
+	// set, so 0 allows lowering priorities only.
+	Renice  bool `json:"renice"`
+	MinNice int  `json:"min_nice"`
+	// Cgroups are cgroup v2 paths relative to /sys/fs/cgroup that may be
+	// frozen, each with everything below it. One holding the agent never
+	// is.
+	Cgroups []string `json:"cgroups"`
+	// MaxProcesses caps how many processes one proc.signal or
+	// proc.renice may act on; one matching more is refused.
+	MaxProcesses int `json:"max_processes"`
+}
+
+// ExecConfig lets the exec command run a fixed set of programs. Nothing is
+// allowed by default.
+type ExecConfig struct {
+	Allow []ExecRule `json:"allow"`
+	// User and Group the programs run as when the agent runs as root, by
+	// name or id. User must be set when Allow is not empty; Group defaults
+	// to the user's primary group.
+	User  string `json:"user"`
+	Group string `json:"group"`
+	// MaxOutputBytes caps what is kept of stdout and of stderr.
+	MaxOutputBytes int64 `json:"max_output_bytes"`
+	// Env is the programs' whole environment besides PATH, LANG and HOME;
+	// nothing is inherited from the agent.
+	Env map[string]string `json:"env"`
+}
+
+// ExecRule allows one program with arguments of a given shape.
+type ExecRule struct {
+	// Path is the program's absolute path.
+	Path string `json:"path"`
+	// Args are regular expressions, one per argument, each matching the
+	// whole argument. The invocation must have exactly as many arguments,
+	// so several rules are needed for optional ones.
+	Args []string `json:"args"`
+}
+
+// ProcsConfig selects processes reported individually as
+// proc.running.<name>, e.g. to alert when one is missing.
+type ProcsConfig struct {
+	// Watch lists process names as shown in /proc/<pid>/comm.
+	Watch []string `json:"watch"`
+}
+
+// AlertsConfig holds rules the agent evaluates on every sample, reporting
+// firing and resolved alerts to the collector as events.
+type AlertsConfig struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+// AlertRule goes pending when its condition holds, fires once it has held
+// for For, and resolves when it no longer holds; threshold rules resolve
+// only once the value is back across Clear.
+type AlertRule struct {
+	Name string `json:"name"`
+	// Metric is a name from the sample stream, e.g. "disk.used_percent".
+	Metric string `json:"metric"`
+	// Op is ">", ">=", "<", "<=", "increase" (the value grew since the
+	// previous sample) or "absent" (the metric is missing from a sample).
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+	// Clear is the value a firing threshold alert resolves at; unset
+	// means Value.
+	Clear *float64 `json:"clear,omitempty"`
+	// For is how long the condition must hold before the alert fires. An
+	// increase rule fires at once and For is how long it stays firing
+	// after the last increase.
+	For Duration `json:"for"`
+	// Severity is "warning" (default) or "critical".
+	Severity string `json:"severity"`
+}
+
+// LogConfig controls the agent's own log output.
+type LogConfig struct {
+	// Format is "text" or "json".
+	Format string `json:"format"`
+	// Level is the default level: debug, info, warn or error.
+	Level string `json:"level"`
+	// Levels overrides the level per component, e.g. {"collect": "error"}.
+	Levels map[string]string `json:"levels"`
+	// Timezone is the IANA zone log times are shown in, e.g.
+	// "America/New_York". Samples always travel in UTC.
+	Timezone string `json:"timezone"`
+}
+
 type Config struct {
 	Interval Duration `json:"interval"`
+	// StateDir holds files that must survive restarts, like the agent
+	// identity.
+	StateDir string `json:"state_dir"`
+	// Labels identify the agent to the collector, which uses them together
+	// with the hostname to pick a managed config document.
+	Labels    map[string]string `json:"labels"`
+	Collector CollectorConfig   `json:"collector"`
+	Outputs   []OutputConfig    `json:"outputs"`
+	Buffer    BufferConfig      `json:"buffer"`
+	Batch     BatchConfig       `json:"batch"`
+	Reload    ReloadConfig      `json:"reload"`
+	Health    HealthConfig      `json:"health"`
+	Debug     DebugConfig       `json:"debug"`
+	Log       LogConfig         `json:"log"`
+	Budget    BudgetConfig      `json:"budget"`
+	Procs     ProcsConfig       `json:"procs"`
+	Alerts    AlertsConfig      `json:"alerts"`
+	Commands  CommandsConfig    `json:"commands"`
 }
 
 func Default() Config {
 	return Config{
 		Interval: Duration{Duration: time.Second},
+		StateDir: "/var/lib/go-agent",
+		Collector: CollectorConfig{
+			Endpoints:     []string{"127.0.0.1:50051"},
+			LoadBalancing: "pick_first",
+			Timeouts: TimeoutConfig{
+				Connect:   Duration{Duration: 3 * time.Second},
+				Register:  Duration{Duration: 5 * time.Second},
+				Heartbeat: Duration{Duration: 3 * time.Second},
+				Metrics:   Duration{Duration: 5 * time.Second},
+				Command:   Duration{Duration: 3 * time.Second},
+			},
+			Retry: RetryConfig{
+				InitialBackoff: Duration{Duration: time.Second},
+				MaxBackoff:     Duration{Duration: 30 * time.Second},
+				Multiplier:     2,
+				Jitter:         0.2,
+			},
+		},
+		Outputs: []OutputConfig{{Type: OutputGRPC}},
+		Buffer: BufferConfig{
+			MaxBytes:     64 << 20,
+			MaxAge:       Duration{Duration: 24 * time.Hour},
+			SegmentBytes: 4 << 20,
+			ReplayBatch:  50,
+		},
+		Reload: ReloadConfig{
+			Watch:    true,
+			Debounce: Duration{Duration: time.Second},
+		},
+		Health: HealthConfig{
+			MaxSendAge: Duration{Duration: 2 * time.Minute},
+		},
+		Log: LogConfig{
+			Format:   "text",
+			Level:    "info",
+			Timezone: "UTC",
+		},
+		Commands: CommandsConfig{
+			Workers:    2,
+			Queue:      32,
+			Timeout:    Duration{Duration: time.Minute},
+			MaxTimeout: Duration{Duration: 30 * time.Minute},
+			Exec: ExecConfig{
+				User:           "nobody",
+				MaxOutputBytes: 1 << 20,
+			},
+			Files: FilesConfig{
+				MaxReadBytes:   8 << 20,
+				MaxListEntries: 10000,
+			},
+			Bundle: BundleConfig{
+				Proc: []string{
+					"version", "uptime", "loadavg", "meminfo", "stat", "vmstat",
+					"pressure/cpu", "pressure/memory", "pressure/io",
+					"mounts", "cgroups", "net/dev", "net/snmp", "net/sockstat",
+					"sys/fs/file-nr", "self/status", "self/limits", "self/cgroup",
+				},
+				Cgroup: []string{
+					"cgroup.controllers", "cpu.stat", "cpu.max", "cpu.pressure",
+					"memory.current", "memory.max", "memory.stat", "memory.events",
+					"memory.pressure", "io.stat", "io.pressure", "pids.current", "pids.max",
+				},
+				MaxBytes: 32 << 20,
+			},
+			Process: ProcessConfig{
+				MaxProcesses: 16,
+			},
+			Signing: SigningConfig{
+				MaxTTL: Duration{Duration: 24 * time.Hour},
+			},
+		},
 	}
 }
 
-func Load(path string) (Config, error) {
-	cfg := Default()
-	if path == "" {
-		return cfg, nil
+// HasOutput reports whether an output of the given type is configured.
+func (c Config) HasOutput(typ string) bool {
+	for _, o := range c.Outputs {
+		if o.Type == typ {
+			return true
+		}
 	}
+	return false
+}
 
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return Config{}, fmt.Errorf("read config: %w", err)
+// Redacted returns a copy with credentials masked, for printing.
+func (c Config) Redacted() Config {
+	out := c
+	out.Outputs = make([]OutputConfig, len(c.Outputs))
+	for i, o := range c.Outputs {
+		if o.Token != "" {
+			o.Token = redactedValue
+		}
+		out.Outputs[i] = o
 	}
-
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return Config{}, fmt.Errorf("parse config json: %w", err)
+	if out.Collector.Enrollment.BootstrapToken != "" {
+		out.Collector.Enrollment.BootstrapToken = redactedValue
 	}
-
-	return cfg, nil
+	return out
 }
+
+const redactedValue = "<redacted>"
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Diff returns the top-level keys whose values differ between a and b, in
+// schema order.
+func Diff(a, b Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonName(t.Field(i))
+		if key == "" {
+			continue
+		}
+		if !sameJSON(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// sameJSON compares by encoded form, with nil and empty collections, which
+// load identically, taken as equal so they are not reported as changes.
+func sameJSON(a, b any) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	var da, db any
+	if json.Unmarshal(ja, &da) != nil || json.Unmarshal(jb, &db) != nil {
+		return string(ja) == string(jb)
+	}
+	return equalJSON(da, db)
+}
+
+// equalJSON compares decoded JSON values, taking null as an empty array or
+// object.
+func equalJSON(a, b any) bool {
+	switch x := a.(type) {
+	case nil:
+		return emptyJSON(b)
+	case []any:
+		y, ok := b.([]any)
+		if !ok {
+			return len(x) == 0 && b == nil
+		}
+		if len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalJSON(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok {
+			return len(x) == 0 && b == nil
+		}
+		if len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !equalJSON(v, w) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func emptyJSON(v any) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case []any:
+		return len(x) == 0
+	case map[string]any:
+		return len(x) == 0
+	}
+	return false
+}
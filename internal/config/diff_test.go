@@ -0,0 +1,22 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	a, b := Default(), Default()
+	a.Labels, b.Labels = nil, map[string]string{}
+	a.Outputs, b.Outputs = nil, []OutputConfig{}
+	a.Commands.Exec.Allow, b.Commands.Exec.Allow = nil, []ExecRule{}
+	if d := Diff(a, b); len(d) != 0 {
+		t.Fatalf("nil and empty differ in %v", d)
+	}
+
+	b.Labels = map[string]string{"env": "prod"}
+	b.Commands.Exec.Allow = []ExecRule{{Path: "/usr/bin/df"}}
+	if d := Diff(a, b); !slices.Equal(d, []string{"labels", "commands"}) {
+		t.Fatalf("Diff = %v", d)
+	}
+}
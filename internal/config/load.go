@@ -0,0 +1,628 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix marks environment variables that override config keys.
+// AGENT_COLLECTOR_TIMEOUTS_HEARTBEAT=5s sets collector.timeouts.heartbeat;
+// underscores inside key names are matched against the schema, so
+// AGENT_STATE_DIR maps to state_dir. Variables that match no key are
+// ignored, since Kubernetes injects AGENT_* service variables on its own.
+const EnvPrefix = "AGENT_"
+
+const includeKey = "include"
+
+var durationType = reflect.TypeOf(Duration{})
+
+// Load builds the effective configuration. Sources in increasing order of
+// precedence: built-in defaults, the file at path (JSON, or YAML for .yaml
+// and .yml) followed by the files it includes, an optional overlay, and
+// AGENT_* environment variables. String values in files may reference
+// ${VAR} or ${VAR:-default}; "$$" yields a literal "$". Unknown keys, type
+// errors and validation failures are all reported together.
+func Load(path string) (Config, error) {
+	cfg, _, err := LoadWithFiles(path)
+	return cfg, err
+}
+
+// LoadWithFiles is Load that also returns every file that was read, the
+// main file first, so callers can watch them for changes.
+func LoadWithFiles(path string) (Config, []string, error) {
+	return LoadWithOverlay(path, nil)
+}
+
+// Overlay is a config document layered between the local files and the
+// environment, such as one distributed by the collector. It may not use
+// include.
+type Overlay struct {
+	Name   string
+	Format string // "json" or "yaml"
+	Body   []byte
+}
+
+// LoadWithOverlay is LoadWithFiles with ov, if not nil, merged on top of
+// the local files.
+func LoadWithOverlay(path string, ov *Overlay) (Config, []string, error) {
+	var files []string
+	cfg, err := load(path, ov, os.Environ(), &files)
+	return cfg, files, err
+}
+
+// overlayKeys are the top-level keys a collector-pushed overlay may set.
+// Everything else, like where the agent connects, its credentials and
+// where it writes on disk, may only be set in local config.
+var overlayKeys = map[string]bool{
+	"interval": true,
+	"batch":    true,
+	"alerts":   true,
+	"log":      true,
+	"procs":    true,
+	"labels":   true,
+	"outputs":  true,
+}
+
+// checkOverlay rejects overlay keys outside overlayKeys, outputs that
+// write to a local file and outputs without the grpc output, which would
+// cut the agent off from the collector that could correct them.
+func checkOverlay(t map[string]any) error {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !overlayKeys[k] {
+			return fmt.Errorf("%s may only be set in local config", k)
+		}
+	}
+	if _, ok := t["outputs"]; !ok {
+		return nil
+	}
+	outs, _ := t["outputs"].([]any)
+	grpc := false
+	for i, o := range outs {
+		m, _ := o.(map[string]any)
+		if m["transport"] == "file" || m["path"] != nil {
+			return fmt.Errorf("outputs[%d]: file outputs may only be set in local config", i)
+		}
+		grpc = grpc || m["type"] == OutputGRPC
+	}
+	if !grpc {
+		return fmt.Errorf("outputs: must keep the %s output", OutputGRPC)
+	}
+	return nil
+}
+
+func load(path string, ov *Overlay, environ []string, files *[]string) (Config, error) {
+	tree := map[string]any{}
+	var errs []error
+
+	if path != "" {
+		t, err := readTree(path, nil, files)
+		if err != nil {
+			return Config{}, err
+		}
+		tree = t
+	}
+	var ovTree map[string]any
+	if ov != nil {
+		t, err := parseTree("overlay."+ov.Format, ov.Body)
+		if err != nil {
+			return Config{}, fmt.Errorf("overlay %s: %w", ov.Name, err)
+		}
+		if _, ok := t[includeKey]; ok {
+			return Config{}, fmt.Errorf("overlay %s: include is not allowed", ov.Name)
+		}
+		if err := checkOverlay(t); err != nil {
+			return Config{}, fmt.Errorf("overlay %s: %w", ov.Name, err)
+		}
+		ovTree = t
+	}
+	errs = append(errs, interpolate(tree, "", envMap(environ))...)
+	// the overlay is merged after interpolation so that ${VAR} in it is
+	// never filled from the agent's environment
+	if ov != nil {
+		merge(tree, ovTree)
+	}
+	errs = append(errs, applyEnv(tree, environ)...)
+	// invalid entries are pruned so that validation still sees the rest
+	schemaErrs, _ := checkSchema(reflect.TypeOf(Config{}), tree, "")
+	errs = append(errs, schemaErrs...)
+
+	cfg := Default()
+	b, err := json.Marshal(tree)
+	if err != nil {
+		return Config{}, fmt.Errorf("encode config: %w", err)
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, fmt.Errorf("decode config: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// readTree parses one file and merges its includes on top of it. Include
+// patterns are globs relative to the including file; a pattern without
+// wildcards must match an existing file.
+func readTree(path string, stack []string, files *[]string) (map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(stack, abs) {
+		return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	if files != nil {
+		*files = append(*files, abs)
+	}
+	tree, err := parseTree(path, b)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := tree[includeKey]
+	if !ok {
+		return tree, nil
+	}
+	delete(tree, includeKey)
+
+	var patterns []string
+	switch v := raw.(type) {
+	case string:
+		patterns = []string{v}
+	case []any:
+		for _, p := range v {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: include entries must be strings", path)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a string or a list", path)
+	}
+
+	for _, pat := range patterns {
+		if !filepath.IsAbs(pat) {
+			pat = filepath.Join(filepath.Dir(abs), pat)
+		}
+		matches, err := filepath.Glob(pat)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %q: %w", path, pat, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pat, "*?[") {
+			return nil, fmt.Errorf("%s: include %q: no such file", path, pat)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			sub, err := readTree(m, append(stack, abs), files)
+			if err != nil {
+				return nil, err
+			}
+			merge(tree, sub)
+		}
+	}
+	return tree, nil
+}
+
+func parseTree(path string, b []byte) (map[string]any, error) {
+	tree := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &tree); err != nil {
+			return nil, fmt.Errorf("parse config yaml %s: %w", path, err)
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		if err := dec.Decode(&tree); err != nil {
+			return nil, fmt.Errorf("parse config json %s: %w", path, err)
+		}
+	}
+	if tree == nil {
+		tree = map[string]any{}
+	}
+	return tree, nil
+}
+
+// merge copies src into dst. Mappings are merged key by key; any other
+// value, lists included, replaces what was there.
+func merge(dst, src map[string]any) {
+	for k, sv := range src {
+		sm, sok := sv.(map[string]any)
+		dm, dok := dst[k].(map[string]any)
+		if sok && dok {
+			merge(dm, sm)
+			continue
+		}
+		dst[k] = sv
+	}
+}
+
+func envMap(environ []string) map[string]string {
+	m := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func interpolate(v any, path string, env map[string]string) []error {
+	var errs []error
+	switch t := v.(type) {
+	case map[string]any:
+		for _, k := range sortedKeys(t) {
+			sv := t[k]
+			p := joinPath(path, k)
+			if s, ok := sv.(string); ok {
+				r, err := expand(s, env)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", p, err))
+				}
+				t[k] = r
+				continue
+			}
+			errs = append(errs, interpolate(sv, p, env)...)
+		}
+	case []any:
+		for i, sv := range t {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			if s, ok := sv.(string); ok {
+				r, err := expand(s, env)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", p, err))
+				}
+				t[i] = r
+				continue
+			}
+			errs = append(errs, interpolate(sv, p, env)...)
+		}
+	}
+	return errs
+}
+
+func expand(s string, env map[string]string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '$' || i+1 >= len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return s, fmt.Errorf("unterminated ${ in %q", s)
+			}
+			expr := s[i+2 : i+2+end]
+			name, def, hasDef := strings.Cut(expr, ":-")
+			if name == "" {
+				return s, fmt.Errorf("empty variable name in %q", s)
+			}
+			val, ok := env[name]
+			switch {
+			case ok && (val != "" || !hasDef):
+				b.WriteString(val)
+			case hasDef:
+				b.WriteString(def)
+			default:
+				return s, fmt.Errorf("variable %s is not set", name)
+			}
+			i += 2 + end
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func applyEnv(tree map[string]any, environ []string) []error {
+	sorted := slices.Clone(environ)
+	sort.Strings(sorted)
+
+	var errs []error
+	for _, kv := range sorted {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(k, EnvPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(k, EnvPrefix))
+		path, typ, ok := resolveEnvPath(reflect.TypeOf(Config{}), name)
+		if !ok {
+			continue
+		}
+		val, err := envValue(typ, v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k, err))
+			continue
+		}
+		setPath(tree, path, val)
+	}
+	return errs
+}
+
+func resolveEnvPath(t reflect.Type, name string) ([]string, reflect.Type, bool) {
+	if t == durationType {
+		return nil, nil, false
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := jsonName(f)
+			if key == "" {
+				continue
+			}
+			if name == key {
+				return []string{key}, f.Type, true
+			}
+			if rest, ok := strings.CutPrefix(name, key+"_"); ok {
+				if p, ft, ok := resolveEnvPath(f.Type, rest); ok {
+					return append([]string{key}, p...), ft, true
+				}
+			}
+		}
+	case reflect.Map:
+		if name != "" {
+			return []string{name}, t.Elem(), true
+		}
+	}
+	return nil, nil, false
+}
+
+// envValue converts an environment string according to the target type.
+// Lists of strings are comma separated, string maps are "k=v,k2=v2" and
+// anything more complex is parsed as YAML (which includes JSON).
+func envValue(t reflect.Type, s string) (any, error) {
+	if t == durationType {
+		return s, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return s, nil
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(s, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(s, 64)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			var out []any
+			for _, p := range strings.Split(s, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					out = append(out, p)
+				}
+			}
+			return out, nil
+		}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.String {
+			out := map[string]any{}
+			for _, p := range strings.Split(s, ",") {
+				if p = strings.TrimSpace(p); p == "" {
+					continue
+				}
+				k, v, ok := strings.Cut(p, "=")
+				if !ok {
+					return nil, fmt.Errorf("expected key=value, got %q", p)
+				}
+				out[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+			return out, nil
+		}
+	}
+
+	var v any
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func setPath(tree map[string]any, path []string, v any) {
+	m := tree
+	for _, k := range path[:len(path)-1] {
+		next, ok := m[k].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			m[k] = next
+		}
+		m = next
+	}
+	m[path[len(path)-1]] = v
+}
+
+// checkSchema walks the raw tree against the Config type and reports
+// unknown keys and values of the wrong type. Offending entries are removed
+// from the tree; the returned bool tells the caller to drop v itself.
+func checkSchema(t reflect.Type, v any, path string) ([]error, bool) {
+	if v == nil {
+		return nil, false
+	}
+	bad := func(format string, args ...any) ([]error, bool) {
+		return []error{fmt.Errorf("%s: %s", displayPath(path), fmt.Sprintf(format, args...))}, true
+	}
+
+	if t == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return bad(`expected a duration like "1s"`)
+		}
+		// ranges are checked by Validate
+		if _, err := time.ParseDuration(s); err != nil {
+			return bad("invalid duration %q", s)
+		}
+		return nil, false
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return bad("expected a mapping")
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			if key := jsonName(t.Field(i)); key != "" {
+				fields[key] = t.Field(i).Type
+			}
+		}
+		var errs []error
+		for _, k := range sortedKeys(m) {
+			ft, ok := fields[k]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown key", joinPath(path, k)))
+				delete(m, k)
+				continue
+			}
+			e, drop := checkSchema(ft, m[k], joinPath(path, k))
+			errs = append(errs, e...)
+			if drop {
+				delete(m, k)
+			}
+		}
+		return errs, false
+	case reflect.Map:
+		m, ok := v.(map[string]any)
+		if !ok {
+			return bad("expected a mapping")
+		}
+		var errs []error
+		for _, k := range sortedKeys(m) {
+			e, drop := checkSchema(t.Elem(), m[k], joinPath(path, k))
+			errs = append(errs, e...)
+			if drop {
+				delete(m, k)
+			}
+		}
+		return errs, false
+	case reflect.Slice:
+		l, ok := v.([]any)
+		if !ok {
+			return bad("expected a list")
+		}
+		// a list with an element of the wrong type goes whole: a zero
+		// element in its place would be reported again by Validate, and
+		// removing it would shift the indices of the rest
+		var errs []error
+		drop := false
+		for i, e := range l {
+			ee, d := checkSchema(t.Elem(), e, fmt.Sprintf("%s[%d]", path, i))
+			errs = append(errs, ee...)
+			drop = drop || d
+		}
+		return errs, drop
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			return bad("expected a string")
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			return bad("expected true or false")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !isInteger(v) {
+			return bad("expected an integer")
+		}
+	case reflect.Float32, reflect.Float64:
+		if !isNumber(v) {
+			return bad("expected a number")
+		}
+	}
+	return nil, false
+}
+
+func isInteger(v any) bool {
+	switch n := v.(type) {
+	case int, int64, uint64:
+		return true
+	case float64:
+		return n == float64(int64(n))
+	case json.Number:
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
+
+func isNumber(v any) bool {
+	switch n := v.(type) {
+	case int, int64, uint64, float64:
+		return true
+	case json.Number:
+		_, err := n.Float64()
+		return err == nil
+	}
+	return false
+}
+
+func jsonName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "-" || !f.IsExported() {
+		return ""
+	}
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "(root)"
+	}
+	return path
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad_LayersIncludesInterpolationAndEnv(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "agent.yaml"), `
+interval: 2s
+include: conf.d/*.yaml
+collector:
+  endpoints: ["${COLLECTOR_HOST:-localhost}:50051"]
+outputs:
+  - type: statsd
+    addr: "${STATSD_ADDR}"
+    prefix: "cost$$"
+`)
+	writeFile(t, filepath.Join(dir, "conf.d", "10-collector.yaml"), `
+collector:
+  load_balancing: round_robin
+`)
+	writeFile(t, filepath.Join(dir, "conf.d", "20-interval.json"), `{"interval": "9s"}`)
+	writeFile(t, filepath.Join(dir, "conf.d", "30-interval.yaml"), `interval: 5s`)
+
+	env := []string{
+		"STATSD_ADDR=127.0.0.1:8125",
+		"AGENT_COLLECTOR_TIMEOUTS_HEARTBEAT=7s",
+		"AGENT_STATE_DIR=/tmp/state",
+		"AGENT_BATCH_MAX_POINTS=100",
+		"AGENT_SERVICE_HOST=10.0.0.1", // injected by Kubernetes, ignored
+	}
+	cfg, err := load(filepath.Join(dir, "agent.yaml"), nil, env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Interval.Duration != 5*time.Second {
+		t.Errorf("interval = %s, want 5s from the last include", cfg.Interval.Duration)
+	}
+	if got := cfg.Collector.Endpoints; len(got) != 1 || got[0] != "localhost:50051" {
+		t.Errorf("endpoints = %v", got)
+	}
+	if cfg.Collector.LoadBalancing != "round_robin" {
+		t.Errorf("load_balancing = %q", cfg.Collector.LoadBalancing)
+	}
+	if cfg.Collector.Timeouts.Heartbeat.Duration != 7*time.Second {
+		t.Errorf("heartbeat timeout = %s", cfg.Collector.Timeouts.Heartbeat.Duration)
+	}
+	if cfg.Collector.Timeouts.Metrics.Duration != 5*time.Second {
+		t.Errorf("metrics timeout default lost: %s", cfg.Collector.Timeouts.Metrics.Duration)
+	}
+	if cfg.StateDir != "/tmp/state" || cfg.Batch.MaxPoints != 100 {
+		t.Errorf("env overrides: state_dir=%q max_points=%d", cfg.StateDir, cfg.Batch.MaxPoints)
+	}
+	if len(cfg.Outputs) != 1 || cfg.Outputs[0].Addr != "127.0.0.1:8125" || cfg.Outputs[0].Prefix != "cost$" {
+		t.Errorf("outputs = %+v", cfg.Outputs)
+	}
+}
+
+func TestLoad_ReportsAllErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.json")
+	writeFile(t, path, `{
+		"interval": "soon",
+		"colector": {},
+		"state_dir": "${MISSING}",
+		"batch": {"compression": "lz4", "max_points": "many"},
+		"outputs": [{"type": "influx", "transport": "carrier-pigeon"}],
+		"debug": {"listen": ":6060"},
+		"commands": {"exec": {"allow": [{"path": "/usr/bin/df"}], "user": ""}}
+	}`)
+
+	_, err := load(path, nil, []string{"AGENT_BATCH_MAX_BYTES=lots"}, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{
+		`interval: invalid duration "soon"`,
+		`colector: unknown key`,
+		`state_dir: variable MISSING is not set`,
+		`batch.max_points: expected an integer`,
+		`AGENT_BATCH_MAX_BYTES:`,
+		`batch.compression: unknown compression "lz4"`,
+		`outputs[0].transport: unknown influx transport "carrier-pigeon"`,
+		`debug.listen: must be a loopback address`,
+		`commands.exec.user: must be set when allow is not empty`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoad_DurationRangesAndLists(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.json")
+	// 0 disables these
+	writeFile(t, path, `{"health": {"max_send_age": "0s"}, "reload": {"debounce": "0s"}, "batch": {"flush_interval": "0s"}}`)
+	if _, err := load(path, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, path, `{
+		"interval": "-1s",
+		"collector": {"endpoints": ["127.0.0.1:4317", 5], "timeouts": {"connect": "0s"}}
+	}`)
+	_, err := load(path, nil, nil, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for want, n := range map[string]int{
+		"interval: must be > 0":                     1,
+		"collector.timeouts.connect: must be > 0":   1,
+		"collector.endpoints[1]: expected a string": 1,
+		"collector.endpoints[1]:":                   1,
+	} {
+		if got := strings.Count(err.Error(), want); got != n {
+			t.Errorf("%q reported %d times in:\n%v", want, got, err)
+		}
+	}
+}
+
+func TestLoad_IncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.yaml"), "include: b.yaml\n")
+	writeFile(t, filepath.Join(dir, "b.yaml"), "include: a.yaml\n")
+
+	if _, err := load(filepath.Join(dir, "a.yaml"), nil, nil, nil); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Fatalf("expected include cycle error, got %v", err)
+	}
+}
+
+func TestLoad_OverlayBetweenFilesAndEnv(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "agent.yaml"), `
+interval: 2s
+log:
+  level: info
+  format: text
+`)
+	ov := &Overlay{Name: "fleet", Format: "json", Body: []byte(`{"interval": "10s", "log": {"level": "debug", "format": "json"}}`)}
+	cfg, err := load(filepath.Join(dir, "agent.yaml"), ov, []string{"AGENT_LOG_LEVEL=warn"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Interval.Duration != 10*time.Second || cfg.Log.Format != "json" {
+		t.Errorf("interval = %s, log.format = %q, want the overlay's", cfg.Interval.Duration, cfg.Log.Format)
+	}
+	if cfg.Log.Level != "warn" {
+		t.Errorf("log.level = %q, want the env override", cfg.Log.Level)
+	}
+
+	ov = &Overlay{Name: "bad", Format: "yaml", Body: []byte("include: /etc/passwd\n")}
+	if _, err := load(filepath.Join(dir, "agent.yaml"), ov, nil, nil); err == nil || !strings.Contains(err.Error(), "include is not allowed") {
+		t.Fatalf("expected include rejection, got %v", err)
+	}
+}
+
+func TestLoad_OverlayNotInterpolated(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "agent.yaml"), "labels:\n  home: ${HOME}\n")
+	ov := &Overlay{Name: "fleet", Format: "json", Body: []byte(`{"labels": {"secret": "${SECRET}"}}`)}
+	cfg, err := load(filepath.Join(dir, "agent.yaml"), ov, []string{"HOME=/root", "SECRET=hunter2"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Labels["home"] != "/root" || cfg.Labels["secret"] != "${SECRET}" {
+		t.Errorf("labels = %v, want only the local file interpolated", cfg.Labels)
+	}
+}
+
+func TestLoad_OverlayRejectsLocalKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "agent.yaml"), "interval: 2s\n")
+	for _, tc := range []struct{ body, want string }{
+		{`{"commands": {"exec": {"allow": [{"path": "/bin/sh"}]}}}`, "commands may only be set in local config"},
+		{`{"collector": {"endpoints": ["evil:443"]}}`, "collector may only be set in local config"},
+		{`{"state_dir": "/tmp/x"}`, "state_dir may only be set in local config"},
+		{`{"buffer": {"dir": "/tmp/x"}}`, "buffer may only be set in local config"},
+		{`{"debug": {"listen": "127.0.0.1:6060"}}`, "debug may only be set in local config"},
+		{`{"health": {"listen": "127.0.0.1:8080"}}`, "health may only be set in local config"},
+		{`{"outputs": [{"type": "grpc"}, {"type": "influx", "transport": "file", "path": "/etc/cron.d/x"}]}`, "outputs[1]: file outputs may only be set in local config"},
+		{`{"outputs": [{"type": "statsd", "addr": "127.0.0.1:8125"}]}`, "outputs: must keep the grpc output"},
+		{`{"outputs": []}`, "outputs: must keep the grpc output"},
+	} {
+		ov := &Overlay{Name: "bad", Format: "json", Body: []byte(tc.body)}
+		if _, err := load(filepath.Join(dir, "agent.yaml"), ov, nil, nil); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.body, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"go-agent/internal/cmdsign"
+	"go-agent/internal/logging"
+)
+
+// Validate checks the whole configuration and reports every problem found,
+// each prefixed with the path of the offending key.
+func (c Config) Validate() error {
+	var v validator
+
+	if c.Interval.Duration <= 0 {
+		v.addf("interval", "must be > 0")
+	}
+	if len(c.Outputs) == 0 {
+		v.addf("outputs", "at least one output is required")
+	}
+	for i, o := range c.Outputs {
+		o.validate(&v, fmt.Sprintf("outputs[%d]", i))
+	}
+	if c.HasOutput(OutputGRPC) {
+		c.Collector.validate(&v, "collector")
+	}
+	c.Buffer.validate(&v, "buffer")
+	c.Batch.validate(&v, "batch")
+	if c.Health.MaxSendAge.Duration < 0 {
+		v.addf("health.max_send_age", "must be >= 0")
+	}
+	if c.Debug.Listen != "" && !loopbackAddr(c.Debug.Listen) {
+		v.addf("debug.listen", "must be a loopback address such as 127.0.0.1:6060")
+	}
+	if c.Reload.Debounce.Duration < 0 {
+		v.addf("reload.debounce", "must be >= 0")
+	}
+	c.Log.validate(&v, "log")
+	c.Budget.validate(&v, "budget", c.Interval.Duration)
+	c.Alerts.validate(&v, "alerts")
+	c.Commands.validate(&v, "commands")
+	for i, name := range c.Procs.Watch {
+		if name == "" || len(name) > 15 {
+			v.addf(fmt.Sprintf("procs.watch[%d]", i), "must be 1 to 15 characters, as in /proc/<pid>/comm")
+		}
+	}
+
+	return v.err()
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) addf(path, format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+func (o OutputConfig) validate(v *validator, path string) {
+	switch o.Type {
+	case OutputGRPC:
+	case OutputInflux:
+		switch o.Transport {
+		case "file":
+			if o.Path == "" {
+				v.addf(path+".path", "required for influx file output")
+			}
+		case "udp":
+			if o.Addr == "" {
+				v.addf(path+".addr", "required for influx udp output")
+			}
+		case "http":
+			if o.URL == "" {
+				v.addf(path+".url", "required for influx http output")
+			}
+		default:
+			v.addf(path+".transport", "unknown influx transport %q", o.Transport)
+		}
+	case OutputStatsD:
+		if o.Addr == "" {
+			v.addf(path+".addr", "required for statsd output")
+		}
+	default:
+		v.addf(path+".type", "unknown output type %q", o.Type)
+	}
+	if o.MaxPacketSize < 0 {
+		v.addf(path+".max_packet_size", "must be >= 0")
+	}
+}
+
+func (b BufferConfig) validate(v *validator, path string) {
+	if b.Dir == "" {
+		return
+	}
+	if b.MaxBytes <= 0 {
+		v.addf(path+".max_bytes", "must be > 0")
+	}
+	if b.MaxAge.Duration < 0 {
+		v.addf(path+".max_age", "must be >= 0")
+	}
+	if b.SegmentBytes < 0 {
+		v.addf(path+".segment_bytes", "must be >= 0")
+	}
+	if b.ReplayBatch < 0 {
+		v.addf(path+".replay_batch", "must be >= 0")
+	}
+}
+
+func (b BatchConfig) validate(v *validator, path string) {
+	switch b.Compression {
+	case "", "gzip", "zstd":
+	default:
+		v.addf(path+".compression", "unknown compression %q", b.Compression)
+	}
+	if b.MaxPoints < 0 {
+		v.addf(path+".max_points", "must be >= 0")
+	}
+	if b.MaxBytes < 0 {
+		v.addf(path+".max_bytes", "must be >= 0")
+	}
+	if b.FlushInterval.Duration < 0 {
+		v.addf(path+".flush_interval", "must be >= 0")
+	}
+	if len(b.Aggregate.Rules) > 0 && b.Aggregate.Window.Duration <= 0 {
+		v.addf(path+".aggregate.window", "required when rules are set")
+	}
+	for i, r := range b.Aggregate.Rules {
+		rp := fmt.Sprintf("%s.aggregate.rules[%d]", path, i)
+		if r.Match == "" {
+			v.addf(rp+".match", "must not be empty")
+		}
+		if len(r.Functions) == 0 {
+			v.addf(rp+".functions", "must not be empty")
+		}
+		for _, fn := range r.Functions {
+			switch fn {
+			case "min", "max", "avg", "last":
+			default:
+				v.addf(rp+".functions", "unknown function %q", fn)
+			}
+		}
+	}
+}
+
+func (c CollectorConfig) validate(v *validator, path string) {
+	if len(c.Endpoints) == 0 {
+		v.addf(path+".endpoints", "at least one endpoint is required")
+	}
+	for i, ep := range c.Endpoints {
+		if ep == "" {
+			v.addf(fmt.Sprintf("%s.endpoints[%d]", path, i), "must not be empty")
+		}
+	}
+	switch c.LoadBalancing {
+	case "", "pick_first", "round_robin":
+	default:
+		v.addf(path+".load_balancing", "unknown policy %q", c.LoadBalancing)
+	}
+	for _, t := range []struct {
+		key string
+		d   Duration
+	}{
+		{"connect", c.Timeouts.Connect},
+		{"register", c.Timeouts.Register},
+		{"heartbeat", c.Timeouts.Heartbeat},
+		{"metrics", c.Timeouts.Metrics},
+		{"command", c.Timeouts.Command},
+	} {
+		if t.d.Duration <= 0 {
+			v.addf(path+".timeouts."+t.key, "must be > 0")
+		}
+	}
+	if c.Retry.InitialBackoff.Duration <= 0 {
+		v.addf(path+".retry.initial_backoff", "must be > 0")
+	}
+	if c.Retry.Multiplier < 1 {
+		v.addf(path+".retry.multiplier", "must be >= 1")
+	}
+	if c.Retry.Jitter < 0 || c.Retry.Jitter > 1 {
+		v.addf(path+".retry.jitter", "must be within 0..1")
+	}
+	if c.Retry.MaxBackoff.Duration < c.Retry.InitialBackoff.Duration {
+		v.addf(path+".retry.max_backoff", "must be >= initial_backoff")
+	}
+	c.TLS.validate(v, path+".tls")
+	if c.Enrollment.BootstrapToken != "" && c.Enrollment.BootstrapTokenFile != "" {
+		v.addf(path+".enrollment", "bootstrap_token and bootstrap_token_file are mutually exclusive")
+	}
+}
+
+func (t TLSConfig) validate(v *validator, path string) {
+	set := t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != ""
+	if set && !t.Enabled {
+		v.addf(path+".enabled", "must be true when other tls settings are given")
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		v.addf(path, "cert_file and key_file must be set together")
+	}
+}
+
+func (l LogConfig) validate(v *validator, path string) {
+	switch l.Format {
+	case "", "text", "json":
+	default:
+		v.addf(path+".format", "must be text or json, got %q", l.Format)
+	}
+	if _, err := logging.ParseLevel(l.Level); err != nil {
+		v.addf(path+".level", "%v", err)
+	}
+	if _, err := logging.LoadLocation(l.Timezone); err != nil {
+		v.addf(path+".timezone", "%v", err)
+	}
+	for c, lv := range l.Levels {
+		if _, err := logging.ParseLevel(lv); err != nil {
+			v.addf(path+".levels."+c, "%v", err)
+		}
+	}
+}
+
+func (b BudgetConfig) validate(v *validator, path string, interval time.Duration) {
+	if b.CPUPercent < 0 {
+		v.addf(path+".cpu_percent", "must be >= 0")
+	}
+	if b.MemoryBytes < 0 {
+		v.addf(path+".memory_bytes", "must be >= 0")
+	}
+	if m := b.MaxInterval.Duration; m < 0 || m != 0 && m < interval {
+		v.addf(path+".max_interval", "must be >= interval (%s)", interval)
+	}
+}
+
+func (c CommandsConfig) validate(v *validator, path string) {
+	if c.Workers < 1 {
+		v.addf(path+".workers", "must be >= 1")
+	}
+	if c.Queue < 0 {
+		v.addf(path+".queue", "must be >= 0")
+	}
+	if c.Timeout.Duration <= 0 {
+		v.addf(path+".timeout", "must be > 0")
+	}
+	if c.MaxTimeout.Duration < c.Timeout.Duration {
+		v.addf(path+".max_timeout", "must be >= timeout (%s)", c.Timeout.Duration)
+	}
+	c.Exec.validate(v, path+".exec")
+	c.Files.validate(v, path+".files")
+	c.Bundle.validate(v, path+".bundle")
+	c.Process.validate(v, path+".process")
+	c.Signing.validate(v, path+".signing")
+}
+
+// loopbackAddr reports whether addr is a host:port only reachable from
+// this machine.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+func (p ProcessConfig) validate(v *validator, path string) {
+	for i, re := range p.Names {
+		if _, err := regexp.Compile(re); err != nil {
+			v.addf(fmt.Sprintf("%s.names[%d]", path, i), "%v", err)
+		}
+	}
+	if p.MinNice < -20 || p.MinNice > 19 {
+		v.addf(path+".min_nice", "must be between -20 and 19")
+	}
+	for i, c := range p.Cgroups {
+		if !filepath.IsLocal(c) || filepath.Clean(c) != c {
+			v.addf(fmt.Sprintf("%s.cgroups[%d]", path, i), "must be a clean path relative to /sys/fs/cgroup")
+		}
+	}
+	if p.MaxProcesses < 1 {
+		v.addf(path+".max_processes", "must be >= 1")
+	}
+}
+
+func (s SigningConfig) validate(v *validator, path string) {
+	for i, k := range s.PublicKeys {
+		if _, err := cmdsign.ParsePublicKey(k); err != nil {
+			v.addf(fmt.Sprintf("%s.public_keys[%d]", path, i), "%v", err)
+		}
+	}
+	if s.MaxTTL.Duration <= 0 {
+		v.addf(path+".max_ttl", "must be > 0")
+	}
+}
+
+func (b BundleConfig) validate(v *validator, path string) {
+	for i, p := range b.Proc {
+		if !filepath.IsLocal(p) || filepath.Clean(p) != p {
+			v.addf(fmt.Sprintf("%s.proc[%d]", path, i), "must be a clean path relative to /proc")
+		}
+	}
+	for i, c := range b.Cgroup {
+		if c == "" || c == "." || c == ".." || strings.Contains(c, "/") {
+			v.addf(fmt.Sprintf("%s.cgroup[%d]", path, i), "must be a file name")
+		}
+	}
+	for i, re := range b.Redact {
+		if _, err := regexp.Compile(re); err != nil {
+			v.addf(fmt.Sprintf("%s.redact[%d]", path, i), "%v", err)
+		}
+	}
+	if b.MaxBytes <= 0 {
+		v.addf(path+".max_bytes", "must be > 0")
+	}
+}
+
+func (f FilesConfig) validate(v *validator, path string) {
+	for i, r := range f.Roots {
+		if !filepath.IsAbs(r) || filepath.Clean(r) != r {
+			v.addf(fmt.Sprintf("%s.roots[%d]", path, i), "must be a clean absolute path")
+		}
+	}
+	if f.MaxReadBytes <= 0 {
+		v.addf(path+".max_read_bytes", "must be > 0")
+	}
+	if f.MaxListEntries <= 0 {
+		v.addf(path+".max_list_entries", "must be > 0")
+	}
+}
+
+func (e ExecConfig) validate(v *validator, path string) {
+	for i, r := range e.Allow {
+		rp := fmt.Sprintf("%s.allow[%d]", path, i)
+		if !filepath.IsAbs(r.Path) || filepath.Clean(r.Path) != r.Path {
+			v.addf(rp+".path", "must be a clean absolute path")
+		}
+		for j, a := range r.Args {
+			if _, err := regexp.Compile(a); err != nil {
+				v.addf(fmt.Sprintf("%s.args[%d]", rp, j), "%v", err)
+			}
+		}
+	}
+	if len(e.Allow) > 0 && e.User == "" {
+		v.addf(path+".user", "must be set when allow is not empty")
+	}
+	if e.MaxOutputBytes <= 0 {
+		v.addf(path+".max_output_bytes", "must be > 0")
+	}
+	for k := range e.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			v.addf(path+".env", "invalid variable name %q", k)
+		}
+	}
+}
+
+func (a AlertsConfig) validate(v *validator, path string) {
+	seen := make(map[string]bool, len(a.Rules))
+	for i, r := range a.Rules {
+		rp := fmt.Sprintf("%s.rules[%d]", path, i)
+		switch {
+		case r.Name == "":
+			v.addf(rp+".name", "must not be empty")
+		case seen[r.Name]:
+			v.addf(rp+".name", "duplicate rule %q", r.Name)
+		}
+		seen[r.Name] = true
+		if r.Metric == "" {
+			v.addf(rp+".metric", "must not be empty")
+		}
+		switch r.Op {
+		case ">", ">=":
+			if r.Clear != nil && *r.Clear > r.Value {
+				v.addf(rp+".clear", "must be <= value for %q", r.Op)
+			}
+		case "<", "<=":
+			if r.Clear != nil && *r.Clear < r.Value {
+				v.addf(rp+".clear", "must be >= value for %q", r.Op)
+			}
+		case "increase", "absent":
+			if r.Clear != nil {
+				v.addf(rp+".clear", "only applies to threshold rules")
+			}
+		default:
+			v.addf(rp+".op", "unknown op %q", r.Op)
+		}
+		if r.For.Duration < 0 {
+			v.addf(rp+".for", "must be >= 0")
+		}
+		switch r.Severity {
+		case "", "warning", "critical":
+		default:
+			v.addf(rp+".severity", "must be warning or critical, got %q", r.Severity)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter lets a message through at most once per interval and counts the
+// repeats it held back; the count is attached as "suppressed" to the next
+// record that gets through.
+type Limiter struct {
+	every time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*limitState
+}
+
+// maxLimitKeys bounds how many messages a Limiter tracks; past it,
+// messages not held back at the moment are forgotten.
+const maxLimitKeys = 1024
+
+type limitState struct {
+	last       time.Time
+	suppressed int
+}
+
+func NewLimiter(every time.Duration) *Limiter {
+	return &Limiter{every: every, seen: make(map[string]*limitState)}
+}
+
+// Log writes msg to l unless the same message was written less than the
+// limiter's interval ago. Messages are told apart by component, text and
+// attributes other than "err", so that e.g. the failures of two outputs
+// are limited separately while a changing error text is not.
+func (lim *Limiter) Log(l *slog.Logger, level slog.Level, msg string, args ...any) {
+	ctx := context.Background()
+	if !l.Enabled(ctx, level) {
+		return
+	}
+
+	key := limitKey(l, msg, args)
+	now := time.Now()
+	lim.mu.Lock()
+	st, ok := lim.seen[key]
+	if !ok {
+		if len(lim.seen) >= maxLimitKeys {
+			lim.pruneLocked(now)
+		}
+		st = &limitState{}
+		lim.seen[key] = st
+	}
+	if ok && now.Sub(st.last) < lim.every {
+		st.suppressed++
+		lim.mu.Unlock()
+		return
+	}
+	n := st.suppressed
+	st.last, st.suppressed = now, 0
+	lim.mu.Unlock()
+
+	if n > 0 {
+		args = append(args, "suppressed", n)
+	}
+	l.Log(ctx, level, msg, args...)
+}
+
+func (lim *Limiter) pruneLocked(now time.Time) {
+	for k, st := range lim.seen {
+		if now.Sub(st.last) >= lim.every {
+			delete(lim.seen, k)
+		}
+	}
+}
+
+func limitKey(l *slog.Logger, msg string, args []any) string {
+	var b strings.Builder
+	if h, ok := l.Handler().(*handler); ok {
+		b.WriteString(h.component)
+	}
+	b.WriteString("\x00")
+	b.WriteString(msg)
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key != "err" {
+			fmt.Fprintf(&b, "\x00%s=%s", a.Key, a.Value)
+		}
+		return true
+	})
+	return b.String()
+}
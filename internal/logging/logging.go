@@ -0,0 +1,278 @@
+// Package logging sets up log/slog for the agent and the collector: text or
+// JSON output, a level per component that can be changed at runtime, fields
+// attached to every record (such as host and agent_id), and rate limiting
+// for errors that would otherwise repeat on every tick.
+//
+// Loggers are obtained with For and may be created before Setup runs; they
+// always write through the current configuration.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	_ "time/tzdata"
+)
+
+type Options struct {
+	// Format is "text" (default) or "json".
+	Format string
+	// Level is the default level: "debug", "info" (default), "warn" or
+	// "error".
+	Level string
+	// Levels overrides the level per component.
+	Levels map[string]string
+	// Timezone is the IANA zone record times are shown in; empty means
+	// UTC.
+	Timezone string
+	// Output defaults to stderr.
+	Output io.Writer
+}
+
+var (
+	base   atomic.Pointer[slog.Handler]
+	fields atomic.Pointer[[]slog.Attr]
+	// tail formats records for Recent.
+	tail atomic.Pointer[slog.Handler]
+
+	mu        sync.Mutex
+	defLevel  slog.Level
+	overrides = map[string]slog.Level{}
+	levels    = map[string]*slog.LevelVar{}
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level:       slog.LevelDebug,
+		ReplaceAttr: inZone(time.UTC),
+	})
+	base.Store(&h)
+	setTail(time.UTC)
+}
+
+// Setup applies opts. It may be called again, e.g. on config reload.
+func Setup(opts Options) error {
+	def, err := ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+	over := make(map[string]slog.Level, len(opts.Levels))
+	for c, l := range opts.Levels {
+		lv, err := ParseLevel(l)
+		if err != nil {
+			return fmt.Errorf("level for %s: %w", c, err)
+		}
+		over[c] = lv
+	}
+
+	tz, err := LoadLocation(opts.Timezone)
+	if err != nil {
+		return err
+	}
+
+	w := opts.Output
+	if w == nil {
+		w = os.Stderr
+	}
+	// filtering happens per component, so the base handler passes all
+	ho := &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: inZone(tz)}
+	var h slog.Handler
+	switch opts.Format {
+	case "", "text":
+		h = slog.NewTextHandler(w, ho)
+	case "json":
+		h = slog.NewJSONHandler(w, ho)
+	default:
+		return fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	base.Store(&h)
+	setTail(tz)
+
+	mu.Lock()
+	defLevel, overrides = def, over
+	for c, v := range levels {
+		v.Set(levelOf(c))
+	}
+	mu.Unlock()
+
+	slog.SetDefault(For("main"))
+	return nil
+}
+
+// LoadLocation resolves an IANA zone name, with "" meaning UTC. Zone data
+// is embedded, so this works on images without tzdata.
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	l, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return l, nil
+}
+
+// inZone shows the record time, and any time attribute, in tz.
+func inZone(tz *time.Location) func([]string, slog.Attr) slog.Attr {
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if a.Value.Kind() == slog.KindTime {
+			a.Value = slog.TimeValue(a.Value.Time().In(tz))
+		}
+		return a
+	}
+}
+
+// ParseLevel accepts slog level names case-insensitively; "" means info.
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return l, nil
+}
+
+// SetLevel changes the level of one component at runtime, or the default
+// level when component is "" (components with their own level keep it).
+func SetLevel(component, level string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if component == "" {
+		defLevel = l
+		for c, v := range levels {
+			v.Set(levelOf(c))
+		}
+		return nil
+	}
+	overrides[component] = l
+	levelVar(component).Set(l)
+	return nil
+}
+
+// Levels returns the effective level of every known component.
+func Levels() map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+	out := map[string]string{"": defLevel.String()}
+	for c, v := range levels {
+		out[c] = v.Level().String()
+	}
+	return out
+}
+
+// SetField attaches key=value to every record from now on; an empty value
+// removes it.
+func SetField(key, value string) {
+	mu.Lock()
+	defer mu.Unlock()
+	var next []slog.Attr
+	if cur := fields.Load(); cur != nil {
+		for _, a := range *cur {
+			if a.Key != key {
+				next = append(next, a)
+			}
+		}
+	}
+	if value != "" {
+		next = append(next, slog.String(key, value))
+	}
+	sort.Slice(next, func(i, j int) bool { return next[i].Key < next[j].Key })
+	fields.Store(&next)
+}
+
+// For returns the logger of a component.
+func For(component string) *slog.Logger {
+	mu.Lock()
+	v := levelVar(component)
+	mu.Unlock()
+	return slog.New(&handler{component: component, level: v})
+}
+
+// levelVar must be called with mu held.
+func levelVar(component string) *slog.LevelVar {
+	v, ok := levels[component]
+	if !ok {
+		v = new(slog.LevelVar)
+		v.Set(levelOf(component))
+		levels[component] = v
+	}
+	return v
+}
+
+func levelOf(component string) slog.Level {
+	if l, ok := overrides[component]; ok {
+		return l
+	}
+	return defLevel
+}
+
+// handler resolves the base handler and global fields on every record so
+// that loggers created at package init follow later Setup calls.
+type handler struct {
+	component string
+	level     *slog.LevelVar
+	ops       []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return errors.Join(h.handle(ctx, *base.Load(), r), h.handle(ctx, *tail.Load(), r.Clone()))
+}
+
+func (h *handler) handle(ctx context.Context, b slog.Handler, r slog.Record) error {
+	attrs := []slog.Attr{slog.String("component", h.component)}
+	if fs := fields.Load(); fs != nil {
+		attrs = append(attrs, *fs...)
+	}
+	b = b.WithAttrs(attrs)
+	for _, op := range h.ops {
+		b = op(b)
+	}
+	return b.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := append(h.ops[:len(h.ops):len(h.ops)], op)
+	return &handler{component: h.component, level: h.level, ops: ops}
+}
+
+// ParseLevels reads "component=level,..." as used by command-line flags.
+func ParseLevels(s string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		c, l, ok := strings.Cut(kv, "=")
+		if !ok || c == "" {
+			return nil, fmt.Errorf("bad component level %q, want component=level", kv)
+		}
+		out[c] = l
+	}
+	return out, nil
+}
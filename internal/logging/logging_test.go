@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("bad record %q: %v", line, err)
+		}
+		out = append(out, m)
+	}
+	buf.Reset()
+	return out
+}
+
+func TestComponentLevelsAndFields(t *testing.T) {
+	var buf bytes.Buffer
+	// created before Setup, like package-level loggers
+	noisy := For("noisy")
+	quiet := For("quiet")
+	if err := Setup(Options{Format: "json", Level: "info", Levels: map[string]string{"noisy": "error"}, Output: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	SetField("agent_id", "a1")
+	defer SetField("agent_id", "")
+
+	noisy.Warn("dropped")
+	quiet.Info("kept", "n", 1)
+	recs := records(t, &buf)
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, want 1: %v", len(recs), recs)
+	}
+	if r := recs[0]; r["component"] != "quiet" || r["agent_id"] != "a1" || r["msg"] != "kept" {
+		t.Fatalf("unexpected record %v", r)
+	}
+
+	if err := SetLevel("noisy", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	noisy.Debug("now shown")
+	if recs := records(t, &buf); len(recs) != 1 {
+		t.Fatalf("after SetLevel got %d records, want 1", len(recs))
+	}
+	if err := SetLevel("", "bogus"); err == nil {
+		t.Fatal("SetLevel accepted an unknown level")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(Options{Format: "json", Output: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	l := For("limit")
+	lim := NewLimiter(50 * time.Millisecond)
+
+	for range 5 {
+		lim.Log(l, slog.LevelWarn, "cpu failed")
+	}
+	if recs := records(t, &buf); len(recs) != 1 {
+		t.Fatalf("got %d records, want 1", len(recs))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	lim.Log(l, slog.LevelWarn, "cpu failed")
+	recs := records(t, &buf)
+	if len(recs) != 1 || recs[0]["suppressed"] != float64(4) {
+		t.Fatalf("want one record with suppressed=4, got %v", recs)
+	}
+
+	// limited per component and output, but not per error text
+	for i := range 3 {
+		lim.Log(l, slog.LevelWarn, "write failed", "output", "influx", "err", fmt.Sprint("timeout ", i))
+		lim.Log(l, slog.LevelWarn, "write failed", "output", "statsd", "err", "refused")
+		lim.Log(For("other"), slog.LevelWarn, "write failed", "output", "influx")
+	}
+	if recs := records(t, &buf); len(recs) != 3 {
+		t.Fatalf("got %d records, want one per component and output: %v", len(recs), recs)
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(Options{Format: "json", Timezone: "America/New_York", Output: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(Options{})
+
+	at := time.Date(2026, 1, 2, 15, 0, 0, 0, time.UTC)
+	For("tz").Info("x", "at", at)
+	recs := records(t, &buf)
+	if len(recs) != 1 || recs[0]["at"] != "2026-01-02T10:00:00-05:00" {
+		t.Fatalf("time not shown in zone: %v", recs)
+	}
+	if _, err := LoadLocation("Mars/Olympus"); err == nil {
+		t.Fatal("unknown zone accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recentBytes is how much of the latest output Recent returns.
+const recentBytes = 1 << 20
+
+// recent keeps the tail of everything logged, for support bundles.
+var recent = &tailBuffer{max: recentBytes}
+
+// redact, if set, is applied to the records kept for Recent.
+var redact atomic.Pointer[func(string) string]
+
+// Recent returns the latest log output as text, at most 1 MiB of whole
+// records.
+func Recent() []byte {
+	return recent.bytes()
+}
+
+// SetRecentRedact makes every string and value logged from now on pass
+// through f before it is kept for Recent, e.g. to mask secrets. It works on
+// the values themselves, before quoting or escaping. nil removes it.
+func SetRecentRedact(f func(string) string) {
+	if f == nil {
+		redact.Store(nil)
+		return
+	}
+	redact.Store(&f)
+}
+
+// setTail formats the records kept for Recent as text, in tz.
+func setTail(tz *time.Location) {
+	zone := inZone(tz)
+	var h slog.Handler = slog.NewTextHandler(recent, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			a = zone(groups, a)
+			f := redact.Load()
+			if f == nil {
+				return a
+			}
+			switch a.Value.Kind() {
+			case slog.KindString, slog.KindAny:
+				a.Value = slog.StringValue((*f)(a.Value.String()))
+			}
+			return a
+		},
+	})
+	tail.Store(&h)
+}
+
+// tailBuffer keeps the last max bytes written to it. It trims only once
+// twice that is held, so that most writes do not copy.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > 2*t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.buf
+	if len(b) > t.max {
+		b = b[len(b)-t.max:]
+		// drop the partial record at the start
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+	return bytes.Clone(b)
+}
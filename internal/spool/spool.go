@@ -0,0 +1,417 @@
+// Package spool implements a crash-safe FIFO queue backed by append-only
+// segment files. It is used to hold metric batches while the collector is
+// unreachable.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize = 16 // length(4) + crc(4) + unix nano(8)
+	segSuffix  = ".seg"
+	cursorFile = "cursor"
+)
+
+var (
+	ErrEmpty    = errors.New("spool: empty")
+	ErrTooLarge = errors.New("spool: record larger than queue")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type Options struct {
+	Dir string
+	// MaxBytes bounds the live records; the oldest are dropped beyond it.
+	MaxBytes int64
+	// MaxAge drops records older than this. Zero disables the age bound.
+	MaxAge time.Duration
+	// SegmentBytes is the size at which a new segment file is started.
+	SegmentBytes int64
+}
+
+type Stats struct {
+	Depth   int
+	Bytes   int64
+	Dropped uint64
+}
+
+type entry struct {
+	seg  uint64
+	off  int64
+	size int64 // including header
+	at   time.Time
+}
+
+// Queue is safe for concurrent use.
+type Queue struct {
+	opt Options
+
+	mu      sync.Mutex
+	entries []entry
+	bytes   int64
+	dropped uint64
+
+	wseg  uint64
+	wfile *os.File
+	wsize int64
+}
+
+func Open(opt Options) (*Queue, error) {
+	if opt.Dir == "" {
+		return nil, errors.New("spool: empty dir")
+	}
+	opt = opt.withDefaults()
+	if err := os.MkdirAll(opt.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("spool: create dir: %w", err)
+	}
+
+	q := &Queue{opt: opt}
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (opt Options) withDefaults() Options {
+	if opt.MaxBytes <= 0 {
+		opt.MaxBytes = 64 << 20
+	}
+	if opt.SegmentBytes <= 0 {
+		opt.SegmentBytes = 4 << 20
+	}
+	if opt.SegmentBytes > opt.MaxBytes {
+		opt.SegmentBytes = opt.MaxBytes
+	}
+	return opt
+}
+
+// SetLimits changes the bounds of an open queue to those of opt, with the
+// defaults Open applies; opt.Dir is ignored. Records beyond the new size
+// bound are dropped right away.
+func (q *Queue) SetLimits(opt Options) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	opt = opt.withDefaults()
+	opt.Dir = q.opt.Dir
+	q.opt = opt
+	if q.bytes <= q.opt.MaxBytes {
+		return nil
+	}
+	for q.bytes > q.opt.MaxBytes {
+		q.dropHead()
+	}
+	return q.commit()
+}
+
+// recover rebuilds the in-memory index from the segment files. A torn or
+// corrupt record ends its segment; anything after it is discarded.
+func (q *Queue) recover() error {
+	ids, err := q.segments()
+	if err != nil {
+		return err
+	}
+	cseg, coff := q.readCursor()
+
+	for _, id := range ids {
+		if id < cseg {
+			_ = os.Remove(q.segPath(id))
+			continue
+		}
+		valid, err := q.scan(id, func(e entry) {
+			if e.seg == cseg && e.off < coff {
+				return
+			}
+			q.entries = append(q.entries, e)
+			q.bytes += e.size
+		})
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(q.segPath(id)); err == nil && fi.Size() > valid {
+			if err := os.Truncate(q.segPath(id), valid); err != nil {
+				return fmt.Errorf("spool: truncate segment %d: %w", id, err)
+			}
+		}
+		q.wseg, q.wsize = id, valid
+	}
+
+	if len(ids) == 0 {
+		q.wseg = cseg
+	}
+	return q.openWriteSegment(len(ids) == 0)
+}
+
+func (q *Queue) scan(id uint64, fn func(entry)) (int64, error) {
+	f, err := os.Open(q.segPath(id))
+	if err != nil {
+		return 0, fmt.Errorf("spool: open segment %d: %w", id, err)
+	}
+	defer f.Close()
+
+	var off int64
+	hdr := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(f, hdr); err != nil {
+			return off, nil
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		sum := binary.BigEndian.Uint32(hdr[4:8])
+		at := int64(binary.BigEndian.Uint64(hdr[8:16]))
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return off, nil
+		}
+		if checksum(hdr[8:16], payload) != sum {
+			return off, nil
+		}
+		fn(entry{seg: id, off: off, size: headerSize + n, at: time.Unix(0, at)})
+		off += headerSize + n
+	}
+}
+
+func (q *Queue) segments() ([]uint64, error) {
+	des, err := os.ReadDir(q.opt.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("spool: read dir: %w", err)
+	}
+	var ids []uint64
+	for _, de := range des {
+		name := de.Name()
+		if !strings.HasSuffix(name, segSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (q *Queue) segPath(id uint64) string {
+	return filepath.Join(q.opt.Dir, fmt.Sprintf("%020d%s", id, segSuffix))
+}
+
+func (q *Queue) openWriteSegment(fresh bool) error {
+	f, err := os.OpenFile(q.segPath(q.wseg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("spool: open segment %d: %w", q.wseg, err)
+	}
+	q.wfile = f
+	if fresh {
+		q.wsize = 0
+	}
+	return nil
+}
+
+func (q *Queue) rotate() error {
+	if err := q.wfile.Close(); err != nil {
+		return err
+	}
+	q.wseg++
+	return q.openWriteSegment(true)
+}
+
+// Append stores rec durably. at is the record's logical time used for the
+// age bound, normally the sample timestamp.
+func (q *Queue) Append(rec []byte, at time.Time) error {
+	size := int64(headerSize + len(rec))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if size > q.opt.MaxBytes {
+		return ErrTooLarge
+	}
+
+	if q.wsize > 0 && q.wsize+size > q.opt.SegmentBytes {
+		if err := q.rotate(); err != nil {
+			return fmt.Errorf("spool: rotate: %w", err)
+		}
+	}
+
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(rec)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(at.UnixNano()))
+	copy(buf[headerSize:], rec)
+	binary.BigEndian.PutUint32(buf[4:8], checksum(buf[8:16], rec))
+
+	if _, err := q.wfile.Write(buf); err != nil {
+		return fmt.Errorf("spool: write: %w", err)
+	}
+	if err := q.wfile.Sync(); err != nil {
+		return fmt.Errorf("spool: sync: %w", err)
+	}
+
+	q.entries = append(q.entries, entry{seg: q.wseg, off: q.wsize, size: size, at: at})
+	q.wsize += size
+	q.bytes += size
+
+	if q.bytes <= q.opt.MaxBytes {
+		return nil
+	}
+	for q.bytes > q.opt.MaxBytes {
+		q.dropHead()
+	}
+	return q.commit()
+}
+
+// Peek returns the oldest record without removing it.
+func (q *Queue) Peek() ([]byte, time.Time, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire()
+	if len(q.entries) == 0 {
+		return nil, time.Time{}, ErrEmpty
+	}
+	e := q.entries[0]
+
+	f, err := os.Open(q.segPath(e.seg))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("spool: open segment %d: %w", e.seg, err)
+	}
+	defer f.Close()
+
+	rec := make([]byte, e.size-headerSize)
+	if _, err := f.ReadAt(rec, e.off+headerSize); err != nil {
+		return nil, time.Time{}, fmt.Errorf("spool: read: %w", err)
+	}
+	return rec, e.at, nil
+}
+
+// Ack removes the record returned by the last Peek.
+func (q *Queue) Ack() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) == 0 {
+		return nil
+	}
+	q.popHead()
+	return q.commit()
+}
+
+// Drop removes the oldest record and counts it as dropped, e.g. when it
+// cannot be decoded.
+func (q *Queue) Drop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) == 0 {
+		return nil
+	}
+	q.dropHead()
+	return q.commit()
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	return Stats{Depth: len(q.entries), Bytes: q.bytes, Dropped: q.dropped}
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.wfile.Close()
+}
+
+func (q *Queue) expire() {
+	if q.opt.MaxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-q.opt.MaxAge)
+	n := 0
+	for len(q.entries) > 0 && q.entries[0].at.Before(cutoff) {
+		q.dropHead()
+		n++
+	}
+	if n > 0 {
+		_ = q.commit()
+	}
+}
+
+func (q *Queue) dropHead() {
+	q.popHead()
+	q.dropped++
+}
+
+func (q *Queue) popHead() {
+	e := q.entries[0]
+	q.entries = q.entries[1:]
+	q.bytes -= e.size
+}
+
+// commit persists the read position and removes segments that no longer
+// hold live records.
+func (q *Queue) commit() error {
+	seg, off := q.wseg, q.wsize
+	if len(q.entries) > 0 {
+		seg, off = q.entries[0].seg, q.entries[0].off
+	}
+
+	for id := seg; id > 0; id-- {
+		p := q.segPath(id - 1)
+		if err := os.Remove(p); err != nil {
+			break
+		}
+	}
+
+	return q.writeCursor(seg, off)
+}
+
+func (q *Queue) readCursor() (uint64, int64) {
+	b, err := os.ReadFile(filepath.Join(q.opt.Dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	var seg uint64
+	var off int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &seg, &off); err != nil {
+		return 0, 0
+	}
+	return seg, off
+}
+
+func (q *Queue) writeCursor(seg uint64, off int64) error {
+	p := filepath.Join(q.opt.Dir, cursorFile)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seg, off)), 0600); err != nil {
+		return fmt.Errorf("spool: write cursor: %w", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("spool: write cursor: %w", err)
+	}
+	return nil
+}
+
+func checksum(ts, payload []byte) uint32 {
+	h := crc32.New(crcTable)
+	_, _ = h.Write(ts)
+	_, _ = h.Write(payload)
+	return h.Sum32()
+}
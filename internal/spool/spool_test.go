@@ -0,0 +1,157 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func mustOpen(t *testing.T, opt Options) *Queue {
+	t.Helper()
+	q, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func drain(t *testing.T, q *Queue) []string {
+	t.Helper()
+	var out []string
+	for {
+		rec, _, err := q.Peek()
+		if errors.Is(err, ErrEmpty) {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, string(rec))
+		if err := q.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueue_ReopenKeepsOrderAndCursor(t *testing.T) {
+	dir := t.TempDir()
+	q := mustOpen(t, Options{Dir: dir, SegmentBytes: 64})
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("rec-%d", i)), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := q.Peek(); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	q = mustOpen(t, Options{Dir: dir, SegmentBytes: 64})
+	defer q.Close()
+	if err := q.Append([]byte("rec-10"), now); err != nil {
+		t.Fatal(err)
+	}
+
+	got := drain(t, q)
+	if len(got) != 8 || got[0] != "rec-3" || got[7] != "rec-10" {
+		t.Fatalf("unexpected records after reopen: %v", got)
+	}
+}
+
+func TestQueue_TornTailIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	q := mustOpen(t, Options{Dir: dir})
+	_ = q.Append([]byte("first"), time.Now())
+	_ = q.Append([]byte("second"), time.Now())
+	q.Close()
+
+	// simulate a crash in the middle of the second write
+	p := q.segPath(0)
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(p, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	q = mustOpen(t, Options{Dir: dir})
+	defer q.Close()
+	_ = q.Append([]byte("third"), time.Now())
+
+	got := drain(t, q)
+	if len(got) != 2 || got[0] != "first" || got[1] != "third" {
+		t.Fatalf("unexpected records: %v", got)
+	}
+}
+
+func TestQueue_Bounds(t *testing.T) {
+	q := mustOpen(t, Options{Dir: t.TempDir(), MaxBytes: 3 * (headerSize + 4), MaxAge: time.Minute})
+	defer q.Close()
+
+	_ = q.Append([]byte("old0"), time.Now().Add(-2*time.Minute))
+	for i := 1; i <= 3; i++ {
+		_ = q.Append([]byte(fmt.Sprintf("rec%d", i)), time.Now())
+	}
+
+	st := q.Stats()
+	if st.Depth != 3 || st.Dropped != 1 {
+		t.Fatalf("size bound: got %+v", st)
+	}
+
+	_ = q.Append([]byte("rec4"), time.Now())
+	got := drain(t, q)
+	if len(got) != 3 || got[0] != "rec2" {
+		t.Fatalf("unexpected records: %v", got)
+	}
+	if st := q.Stats(); st.Dropped != 2 {
+		t.Fatalf("dropped: got %d", st.Dropped)
+	}
+
+	if err := q.Append(make([]byte, 100), time.Now()); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestQueue_SetLimits(t *testing.T) {
+	q := mustOpen(t, Options{Dir: t.TempDir()})
+	defer q.Close()
+
+	for i := 1; i <= 3; i++ {
+		_ = q.Append([]byte(fmt.Sprintf("rec%d", i)), time.Now())
+	}
+	if err := q.SetLimits(Options{MaxBytes: 2 * (headerSize + 4)}); err != nil {
+		t.Fatal(err)
+	}
+	if st := q.Stats(); st.Depth != 2 || st.Dropped != 1 {
+		t.Fatalf("after shrinking: got %+v", st)
+	}
+	if got := drain(t, q); len(got) != 2 || got[0] != "rec2" {
+		t.Fatalf("unexpected records: %v", got)
+	}
+}
+
+func TestQueue_AgeBound(t *testing.T) {
+	q := mustOpen(t, Options{Dir: t.TempDir(), MaxAge: time.Minute})
+	defer q.Close()
+
+	_ = q.Append([]byte("stale"), time.Now().Add(-time.Hour))
+	_ = q.Append([]byte("fresh"), time.Now())
+
+	got := drain(t, q)
+	if len(got) != 1 || got[0] != "fresh" {
+		t.Fatalf("unexpected records: %v", got)
+	}
+	if st := q.Stats(); st.Dropped != 1 {
+		t.Fatalf("dropped: got %d", st.Dropped)
+	}
+}
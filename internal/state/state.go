@@ -0,0 +1,113 @@
+// Package state persists agent identity and collector-managed config across
+// restarts.
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type State struct {
+	AgentID      string    `json:"agent_id"`
+	Hostname     string    `json:"hostname"`
+	RegisteredAt time.Time `json:"registered_at"`
+	// Credential authenticates the agent once it has enrolled.
+	Credential string `json:"credential,omitempty"`
+	// Config is the last collector-managed config document that was
+	// applied, so the agent comes back on the same revision.
+	Config *RemoteConfig `json:"config,omitempty"`
+	// SeenCommands maps the ids of signed commands the agent accepted to
+	// when they expire, so that none runs again after a restart.
+	SeenCommands map[string]time.Time `json:"seen_commands,omitempty"`
+}
+
+type RemoteConfig struct {
+	Name    string `json:"name"`
+	Version int64  `json:"version"`
+	Format  string `json:"format"`
+	Body    string `json:"body"`
+}
+
+// Store keeps State in a JSON file that is replaced atomically on update.
+type Store struct {
+	path string
+
+	mu  sync.Mutex
+	cur State
+}
+
+// Open loads path if it exists. A missing file yields an empty State.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	if err := json.Unmarshal(b, &s.cur); err != nil {
+		return nil, fmt.Errorf("parse state %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *Store) Get() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// Update applies fn to a copy of the state and persists the result. The
+// in-memory state only changes when the write succeeds.
+func (s *Store) Update(fn func(*State)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.cur
+	fn(&next)
+
+	b, err := json.MarshalIndent(next, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	s.cur = next
+	return nil
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
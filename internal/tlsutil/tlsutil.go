@@ -0,0 +1,204 @@
+// Package tlsutil builds TLS configs whose certificates and CA bundles are
+// re-read from disk when the files change, so rotated certificates take
+// effect on the next handshake without a restart.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files names the PEM files of one side of a connection. CertFile and
+// KeyFile are this side's certificate; CAFile is the bundle used to verify
+// the peer.
+type Files struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// Reloader holds the parsed contents of Files and refreshes them when a
+// file's modification time changes. Checks are made at most once a second.
+type Reloader struct {
+	files Files
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	mtimes  [3]time.Time
+	checked time.Time
+}
+
+// NewReloader loads files once, failing if any configured file is missing
+// or invalid.
+func NewReloader(files Files) (*Reloader, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("tls: cert and key must be set together")
+	}
+	r := &Reloader{files: files}
+	if err := r.load(r.stat()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) stat() [3]time.Time {
+	var m [3]time.Time
+	for i, p := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if p == "" {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil {
+			m[i] = fi.ModTime()
+		}
+	}
+	return m
+}
+
+func (r *Reloader) load(mtimes [3]time.Time) error {
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tls: load key pair: %w", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		b, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return fmt.Errorf("tls: read ca: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("tls: no certificates in %s", r.files.CAFile)
+		}
+	}
+
+	r.cert, r.pool, r.mtimes = cert, pool, mtimes
+	return nil
+}
+
+// current returns the latest certificate and pool. A file that fails to
+// load during rotation (e.g. key written before cert) keeps the previous
+// material in use until the next check.
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) >= time.Second {
+		r.checked = now
+		if m := r.stat(); m != r.mtimes {
+			_ = r.load(m)
+		}
+	}
+	return r.cert, r.pool
+}
+
+// ClientConfig verifies the server against the CA bundle, or the system
+// roots if none is configured, and presents the client certificate if one
+// is configured. serverName overrides the name checked in the server
+// certificate.
+func ClientConfig(r *Reloader, serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+		// verification is done below against the reloadable pool
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, pool := r.current()
+			return verify(cs.PeerCertificates, pool, cs.ServerName, x509.ExtKeyUsageServerAuth)
+		},
+	}
+}
+
+// ClientAuth selects how the server treats client certificates.
+type ClientAuth string
+
+const (
+	ClientAuthNone     ClientAuth = "none"
+	ClientAuthOptional ClientAuth = "optional" // verified if presented
+	ClientAuthRequire  ClientAuth = "require"
+)
+
+// ServerConfig presents the server certificate and, unless auth is none,
+// verifies client certificates against the CA bundle.
+func ServerConfig(r *Reloader, auth ClientAuth) (*tls.Config, error) {
+	if r.files.CertFile == "" {
+		return nil, errors.New("tls: server needs a cert and key")
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+
+	switch auth {
+	case "", ClientAuthNone:
+		return cfg, nil
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.RequestClientCert
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	default:
+		return nil, fmt.Errorf("tls: unknown client auth %q", auth)
+	}
+	if r.files.CAFile == "" {
+		return nil, errors.New("tls: client auth needs a client ca")
+	}
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil // only reachable with optional auth
+		}
+		_, pool := r.current()
+		return verify(cs.PeerCertificates, pool, "", x509.ExtKeyUsageClientAuth)
+	}
+	return cfg, nil
+}
+
+func verify(chain []*x509.Certificate, roots *x509.CertPool, name string, usage x509.ExtKeyUsage) error {
+	if len(chain) == 0 {
+		return errors.New("tls: peer sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, c := range chain[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(opts)
+	return err
+}
+
+// Identity names the subject of a verified peer certificate: its first URI
+// SAN (e.g. a SPIFFE ID), else its first DNS SAN, else its common name.
+func Identity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	default:
+		return cert.Subject.CommonName
+	}
+}
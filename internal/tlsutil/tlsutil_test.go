@@ -0,0 +1,154 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCert(t *testing.T, cn string, parent *keyPair, usage x509.ExtKeyUsage) *keyPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &keyPair{cert: cert, key: key}
+}
+
+func (kp *keyPair) write(t *testing.T, certPath, keyPath string) {
+	t.Helper()
+	writePEM(t, certPath, "CERTIFICATE", kp.cert.Raw)
+	if keyPath != "" {
+		der, err := x509.MarshalECPrivateKey(kp.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, keyPath, "EC PRIVATE KEY", der)
+	}
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the reload is triggered by a changed mtime, which a rewrite within
+	// the same clock tick might not produce
+	if fi, err := os.Stat(path); err == nil {
+		mt := fi.ModTime().Add(time.Duration(mrand.Int63()%1000+1) * time.Millisecond)
+		_ = os.Chtimes(path, mt, mt)
+	}
+}
+
+func handshake(t *testing.T, server, client *tls.Config) error {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		c, err := lis.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer c.Close()
+		errCh <- tls.Server(c, server).Handshake()
+	}()
+
+	c, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cerr := tls.Client(c, client).Handshake()
+	if serr := <-errCh; serr != nil {
+		return serr
+	}
+	return cerr
+}
+
+func TestMutualTLSAndRotation(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	ca := newCert(t, "ca", nil, 0)
+	other := newCert(t, "other-ca", nil, 0)
+	ca.write(t, p("ca.pem"), "")
+	newCert(t, "collector", ca, x509.ExtKeyUsageServerAuth).write(t, p("server.pem"), p("server.key"))
+	newCert(t, "agent-1", ca, x509.ExtKeyUsageClientAuth).write(t, p("client.pem"), p("client.key"))
+
+	sr, err := NewReloader(Files{CertFile: p("server.pem"), KeyFile: p("server.key"), CAFile: p("ca.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ServerConfig(sr, ClientAuthRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewReloader(Files{CertFile: p("client.pem"), KeyFile: p("client.key"), CAFile: p("ca.pem")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ClientConfig(cr, "127.0.0.1")
+
+	if err := handshake(t, server, client); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	// rotate the client to a certificate from an untrusted CA
+	newCert(t, "agent-1", other, x509.ExtKeyUsageClientAuth).write(t, p("client.pem"), p("client.key"))
+	cr.mu.Lock()
+	cr.checked = time.Time{}
+	cr.mu.Unlock()
+	if err := handshake(t, server, client); err == nil {
+		t.Fatal("handshake with untrusted client certificate succeeded")
+	}
+
+	// a client that verifies a different name rejects the server
+	cr2, _ := NewReloader(Files{CAFile: p("ca.pem")})
+	if err := handshake(t, server, ClientConfig(cr2, "collector.example")); err == nil {
+		t.Fatal("handshake with mismatched server name succeeded")
+	}
+}
@@ -2,52 +2,143 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"go-agent/internal/transport/zstd"
 	pb "go-agent/proto/agentv1"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 )
 
 type Client struct {
-	cc  *grpc.ClientConn
-	api pb.CollectorServiceClient
+	cc   *grpc.ClientConn
+	api  pb.CollectorServiceClient
+	cred atomic.Value // string
 
 	Id *pb.RegisterResponse
 }
 
 type Options struct {
-	Addr string
+	// Endpoints lists collector addresses ("host:port"). A single endpoint
+	// is resolved through DNS so every A/AAAA record becomes a backend.
+	Endpoints []string
+	// LoadBalancing is "pick_first" (failover in order) or "round_robin".
+	LoadBalancing string
+	// Compression is "", "gzip" or "zstd".
+	Compression string
+
+	ConnectTimeout time.Duration
+	MaxBackoff     time.Duration
+
+	// TLS secures the connection; nil means plaintext.
+	TLS *tls.Config
 }
 
 func New(opt Options) (*Client, error) {
-	if opt.Addr == "" {
+	if len(opt.Endpoints) == 0 {
 		return nil, fmt.Errorf("empty grpc addr")
 	}
+	if opt.ConnectTimeout <= 0 {
+		opt.ConnectTimeout = 3 * time.Second
+	}
+	if opt.MaxBackoff <= 0 {
+		opt.MaxBackoff = 5 * time.Second
+	}
+
+	lb := opt.LoadBalancing
+	switch lb {
+	case "":
+		lb = "pick_first"
+	case "pick_first", "round_robin":
+	default:
+		return nil, fmt.Errorf("unsupported load balancing %q", lb)
+	}
+
+	creds := insecure.NewCredentials()
+	if opt.TLS != nil {
+		creds = credentials.NewTLS(opt.TLS)
+	}
 
-	cc, err := grpc.NewClient(
-		opt.Addr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
 		grpc.WithConnectParams(grpc.ConnectParams{
 			Backoff: backoff.Config{
 				BaseDelay:  200 * time.Millisecond,
 				Multiplier: 1.6,
-				MaxDelay:   5 * time.Second,
+				MaxDelay:   opt.MaxBackoff,
 			},
-			MinConnectTimeout: 3 * time.Second,
+			MinConnectTimeout: opt.ConnectTimeout,
 		}),
-	)
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{%q:{}}]}`, lb)),
+	}
+
+	target := opt.Endpoints[0]
+	if len(opt.Endpoints) > 1 {
+		// a static list: hand all addresses to the balancer at once
+		r := manual.NewBuilderWithScheme("collectors")
+		addrs := make([]resolver.Address, 0, len(opt.Endpoints))
+		for _, ep := range opt.Endpoints {
+			// the per-address name is what TLS verifies the collector as
+			host, _, err := net.SplitHostPort(ep)
+			if err != nil {
+				host = ep
+			}
+			addrs = append(addrs, resolver.Address{Addr: ep, ServerName: host})
+		}
+		r.InitialState(resolver.State{Addresses: addrs})
+		dialOpts = append(dialOpts, grpc.WithResolvers(r))
+		target = r.Scheme() + ":///"
+	} else if !strings.Contains(target, ":///") && !strings.HasPrefix(target, "unix:") {
+		target = "dns:///" + target
+	}
+
+	switch opt.Compression {
+	case "":
+	case gzip.Name, zstd.Name:
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(opt.Compression)))
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", opt.Compression)
+	}
+
+	c := &Client{}
+	dialOpts = append(dialOpts, grpc.WithUnaryInterceptor(c.authenticate))
+
+	cc, err := grpc.NewClient(target, dialOpts...)
 	if err != nil {
 		return nil, err
 	}
+	c.cc = cc
+	c.api = pb.NewCollectorServiceClient(cc)
+	return c, nil
+}
+
+// SetCredential sets the credential sent with every call; "" sends none.
+func (c *Client) SetCredential(cred string) {
+	c.cred.Store(cred)
+}
+
+func (c *Client) Credential() string {
+	cred, _ := c.cred.Load().(string)
+	return cred
+}
 
-	return &Client{
-		cc:  cc,
-		api: pb.NewCollectorServiceClient(cc),
-	}, nil
+func (c *Client) authenticate(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if cred := c.Credential(); cred != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+cred)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
 }
 
 func (c *Client) Close() error {
@@ -56,8 +147,11 @@ func (c *Client) Close() error {
 
 func (c *Client) Register(ctx context.Context, req *pb.RegisterRequest) error {
 	id, err := c.api.Register(ctx, req)
+	if err != nil {
+		return err
+	}
 	c.Id = id
-	return err
+	return nil
 }
 
 func (c *Client) SendHeartbeat(ctx context.Context, hb *pb.Heartbeat) (*pb.HeartbeatResponse, error) {
@@ -70,6 +164,16 @@ func (c *Client) ReportCommandResult(ctx context.Context, res *pb.CommandResult)
 	return err
 }
 
+func (c *Client) ReportEvent(ctx context.Context, ev *pb.Event) error {
+	_, err := c.api.ReportEvent(ctx, ev)
+	return err
+}
+
+func (c *Client) AckConfig(ctx context.Context, ack *pb.ConfigAck) error {
+	_, err := c.api.AckConfig(ctx, ack)
+	return err
+}
+
 func (c *Client) SendMetrics(ctx context.Context, mb *pb.MetricBatch) error {
 	_, err := c.api.SendMetrics(ctx, mb)
 	return err
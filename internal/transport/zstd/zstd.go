@@ -0,0 +1,100 @@
+// Package zstd registers a zstd compressor with gRPC. Importing it for its
+// side effect makes "zstd" usable both for client calls and on the server.
+package zstd
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+)
+
+const Name = "zstd"
+
+func init() {
+	encoding.RegisterCompressor(&compressor{})
+}
+
+type compressor struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (c *compressor) Name() string { return Name }
+
+func (c *compressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if enc, ok := c.encoders.Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return &writer{Encoder: enc, pool: &c.encoders}, nil
+	}
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &writer{Encoder: enc, pool: &c.encoders}, nil
+}
+
+func (c *compressor) Decompress(r io.Reader) (io.Reader, error) {
+	if dec, ok := c.decoders.Get().(*zstd.Decoder); ok {
+		if err := dec.Reset(r); err != nil {
+			c.decoders.Put(dec)
+			return nil, err
+		}
+		return &reader{Decoder: dec, pool: &c.decoders}, nil
+	}
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &reader{Decoder: dec, pool: &c.decoders}, nil
+}
+
+type writer struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *writer) Close() error {
+	err := w.Encoder.Close()
+	w.pool.Put(w.Encoder)
+	return err
+}
+
+// reader returns its decoder to the pool at EOF or on Close, and drops it
+// on a decoding error. gRPC neither closes the reader nor reads past its
+// message size limit; a decoder left behind that way started no
+// goroutines (concurrency 1) and is collected with the reader.
+type reader struct {
+	*zstd.Decoder
+	pool *sync.Pool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.Decoder == nil {
+		return 0, io.EOF
+	}
+	n, err := r.Decoder.Read(p)
+	switch {
+	case err == io.EOF:
+		r.release()
+	case err != nil:
+		r.Decoder.Close()
+		r.Decoder = nil
+	}
+	return n, err
+}
+
+// Close returns the decoder to the pool; reading after Close reports EOF.
+func (r *reader) Close() error {
+	if r.Decoder != nil {
+		r.release()
+	}
+	return nil
+}
+
+func (r *reader) release() {
+	_ = r.Decoder.Reset(nil)
+	r.pool.Put(r.Decoder)
+	r.Decoder = nil
+}
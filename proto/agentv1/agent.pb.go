@@ -28,6 +28,20 @@ const (
 	CommandResult_STATUS_UNSPECIFIED CommandResult_Status = 0
 	CommandResult_OK                 CommandResult_Status = 1
 	CommandResult_ERROR              CommandResult_Status = 2
+	// the agent does not know the command
+	CommandResult_UNKNOWN_COMMAND CommandResult_Status = 3
+	// args_json did not match the command's arguments
+	CommandResult_INVALID_ARGS CommandResult_Status = 4
+	// the command has started and has not finished yet
+	CommandResult_RUNNING   CommandResult_Status = 5
+	CommandResult_TIMED_OUT CommandResult_Status = 6
+	// aborted by a cancel command
+	CommandResult_CANCELLED CommandResult_Status = 7
+	// the signature was missing or invalid, the command expired, or its
+	// command_id was already seen; it was not run
+	CommandResult_BAD_SIGNATURE CommandResult_Status = 8
+	// expires passed before the command could start; it was not run
+	CommandResult_EXPIRED CommandResult_Status = 9
 )
 
 // Enum value maps for CommandResult_Status.
@@ -36,11 +50,25 @@ var (
 		0: "STATUS_UNSPECIFIED",
 		1: "OK",
 		2: "ERROR",
+		3: "UNKNOWN_COMMAND",
+		4: "INVALID_ARGS",
+		5: "RUNNING",
+		6: "TIMED_OUT",
+		7: "CANCELLED",
+		8: "BAD_SIGNATURE",
+		9: "EXPIRED",
 	}
 	CommandResult_Status_value = map[string]int32{
 		"STATUS_UNSPECIFIED": 0,
 		"OK":                 1,
 		"ERROR":              2,
+		"UNKNOWN_COMMAND":    3,
+		"INVALID_ARGS":       4,
+		"RUNNING":            5,
+		"TIMED_OUT":          6,
+		"CANCELLED":          7,
+		"BAD_SIGNATURE":      8,
+		"EXPIRED":            9,
 	}
 )
 
@@ -68,14 +96,81 @@ func (x CommandResult_Status) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use CommandResult_Status.Descriptor instead.
 func (CommandResult_Status) EnumDescriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{5, 0}
+	return file_proto_agent_proto_rawDescGZIP(), []int{9, 0}
+}
+
+type Event_Severity int32
+
+const (
+	Event_SEVERITY_UNSPECIFIED Event_Severity = 0
+	Event_INFO                 Event_Severity = 1
+	Event_WARNING              Event_Severity = 2
+	Event_CRITICAL             Event_Severity = 3
+)
+
+// Enum value maps for Event_Severity.
+var (
+	Event_Severity_name = map[int32]string{
+		0: "SEVERITY_UNSPECIFIED",
+		1: "INFO",
+		2: "WARNING",
+		3: "CRITICAL",
+	}
+	Event_Severity_value = map[string]int32{
+		"SEVERITY_UNSPECIFIED": 0,
+		"INFO":                 1,
+		"WARNING":              2,
+		"CRITICAL":             3,
+	}
+)
+
+func (x Event_Severity) Enum() *Event_Severity {
+	p := new(Event_Severity)
+	*p = x
+	return p
+}
+
+func (x Event_Severity) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Event_Severity) Descriptor() protoreflect.EnumDescriptor {
+	return file_proto_agent_proto_enumTypes[1].Descriptor()
+}
+
+func (Event_Severity) Type() protoreflect.EnumType {
+	return &file_proto_agent_proto_enumTypes[1]
+}
+
+func (x Event_Severity) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Event_Severity.Descriptor instead.
+func (Event_Severity) EnumDescriptor() ([]byte, []int) {
+	return file_proto_agent_proto_rawDescGZIP(), []int{12, 0}
 }
 
 type RegisterRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Hostname      string                 `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Hostname string                 `protobuf:"bytes,1,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	// identity from a previous registration; the collector reuses it so
+	// that history stays attached to the same agent
+	AgentId string `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	// used by the collector to target config documents
+	Labels map[string]string `protobuf:"bytes,3,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// one-time enrollment; only needed until the agent holds a credential
+	BootstrapToken string `protobuf:"bytes,4,opt,name=bootstrap_token,json=bootstrapToken,proto3" json:"bootstrap_token,omitempty"`
+	// commands this agent can run
+	Commands []*CommandSpec `protobuf:"bytes,5,rep,name=commands,proto3" json:"commands,omitempty"`
+	// the agent only runs commands signed with an operator key, so the
+	// collector must not queue commands of its own to it
+	RequiresSignedCommands bool `protobuf:"varint,6,opt,name=requires_signed_commands,json=requiresSignedCommands,proto3" json:"requires_signed_commands,omitempty"`
+	// with requires_signed_commands: how far ahead a signed command may
+	// expire, which the collector checks when it is queued
+	MaxSignedTtlSeconds uint32 `protobuf:"varint,7,opt,name=max_signed_ttl_seconds,json=maxSignedTtlSeconds,proto3" json:"max_signed_ttl_seconds,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
 }
 
 func (x *RegisterRequest) Reset() {
@@ -115,16 +210,201 @@ func (x *RegisterRequest) GetHostname() string {
 	return ""
 }
 
-type RegisterResponse struct {
+func (x *RegisterRequest) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetBootstrapToken() string {
+	if x != nil {
+		return x.BootstrapToken
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetCommands() []*CommandSpec {
+	if x != nil {
+		return x.Commands
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetRequiresSignedCommands() bool {
+	if x != nil {
+		return x.RequiresSignedCommands
+	}
+	return false
+}
+
+func (x *RegisterRequest) GetMaxSignedTtlSeconds() uint32 {
+	if x != nil {
+		return x.MaxSignedTtlSeconds
+	}
+	return 0
+}
+
+// CommandSpec describes a command and the arguments it takes in
+// Command.args_json.
+type CommandSpec struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Description   string                 `protobuf:"bytes,2,opt,name=description,proto3" json:"description,omitempty"`
+	Args          []*ArgSpec             `protobuf:"bytes,3,rep,name=args,proto3" json:"args,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CommandSpec) Reset() {
+	*x = CommandSpec{}
+	mi := &file_proto_agent_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CommandSpec) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CommandSpec) ProtoMessage() {}
+
+func (x *CommandSpec) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_agent_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CommandSpec.ProtoReflect.Descriptor instead.
+func (*CommandSpec) Descriptor() ([]byte, []int) {
+	return file_proto_agent_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CommandSpec) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CommandSpec) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *CommandSpec) GetArgs() []*ArgSpec {
+	if x != nil {
+		return x.Args
+	}
+	return nil
+}
+
+type ArgSpec struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// "string", "int", "number", "bool" or "duration"
+	Type        string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Required    bool   `protobuf:"varint,3,opt,name=required,proto3" json:"required,omitempty"`
+	Description string `protobuf:"bytes,4,opt,name=description,proto3" json:"description,omitempty"`
+	// allowed values of a string argument; empty allows any
+	Enum          []string `protobuf:"bytes,5,rep,name=enum,proto3" json:"enum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ArgSpec) Reset() {
+	*x = ArgSpec{}
+	mi := &file_proto_agent_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ArgSpec) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ArgSpec) ProtoMessage() {}
+
+func (x *ArgSpec) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_agent_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ArgSpec.ProtoReflect.Descriptor instead.
+func (*ArgSpec) Descriptor() ([]byte, []int) {
+	return file_proto_agent_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ArgSpec) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *ArgSpec) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *ArgSpec) GetRequired() bool {
+	if x != nil {
+		return x.Required
+	}
+	return false
+}
+
+func (x *ArgSpec) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
+func (x *ArgSpec) GetEnum() []string {
+	if x != nil {
+		return x.Enum
+	}
+	return nil
+}
+
+type RegisterResponse struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	AgentId string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	// per-agent secret issued at enrollment; sent back as
+	// "authorization: Bearer <credential>" metadata on every call
+	Credential    string `protobuf:"bytes,2,opt,name=credential,proto3" json:"credential,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *RegisterResponse) Reset() {
 	*x = RegisterResponse{}
-	mi := &file_proto_agent_proto_msgTypes[1]
+	mi := &file_proto_agent_proto_msgTypes[3]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -136,7 +416,7 @@ func (x *RegisterResponse) String() string {
 func (*RegisterResponse) ProtoMessage() {}
 
 func (x *RegisterResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[1]
+	mi := &file_proto_agent_proto_msgTypes[3]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -149,7 +429,7 @@ func (x *RegisterResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use RegisterResponse.ProtoReflect.Descriptor instead.
 func (*RegisterResponse) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{1}
+	return file_proto_agent_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *RegisterResponse) GetAgentId() string {
@@ -159,18 +439,33 @@ func (x *RegisterResponse) GetAgentId() string {
 	return ""
 }
 
+func (x *RegisterResponse) GetCredential() string {
+	if x != nil {
+		return x.Credential
+	}
+	return ""
+}
+
 type Heartbeat struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
-	Hostname      string                 `protobuf:"bytes,2,opt,name=hostname,proto3" json:"hostname,omitempty"`
-	Time          *timestamp.Timestamp   `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	AgentId  string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Hostname string                 `protobuf:"bytes,2,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	Time     *timestamp.Timestamp   `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	// collector-managed config currently applied; empty name and zero
+	// version mean the agent runs on its local config only
+	ConfigName    string `protobuf:"bytes,4,opt,name=config_name,json=configName,proto3" json:"config_name,omitempty"`
+	ConfigVersion int64  `protobuf:"varint,5,opt,name=config_version,json=configVersion,proto3" json:"config_version,omitempty"`
+	// self-throttling level, 0 when the agent is within its resource
+	// budget; reason names the exceeded resources
+	BudgetLevel   uint32 `protobuf:"varint,6,opt,name=budget_level,json=budgetLevel,proto3" json:"budget_level,omitempty"`
+	BudgetReason  string `protobuf:"bytes,7,opt,name=budget_reason,json=budgetReason,proto3" json:"budget_reason,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Heartbeat) Reset() {
 	*x = Heartbeat{}
-	mi := &file_proto_agent_proto_msgTypes[2]
+	mi := &file_proto_agent_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -182,7 +477,7 @@ func (x *Heartbeat) String() string {
 func (*Heartbeat) ProtoMessage() {}
 
 func (x *Heartbeat) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[2]
+	mi := &file_proto_agent_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -195,7 +490,7 @@ func (x *Heartbeat) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Heartbeat.ProtoReflect.Descriptor instead.
 func (*Heartbeat) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{2}
+	return file_proto_agent_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *Heartbeat) GetAgentId() string {
@@ -219,17 +514,47 @@ func (x *Heartbeat) GetTime() *timestamp.Timestamp {
 	return nil
 }
 
+func (x *Heartbeat) GetConfigName() string {
+	if x != nil {
+		return x.ConfigName
+	}
+	return ""
+}
+
+func (x *Heartbeat) GetConfigVersion() int64 {
+	if x != nil {
+		return x.ConfigVersion
+	}
+	return 0
+}
+
+func (x *Heartbeat) GetBudgetLevel() uint32 {
+	if x != nil {
+		return x.BudgetLevel
+	}
+	return 0
+}
+
+func (x *Heartbeat) GetBudgetReason() string {
+	if x != nil {
+		return x.BudgetReason
+	}
+	return ""
+}
+
 type HeartbeatResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Ok            bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
-	Commands      []*Command             `protobuf:"bytes,2,rep,name=commands,proto3" json:"commands,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Ok       bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	Commands []*Command             `protobuf:"bytes,2,rep,name=commands,proto3" json:"commands,omitempty"`
+	// set when the agent should switch config revision
+	Config        *AgentConfig `protobuf:"bytes,3,opt,name=config,proto3" json:"config,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *HeartbeatResponse) Reset() {
 	*x = HeartbeatResponse{}
-	mi := &file_proto_agent_proto_msgTypes[3]
+	mi := &file_proto_agent_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -241,7 +566,7 @@ func (x *HeartbeatResponse) String() string {
 func (*HeartbeatResponse) ProtoMessage() {}
 
 func (x *HeartbeatResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[3]
+	mi := &file_proto_agent_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -254,7 +579,7 @@ func (x *HeartbeatResponse) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use HeartbeatResponse.ProtoReflect.Descriptor instead.
 func (*HeartbeatResponse) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{3}
+	return file_proto_agent_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *HeartbeatResponse) GetOk() bool {
@@ -271,18 +596,189 @@ func (x *HeartbeatResponse) GetCommands() []*Command {
 	return nil
 }
 
+func (x *HeartbeatResponse) GetConfig() *AgentConfig {
+	if x != nil {
+		return x.Config
+	}
+	return nil
+}
+
+// AgentConfig is a config document layered over the agent's local files.
+// An empty name tells the agent to drop the remote layer.
+type AgentConfig struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Name    string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Version int64                  `protobuf:"varint,2,opt,name=version,proto3" json:"version,omitempty"`
+	// "json" or "yaml"
+	Format        string `protobuf:"bytes,3,opt,name=format,proto3" json:"format,omitempty"`
+	Body          []byte `protobuf:"bytes,4,opt,name=body,proto3" json:"body,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AgentConfig) Reset() {
+	*x = AgentConfig{}
+	mi := &file_proto_agent_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AgentConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AgentConfig) ProtoMessage() {}
+
+func (x *AgentConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_agent_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AgentConfig.ProtoReflect.Descriptor instead.
+func (*AgentConfig) Descriptor() ([]byte, []int) {
+	return file_proto_agent_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AgentConfig) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *AgentConfig) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *AgentConfig) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *AgentConfig) GetBody() []byte {
+	if x != nil {
+		return x.Body
+	}
+	return nil
+}
+
+type ConfigAck struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	AgentId string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Name    string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Version int64                  `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	Applied bool                   `protobuf:"varint,4,opt,name=applied,proto3" json:"applied,omitempty"`
+	// why the document was rejected when applied is false
+	Error         string               `protobuf:"bytes,5,opt,name=error,proto3" json:"error,omitempty"`
+	Time          *timestamp.Timestamp `protobuf:"bytes,6,opt,name=time,proto3" json:"time,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConfigAck) Reset() {
+	*x = ConfigAck{}
+	mi := &file_proto_agent_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConfigAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigAck) ProtoMessage() {}
+
+func (x *ConfigAck) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_agent_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigAck.ProtoReflect.Descriptor instead.
+func (*ConfigAck) Descriptor() ([]byte, []int) {
+	return file_proto_agent_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ConfigAck) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *ConfigAck) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *ConfigAck) GetVersion() int64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *ConfigAck) GetApplied() bool {
+	if x != nil {
+		return x.Applied
+	}
+	return false
+}
+
+func (x *ConfigAck) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *ConfigAck) GetTime() *timestamp.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
 type Command struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	CommandId     string                 `protobuf:"bytes,1,opt,name=command_id,json=commandId,proto3" json:"command_id,omitempty"`
-	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
-	ArgsJson      string                 `protobuf:"bytes,3,opt,name=args_json,json=argsJson,proto3" json:"args_json,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	CommandId string                 `protobuf:"bytes,1,opt,name=command_id,json=commandId,proto3" json:"command_id,omitempty"`
+	Name      string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	ArgsJson  string                 `protobuf:"bytes,3,opt,name=args_json,json=argsJson,proto3" json:"args_json,omitempty"`
+	// how long the command may run; 0 leaves it to the agent's default
+	TimeoutSeconds uint32 `protobuf:"varint,4,opt,name=timeout_seconds,json=timeoutSeconds,proto3" json:"timeout_seconds,omitempty"`
+	// after this the agent refuses the command; part of what is signed
+	Expires *timestamp.Timestamp `protobuf:"bytes,5,opt,name=expires,proto3" json:"expires,omitempty"`
+	// ed25519 signature by an operator key over agent_id, command_id, name,
+	// args_json and expires; agents configured with signing keys refuse
+	// commands without a valid one
+	Signature     []byte `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Command) Reset() {
 	*x = Command{}
-	mi := &file_proto_agent_proto_msgTypes[4]
+	mi := &file_proto_agent_proto_msgTypes[8]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -294,7 +790,7 @@ func (x *Command) String() string {
 func (*Command) ProtoMessage() {}
 
 func (x *Command) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[4]
+	mi := &file_proto_agent_proto_msgTypes[8]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -307,7 +803,7 @@ func (x *Command) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Command.ProtoReflect.Descriptor instead.
 func (*Command) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{4}
+	return file_proto_agent_proto_rawDescGZIP(), []int{8}
 }
 
 func (x *Command) GetCommandId() string {
@@ -331,21 +827,55 @@ func (x *Command) GetArgsJson() string {
 	return ""
 }
 
+func (x *Command) GetTimeoutSeconds() uint32 {
+	if x != nil {
+		return x.TimeoutSeconds
+	}
+	return 0
+}
+
+func (x *Command) GetExpires() *timestamp.Timestamp {
+	if x != nil {
+		return x.Expires
+	}
+	return nil
+}
+
+func (x *Command) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
 type CommandResult struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
-	CommandId     string                 `protobuf:"bytes,2,opt,name=command_id,json=commandId,proto3" json:"command_id,omitempty"`
-	Time          *timestamp.Timestamp   `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
-	Status        CommandResult_Status   `protobuf:"varint,4,opt,name=status,proto3,enum=agent.v1.CommandResult_Status" json:"status,omitempty"`
-	Output        string                 `protobuf:"bytes,5,opt,name=output,proto3" json:"output,omitempty"`
-	Error         string                 `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	AgentId   string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	CommandId string                 `protobuf:"bytes,2,opt,name=command_id,json=commandId,proto3" json:"command_id,omitempty"`
+	Time      *timestamp.Timestamp   `protobuf:"bytes,3,opt,name=time,proto3" json:"time,omitempty"`
+	Status    CommandResult_Status   `protobuf:"varint,4,opt,name=status,proto3,enum=agent.v1.CommandResult_Status" json:"status,omitempty"`
+	Output    string                 `protobuf:"bytes,5,opt,name=output,proto3" json:"output,omitempty"`
+	Error     string                 `protobuf:"bytes,6,opt,name=error,proto3" json:"error,omitempty"`
+	// A command's output is streamed as several results with the same
+	// command_id: chunk counts from 0 and more is set on all but the last.
+	// While more is set the status is RUNNING, and output is the part
+	// produced since the previous chunk. Error is only set on the last one.
+	Chunk uint32 `protobuf:"varint,7,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	More  bool   `protobuf:"varint,8,opt,name=more,proto3" json:"more,omitempty"`
+	// percent done as estimated by a RUNNING command, 0 if unknown
+	Progress uint32 `protobuf:"varint,9,opt,name=progress,proto3" json:"progress,omitempty"`
+	// Binary output, such as an archive, travels in data instead of output,
+	// chunked the same way. The collector stores it as a file named artifact
+	// for download.
+	Artifact      string `protobuf:"bytes,10,opt,name=artifact,proto3" json:"artifact,omitempty"`
+	Data          []byte `protobuf:"bytes,11,opt,name=data,proto3" json:"data,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *CommandResult) Reset() {
 	*x = CommandResult{}
-	mi := &file_proto_agent_proto_msgTypes[5]
+	mi := &file_proto_agent_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -357,7 +887,7 @@ func (x *CommandResult) String() string {
 func (*CommandResult) ProtoMessage() {}
 
 func (x *CommandResult) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[5]
+	mi := &file_proto_agent_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -370,7 +900,7 @@ func (x *CommandResult) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use CommandResult.ProtoReflect.Descriptor instead.
 func (*CommandResult) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{5}
+	return file_proto_agent_proto_rawDescGZIP(), []int{9}
 }
 
 func (x *CommandResult) GetAgentId() string {
@@ -415,18 +945,56 @@ func (x *CommandResult) GetError() string {
 	return ""
 }
 
+func (x *CommandResult) GetChunk() uint32 {
+	if x != nil {
+		return x.Chunk
+	}
+	return 0
+}
+
+func (x *CommandResult) GetMore() bool {
+	if x != nil {
+		return x.More
+	}
+	return false
+}
+
+func (x *CommandResult) GetProgress() uint32 {
+	if x != nil {
+		return x.Progress
+	}
+	return 0
+}
+
+func (x *CommandResult) GetArtifact() string {
+	if x != nil {
+		return x.Artifact
+	}
+	return ""
+}
+
+func (x *CommandResult) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
 type Metric struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Value         float64                `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
-	Unit          string                 `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit,omitempty"`
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Name  string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value float64                `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	Unit  string                 `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit,omitempty"`
+	// sample time when the batch spans several collection ticks;
+	// unset means MetricBatch.time
+	Time          *timestamp.Timestamp `protobuf:"bytes,4,opt,name=time,proto3" json:"time,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
 func (x *Metric) Reset() {
 	*x = Metric{}
-	mi := &file_proto_agent_proto_msgTypes[6]
+	mi := &file_proto_agent_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -438,7 +1006,7 @@ func (x *Metric) String() string {
 func (*Metric) ProtoMessage() {}
 
 func (x *Metric) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[6]
+	mi := &file_proto_agent_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -451,7 +1019,7 @@ func (x *Metric) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Metric.ProtoReflect.Descriptor instead.
 func (*Metric) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{6}
+	return file_proto_agent_proto_rawDescGZIP(), []int{10}
 }
 
 func (x *Metric) GetName() string {
@@ -475,6 +1043,13 @@ func (x *Metric) GetUnit() string {
 	return ""
 }
 
+func (x *Metric) GetTime() *timestamp.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
 type MetricBatch struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	AgentId       string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
@@ -486,7 +1061,7 @@ type MetricBatch struct {
 
 func (x *MetricBatch) Reset() {
 	*x = MetricBatch{}
-	mi := &file_proto_agent_proto_msgTypes[7]
+	mi := &file_proto_agent_proto_msgTypes[11]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -498,7 +1073,7 @@ func (x *MetricBatch) String() string {
 func (*MetricBatch) ProtoMessage() {}
 
 func (x *MetricBatch) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[7]
+	mi := &file_proto_agent_proto_msgTypes[11]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -511,7 +1086,7 @@ func (x *MetricBatch) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use MetricBatch.ProtoReflect.Descriptor instead.
 func (*MetricBatch) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{7}
+	return file_proto_agent_proto_rawDescGZIP(), []int{11}
 }
 
 func (x *MetricBatch) GetAgentId() string {
@@ -535,6 +1110,93 @@ func (x *MetricBatch) GetMetrics() []*Metric {
 	return nil
 }
 
+// Event is a discrete occurrence on the agent, such as a configuration
+// reload, that the collector should learn about immediately.
+type Event struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	AgentId string                 `protobuf:"bytes,1,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	Time    *timestamp.Timestamp   `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	// dotted kind, e.g. "config.reload"
+	Type          string            `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	Severity      Event_Severity    `protobuf:"varint,4,opt,name=severity,proto3,enum=agent.v1.Event_Severity" json:"severity,omitempty"`
+	Message       string            `protobuf:"bytes,5,opt,name=message,proto3" json:"message,omitempty"`
+	Attributes    map[string]string `protobuf:"bytes,6,rep,name=attributes,proto3" json:"attributes,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_proto_agent_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_agent_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_proto_agent_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *Event) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *Event) GetTime() *timestamp.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *Event) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *Event) GetSeverity() Event_Severity {
+	if x != nil {
+		return x.Severity
+	}
+	return Event_SEVERITY_UNSPECIFIED
+}
+
+func (x *Event) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Event) GetAttributes() map[string]string {
+	if x != nil {
+		return x.Attributes
+	}
+	return nil
+}
+
 type Ack struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Ok            bool                   `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
@@ -545,7 +1207,7 @@ type Ack struct {
 
 func (x *Ack) Reset() {
 	*x = Ack{}
-	mi := &file_proto_agent_proto_msgTypes[8]
+	mi := &file_proto_agent_proto_msgTypes[13]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -557,7 +1219,7 @@ func (x *Ack) String() string {
 func (*Ack) ProtoMessage() {}
 
 func (x *Ack) ProtoReflect() protoreflect.Message {
-	mi := &file_proto_agent_proto_msgTypes[8]
+	mi := &file_proto_agent_proto_msgTypes[13]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -570,7 +1232,7 @@ func (x *Ack) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use Ack.ProtoReflect.Descriptor instead.
 func (*Ack) Descriptor() ([]byte, []int) {
-	return file_proto_agent_proto_rawDescGZIP(), []int{8}
+	return file_proto_agent_proto_rawDescGZIP(), []int{13}
 }
 
 func (x *Ack) GetOk() bool {
@@ -591,23 +1253,66 @@ var File_proto_agent_proto protoreflect.FileDescriptor
 
 const file_proto_agent_proto_rawDesc = "" +
 	"\n" +
-	"\x11proto/agent.proto\x12\bagent.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"-\n" +
+	"\x11proto/agent.proto\x12\bagent.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"\x8d\x03\n" +
 	"\x0fRegisterRequest\x12\x1a\n" +
-	"\bhostname\x18\x01 \x01(\tR\bhostname\"-\n" +
+	"\bhostname\x18\x01 \x01(\tR\bhostname\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\x12=\n" +
+	"\x06labels\x18\x03 \x03(\v2%.agent.v1.RegisterRequest.LabelsEntryR\x06labels\x12'\n" +
+	"\x0fbootstrap_token\x18\x04 \x01(\tR\x0ebootstrapToken\x121\n" +
+	"\bcommands\x18\x05 \x03(\v2\x15.agent.v1.CommandSpecR\bcommands\x128\n" +
+	"\x18requires_signed_commands\x18\x06 \x01(\bR\x16requiresSignedCommands\x123\n" +
+	"\x16max_signed_ttl_seconds\x18\a \x01(\rR\x13maxSignedTtlSeconds\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"j\n" +
+	"\vCommandSpec\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12 \n" +
+	"\vdescription\x18\x02 \x01(\tR\vdescription\x12%\n" +
+	"\x04args\x18\x03 \x03(\v2\x11.agent.v1.ArgSpecR\x04args\"\x83\x01\n" +
+	"\aArgSpec\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x1a\n" +
+	"\brequired\x18\x03 \x01(\bR\brequired\x12 \n" +
+	"\vdescription\x18\x04 \x01(\tR\vdescription\x12\x12\n" +
+	"\x04enum\x18\x05 \x03(\tR\x04enum\"M\n" +
 	"\x10RegisterResponse\x12\x19\n" +
-	"\bagent_id\x18\x01 \x01(\tR\aagentId\"r\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1e\n" +
+	"\n" +
+	"credential\x18\x02 \x01(\tR\n" +
+	"credential\"\x82\x02\n" +
 	"\tHeartbeat\x12\x19\n" +
 	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1a\n" +
 	"\bhostname\x18\x02 \x01(\tR\bhostname\x12.\n" +
-	"\x04time\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\"R\n" +
+	"\x04time\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x1f\n" +
+	"\vconfig_name\x18\x04 \x01(\tR\n" +
+	"configName\x12%\n" +
+	"\x0econfig_version\x18\x05 \x01(\x03R\rconfigVersion\x12!\n" +
+	"\fbudget_level\x18\x06 \x01(\rR\vbudgetLevel\x12#\n" +
+	"\rbudget_reason\x18\a \x01(\tR\fbudgetReason\"\x81\x01\n" +
 	"\x11HeartbeatResponse\x12\x0e\n" +
 	"\x02ok\x18\x01 \x01(\bR\x02ok\x12-\n" +
-	"\bcommands\x18\x02 \x03(\v2\x11.agent.v1.CommandR\bcommands\"Y\n" +
+	"\bcommands\x18\x02 \x03(\v2\x11.agent.v1.CommandR\bcommands\x12-\n" +
+	"\x06config\x18\x03 \x01(\v2\x15.agent.v1.AgentConfigR\x06config\"g\n" +
+	"\vAgentConfig\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x18\n" +
+	"\aversion\x18\x02 \x01(\x03R\aversion\x12\x16\n" +
+	"\x06format\x18\x03 \x01(\tR\x06format\x12\x12\n" +
+	"\x04body\x18\x04 \x01(\fR\x04body\"\xb4\x01\n" +
+	"\tConfigAck\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\x03R\aversion\x12\x18\n" +
+	"\aapplied\x18\x04 \x01(\bR\aapplied\x12\x14\n" +
+	"\x05error\x18\x05 \x01(\tR\x05error\x12.\n" +
+	"\x04time\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\"\xd6\x01\n" +
 	"\aCommand\x12\x1d\n" +
 	"\n" +
 	"command_id\x18\x01 \x01(\tR\tcommandId\x12\x12\n" +
 	"\x04name\x18\x02 \x01(\tR\x04name\x12\x1b\n" +
-	"\targs_json\x18\x03 \x01(\tR\bargsJson\"\x94\x02\n" +
+	"\targs_json\x18\x03 \x01(\tR\bargsJson\x12'\n" +
+	"\x0ftimeout_seconds\x18\x04 \x01(\rR\x0etimeoutSeconds\x124\n" +
+	"\aexpires\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\aexpires\x12\x1c\n" +
+	"\tsignature\x18\x06 \x01(\fR\tsignature\"\xfd\x03\n" +
 	"\rCommandResult\x12\x19\n" +
 	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12\x1d\n" +
 	"\n" +
@@ -615,27 +1320,60 @@ const file_proto_agent_proto_rawDesc = "" +
 	"\x04time\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x126\n" +
 	"\x06status\x18\x04 \x01(\x0e2\x1e.agent.v1.CommandResult.StatusR\x06status\x12\x16\n" +
 	"\x06output\x18\x05 \x01(\tR\x06output\x12\x14\n" +
-	"\x05error\x18\x06 \x01(\tR\x05error\"3\n" +
+	"\x05error\x18\x06 \x01(\tR\x05error\x12\x14\n" +
+	"\x05chunk\x18\a \x01(\rR\x05chunk\x12\x12\n" +
+	"\x04more\x18\b \x01(\bR\x04more\x12\x1a\n" +
+	"\bprogress\x18\t \x01(\rR\bprogress\x12\x1a\n" +
+	"\bartifact\x18\n" +
+	" \x01(\tR\bartifact\x12\x12\n" +
+	"\x04data\x18\v \x01(\fR\x04data\"\xa5\x01\n" +
 	"\x06Status\x12\x16\n" +
 	"\x12STATUS_UNSPECIFIED\x10\x00\x12\x06\n" +
 	"\x02OK\x10\x01\x12\t\n" +
-	"\x05ERROR\x10\x02\"F\n" +
+	"\x05ERROR\x10\x02\x12\x13\n" +
+	"\x0fUNKNOWN_COMMAND\x10\x03\x12\x10\n" +
+	"\fINVALID_ARGS\x10\x04\x12\v\n" +
+	"\aRUNNING\x10\x05\x12\r\n" +
+	"\tTIMED_OUT\x10\x06\x12\r\n" +
+	"\tCANCELLED\x10\a\x12\x11\n" +
+	"\rBAD_SIGNATURE\x10\b\x12\v\n" +
+	"\aEXPIRED\x10\t\"v\n" +
 	"\x06Metric\x12\x12\n" +
 	"\x04name\x18\x01 \x01(\tR\x04name\x12\x14\n" +
 	"\x05value\x18\x02 \x01(\x01R\x05value\x12\x12\n" +
-	"\x04unit\x18\x03 \x01(\tR\x04unit\"\x84\x01\n" +
+	"\x04unit\x18\x03 \x01(\tR\x04unit\x12.\n" +
+	"\x04time\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\"\x84\x01\n" +
 	"\vMetricBatch\x12\x19\n" +
 	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12.\n" +
 	"\x04time\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12*\n" +
-	"\ametrics\x18\x03 \x03(\v2\x10.agent.v1.MetricR\ametrics\"/\n" +
+	"\ametrics\x18\x03 \x03(\v2\x10.agent.v1.MetricR\ametrics\"\x81\x03\n" +
+	"\x05Event\x12\x19\n" +
+	"\bagent_id\x18\x01 \x01(\tR\aagentId\x12.\n" +
+	"\x04time\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x12\n" +
+	"\x04type\x18\x03 \x01(\tR\x04type\x124\n" +
+	"\bseverity\x18\x04 \x01(\x0e2\x18.agent.v1.Event.SeverityR\bseverity\x12\x18\n" +
+	"\amessage\x18\x05 \x01(\tR\amessage\x12?\n" +
+	"\n" +
+	"attributes\x18\x06 \x03(\v2\x1f.agent.v1.Event.AttributesEntryR\n" +
+	"attributes\x1a=\n" +
+	"\x0fAttributesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"I\n" +
+	"\bSeverity\x12\x18\n" +
+	"\x14SEVERITY_UNSPECIFIED\x10\x00\x12\b\n" +
+	"\x04INFO\x10\x01\x12\v\n" +
+	"\aWARNING\x10\x02\x12\f\n" +
+	"\bCRITICAL\x10\x03\"/\n" +
 	"\x03Ack\x12\x0e\n" +
 	"\x02ok\x18\x01 \x01(\bR\x02ok\x12\x18\n" +
-	"\amessage\x18\x02 \x01(\tR\amessage2\x8c\x02\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage2\xec\x02\n" +
 	"\x10CollectorService\x12A\n" +
 	"\bRegister\x12\x19.agent.v1.RegisterRequest\x1a\x1a.agent.v1.RegisterResponse\x12A\n" +
 	"\rSendHeartbeat\x12\x13.agent.v1.Heartbeat\x1a\x1b.agent.v1.HeartbeatResponse\x123\n" +
 	"\vSendMetrics\x12\x15.agent.v1.MetricBatch\x1a\r.agent.v1.Ack\x12=\n" +
-	"\x13ReportCommandResult\x12\x17.agent.v1.CommandResult\x1a\r.agent.v1.AckB\x17Z\x15proto/agentv1;agentv1b\x06proto3"
+	"\x13ReportCommandResult\x12\x17.agent.v1.CommandResult\x1a\r.agent.v1.Ack\x12-\n" +
+	"\vReportEvent\x12\x0f.agent.v1.Event\x1a\r.agent.v1.Ack\x12/\n" +
+	"\tAckConfig\x12\x13.agent.v1.ConfigAck\x1a\r.agent.v1.AckB\x17Z\x15proto/agentv1;agentv1b\x06proto3"
 
 var (
 	file_proto_agent_proto_rawDescOnce sync.Once
@@ -649,41 +1387,63 @@ func file_proto_agent_proto_rawDescGZIP() []byte {
 	return file_proto_agent_proto_rawDescData
 }
 
-var file_proto_agent_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_proto_agent_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_proto_agent_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_proto_agent_proto_msgTypes = make([]protoimpl.MessageInfo, 16)
 var file_proto_agent_proto_goTypes = []any{
 	(CommandResult_Status)(0),   // 0: agent.v1.CommandResult.Status
-	(*RegisterRequest)(nil),     // 1: agent.v1.RegisterRequest
-	(*RegisterResponse)(nil),    // 2: agent.v1.RegisterResponse
-	(*Heartbeat)(nil),           // 3: agent.v1.Heartbeat
-	(*HeartbeatResponse)(nil),   // 4: agent.v1.HeartbeatResponse
-	(*Command)(nil),             // 5: agent.v1.Command
-	(*CommandResult)(nil),       // 6: agent.v1.CommandResult
-	(*Metric)(nil),              // 7: agent.v1.Metric
-	(*MetricBatch)(nil),         // 8: agent.v1.MetricBatch
-	(*Ack)(nil),                 // 9: agent.v1.Ack
-	(*timestamp.Timestamp)(nil), // 10: google.protobuf.Timestamp
+	(Event_Severity)(0),         // 1: agent.v1.Event.Severity
+	(*RegisterRequest)(nil),     // 2: agent.v1.RegisterRequest
+	(*CommandSpec)(nil),         // 3: agent.v1.CommandSpec
+	(*ArgSpec)(nil),             // 4: agent.v1.ArgSpec
+	(*RegisterResponse)(nil),    // 5: agent.v1.RegisterResponse
+	(*Heartbeat)(nil),           // 6: agent.v1.Heartbeat
+	(*HeartbeatResponse)(nil),   // 7: agent.v1.HeartbeatResponse
+	(*AgentConfig)(nil),         // 8: agent.v1.AgentConfig
+	(*ConfigAck)(nil),           // 9: agent.v1.ConfigAck
+	(*Command)(nil),             // 10: agent.v1.Command
+	(*CommandResult)(nil),       // 11: agent.v1.CommandResult
+	(*Metric)(nil),              // 12: agent.v1.Metric
+	(*MetricBatch)(nil),         // 13: agent.v1.MetricBatch
+	(*Event)(nil),               // 14: agent.v1.Event
+	(*Ack)(nil),                 // 15: agent.v1.Ack
+	nil,                         // 16: agent.v1.RegisterRequest.LabelsEntry
+	nil,                         // 17: agent.v1.Event.AttributesEntry
+	(*timestamp.Timestamp)(nil), // 18: google.protobuf.Timestamp
 }
 var file_proto_agent_proto_depIdxs = []int32{
-	10, // 0: agent.v1.Heartbeat.time:type_name -> google.protobuf.Timestamp
-	5,  // 1: agent.v1.HeartbeatResponse.commands:type_name -> agent.v1.Command
-	10, // 2: agent.v1.CommandResult.time:type_name -> google.protobuf.Timestamp
-	0,  // 3: agent.v1.CommandResult.status:type_name -> agent.v1.CommandResult.Status
-	10, // 4: agent.v1.MetricBatch.time:type_name -> google.protobuf.Timestamp
-	7,  // 5: agent.v1.MetricBatch.metrics:type_name -> agent.v1.Metric
-	1,  // 6: agent.v1.CollectorService.Register:input_type -> agent.v1.RegisterRequest
-	3,  // 7: agent.v1.CollectorService.SendHeartbeat:input_type -> agent.v1.Heartbeat
-	8,  // 8: agent.v1.CollectorService.SendMetrics:input_type -> agent.v1.MetricBatch
-	6,  // 9: agent.v1.CollectorService.ReportCommandResult:input_type -> agent.v1.CommandResult
-	2,  // 10: agent.v1.CollectorService.Register:output_type -> agent.v1.RegisterResponse
-	4,  // 11: agent.v1.CollectorService.SendHeartbeat:output_type -> agent.v1.HeartbeatResponse
-	9,  // 12: agent.v1.CollectorService.SendMetrics:output_type -> agent.v1.Ack
-	9,  // 13: agent.v1.CollectorService.ReportCommandResult:output_type -> agent.v1.Ack
-	10, // [10:14] is the sub-list for method output_type
-	6,  // [6:10] is the sub-list for method input_type
-	6,  // [6:6] is the sub-list for extension type_name
-	6,  // [6:6] is the sub-list for extension extendee
-	0,  // [0:6] is the sub-list for field type_name
+	16, // 0: agent.v1.RegisterRequest.labels:type_name -> agent.v1.RegisterRequest.LabelsEntry
+	3,  // 1: agent.v1.RegisterRequest.commands:type_name -> agent.v1.CommandSpec
+	4,  // 2: agent.v1.CommandSpec.args:type_name -> agent.v1.ArgSpec
+	18, // 3: agent.v1.Heartbeat.time:type_name -> google.protobuf.Timestamp
+	10, // 4: agent.v1.HeartbeatResponse.commands:type_name -> agent.v1.Command
+	8,  // 5: agent.v1.HeartbeatResponse.config:type_name -> agent.v1.AgentConfig
+	18, // 6: agent.v1.ConfigAck.time:type_name -> google.protobuf.Timestamp
+	18, // 7: agent.v1.Command.expires:type_name -> google.protobuf.Timestamp
+	18, // 8: agent.v1.CommandResult.time:type_name -> google.protobuf.Timestamp
+	0,  // 9: agent.v1.CommandResult.status:type_name -> agent.v1.CommandResult.Status
+	18, // 10: agent.v1.Metric.time:type_name -> google.protobuf.Timestamp
+	18, // 11: agent.v1.MetricBatch.time:type_name -> google.protobuf.Timestamp
+	12, // 12: agent.v1.MetricBatch.metrics:type_name -> agent.v1.Metric
+	18, // 13: agent.v1.Event.time:type_name -> google.protobuf.Timestamp
+	1,  // 14: agent.v1.Event.severity:type_name -> agent.v1.Event.Severity
+	17, // 15: agent.v1.Event.attributes:type_name -> agent.v1.Event.AttributesEntry
+	2,  // 16: agent.v1.CollectorService.Register:input_type -> agent.v1.RegisterRequest
+	6,  // 17: agent.v1.CollectorService.SendHeartbeat:input_type -> agent.v1.Heartbeat
+	13, // 18: agent.v1.CollectorService.SendMetrics:input_type -> agent.v1.MetricBatch
+	11, // 19: agent.v1.CollectorService.ReportCommandResult:input_type -> agent.v1.CommandResult
+	14, // 20: agent.v1.CollectorService.ReportEvent:input_type -> agent.v1.Event
+	9,  // 21: agent.v1.CollectorService.AckConfig:input_type -> agent.v1.ConfigAck
+	5,  // 22: agent.v1.CollectorService.Register:output_type -> agent.v1.RegisterResponse
+	7,  // 23: agent.v1.CollectorService.SendHeartbeat:output_type -> agent.v1.HeartbeatResponse
+	15, // 24: agent.v1.CollectorService.SendMetrics:output_type -> agent.v1.Ack
+	15, // 25: agent.v1.CollectorService.ReportCommandResult:output_type -> agent.v1.Ack
+	15, // 26: agent.v1.CollectorService.ReportEvent:output_type -> agent.v1.Ack
+	15, // 27: agent.v1.CollectorService.AckConfig:output_type -> agent.v1.Ack
+	22, // [22:28] is the sub-list for method output_type
+	16, // [16:22] is the sub-list for method input_type
+	16, // [16:16] is the sub-list for extension type_name
+	16, // [16:16] is the sub-list for extension extendee
+	0,  // [0:16] is the sub-list for field type_name
 }
 
 func init() { file_proto_agent_proto_init() }
@@ -696,8 +1456,8 @@ func file_proto_agent_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_agent_proto_rawDesc), len(file_proto_agent_proto_rawDesc)),
-			NumEnums:      1,
-			NumMessages:   9,
+			NumEnums:      2,
+			NumMessages:   16,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
@@ -23,6 +23,8 @@ const (
 	CollectorService_SendHeartbeat_FullMethodName       = "/agent.v1.CollectorService/SendHeartbeat"
 	CollectorService_SendMetrics_FullMethodName         = "/agent.v1.CollectorService/SendMetrics"
 	CollectorService_ReportCommandResult_FullMethodName = "/agent.v1.CollectorService/ReportCommandResult"
+	CollectorService_ReportEvent_FullMethodName         = "/agent.v1.CollectorService/ReportEvent"
+	CollectorService_AckConfig_FullMethodName           = "/agent.v1.CollectorService/AckConfig"
 )
 
 // CollectorServiceClient is the client API for CollectorService service.
@@ -33,6 +35,8 @@ type CollectorServiceClient interface {
 	SendHeartbeat(ctx context.Context, in *Heartbeat, opts ...grpc.CallOption) (*HeartbeatResponse, error)
 	SendMetrics(ctx context.Context, in *MetricBatch, opts ...grpc.CallOption) (*Ack, error)
 	ReportCommandResult(ctx context.Context, in *CommandResult, opts ...grpc.CallOption) (*Ack, error)
+	ReportEvent(ctx context.Context, in *Event, opts ...grpc.CallOption) (*Ack, error)
+	AckConfig(ctx context.Context, in *ConfigAck, opts ...grpc.CallOption) (*Ack, error)
 }
 
 type collectorServiceClient struct {
@@ -83,6 +87,26 @@ func (c *collectorServiceClient) ReportCommandResult(ctx context.Context, in *Co
 	return out, nil
 }
 
+func (c *collectorServiceClient) ReportEvent(ctx context.Context, in *Event, opts ...grpc.CallOption) (*Ack, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, CollectorService_ReportEvent_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *collectorServiceClient) AckConfig(ctx context.Context, in *ConfigAck, opts ...grpc.CallOption) (*Ack, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, CollectorService_AckConfig_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CollectorServiceServer is the server API for CollectorService service.
 // All implementations must embed UnimplementedCollectorServiceServer
 // for forward compatibility.
@@ -91,6 +115,8 @@ type CollectorServiceServer interface {
 	SendHeartbeat(context.Context, *Heartbeat) (*HeartbeatResponse, error)
 	SendMetrics(context.Context, *MetricBatch) (*Ack, error)
 	ReportCommandResult(context.Context, *CommandResult) (*Ack, error)
+	ReportEvent(context.Context, *Event) (*Ack, error)
+	AckConfig(context.Context, *ConfigAck) (*Ack, error)
 	mustEmbedUnimplementedCollectorServiceServer()
 }
 
@@ -113,6 +139,12 @@ func (UnimplementedCollectorServiceServer) SendMetrics(context.Context, *MetricB
 func (UnimplementedCollectorServiceServer) ReportCommandResult(context.Context, *CommandResult) (*Ack, error) {
 	return nil, status.Error(codes.Unimplemented, "method ReportCommandResult not implemented")
 }
+func (UnimplementedCollectorServiceServer) ReportEvent(context.Context, *Event) (*Ack, error) {
+	return nil, status.Error(codes.Unimplemented, "method ReportEvent not implemented")
+}
+func (UnimplementedCollectorServiceServer) AckConfig(context.Context, *ConfigAck) (*Ack, error) {
+	return nil, status.Error(codes.Unimplemented, "method AckConfig not implemented")
+}
 func (UnimplementedCollectorServiceServer) mustEmbedUnimplementedCollectorServiceServer() {}
 func (UnimplementedCollectorServiceServer) testEmbeddedByValue()                          {}
 
@@ -206,6 +238,42 @@ func _CollectorService_ReportCommandResult_Handler(srv interface{}, ctx context.
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CollectorService_ReportEvent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Event)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CollectorServiceServer).ReportEvent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CollectorService_ReportEvent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CollectorServiceServer).ReportEvent(ctx, req.(*Event))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CollectorService_AckConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConfigAck)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CollectorServiceServer).AckConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CollectorService_AckConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CollectorServiceServer).AckConfig(ctx, req.(*ConfigAck))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // CollectorService_ServiceDesc is the grpc.ServiceDesc for CollectorService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -229,6 +297,14 @@ var CollectorService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ReportCommandResult",
 			Handler:    _CollectorService_ReportCommandResult_Handler,
 		},
+		{
+			MethodName: "ReportEvent",
+			Handler:    _CollectorService_ReportEvent_Handler,
+		},
+		{
+			MethodName: "AckConfig",
+			Handler:    _CollectorService_AckConfig_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/agent.proto",